@@ -3,11 +3,15 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/yourusername/go-rest-api-lab/models"
+	"github.com/yourusername/go-rest-api-lab/tracing"
 )
 
 // APIClient handles HTTP requests to the API
@@ -15,6 +19,7 @@ type APIClient struct {
 	baseURL     string
 	bearerToken string
 	httpClient  *http.Client
+	postRetries int
 }
 
 // NewAPIClient creates a new API client with timeout
@@ -25,6 +30,7 @@ func NewAPIClient(baseURL, bearerToken string, timeout time.Duration) *APIClient
 		httpClient: &http.Client{
 			Timeout: timeout,
 		},
+		postRetries: defaultPostRetries,
 	}
 }
 
@@ -33,9 +39,40 @@ func (c *APIClient) Get(ctx context.Context, endpoint string, result interface{}
 	return c.doRequest(ctx, http.MethodGet, endpoint, nil, result)
 }
 
-// Post performs a POST request to the specified endpoint
+// Post performs a POST request to the specified endpoint. On the endpoints
+// the server deduplicates, POST /users and POST /posts, it sends an
+// Idempotency-Key, the one from WithIdempotencyKey or a new random one, and
+// retries network failures and 5xx responses with the same key, so a retry
+// never creates a second resource. Other endpoints are sent once.
 func (c *APIClient) Post(ctx context.Context, endpoint string, data interface{}, result interface{}) error {
-	return c.doRequest(ctx, http.MethodPost, endpoint, data, result)
+	if !deduplicated(endpoint) {
+		return c.doRequest(ctx, http.MethodPost, endpoint, data, result)
+	}
+	if _, ok := idempotencyKeyFrom(ctx); !ok {
+		key, err := NewIdempotencyKey()
+		if err != nil {
+			return err
+		}
+		ctx = WithIdempotencyKey(ctx, key)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.doRequest(ctx, http.MethodPost, endpoint, data, result)
+		if err == nil || attempt >= c.postRetries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt+1) * postRetryDelay):
+		}
+	}
+}
+
+// SetPostRetries sets how many times Post retries a failed request to an
+// endpoint the server deduplicates (default 2)
+func (c *APIClient) SetPostRetries(n int) {
+	c.postRetries = n
 }
 
 // Put performs a PUT request to the specified endpoint
@@ -53,10 +90,36 @@ func (c *APIClient) Delete(ctx context.Context, endpoint string) error {
 	return c.doRequest(ctx, http.MethodDelete, endpoint, nil, nil)
 }
 
+// Batch sends operations to POST /batch so they run in one transaction. A
+// rolled-back atomic batch is answered with the failing operation's status,
+// but it still returns the per-operation results with Committed false, not
+// an error.
+func (c *APIClient) Batch(ctx context.Context, batch models.BatchRequest) (*models.BatchResponse, error) {
+	var result models.BatchResponse
+	err := c.doRequest(ctx, http.MethodPost, "/batch", batch, &result)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Problem == nil {
+		var rolledBack models.BatchResponse
+		if json.Unmarshal([]byte(apiErr.Body), &rolledBack) == nil && rolledBack.Results != nil {
+			return &rolledBack, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 // doRequest is the core method that handles all HTTP requests
-func (c *APIClient) doRequest(ctx context.Context, method, endpoint string, data interface{}, result interface{}) error {
+func (c *APIClient) doRequest(ctx context.Context, method, endpoint string, data interface{}, result interface{}) (err error) {
 	url := c.baseURL + endpoint
-	
+
+	// Each request is a client span; the server continues its trace
+	ctx, span := tracing.Start(ctx, "HTTP "+method, tracing.KindClient)
+	span.SetAttribute("http.method", method)
+	span.SetAttribute("http.url", url)
+	defer func() { span.Finish(err) }()
+
 	var bodyReader io.Reader
 	if data != nil {
 		jsonData, err := json.Marshal(data)
@@ -65,39 +128,44 @@ func (c *APIClient) doRequest(ctx context.Context, method, endpoint string, data
 		}
 		bodyReader = strings.NewReader(string(jsonData))
 	}
-	
+
 	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
-	
+
 	// Add Authorization header with Bearer token
 	req.Header.Set("Authorization", "Bearer "+c.bearerToken)
 	req.Header.Set("Content-Type", "application/json")
-	
+	if key, ok := idempotencyKeyFrom(ctx); ok {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	req.Header.Set(tracing.TraceparentHeader, span.Context().Traceparent())
+
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
-	
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
-	
+
 	// Check status code
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		return newAPIError(resp.StatusCode, resp.Header.Get("Content-Type"), body)
 	}
-	
+
 	// Parse JSON response if result is provided
 	if result != nil && len(body) > 0 {
 		if err := json.Unmarshal(body, result); err != nil {
 			return fmt.Errorf("failed to parse JSON response: %w", err)
 		}
 	}
-	
+
 	return nil
 }
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yourusername/go-rest-api-lab/models"
+)
+
+func TestBatch(t *testing.T) {
+	const rolledBack = `{"committed":false,"results":[` +
+		`{"index":0,"status":201,"body":{"id":3}},` +
+		`{"index":1,"status":404,"error":{"type":"about:blank","title":"Not Found","status":404,"code":"user_not_found"}},` +
+		`{"index":2,"status":424,"error":{"type":"about:blank","title":"Failed Dependency","status":424,"code":"not_executed"}}]}`
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		committed   bool
+		statuses    []int
+		// code is the error's problem code; err is set for any error
+		err  bool
+		code string
+	}{
+		{
+			name:        "committed",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"committed":true,"results":[{"index":0,"status":201,"body":{"id":3}}]}`,
+			committed:   true,
+			statuses:    []int{201},
+		},
+		{
+			name:        "rolled back keeps the results",
+			status:      http.StatusNotFound,
+			contentType: "application/json",
+			body:        rolledBack,
+			statuses:    []int{201, 404, 424},
+		},
+		{
+			name:        "rejected batch is an error",
+			status:      http.StatusBadRequest,
+			contentType: "application/problem+json",
+			body:        `{"type":"about:blank","title":"Bad Request","status":400,"code":"bad_request","detail":"At least one operation is required"}`,
+			err:         true,
+			code:        "bad_request",
+		},
+		{
+			name:        "other failure is an error",
+			status:      http.StatusBadGateway,
+			contentType: "text/plain",
+			body:        "upstream unavailable",
+			err:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/batch" {
+					t.Errorf("request %s %s", r.Method, r.URL.Path)
+				}
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			c := NewAPIClient(server.URL, "token", time.Second)
+			got, err := c.Batch(context.Background(), models.BatchRequest{Atomic: true})
+			if tt.err {
+				if err == nil || ErrorCode(err) != tt.code {
+					t.Fatalf("err = %v, want an error with code %q", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Committed != tt.committed || len(got.Results) != len(tt.statuses) {
+				t.Fatalf("got %+v", got)
+			}
+			for i, result := range got.Results {
+				if result.Status != tt.statuses[i] {
+					t.Errorf("result %d status = %d, want %d", i, result.Status, tt.statuses[i])
+				}
+			}
+			if !tt.committed && got.Results[1].Error.Code != "user_not_found" {
+				t.Errorf("failing operation's error = %+v", got.Results[1].Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+
+	"github.com/yourusername/go-rest-api-lab/models"
+)
+
+// Error codes returned by the API in models.Problem.Code
+const (
+	CodeValidationFailed   = "validation_failed"
+	CodeUserNotFound       = "user_not_found"
+	CodePostNotFound       = "post_not_found"
+	CodeAuthorNotFound     = "author_not_found"
+	CodeDuplicateEmail     = "duplicate_email"
+	CodeDuplicateUsername  = "duplicate_username"
+	CodePreconditionFailed = "precondition_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeIdempotencyInProgress = "idempotency_in_progress"
+
+	CodeInvalidBody          = "invalid_body"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+)
+
+// APIError is a non-2xx response. Problem is set when the server sent a
+// problem details body; otherwise Body holds whatever it sent.
+type APIError struct {
+	StatusCode int
+	Problem    *models.Problem
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Problem == nil {
+		return fmt.Sprintf("API returned status %d: %s", e.StatusCode, e.Body)
+	}
+	msg := fmt.Sprintf("API returned status %d (%s): %s", e.StatusCode, e.Problem.Code, e.Problem.Detail)
+	for _, field := range e.Problem.Errors {
+		msg += fmt.Sprintf("; %s: %s", field.Field, field.Message)
+	}
+	return msg
+}
+
+// Code returns the problem's error code, or "" when there is none
+func (e *APIError) Code() string {
+	if e.Problem == nil {
+		return ""
+	}
+	return e.Problem.Code
+}
+
+// ErrorCode returns the API error code carried by err, or "" when err is not
+// an *APIError with a problem body
+func ErrorCode(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code()
+	}
+	return ""
+}
+
+// newAPIError builds an APIError from a response, decoding the body when it
+// is application/problem+json
+func newAPIError(statusCode int, contentType string, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Body: string(body)}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/problem+json" {
+		var problem models.Problem
+		if err := json.Unmarshal(body, &problem); err == nil {
+			apiErr.Problem = &problem
+		}
+	}
+	return apiErr
+}
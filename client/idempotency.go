@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPostRetries = 2
+	postRetryDelay     = 200 * time.Millisecond
+)
+
+// idempotentEndpoints are the POST endpoints where the server honors
+// Idempotency-Key. A retry anywhere else could apply the request twice.
+var idempotentEndpoints = map[string]bool{
+	"/users": true,
+	"/posts": true,
+}
+
+// deduplicated reports whether the server honors Idempotency-Key on a POST to
+// endpoint, with or without a /v1 or /v2 prefix
+func deduplicated(endpoint string) bool {
+	path, _, _ := strings.Cut(endpoint, "?")
+	path = strings.TrimSuffix(path, "/")
+	for _, prefix := range []string{"/v1", "/v2"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok && strings.HasPrefix(rest, "/") {
+			path = rest
+			break
+		}
+	}
+	return idempotentEndpoints[path]
+}
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey returns a context that makes Post send key as its
+// Idempotency-Key. Reuse the same key when retrying a request yourself. The
+// server ignores the key on endpoints other than POST /users and /posts.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+func idempotencyKeyFrom(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key, ok && key != ""
+}
+
+// NewIdempotencyKey returns a random key suitable for WithIdempotencyKey
+func NewIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate idempotency key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// retryable reports whether a failed Post may be sent again with the same key:
+// the request may not have reached the server, the server failed, or the
+// first attempt is still running
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError || apiErr.Code() == CodeIdempotencyInProgress
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled)
+}
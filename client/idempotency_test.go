@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeduplicated(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     bool
+	}{
+		{"/users", true},
+		{"/posts", true},
+		{"/posts/", true},
+		{"/users?notify=true", true},
+		{"/v1/users", true},
+		{"/v2/posts", true},
+		{"/users/1/restore", false},
+		{"/batch", false},
+		{"/graphql", false},
+		{"/webhooks", false},
+		{"/v3/users", false},
+		{"/v1", false},
+	}
+	for _, tt := range tests {
+		if got := deduplicated(tt.endpoint); got != tt.want {
+			t.Errorf("deduplicated(%q) = %v, want %v", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestPostIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		key      string // set with WithIdempotencyKey
+		statuses []int  // answered in turn
+		// attempts is how many requests reach the server; keyed whether
+		// they carry an Idempotency-Key
+		attempts int
+		keyed    bool
+		err      bool
+	}{
+		{name: "create is keyed", endpoint: "/users", statuses: []int{201}, attempts: 1, keyed: true},
+		{name: "retried with the same key", endpoint: "/v2/posts", statuses: []int{503, 409, 201}, attempts: 3, keyed: true},
+		{name: "gives up after the retries", endpoint: "/users", statuses: []int{500, 500, 500, 500}, attempts: 3, keyed: true, err: true},
+		{name: "client error is not retried", endpoint: "/users", statuses: []int{400}, attempts: 1, keyed: true, err: true},
+		{name: "caller's key", endpoint: "/posts", key: "mine", statuses: []int{201}, attempts: 1, keyed: true},
+		{name: "other POSTs are sent once", endpoint: "/batch", statuses: []int{503}, attempts: 1, err: true},
+		{name: "restore is sent once", endpoint: "/users/1/restore", statuses: []int{503}, attempts: 1, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var keys []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				status := tt.statuses[len(keys)]
+				keys = append(keys, r.Header.Get("Idempotency-Key"))
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(status)
+				if status == http.StatusConflict {
+					w.Write([]byte(`{"type":"about:blank","title":"Conflict","status":409,"code":"idempotency_in_progress"}`))
+				} else {
+					w.Write([]byte(`{}`))
+				}
+			}))
+			defer server.Close()
+
+			c := NewAPIClient(server.URL, "token", time.Second)
+			ctx := context.Background()
+			if tt.key != "" {
+				ctx = WithIdempotencyKey(ctx, tt.key)
+			}
+			err := c.Post(ctx, tt.endpoint, map[string]string{"name": "Ann"}, nil)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+
+			if len(keys) != tt.attempts {
+				t.Fatalf("%d attempts, want %d", len(keys), tt.attempts)
+			}
+			for _, key := range keys {
+				if (key != "") != tt.keyed || key != keys[0] {
+					t.Errorf("Idempotency-Key of the attempts = %q", keys)
+					break
+				}
+			}
+			if tt.key != "" && keys[0] != tt.key {
+				t.Errorf("sent key %q, want %q", keys[0], tt.key)
+			}
+		})
+	}
+}
+
+func TestPostKeysDiffer(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	c := NewAPIClient(server.URL, "token", time.Second)
+	for i := 0; i < 2; i++ {
+		if err := c.Post(context.Background(), "/users", map[string]string{"name": "Ann"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(keys) != 2 || keys[0] == keys[1] {
+		t.Errorf("keys of two creates = %q", keys)
+	}
+}
@@ -1,11 +1,22 @@
+-- Enable trigram matching for fuzzy user search
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Schema versions applied to this database. /readyz fails while the latest
+-- is older than the server's SCHEMA_VERSION.
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Create users table
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    email VARCHAR(255) NOT NULL UNIQUE,
-    username VARCHAR(100) NOT NULL UNIQUE,
+    email VARCHAR(255) NOT NULL,
+    username VARCHAR(100) NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP
 );
 
 -- Create posts table
@@ -15,19 +26,72 @@ CREATE TABLE IF NOT EXISTS posts (
     title VARCHAR(500) NOT NULL,
     body TEXT NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP
+);
+
+-- Responses to POST requests sent with an Idempotency-Key, replayed when the
+-- same request is retried. status_code is NULL while the first request runs.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key VARCHAR(255) NOT NULL,
+    scope VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INTEGER,
+    response_headers JSONB,
+    response_body BYTEA,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (idempotency_key, scope)
+);
+
+-- Outgoing webhooks. events holds event types such as 'post.created', or
+-- '*' for all of them; secret signs every delivery.
+CREATE TABLE IF NOT EXISTS webhooks (
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One row per event per webhook. Pending deliveries are retried at
+-- next_attempt_at until they succeed or run out of attempts and become dead.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INTEGER,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP
 );
 
 -- Create indexes
-CREATE INDEX idx_users_email ON users(email);
-CREATE INDEX idx_users_username ON users(username);
+-- Email and username only need to be unique among users that are not
+-- soft-deleted, so a deleted account does not block re-registration
+CREATE UNIQUE INDEX users_email_key ON users(email) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_username_key ON users(username) WHERE deleted_at IS NULL;
 CREATE INDEX idx_posts_user_id ON posts(user_id);
+CREATE INDEX idx_users_deleted_at ON users(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_posts_deleted_at ON posts(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, id);
+
+-- Trigram indexes for GET /users/search
+CREATE INDEX idx_users_name_trgm ON users USING gin (name gin_trgm_ops);
+CREATE INDEX idx_users_username_trgm ON users USING gin (username gin_trgm_ops);
+CREATE INDEX idx_users_email_trgm ON users USING gin (email gin_trgm_ops);
 
 -- Insert sample data
 INSERT INTO users (name, email, username) VALUES
     ('John Doe', 'john.doe@example.com', 'johndoe'),
     ('Jane Smith', 'jane.smith@example.com', 'janesmith')
-ON CONFLICT (email) DO NOTHING;
+ON CONFLICT (email) WHERE deleted_at IS NULL DO NOTHING;
 
 INSERT INTO posts (user_id, title, body) VALUES
     (1, 'My First Post', 'This is the content of my first post. Testing Bearer token authentication!'),
@@ -35,11 +99,13 @@ INSERT INTO posts (user_id, title, body) VALUES
     (2, 'Jane''s Post', 'Hello from Jane!')
 ON CONFLICT DO NOTHING;
 
--- Create function to update updated_at timestamp
+-- Create function to update updated_at timestamp. clock_timestamp() rather
+-- than CURRENT_TIMESTAMP, which is fixed for the transaction: updated_at is
+-- the ETag, so a second update in the same transaction must change it too.
 CREATE OR REPLACE FUNCTION update_updated_at_column()
 RETURNS TRIGGER AS $$
 BEGIN
-    NEW.updated_at = CURRENT_TIMESTAMP;
+    NEW.updated_at = clock_timestamp();
     RETURN NEW;
 END;
 $$ language 'plpgsql';
@@ -50,3 +116,6 @@ CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users
 
 CREATE TRIGGER update_posts_updated_at BEFORE UPDATE ON posts
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Record the schema version this file creates
+INSERT INTO schema_migrations (version) VALUES (1), (2) ON CONFLICT DO NOTHING;
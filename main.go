@@ -10,6 +10,7 @@ import (
 	"github.com/yourusername/go-rest-api-lab/client"
 	"github.com/yourusername/go-rest-api-lab/config"
 	"github.com/yourusername/go-rest-api-lab/models"
+	"github.com/yourusername/go-rest-api-lab/tracing"
 )
 
 func main() {
@@ -32,6 +33,25 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	// This run's spans are written as JSON lines to TRACE_EXPORT: stderr by
+	// default, apart from the report on stdout, or stdout, a file path, or
+	// off. Every request joins one trace, which the server continues.
+	traceExport := os.Getenv("TRACE_EXPORT")
+	if traceExport == "" {
+		traceExport = "stderr"
+	}
+	exporter, closer, err := tracing.OpenExporter(traceExport)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer closer.Close()
+	tracing.SetExporter(exporter)
+	ctx, span := tracing.Start(ctx, "cli test suite", tracing.KindInternal)
+	defer span.Finish(nil)
+	if exporter != nil {
+		fmt.Printf("Trace ID: %s\n", span.Context().TraceIDString())
+	}
+
 	fmt.Println("========================================")
 	fmt.Println("🧪 REST API Client - Full Test Suite")
 	fmt.Println("========================================\n")
@@ -73,7 +93,7 @@ func main() {
 func testGetUser(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("GET /users/1")
 	var user models.User
-	
+
 	if err := apiClient.Get(ctx, "/users/1", &user); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
 		return
@@ -87,7 +107,7 @@ func testGetUser(ctx context.Context, apiClient *client.APIClient) {
 func testGetPost(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("\nGET /posts/1")
 	var post models.Post
-	
+
 	if err := apiClient.Get(ctx, "/posts/1", &post); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
 		return
@@ -99,13 +119,13 @@ func testGetPost(ctx context.Context, apiClient *client.APIClient) {
 
 func testCreateUser(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("POST /users")
-	
+
 	newUser := models.CreateUserRequest{
 		Name:     "Jane Smith",
 		Email:    "jane.smith@example.com",
 		Username: "janesmith",
 	}
-	
+
 	var result models.User
 	if err := apiClient.Post(ctx, "/users", newUser, &result); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
@@ -119,13 +139,13 @@ func testCreateUser(ctx context.Context, apiClient *client.APIClient) {
 
 func testCreatePost(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("\nPOST /posts")
-	
+
 	newPost := models.CreatePostRequest{
 		UserID: 1,
 		Title:  "New Post Title",
 		Body:   "This is the body of the new post created via API",
 	}
-	
+
 	var result models.Post
 	if err := apiClient.Post(ctx, "/posts", newPost, &result); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
@@ -138,13 +158,13 @@ func testCreatePost(ctx context.Context, apiClient *client.APIClient) {
 
 func testUpdateUser(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("PUT /users/1")
-	
+
 	updateData := models.UpdateUserRequest{
 		Name:     "John Updated",
 		Email:    "john.updated@example.com",
 		Username: "johnupdated",
 	}
-	
+
 	var result models.User
 	if err := apiClient.Put(ctx, "/users/1", updateData, &result); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
@@ -158,13 +178,13 @@ func testUpdateUser(ctx context.Context, apiClient *client.APIClient) {
 
 func testUpdatePost(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("\nPUT /posts/1")
-	
+
 	updateData := models.CreatePostRequest{
 		UserID: 1,
 		Title:  "Updated Post Title",
 		Body:   "This post has been updated via PUT request",
 	}
-	
+
 	var result models.Post
 	if err := apiClient.Put(ctx, "/posts/1", updateData, &result); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
@@ -177,12 +197,12 @@ func testUpdatePost(ctx context.Context, apiClient *client.APIClient) {
 
 func testPatchUser(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("PATCH /users/1")
-	
+
 	newName := "John Patched"
 	patchData := models.PatchUserRequest{
 		Name: &newName,
 	}
-	
+
 	var result models.User
 	if err := apiClient.Patch(ctx, "/users/1", patchData, &result); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
@@ -196,7 +216,7 @@ func testPatchUser(ctx context.Context, apiClient *client.APIClient) {
 
 func testDeleteUser(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("DELETE /users/1")
-	
+
 	if err := apiClient.Delete(ctx, "/users/1"); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
 		return
@@ -207,7 +227,7 @@ func testDeleteUser(ctx context.Context, apiClient *client.APIClient) {
 
 func testDeletePost(ctx context.Context, apiClient *client.APIClient) {
 	fmt.Println("\nDELETE /posts/1")
-	
+
 	if err := apiClient.Delete(ctx, "/posts/1"); err != nil {
 		log.Printf("  ❌ Error: %v\n", err)
 		return
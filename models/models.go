@@ -1,11 +1,14 @@
 package models
 
+import "encoding/json"
+
 // User represents a user entity
 type User struct {
 	ID       int    `json:"id"`
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Username string `json:"username"`
+	Posts    []Post `json:"posts,omitempty"` // with ?include=posts
 }
 
 // Post represents a blog post entity
@@ -14,6 +17,7 @@ type Post struct {
 	ID     int    `json:"id"`
 	Title  string `json:"title"`
 	Body   string `json:"body"`
+	Author *User  `json:"author,omitempty"` // with ?include=author
 }
 
 // CreateUserRequest for POST /users
@@ -32,8 +36,9 @@ type UpdateUserRequest struct {
 
 // PatchUserRequest for PATCH /users/:id
 type PatchUserRequest struct {
-	Name *string `json:"name,omitempty"`
-	Email *string `json:"email,omitempty"`
+	Name     *string `json:"name,omitempty"`
+	Email    *string `json:"email,omitempty"`
+	Username *string `json:"username,omitempty"`
 }
 
 // CreatePostRequest for POST /posts
@@ -48,3 +53,61 @@ type SuccessResponse struct {
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
 }
+
+// BatchRequest for POST /batch
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is one create, update or delete in a batch. ID and values
+// inside Body may be a Ref to reuse an ID created earlier in the batch.
+type BatchOperation struct {
+	Ref      string      `json:"ref,omitempty"`
+	Action   string      `json:"action"`
+	Resource string      `json:"resource"`
+	ID       interface{} `json:"id,omitempty"`
+	Body     interface{} `json:"body,omitempty"`
+	IfMatch  string      `json:"ifMatch,omitempty"` // ETag for update and delete
+}
+
+// Ref refers to the ID produced by the batch operation with the given ref
+type Ref struct {
+	Ref string `json:"$ref"`
+}
+
+// BatchResult is the outcome of one batch operation
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Ref    string          `json:"ref,omitempty"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  *Problem        `json:"error,omitempty"`
+}
+
+// BatchResponse from POST /batch
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// Problem is an RFC 7807 error body (application/problem+json). Code is a
+// stable identifier such as "user_not_found" or "duplicate_email".
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is one invalid field reported with code "validation_failed" or
+// "invalid_body"
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Offset  int64  `json:"offset,omitempty"`
+}
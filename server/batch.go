@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/yourusername/go-rest-api-lab/tracing"
+)
+
+// maxBatchOperations bounds a single POST /batch request
+const maxBatchOperations = 1000
+
+// errBatchRolledBack marks the span of an atomic batch that did not commit
+var errBatchRolledBack = errors.New("batch rolled back")
+
+// BatchRequest is the body of POST /batch
+type BatchRequest struct {
+	// Atomic rolls back the whole batch when any operation fails. Otherwise
+	// failed operations are rolled back individually and the rest commit.
+	Atomic     bool             `json:"atomic,omitempty"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is one create, update or delete on users or posts. ID and
+// any value inside Body may be {"$ref": "<ref>"} to use the ID produced by
+// an earlier operation with that Ref. IfMatch is the operation's If-Match
+// header.
+type BatchOperation struct {
+	Ref      string          `json:"ref,omitempty"`
+	Action   string          `json:"action" enum:"create,update,delete"`
+	Resource string          `json:"resource" enum:"users,posts"`
+	ID       json.RawMessage `json:"id,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	IfMatch  string          `json:"ifMatch,omitempty"`
+}
+
+// BatchResult is the outcome of one operation, in request order
+type BatchResult struct {
+	Index  int         `json:"index"`
+	Ref    string      `json:"ref,omitempty"`
+	Status int         `json:"status"`
+	Body   interface{} `json:"body,omitempty"`
+	Error  *Problem    `json:"error,omitempty"`
+}
+
+// BatchResponse reports whether the transaction committed and every result
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	if len(req.Operations) == 0 {
+		respondWithProblem(w, r, http.StatusBadRequest, codeBadRequest, "At least one operation is required")
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		respondWithProblem(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("A batch may contain at most %d operations", maxBatchOperations))
+		return
+	}
+
+	response, status, err := runBatch(r, req)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	respond(w, r, status, response)
+}
+
+// runBatch executes every operation in one transaction. Each operation runs
+// under a savepoint so that, outside atomic mode, a failure only undoes that
+// operation. The returned status is 200 when the batch committed and the
+// failing operation's status when an atomic batch was rolled back.
+func runBatch(r *http.Request, req BatchRequest) (response *BatchResponse, status int, err error) {
+	ctx, span := tracing.Start(r.Context(), "db transaction", tracing.KindInternal)
+	defer func() {
+		if err == nil && !response.Committed {
+			span.Finish(errBatchRolledBack)
+			return
+		}
+		span.Finish(err)
+	}()
+	sqlTx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer sqlTx.Rollback()
+	tx := traced(ctx, sqlTx)
+
+	refs := map[string]int{}
+	results := make([]BatchResult, 0, len(req.Operations))
+	// Events are queued for webhooks with the batch and published once it
+	// commits, so nobody hears of a change that was rolled back
+	var changes []Event
+	for i, op := range req.Operations {
+		if _, err := tx.Exec(`SAVEPOINT batch_op`); err != nil {
+			return nil, 0, err
+		}
+
+		result := BatchResult{Index: i, Ref: op.Ref}
+		var cascaded []Event
+		status, body, id, err := executeBatchOperation(tx, op, refs, &cascaded)
+		if err != nil {
+			if _, rbErr := tx.Exec(`ROLLBACK TO SAVEPOINT batch_op`); rbErr != nil {
+				return nil, 0, rbErr
+			}
+			apiErr := classifyError(err)
+			if apiErr.status == http.StatusInternalServerError {
+				logFor(r).Error("batch operation failed", "index", i, "error", err)
+			}
+			result.Status, result.Error = apiErr.status, apiErr.problem("")
+			results = append(results, result)
+
+			if req.Atomic {
+				for j := i + 1; j < len(req.Operations); j++ {
+					results = append(results, BatchResult{
+						Index:  j,
+						Ref:    req.Operations[j].Ref,
+						Status: http.StatusFailedDependency,
+						Error:  newAPIError(http.StatusFailedDependency, codeNotExecuted, "Not executed: batch was rolled back").problem(""),
+					})
+				}
+				return &BatchResponse{Committed: false, Results: results}, result.Status, nil
+			}
+			continue
+		}
+
+		if _, err := tx.Exec(`RELEASE SAVEPOINT batch_op`); err != nil {
+			return nil, 0, err
+		}
+		if op.Ref != "" {
+			refs[op.Ref] = id
+		}
+		result.Status, result.Body = status, body
+		results = append(results, result)
+		changes = append(changes, batchEvent(op, id, body))
+		changes = append(changes, cascaded...)
+	}
+
+	if err := queueWebhookDeliveries(tx, changes); err != nil {
+		return nil, 0, err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	publishChanges(changes)
+	return &BatchResponse{Committed: true, Results: results}, http.StatusOK, nil
+}
+
+// executeBatchOperation runs op inside tx and returns the status and body the
+// equivalent REST call would have produced, plus the ID of the affected row.
+// Events for other rows the operation changed are added to cascaded.
+func executeBatchOperation(tx queryer, op BatchOperation, refs map[string]int, cascaded *[]Event) (int, interface{}, int, error) {
+	if op.Ref != "" {
+		if _, taken := refs[op.Ref]; taken {
+			return 0, nil, 0, &validationError{msg: fmt.Sprintf("Duplicate ref %q", op.Ref)}
+		}
+	}
+
+	var id int
+	var cond *ifMatch
+	if op.Action == "update" || op.Action == "delete" {
+		if len(op.ID) == 0 {
+			return 0, nil, 0, &validationError{msg: fmt.Sprintf("%q requires an id", op.Action)}
+		}
+		raw, err := resolveBatchRefs(op.ID, refs)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return 0, nil, 0, &validationError{msg: "id must be an integer or a $ref"}
+		}
+		if op.IfMatch == "" && REQUIRE_IF_MATCH {
+			return 0, nil, 0, newAPIError(http.StatusPreconditionRequired, codePreconditionRequired, fmt.Sprintf("%q requires ifMatch", op.Action))
+		}
+		cond = parseIfMatch(op.IfMatch)
+	} else if op.IfMatch != "" {
+		return 0, nil, 0, &validationError{msg: "ifMatch only applies to update and delete"}
+	}
+
+	var body []byte
+	if op.Action == "create" || op.Action == "update" {
+		if len(op.Body) == 0 {
+			return 0, nil, 0, &validationError{msg: fmt.Sprintf("%q requires a body", op.Action)}
+		}
+		var err error
+		if body, err = resolveBatchRefs(op.Body, refs); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+
+	switch op.Resource + "." + op.Action {
+	case "users.create":
+		var req CreateUserRequest
+		if err := decodeBatchBody(body, &req); err != nil {
+			return 0, nil, 0, err
+		}
+		user, err := insertUser(tx, req.Name, req.Email, req.Username)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		return http.StatusCreated, user, user.ID, nil
+	case "users.update":
+		var req UpdateUserRequest
+		if err := decodeBatchBody(body, &req); err != nil {
+			return 0, nil, 0, err
+		}
+		user, err := updateUserTx(tx, id, req.Name, req.Email, req.Username, cond)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		return http.StatusOK, user, id, nil
+	case "users.delete":
+		postIDs, err := deleteUserTx(tx, id, cond)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		for _, postID := range postIDs {
+			*cascaded = append(*cascaded, newEvent("post.deleted", "posts", postID, deletedEvent(postID, false)))
+		}
+		return http.StatusOK, SuccessResponse{Message: "User deleted successfully", Data: map[string]int{"id": id}}, id, nil
+	case "posts.create":
+		var req CreatePostRequest
+		if err := decodeBatchBody(body, &req); err != nil {
+			return 0, nil, 0, err
+		}
+		post, err := insertPost(tx, req.UserID, req.Title, req.Body)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		return http.StatusCreated, post, post.ID, nil
+	case "posts.update":
+		var req CreatePostRequest
+		if err := decodeBatchBody(body, &req); err != nil {
+			return 0, nil, 0, err
+		}
+		post, err := updatePostTx(tx, id, req.UserID, req.Title, req.Body, cond)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		return http.StatusOK, post, id, nil
+	case "posts.delete":
+		if err := deletePostTx(tx, id, cond); err != nil {
+			return 0, nil, 0, err
+		}
+		return http.StatusOK, SuccessResponse{Message: "Post deleted successfully", Data: map[string]int{"id": id}}, id, nil
+	}
+	return 0, nil, 0, &validationError{msg: fmt.Sprintf("Unsupported operation %q on %q", op.Action, op.Resource)}
+}
+
+// decodeBatchBody decodes an operation body into a request type and validates
+// it. Offsets in decoding errors are relative to the operation's body.
+func decodeBatchBody(body []byte, req interface{ validate() error }) error {
+	if err := decodeStrict(bytes.NewReader(body), req); err != nil {
+		return err
+	}
+	return req.validate()
+}
+
+// resolveBatchRefs replaces every {"$ref": "<ref>"} in raw with the ID that
+// operation produced
+func resolveBatchRefs(raw json.RawMessage, refs map[string]int) ([]byte, error) {
+	value, err := decodeJSONValue(raw)
+	if err != nil {
+		return nil, &validationError{msg: "Invalid JSON in operation"}
+	}
+	resolved, err := substituteRefs(value, refs)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+func substituteRefs(value interface{}, refs map[string]int) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok && len(v) == 1 {
+			id, ok := refs[ref]
+			if !ok {
+				return nil, &validationError{msg: fmt.Sprintf("Unknown ref %q: it must name an earlier successful operation", ref)}
+			}
+			return json.Number(strconv.Itoa(id)), nil
+		}
+		for key, child := range v {
+			resolved, err := substituteRefs(child, refs)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = resolved
+		}
+	case []interface{}:
+		for i, child := range v {
+			resolved, err := substituteRefs(child, refs)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	}
+	return value, nil
+}
+
+// batchEvent describes the change a successful operation made
+func batchEvent(op BatchOperation, id int, body interface{}) Event {
+	e := newEvent(singular(op.Resource)+"."+op.Action+"d", op.Resource, id, body)
+	if op.Action == "delete" {
+		e.Data = deletedEvent(id, false)
+	}
+	return e
+}
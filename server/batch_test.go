@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestResolveBatchRefs(t *testing.T) {
+	refs := map[string]int{"u": 7, "p": 12}
+
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{name: "bare id", raw: `3`, want: `3`},
+		{name: "id", raw: `{"$ref":"u"}`, want: `7`},
+		{name: "field", raw: `{"userId":{"$ref":"u"},"title":"t"}`, want: `{"title":"t","userId":7}`},
+		{name: "nested", raw: `{"a":{"b":[{"$ref":"p"},{"$ref":"u"}]}}`, want: `{"a":{"b":[12,7]}}`},
+		{name: "inside an array", raw: `[{"$ref":"u"},1]`, want: `[7,1]`},
+		{name: "ref with other keys is data", raw: `{"$ref":"u","x":1}`, want: `{"$ref":"u","x":1}`},
+		{name: "non-string ref is data", raw: `{"$ref":1}`, want: `{"$ref":1}`},
+		{name: "large numbers are kept", raw: `{"n":12345678901234567890}`, want: `{"n":12345678901234567890}`},
+		{name: "unknown ref", raw: `{"userId":{"$ref":"nope"}}`, wantErr: true},
+		{name: "invalid JSON", raw: `{"userId":`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveBatchRefs(json.RawMessage(tt.raw), refs)
+			var invalid *validationError
+			if tt.wantErr {
+				if !errors.As(err, &invalid) {
+					t.Errorf("error = %v, want a validation error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// batchDB answers the statements of user and post operations. Creating a
+// user named "taken" violates the unique email constraint, and row 404 does
+// not exist.
+func batchDB(t *testing.T) *fakeDB {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	nextID := int64(100)
+	return useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO users"):
+			if args[0] == "taken" {
+				return nil, &pq.Error{Code: "23505", Constraint: "users_email_key", Message: `duplicate key value violates unique constraint "users_email_key"`}
+			}
+			nextID++
+			return &fakeResult{
+				columns: []string{"id", "name", "email", "username", "created_at", "updated_at"},
+				rows:    [][]driver.Value{{nextID, args[0], args[1], args[2], now, now}},
+			}, nil
+		case strings.HasPrefix(query, "INSERT INTO posts"):
+			nextID++
+			return &fakeResult{
+				columns: []string{"id", "user_id", "title", "body", "created_at", "updated_at"},
+				rows:    [][]driver.Value{{nextID, args[0], args[1], args[2], now, now}},
+			}, nil
+		case strings.HasPrefix(query, "SELECT updated_at FROM"):
+			if args[0] == int64(404) {
+				return &fakeResult{columns: []string{"updated_at"}}, nil
+			}
+			return &fakeResult{columns: []string{"updated_at"}, rows: [][]driver.Value{{now}}}, nil
+		case strings.HasPrefix(query, "UPDATE posts SET deleted_at"):
+			// The user's two live posts go with them
+			return &fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+		}
+		return &fakeResult{affected: 1}, nil
+	})
+}
+
+func TestRunBatch(t *testing.T) {
+	const (
+		createUser = `{"ref":"u","action":"create","resource":"users","body":{"name":"Ann","email":"ann@example.com","username":"ann"}}`
+		createPost = `{"action":"create","resource":"posts","body":{"userId":{"$ref":"u"},"title":"Hi","body":"First"}}`
+		takenUser  = `{"action":"create","resource":"users","body":{"name":"taken","email":"x@example.com","username":"x"}}`
+		deleteUser = `{"action":"delete","resource":"users","id":5}`
+		missing    = `{"action":"delete","resource":"posts","id":404}`
+	)
+
+	tests := []struct {
+		name      string
+		atomic    bool
+		ops       []string
+		status    int
+		committed bool
+		results   []int
+		// events are the types published, in order
+		events []string
+		// rolledBack is how many operations were undone to their savepoint
+		rolledBack int
+	}{
+		{name: "refs", ops: []string{createUser, createPost},
+			status: 200, committed: true, results: []int{201, 201},
+			events: []string{"user.created", "post.created"}},
+		{name: "cascaded deletes", ops: []string{deleteUser},
+			status: 200, committed: true, results: []int{200},
+			events: []string{"user.deleted", "post.deleted", "post.deleted"}},
+		{name: "failure commits the rest", ops: []string{createUser, takenUser, createPost},
+			status: 200, committed: true, results: []int{201, 409, 201},
+			events: []string{"user.created", "post.created"}, rolledBack: 1},
+		{name: "failed ref is unknown", ops: []string{strings.Replace(takenUser, `{"action"`, `{"ref":"u","action"`, 1), createPost},
+			status: 200, committed: true, results: []int{409, 400}, rolledBack: 2},
+		{name: "atomic", atomic: true, ops: []string{createUser, createPost},
+			status: 200, committed: true, results: []int{201, 201},
+			events: []string{"user.created", "post.created"}},
+		{name: "atomic failure rolls back", atomic: true, ops: []string{createUser, missing, createPost},
+			status: 404, results: []int{201, 404, 424}, rolledBack: 1},
+		{name: "atomic failure first", atomic: true, ops: []string{takenUser, createUser},
+			status: 409, results: []int{409, 424}, rolledBack: 1},
+		{name: "duplicate ref", ops: []string{createUser, createUser},
+			status: 200, committed: true, results: []int{201, 400},
+			events: []string{"user.created"}, rolledBack: 1},
+		{name: "unsupported operation", ops: []string{`{"action":"create","resource":"comments","body":{}}`},
+			status: 200, committed: true, results: []int{400}, rolledBack: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := batchDB(t)
+			savedEvents := events
+			events = newEventBroker(16)
+			defer func() { events = savedEvents }()
+			sub, _, _ := events.subscribe(eventFilter{}, 0, false)
+
+			req := BatchRequest{Atomic: tt.atomic}
+			for _, op := range tt.ops {
+				var batchOp BatchOperation
+				if err := json.Unmarshal([]byte(op), &batchOp); err != nil {
+					t.Fatal(err)
+				}
+				req.Operations = append(req.Operations, batchOp)
+			}
+			response, status, err := runBatch(httptest.NewRequest(http.MethodPost, "/batch", nil), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if status != tt.status || response.Committed != tt.committed {
+				t.Errorf("status %d, committed %v; want %d, %v", status, response.Committed, tt.status, tt.committed)
+			}
+			var results []int
+			for _, result := range response.Results {
+				results = append(results, result.Status)
+			}
+			if !reflect.DeepEqual(results, tt.results) {
+				t.Errorf("results = %v, want %v", results, tt.results)
+			}
+
+			if got := fake.ran("ROLLBACK TO SAVEPOINT"); got != tt.rolledBack {
+				t.Errorf("%d operations rolled back, want %d", got, tt.rolledBack)
+			}
+			statements := fake.statements()
+			end := statements[len(statements)-1]
+			if tt.committed && end != "COMMIT" || !tt.committed && end != "ROLLBACK" {
+				t.Errorf("transaction ended with %s", end)
+			}
+			if queued := fake.ran("INSERT INTO webhook_deliveries"); queued != len(tt.events) {
+				t.Errorf("%d webhook deliveries queued, want %d", queued, len(tt.events))
+			}
+
+			var published []string
+			for len(sub.ch) > 0 {
+				published = append(published, (<-sub.ch).Type)
+			}
+			if !reflect.DeepEqual(published, tt.events) {
+				t.Errorf("published %v, want %v", published, tt.events)
+			}
+		})
+	}
+}
+
+func TestRunBatchSubstitutesRefs(t *testing.T) {
+	fake := batchDB(t)
+	req := BatchRequest{Operations: []BatchOperation{
+		{Ref: "u", Action: "create", Resource: "users", Body: json.RawMessage(`{"name":"Ann","email":"ann@example.com","username":"ann"}`)},
+		{Action: "create", Resource: "posts", Body: json.RawMessage(`{"userId":{"$ref":"u"},"title":"Hi","body":"First"}`)},
+		{Action: "delete", Resource: "users", ID: json.RawMessage(`{"$ref":"u"}`)},
+	}}
+	if _, _, err := runBatch(httptest.NewRequest(http.MethodPost, "/batch", nil), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user got ID 101; the post and the delete must both name it
+	var postAuthor, deleted []driver.Value
+	for i, s := range fake.statements() {
+		switch {
+		case strings.HasPrefix(s, "INSERT INTO posts"):
+			postAuthor = fake.args[i]
+		case strings.HasPrefix(s, "UPDATE users SET deleted_at"):
+			deleted = fake.args[i]
+		}
+	}
+	if len(postAuthor) == 0 || postAuthor[0] != int64(101) {
+		t.Errorf("post created with %v, want user 101", postAuthor)
+	}
+	if len(deleted) == 0 || deleted[0] != int64(101) {
+		t.Errorf("deleted %v, want user 101", deleted)
+	}
+}
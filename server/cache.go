@@ -0,0 +1,210 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	// CACHE_SIZE is how many users, and separately how many posts, are kept
+	// in memory. 0 turns the cache off.
+	CACHE_SIZE = 1000
+	// CACHE_TTL bounds how long an entry is served. Writes through this
+	// instance invalidate entries at once; the TTL is what limits staleness
+	// after writes through another instance.
+	CACHE_TTL = 30 * time.Second
+)
+
+// userCache and postCache hold live rows by ID for getUserByID and
+// getPostByID. They are replaced in main once CACHE_SIZE and CACHE_TTL are
+// known.
+var (
+	userCache = newLRUCache[*User]("users", CACHE_SIZE, CACHE_TTL)
+	postCache = newLRUCache[*Post]("posts", CACHE_SIZE, CACHE_TTL)
+)
+
+var (
+	cacheLookups = newCounterVec("cache_lookups_total",
+		"Cache lookups by cache and result: hit, miss, or coalesced for a miss that waited for another request's query.", "cache", "result")
+	cacheEvictions = newCounterVec("cache_evictions_total",
+		"Entries dropped by cache and reason: capacity or expired.", "cache", "reason")
+)
+
+// errCacheLoadFailed is what requests get when the load they wait for panics
+var errCacheLoadFailed = errors.New("cache load failed")
+
+// lruCache is a read-through cache of up to size entries, each served for at
+// most ttl. Concurrent misses for a key share one load.
+type lruCache[V any] struct {
+	name string
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[int]*list.Element
+	loading map[int]*cacheLoad[V]
+	// gen changes on every invalidation. A load that started before one may
+	// have read the old row, so its result is returned but not stored.
+	gen uint64
+}
+
+type cacheEntry[V any] struct {
+	key     int
+	value   V
+	expires time.Time
+}
+
+// cacheLoad is a load in progress; done is closed once value and err are set
+type cacheLoad[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+func newLRUCache[V any](name string, size int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		name:    name,
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[int]*list.Element{},
+		loading: map[int]*cacheLoad[V]{},
+	}
+}
+
+// get returns the cached value for key, calling load on a miss. Errors are
+// not cached. The load does not stop when the request that started it goes
+// away, since others may be waiting for it; each request stops waiting when
+// its own context is done and gets the context's error.
+func (c *lruCache[V]) get(ctx context.Context, key int, load func(ctx context.Context) (V, error)) (V, error) {
+	if c.size <= 0 {
+		return load(ctx)
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry[V])
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(elem)
+			c.mu.Unlock()
+			cacheLookups.inc(c.name, "hit")
+			return entry.value, nil
+		}
+		c.remove(elem)
+		cacheEvictions.inc(c.name, "expired")
+	}
+	pending, ok := c.loading[key]
+	if ok {
+		c.mu.Unlock()
+		cacheLookups.inc(c.name, "coalesced")
+	} else {
+		// The error stands if load panics, so waiters do not use a zero value
+		pending = &cacheLoad[V]{done: make(chan struct{}), err: errCacheLoadFailed}
+		c.loading[key] = pending
+		gen := c.gen
+		c.mu.Unlock()
+		cacheLookups.inc(c.name, "miss")
+		go c.run(context.WithoutCancel(ctx), key, gen, pending, load)
+	}
+
+	select {
+	case <-pending.done:
+		return pending.value, pending.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// run performs a load for get. A panic is logged and reported to the
+// waiting requests as errCacheLoadFailed.
+func (c *lruCache[V]) run(ctx context.Context, key int, gen uint64, pending *cacheLoad[V], load func(ctx context.Context) (V, error)) {
+	defer c.finish(key, gen, pending)
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("cache load panicked", "cache", c.name, "key", key, "panic", fmt.Sprint(p))
+		}
+	}()
+	pending.value, pending.err = load(ctx)
+}
+
+// finish stores a load's result, unless it failed or an invalidation came
+// after it started, and releases the requests waiting for it
+func (c *lruCache[V]) finish(key int, gen uint64, pending *cacheLoad[V]) {
+	c.mu.Lock()
+	if c.loading[key] == pending {
+		delete(c.loading, key)
+	}
+	if pending.err == nil && c.gen == gen {
+		c.store(key, pending.value)
+	}
+	c.mu.Unlock()
+	close(pending.done)
+}
+
+// store adds or replaces key, evicting the least recently used entry when
+// the cache is full. c.mu must be held.
+func (c *lruCache[V]) store(key int, value V) {
+	entry := &cacheEntry[V]{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		cacheEvictions.inc(c.name, "capacity")
+	}
+}
+
+// remove drops an entry. c.mu must be held.
+func (c *lruCache[V]) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry[V]).key)
+}
+
+// invalidate drops key after a write. Lookups from then on load it again
+// instead of waiting for a load that may have read the old row.
+func (c *lruCache[V]) invalidate(key int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	delete(c.loading, key)
+	c.gen++
+}
+
+func (c *lruCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// invalidateUser drops a user from the cache after a write. Posts changed
+// with the user are invalidated one by one, like the events sent for them.
+func invalidateUser(id int) {
+	userCache.invalidate(id)
+}
+
+func invalidatePost(id int) {
+	postCache.invalidate(id)
+}
+
+// writeCacheStats exposes the lookup and eviction counters and the size of
+// each cache
+func writeCacheStats(out io.Writer) {
+	cacheLookups.write(out)
+	cacheEvictions.write(out)
+	fmt.Fprint(out, "# HELP cache_entries Entries currently cached.\n# TYPE cache_entries gauge\n")
+	fmt.Fprintf(out, "cache_entries%s %d\n", formatLabels([]string{"cache"}, []string{userCache.name}), userCache.len())
+	fmt.Fprintf(out, "cache_entries%s %d\n", formatLabels([]string{"cache"}, []string{postCache.name}), postCache.len())
+}
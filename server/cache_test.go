@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingLoad is a load that counts its calls and waits for release
+type blockingLoad struct {
+	calls   atomic.Int32
+	started chan struct{}
+	release chan string
+}
+
+func newBlockingLoad() *blockingLoad {
+	return &blockingLoad{started: make(chan struct{}, 10), release: make(chan string)}
+}
+
+func (b *blockingLoad) load(ctx context.Context) (string, error) {
+	b.calls.Add(1)
+	b.started <- struct{}{}
+	value := <-b.release
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return value, nil
+}
+
+func constLoad(value string, calls *int) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		*calls++
+		return value, nil
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	failing := errors.New("no such row")
+
+	// Each step is a get of key; load says whether it had to load
+	tests := []struct {
+		name  string
+		size  int
+		ttl   time.Duration
+		keys  []int
+		loads []bool
+	}{
+		{name: "hits", size: 2, ttl: time.Minute,
+			keys: []int{1, 1, 2, 1, 2}, loads: []bool{true, false, true, false, false}},
+		{name: "least recently used is evicted", size: 2, ttl: time.Minute,
+			keys: []int{1, 2, 1, 3, 1, 2}, loads: []bool{true, true, false, true, false, true}},
+		{name: "expired", size: 2, ttl: 0,
+			keys: []int{1, 1}, loads: []bool{true, true}},
+		{name: "disabled", size: 0, ttl: time.Minute,
+			keys: []int{1, 1}, loads: []bool{true, true}},
+		{name: "errors are not cached", size: 2, ttl: time.Minute,
+			keys: []int{-1, -1, 1, 1}, loads: []bool{true, true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newLRUCache[string]("test", tt.size, tt.ttl)
+			for i, key := range tt.keys {
+				loaded := false
+				value, err := cache.get(context.Background(), key, func(context.Context) (string, error) {
+					loaded = true
+					if key < 0 {
+						return "", failing
+					}
+					return fmt.Sprint(key), nil
+				})
+				if key < 0 && !errors.Is(err, failing) || key >= 0 && value != fmt.Sprint(key) {
+					t.Errorf("get %d = %q, %v", key, value, err)
+				}
+				if loaded != tt.loads[i] {
+					t.Errorf("step %d: get %d loaded %v, want %v", i, key, loaded, tt.loads[i])
+				}
+			}
+			if tt.size > 0 && cache.len() > tt.size {
+				t.Errorf("%d entries, want at most %d", cache.len(), tt.size)
+			}
+		})
+	}
+}
+
+func TestLRUCacheCoalesces(t *testing.T) {
+	cache := newLRUCache[string]("coalescing", 10, time.Minute)
+	loader := newBlockingLoad()
+	coalesced := counterValue(cacheLookups, "coalescing", "coalesced")
+
+	const requests = 10
+	results := make(chan string, requests)
+	get := func() {
+		value, err := cache.get(context.Background(), 1, loader.load)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- value
+	}
+	go get()
+	<-loader.started
+
+	// The rest arrive while the first load runs and wait for it
+	var wg sync.WaitGroup
+	for i := 1; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	for counterValue(cacheLookups, "coalescing", "coalesced") < coalesced+requests-1 {
+		time.Sleep(time.Millisecond)
+	}
+	loader.release <- "ann"
+	wg.Wait()
+
+	for i := 0; i < requests; i++ {
+		if value := <-results; value != "ann" {
+			t.Errorf("got %q, want ann", value)
+		}
+	}
+	if calls := loader.calls.Load(); calls != 1 {
+		t.Errorf("loaded %d times, want once", calls)
+	}
+}
+
+func TestLRUCacheInvalidationDuringLoad(t *testing.T) {
+	cache := newLRUCache[string]("test", 10, time.Minute)
+	loader := newBlockingLoad()
+
+	first := make(chan string)
+	go func() {
+		value, _ := cache.get(context.Background(), 1, loader.load)
+		first <- value
+	}()
+	<-loader.started
+
+	// A write lands while the row is being read; the next lookup must not
+	// wait for the load that may have read the old row
+	cache.invalidate(1)
+	second := make(chan string)
+	go func() {
+		value, _ := cache.get(context.Background(), 1, loader.load)
+		second <- value
+	}()
+	<-loader.started
+
+	loader.release <- "old"
+	if value := <-first; value != "old" {
+		t.Errorf("first get = %q, want old", value)
+	}
+	loader.release <- "new"
+	if value := <-second; value != "new" {
+		t.Errorf("second get = %q, want new", value)
+	}
+
+	calls := 0
+	if value, _ := cache.get(context.Background(), 1, constLoad("reloaded", &calls)); value != "new" || calls != 0 {
+		t.Errorf("cached %q (%d loads), want the load that started after the write", value, calls)
+	}
+}
+
+func TestLRUCacheStaleLoadIsNotStored(t *testing.T) {
+	cache := newLRUCache[string]("test", 10, time.Minute)
+	loader := newBlockingLoad()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.get(context.Background(), 1, loader.load)
+	}()
+	<-loader.started
+	// An unrelated key's write also makes the load's result unsafe to keep
+	cache.invalidate(2)
+	loader.release <- "old"
+	<-done
+
+	calls := 0
+	if value, _ := cache.get(context.Background(), 1, constLoad("fresh", &calls)); value != "fresh" || calls != 1 {
+		t.Errorf("got %q after %d loads, want a fresh load", value, calls)
+	}
+}
+
+func TestLRUCacheCallerGoesAway(t *testing.T) {
+	cache := newLRUCache[string]("test", 10, time.Minute)
+	loader := newBlockingLoad()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := cache.get(ctx, 1, loader.load)
+		errs <- err
+	}()
+	<-loader.started
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("get = %v, want context.Canceled", err)
+	}
+
+	// The load goes on with a context that is not cancelled, and the next
+	// lookup gets its result, whether it is still running or stored
+	loader.release <- "ann"
+	calls := 0
+	if value, err := cache.get(context.Background(), 1, constLoad("again", &calls)); err != nil || value != "ann" || calls != 0 {
+		t.Errorf("got %q, %v after %d loads, want the abandoned load's result", value, err, calls)
+	}
+}
+
+func TestLRUCachePanic(t *testing.T) {
+	cache := newLRUCache[string]("test", 10, time.Minute)
+	_, err := cache.get(context.Background(), 1, func(context.Context) (string, error) {
+		panic("boom")
+	})
+	if !errors.Is(err, errCacheLoadFailed) {
+		t.Fatalf("get = %v, want errCacheLoadFailed", err)
+	}
+
+	calls := 0
+	if value, err := cache.get(context.Background(), 1, constLoad("ann", &calls)); err != nil || value != "ann" || calls != 1 {
+		t.Errorf("got %q, %v after %d loads; the panic must not be cached", value, err, calls)
+	}
+}
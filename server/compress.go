@@ -0,0 +1,273 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// COMPRESSION gzips responses for clients that send Accept-Encoding: gzip
+	COMPRESSION = true
+	// COMPRESSION_MIN_SIZE is the smallest body worth compressing. Streamed
+	// responses are compressed from their first flush whatever their size.
+	COMPRESSION_MIN_SIZE = 1024
+	// COMPRESSION_LEVEL is the gzip level, 1 (fastest) to 9 (smallest)
+	COMPRESSION_LEVEL = gzip.DefaultCompression
+	// COMPRESSION_TYPES are the media types that are compressed. Images and
+	// other already compressed formats gain nothing.
+	COMPRESSION_TYPES = []string{
+		"application/json",
+		"application/problem+json",
+		"application/xml",
+		"application/problem+xml",
+		"application/x-ndjson",
+		"text/csv",
+		"text/plain",
+		"text/event-stream",
+	}
+)
+
+// gzipWriters reuses writers, which hold large compression tables
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		gz, err := gzip.NewWriterLevel(nil, COMPRESSION_LEVEL)
+		if err != nil {
+			gz = gzip.NewWriter(nil)
+		}
+		return gz
+	},
+}
+
+// compress gzips responses the client accepts compressed. Whether to
+// compress is decided once the body reaches COMPRESSION_MIN_SIZE, the
+// handler flushes or the response ends, so short bodies go out as they are.
+func compress(next http.Handler) http.Handler {
+	if !COMPRESSION {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := &gzipWriter{
+			ResponseWriter: w,
+			accepts:        acceptsGzip(r.Header.Get("Accept-Encoding")),
+			ifNoneMatch:    r.Header.Get("If-None-Match"),
+			status:         http.StatusOK,
+		}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, either
+// by name or through * when gzip is not listed
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			q = parsed
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// parseMediaTypes parses a comma separated COMPRESSION_TYPES value
+func parseMediaTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// compressibleType reports whether contentType is in COMPRESSION_TYPES
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range COMPRESSION_TYPES {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter holds back the start of the body until it knows whether to
+// compress it. It passes Flush through so event streams keep working.
+type gzipWriter struct {
+	http.ResponseWriter
+	accepts     bool
+	ifNoneMatch string
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	gz          *gzip.Writer
+	// err is the last error writing to the client, which gzip would
+	// otherwise only report on a flush
+	err error
+}
+
+func (gw *gzipWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		// Informational responses such as 103 Early Hints go out now
+		gw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if gw.wroteHeader {
+		return
+	}
+	gw.status, gw.wroteHeader = status, true
+	if !bodyAllowed(status) {
+		gw.decide(false)
+	}
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.err != nil {
+		return 0, gw.err
+	}
+	if !gw.decided {
+		gw.buf = append(gw.buf, p...)
+		if len(gw.buf) >= COMPRESSION_MIN_SIZE {
+			gw.decide(true)
+		}
+		return len(p), gw.err
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+	return gw.ResponseWriter.Write(p)
+}
+
+func (gw *gzipWriter) Flush() {
+	if !gw.decided && gw.wroteHeader {
+		gw.decide(true)
+	}
+	if gw.gz != nil && gw.err == nil {
+		gw.err = gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// decide sends the header, compressed when the response qualifies and large
+// is set, followed by whatever body was held back
+func (gw *gzipWriter) decide(large bool) {
+	gw.decided = true
+	header := gw.Header()
+	if header.Get("Content-Type") == "" && len(gw.buf) > 0 {
+		// net/http would sniff the body, which it cannot once it is compressed
+		header.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+	if bodyAllowed(gw.status) && header.Get("Content-Encoding") == "" && compressibleType(header.Get("Content-Type")) {
+		// Caches must not serve a compressed copy to a client that did not
+		// ask for one, even when this copy is not compressed
+		if !varies(header, "Accept-Encoding") {
+			header.Add("Vary", "Accept-Encoding")
+		}
+		if gw.accepts && large {
+			// The compressed bytes get their own tag. Preconditions strip
+			// the suffix again, since If-Match compares the row version.
+			if etag := header.Get("ETag"); etag != "" {
+				header.Set("ETag", gzipETag(etag))
+			}
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			gw.gz = gzipWriters.Get().(*gzip.Writer)
+			gw.gz.Reset(gw.ResponseWriter)
+		}
+	}
+	if gw.status == http.StatusNotModified {
+		gw.revalidatedETag()
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+	if len(gw.buf) == 0 {
+		return
+	}
+	if gw.gz != nil {
+		_, gw.err = gw.gz.Write(gw.buf)
+	} else {
+		_, gw.err = gw.ResponseWriter.Write(gw.buf)
+	}
+	gw.buf = nil
+}
+
+// revalidatedETag gives a 304 the tag of the variant the client holds, which
+// is the gzipped one when that is what it asked about
+func (gw *gzipWriter) revalidatedETag() {
+	header := gw.Header()
+	etag := header.Get("ETag")
+	if etag == "" {
+		return
+	}
+	variant := gzipETag(etag)
+	for _, tag := range parseETags(gw.ifNoneMatch) {
+		if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(variant, "W/") {
+			header.Set("ETag", variant)
+			return
+		}
+	}
+}
+
+// close ends the response, sending a body that stayed below
+// COMPRESSION_MIN_SIZE as it is
+func (gw *gzipWriter) close() {
+	if !gw.decided && gw.wroteHeader {
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+		gw.gz.Reset(nil)
+		gzipWriters.Put(gw.gz)
+		gw.gz = nil
+	}
+}
+
+// bodyAllowed reports whether a response with status has a body
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// varies reports whether the Vary header already names field
+func varies(header http.Header, field string) bool {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), field) || strings.TrimSpace(name) == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"br", false},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0, *", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"identity, *;q=0.1", true},
+		{"gzip;q=2", false},
+		{"gzip;q=bogus, *", true},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"name":"Ann"},`, 100)
+	const etag = `"abc"`
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		ifNoneMatch    string
+		contentType    string
+		status         int
+		body           string
+		gzipped        bool
+		vary           bool
+		etag           string
+	}{
+		{name: "large", acceptEncoding: "gzip", contentType: "application/json", body: large,
+			gzipped: true, vary: true, etag: `"abc-gzip"`},
+		{name: "small", acceptEncoding: "gzip", contentType: "application/json", body: `{}`,
+			vary: true, etag: etag},
+		{name: "not accepted", contentType: "application/json", body: large,
+			vary: true, etag: etag},
+		{name: "refused", acceptEncoding: "gzip;q=0", contentType: "application/json", body: large,
+			vary: true, etag: etag},
+		{name: "problem with charset", acceptEncoding: "gzip", contentType: "application/problem+json; charset=utf-8", body: large,
+			status: 404, gzipped: true, vary: true, etag: `"abc-gzip"`},
+		{name: "not compressible", acceptEncoding: "gzip", contentType: "image/png", body: large,
+			etag: etag},
+		{name: "sniffed type", acceptEncoding: "gzip", body: strings.Repeat("plain text ", 200),
+			gzipped: true, vary: true, etag: `"abc-gzip"`},
+		{name: "no content", acceptEncoding: "gzip", contentType: "application/json",
+			status: 204, etag: etag},
+		{name: "not modified", acceptEncoding: "gzip", contentType: "application/json",
+			status: 304, etag: etag},
+		{name: "not modified, gzipped copy", acceptEncoding: "gzip", ifNoneMatch: `"abc-gzip"`, contentType: "application/json",
+			status: 304, etag: `"abc-gzip"`},
+		{name: "not modified, weak gzipped copy", acceptEncoding: "gzip", ifNoneMatch: `W/"abc-gzip"`, contentType: "application/json",
+			status: 304, etag: `"abc-gzip"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.Header().Set("ETag", etag)
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				// Written in pieces, so the decision comes mid-body
+				for i := 0; i < len(tt.body); i += 100 {
+					io.WriteString(w, tt.body[i:min(i+100, len(tt.body))])
+				}
+			}))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/users", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			handler.ServeHTTP(w, r)
+
+			if want := max(tt.status, 200); w.Code != want {
+				t.Errorf("status = %d, want %d", w.Code, want)
+			}
+			if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != tt.gzipped {
+				t.Fatalf("Content-Encoding = %q", w.Header().Get("Content-Encoding"))
+			}
+			if vary := w.Header().Get("Vary") == "Accept-Encoding"; vary != tt.vary {
+				t.Errorf("Vary = %q", w.Header().Get("Vary"))
+			}
+			if got := w.Header().Get("ETag"); got != tt.etag {
+				t.Errorf("ETag = %s, want %s", got, tt.etag)
+			}
+
+			body := w.Body.Bytes()
+			if tt.gzipped {
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestCompressKeepsVary(t *testing.T) {
+	handler := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept, accept-encoding")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+	if got := w.Header().Values("Vary"); len(got) != 1 {
+		t.Errorf("Vary = %q, want Accept-Encoding named once", got)
+	}
+}
+
+func TestCompressStreams(t *testing.T) {
+	const event = "data: 1\n\n"
+	recorder := httptest.NewRecorder()
+	handler := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, event)
+		w.(http.Flusher).Flush()
+
+		// A small event is compressed from the flush, not held back until
+		// the stream ends
+		if recorder.Header().Get("Content-Encoding") != "gzip" || !recorder.Flushed {
+			t.Fatalf("Content-Encoding = %q, flushed %v", recorder.Header().Get("Content-Encoding"), recorder.Flushed)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(recorder.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(event))
+		if _, err := io.ReadFull(gz, got); err != nil || string(got) != event {
+			t.Errorf("flushed %q, %v", got, err)
+		}
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(recorder, r)
+}
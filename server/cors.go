@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// CORS_ALLOWED_ORIGINS lists the origins browsers may call the API from:
+	// exact origins like https://app.example.com, patterns with one wildcard
+	// like https://*.example.com, or "*" for any origin
+	CORS_ALLOWED_ORIGINS = []string{"*"}
+	// CORS_ALLOW_CREDENTIALS lets browsers send cookies. It cannot be
+	// combined with "*".
+	CORS_ALLOW_CREDENTIALS = false
+	// CORS_MAX_AGE is how long browsers may cache a preflight response
+	CORS_MAX_AGE = 10 * time.Minute
+)
+
+// corsAllowHeaders are the request headers browsers may send
+var corsAllowHeaders = []string{
+	"Authorization", "Content-Type", "If-Match", "If-None-Match", "If-Modified-Since",
+	"Idempotency-Key", "API-Version", "Last-Event-ID", "X-Request-ID", "traceparent",
+}
+
+// corsExposeHeaders are the response headers scripts may read
+var corsExposeHeaders = []string{
+	"ETag", "Idempotent-Replayed", "API-Version", "Deprecation", "Sunset", "Link", "X-Request-ID",
+}
+
+// corsPolicy decides which origins may make cross-origin requests to a route
+// and what the browser is told about them
+type corsPolicy struct {
+	// origins are exact origins or patterns with one *; "*" allows any origin.
+	// An empty list rejects every cross-origin request.
+	origins          []string
+	allowCredentials bool
+	allowHeaders     []string
+	exposeHeaders    []string
+	maxAge           time.Duration
+}
+
+// publicCORS is for unauthenticated endpoints anyone may read, like /health
+var publicCORS = &corsPolicy{
+	origins:      []string{"*"},
+	allowHeaders: corsAllowHeaders,
+	maxAge:       24 * time.Hour,
+}
+
+// noCORS is for endpoints browsers have no business calling, like /metrics
+var noCORS = &corsPolicy{}
+
+// defaultCORS builds the policy configured by the CORS_* variables
+func defaultCORS() *corsPolicy {
+	return &corsPolicy{
+		origins:          CORS_ALLOWED_ORIGINS,
+		allowCredentials: CORS_ALLOW_CREDENTIALS,
+		allowHeaders:     corsAllowHeaders,
+		exposeHeaders:    corsExposeHeaders,
+		maxAge:           CORS_MAX_AGE,
+	}
+}
+
+// validate rejects a policy browsers would refuse or that would be unsafe
+func (p *corsPolicy) validate() error {
+	for _, origin := range p.origins {
+		if origin == "*" {
+			if p.allowCredentials {
+				return fmt.Errorf(`CORS credentials cannot be allowed for any origin ("*"); list the origins`)
+			}
+			continue
+		}
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("CORS origin %q may contain at most one *", origin)
+		}
+		if origin != "null" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("CORS origin %q must start with http:// or https://", origin)
+		}
+	}
+	return nil
+}
+
+// allowsOrigin reports whether origin, as sent by the browser, may call
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(allowed, "*")
+		if !ok || len(origin) <= len(prefix)+len(suffix) {
+			continue
+		}
+		// The wildcard stands for one or more subdomain labels, never a
+		// path, port or scheme
+		middle := origin[len(prefix) : len(origin)-len(suffix)]
+		if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) && !strings.ContainsAny(middle, "/:@") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAnyOrigin reports whether the response can say "*" rather than
+// echoing the origin
+func (p *corsPolicy) allowsAnyOrigin() bool {
+	return !p.allowCredentials && slices.Contains(p.origins, "*")
+}
+
+func (p *corsPolicy) allowsHeader(name string) bool {
+	for _, allowed := range p.allowHeaders {
+		if strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware applies policy to a group of routes serving methods. It
+// answers preflight and plain OPTIONS requests itself and rejects requests
+// from origins the policy does not allow. Requests without an Origin header,
+// i.e. not from a browser, pass through untouched apart from Vary.
+func corsMiddleware(policy *corsPolicy, methods []string, next http.HandlerFunc) http.HandlerFunc {
+	allowMethods := strings.Join(append(slices.Clone(methods), http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ by origin, so caches must not share them across
+		// origins, even when this one is not cross-origin
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if origin != "" {
+			if !policy.allowsOrigin(origin) {
+				respondWithProblem(w, r, http.StatusForbidden, codeCORSRejected, "Origin "+origin+" is not allowed")
+				return
+			}
+			if policy.allowsAnyOrigin() {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if policy.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(policy.exposeHeaders) > 0 && !preflight {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.exposeHeaders, ", "))
+			}
+		}
+
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+			method := r.Header.Get("Access-Control-Request-Method")
+			if !slices.Contains(methods, method) {
+				respondWithProblem(w, r, http.StatusForbidden, codeCORSRejected, "Method "+method+" is not allowed")
+				return
+			}
+			for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+				if name = strings.TrimSpace(name); name != "" && !policy.allowsHeader(name) {
+					respondWithProblem(w, r, http.StatusForbidden, codeCORSRejected, "Header "+name+" is not allowed")
+					return
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.allowHeaders, ", "))
+			if policy.maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.maxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allowMethods)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// parseOrigins splits a comma separated CORS_ALLOWED_ORIGINS value
+func parseOrigins(s string) []string {
+	var origins []string
+	for _, origin := range strings.Split(s, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAllowsOrigin(t *testing.T) {
+	policy := &corsPolicy{origins: []string{"https://app.example.com", "https://*.example.org", "http://localhost:3000"}}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://App.Example.com", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://evil.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://.example.org", false},
+		{"https://evil.com/.example.org", false},
+		{"https://evil.com:1@x.example.org", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := policy.allowsOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowsOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+	if !publicCORS.allowsOrigin("https://anywhere.test") {
+		t.Error(`"*" rejects an origin`)
+	}
+	if noCORS.allowsOrigin("https://app.example.com") {
+		t.Error("an empty policy allows an origin")
+	}
+}
+
+func TestCORSPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  corsPolicy
+		wantErr bool
+	}{
+		{name: "exact origins", policy: corsPolicy{origins: []string{"https://a.test", "http://localhost:3000", "null"}}},
+		{name: "wildcard", policy: corsPolicy{origins: []string{"*"}}},
+		{name: "credentials with a list", policy: corsPolicy{origins: []string{"https://*.a.test"}, allowCredentials: true}},
+		{name: "credentials with any origin", policy: corsPolicy{origins: []string{"*"}, allowCredentials: true}, wantErr: true},
+		{name: "two wildcards", policy: corsPolicy{origins: []string{"https://*.*.a.test"}}, wantErr: true},
+		{name: "no scheme", policy: corsPolicy{origins: []string{"a.test"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	listed := &corsPolicy{
+		origins:       []string{"https://app.example.com"},
+		allowHeaders:  corsAllowHeaders,
+		exposeHeaders: corsExposeHeaders,
+		maxAge:        10 * time.Minute,
+	}
+	credentialed := &corsPolicy{origins: []string{"*.example.com", "https://app.example.com"}, allowCredentials: true}
+
+	tests := []struct {
+		name          string
+		policy        *corsPolicy
+		method        string
+		origin        string
+		requestMethod string // Access-Control-Request-Method, for preflights
+		requestHeader string // Access-Control-Request-Headers
+		status        int
+		allowOrigin   string
+		reached       bool
+	}{
+		{name: "same-origin or non-browser", policy: listed, method: http.MethodGet, status: http.StatusOK, reached: true},
+		{name: "allowed origin", policy: listed, method: http.MethodGet, origin: "https://app.example.com", status: http.StatusOK, allowOrigin: "https://app.example.com", reached: true},
+		{name: "rejected origin", policy: listed, method: http.MethodGet, origin: "https://evil.com", status: http.StatusForbidden},
+		{name: "no CORS route", policy: noCORS, method: http.MethodGet, origin: "https://app.example.com", status: http.StatusForbidden},
+		{name: "any origin", policy: publicCORS, method: http.MethodGet, origin: "https://anywhere.test", status: http.StatusOK, allowOrigin: "*", reached: true},
+		{name: "credentials echo the origin", policy: credentialed, method: http.MethodGet, origin: "https://app.example.com", status: http.StatusOK, allowOrigin: "https://app.example.com", reached: true},
+		{name: "preflight", policy: listed, method: http.MethodOptions, origin: "https://app.example.com", requestMethod: http.MethodPut, requestHeader: "authorization, if-match", status: http.StatusNoContent, allowOrigin: "https://app.example.com"},
+		{name: "preflight for another method", policy: listed, method: http.MethodOptions, origin: "https://app.example.com", requestMethod: http.MethodDelete, status: http.StatusForbidden, allowOrigin: "https://app.example.com"},
+		{name: "preflight with another header", policy: listed, method: http.MethodOptions, origin: "https://app.example.com", requestMethod: http.MethodGet, requestHeader: "X-Custom", status: http.StatusForbidden, allowOrigin: "https://app.example.com"},
+		{name: "preflight from a rejected origin", policy: listed, method: http.MethodOptions, origin: "https://evil.com", requestMethod: http.MethodGet, status: http.StatusForbidden},
+		{name: "plain OPTIONS", policy: listed, method: http.MethodOptions, status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			handler := corsMiddleware(tt.policy, []string{http.MethodGet, http.MethodPut}, func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			})
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/users/1", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			if tt.requestHeader != "" {
+				r.Header.Set("Access-Control-Request-Headers", tt.requestHeader)
+			}
+			handler(w, r)
+
+			if w.Code != tt.status || reached != tt.reached {
+				t.Fatalf("status = %d, handler reached %v; want %d, %v", w.Code, reached, tt.status, tt.reached)
+			}
+			header := w.Header()
+			if got := header.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if !slices.Contains(header.Values("Vary"), "Origin") {
+				t.Errorf("Vary = %q, want Origin", header.Values("Vary"))
+			}
+			if got := header.Get("Access-Control-Allow-Credentials"); (got == "true") != (tt.policy.allowCredentials && tt.allowOrigin != "") {
+				t.Errorf("Access-Control-Allow-Credentials = %q", got)
+			}
+			if tt.status == http.StatusNoContent && tt.requestMethod != "" {
+				if got := header.Get("Access-Control-Allow-Methods"); got != "GET, PUT, OPTIONS" {
+					t.Errorf("Access-Control-Allow-Methods = %q", got)
+				}
+				if got := header.Get("Access-Control-Max-Age"); got != "600" {
+					t.Errorf("Access-Control-Max-Age = %q", got)
+				}
+			}
+			if tt.reached && tt.policy == listed && header.Get("Access-Control-Expose-Headers") == "" && tt.origin != "" {
+				t.Error("no Access-Control-Expose-Headers")
+			}
+		})
+	}
+}
+
+func TestParseOrigins(t *testing.T) {
+	got := parseOrigins(" https://a.test/ ,,http://localhost:3000 ")
+	want := []string{"https://a.test", "http://localhost:3000"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseOrigins = %q, want %q", got, want)
+	}
+}
@@ -1,17 +1,35 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/yourusername/go-rest-api-lab/tracing"
 )
 
 var db *sql.DB
 
+var (
+	errUserNotFound   = errors.New("user not found")
+	errPostNotFound   = errors.New("post not found")
+	errUserNotDeleted = errors.New("user is not deleted")
+	errPostNotDeleted = errors.New("post is not deleted")
+
+	// errAuthorNotFound means a post refers to a user that does not exist or
+	// is soft-deleted
+	errAuthorNotFound = errors.New("author not found")
+	// errAuthorDeleted means a post cannot be restored before its author
+	errAuthorDeleted = errors.New("author is deleted")
+)
+
 // InitDB initializes the database connection
 func InitDB() error {
 	host := getEnv("DB_HOST", "localhost")
@@ -39,7 +57,7 @@ func InitDB() error {
 		return fmt.Errorf("error connecting to database: %w", err)
 	}
 
-	log.Println("✅ Database connected successfully")
+	slog.Info("Database connected", "host", host, "port", port, "database", dbname)
 	return nil
 }
 
@@ -57,14 +75,88 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// sqlQueryer is satisfied by both *sql.DB and *sql.Tx so the same statements
+// can run standalone or as part of a larger transaction such as POST /batch.
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// queryer is what storage functions run statements on: a sqlQueryer wrapped
+// by traced
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rows is the part of *sql.Rows that results are read with, so a traced
+// query's span can last until its rows are closed
+type rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// withTx runs fn in a transaction, committing if fn returns nil and rolling
+// back otherwise. The transaction gets a span, with fn's statements under it.
+func withTx(ctx context.Context, fn func(tx queryer) error) (err error) {
+	ctx, span := tracing.Start(ctx, "db transaction", tracing.KindInternal)
+	defer func() { span.Finish(err) }()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(traced(ctx, tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// withWriteTx is withTx for writes. Once fn succeeds, changes lists the
+// events it caused: they are queued for webhooks in the same transaction,
+// then published and invalidated in the caches after it commits.
+func withWriteTx(ctx context.Context, fn func(tx queryer) error, changes func() []Event) error {
+	var committed []Event
+	err := withTx(ctx, func(tx queryer) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		committed = changes()
+		return queueWebhookDeliveries(tx, committed)
+	})
+	if err == nil {
+		publishChanges(committed)
+	}
+	return err
+}
+
 // User database operations
 
-func getUserByID(id int) (*User, error) {
+// getUserByID returns a live user, from userCache when it is there
+func getUserByID(ctx context.Context, id int) (*User, error) {
+	user, err := userCache.get(ctx, id, func(ctx context.Context) (*User, error) {
+		return queryUserByID(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Callers may modify what they get; the cached user must not change
+	copied := *user
+	return &copied, nil
+}
+
+func queryUserByID(ctx context.Context, id int) (*User, error) {
 	user := &User{}
-	query := `SELECT id, name, email, username, created_at, updated_at FROM users WHERE id = $1`
-	err := db.QueryRow(query, id).Scan(&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt)
+	query := `SELECT id, name, email, username, created_at, updated_at FROM users WHERE id = $1 AND deleted_at IS NULL`
+	err := traced(ctx, db).QueryRow(query, id).Scan(&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("user not found")
+		return nil, errUserNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -72,11 +164,23 @@ func getUserByID(id int) (*User, error) {
 	return user, nil
 }
 
-func createUser(name, email, username string) (*User, error) {
+func createUser(ctx context.Context, name, email, username string) (*User, error) {
+	var user *User
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var err error
+		user, err = insertUser(tx, name, email, username)
+		return err
+	}, func() []Event {
+		return []Event{newEvent("user.created", "users", user.ID, user)}
+	})
+	return user, err
+}
+
+func insertUser(q queryer, name, email, username string) (*User, error) {
 	user := &User{}
 	query := `INSERT INTO users (name, email, username) VALUES ($1, $2, $3) 
 	          RETURNING id, name, email, username, created_at, updated_at`
-	err := db.QueryRow(query, name, email, username).Scan(
+	err := q.QueryRow(query, name, email, username).Scan(
 		&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
@@ -84,70 +188,268 @@ func createUser(name, email, username string) (*User, error) {
 	return user, nil
 }
 
-func updateUser(id int, name, email, username string) (*User, error) {
-	query := `UPDATE users SET name = $1, email = $2, username = $3, updated_at = CURRENT_TIMESTAMP 
+func updateUser(ctx context.Context, id int, name, email, username string, cond *ifMatch) (*User, error) {
+	var user *User
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var err error
+		user, err = updateUserTx(tx, id, name, email, username, cond)
+		return err
+	}, func() []Event {
+		return []Event{newEvent("user.updated", "users", id, user)}
+	})
+	return user, err
+}
+
+func updateUserTx(tx queryer, id int, name, email, username string, cond *ifMatch) (*User, error) {
+	if err := lockRow(tx, "users", id, cond); err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE users SET name = $1, email = $2, username = $3, updated_at = clock_timestamp() 
 	          WHERE id = $4 RETURNING id, name, email, username, created_at, updated_at`
 	user := &User{}
-	err := db.QueryRow(query, name, email, username, id).Scan(
+	err := tx.QueryRow(query, name, email, username, id).Scan(
 		&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt)
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("user not found")
+	if err != nil {
+		return nil, err
 	}
+	return user, nil
+}
+
+// patchUserDB locks the user row, checks cond, lets apply compute the new state
+// and writes it back, all in one transaction so concurrent patches cannot
+// interleave.
+func patchUserDB(ctx context.Context, id int, cond *ifMatch, apply func(current *User) (*User, error)) (*User, error) {
+	user := &User{}
+	err := withWriteTx(ctx, func(tx queryer) error {
+		current := &User{}
+		query := `SELECT id, name, email, username, created_at, updated_at FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+		err := tx.QueryRow(query, id).Scan(
+			&current.ID, &current.Name, &current.Email, &current.Username, &current.CreatedAt, &current.UpdatedAt)
+		if err == sql.ErrNoRows {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := cond.check(current.UpdatedAt); err != nil {
+			return err
+		}
+
+		patched, err := apply(current)
+		if err != nil {
+			return err
+		}
+
+		query = `UPDATE users SET name = $1, email = $2, username = $3, updated_at = clock_timestamp() 
+		         WHERE id = $4 RETURNING id, name, email, username, created_at, updated_at`
+		return tx.QueryRow(query, patched.Name, patched.Email, patched.Username, id).Scan(
+			&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt)
+	}, func() []Event {
+		return []Event{newEvent("user.updated", "users", id, user)}
+	})
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-func patchUserDB(id int, name, email *string) (*User, error) {
-	// First get current user
-	user, err := getUserByID(id)
+func deleteUser(ctx context.Context, id int, cond *ifMatch) error {
+	var postIDs []int
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var err error
+		postIDs, err = deleteUserTx(tx, id, cond)
+		return err
+	}, func() []Event {
+		changes := []Event{newEvent("user.deleted", "users", id, deletedEvent(id, false))}
+		return append(changes, postsDeleted(postIDs, false)...)
+	})
+	return err
+}
+
+// deleteUserTx soft-deletes a user together with their live posts and
+// returns the posts' IDs. The posts get the same deleted_at so restoreUser
+// can bring back exactly those.
+func deleteUserTx(tx queryer, id int, cond *ifMatch) ([]int, error) {
+	if err := lockRow(tx, "users", id, cond); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`UPDATE posts SET deleted_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND deleted_at IS NULL RETURNING id`, id)
 	if err != nil {
 		return nil, err
 	}
+	return scanIDs(rows)
+}
 
-	// Update only provided fields
-	if name != nil {
-		user.Name = *name
+// postsDeleted are the events for posts deleted along with their author
+func postsDeleted(ids []int, hard bool) []Event {
+	changes := make([]Event, 0, len(ids))
+	for _, id := range ids {
+		changes = append(changes, newEvent("post.deleted", "posts", id, deletedEvent(id, hard)))
 	}
-	if email != nil {
-		user.Email = *email
+	return changes
+}
+
+func scanIDs(rows rows) ([]int, error) {
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
+	return ids, rows.Err()
+}
 
-	query := `UPDATE users SET name = $1, email = $2, updated_at = CURRENT_TIMESTAMP 
-	          WHERE id = $3 RETURNING id, name, email, username, created_at, updated_at`
-	err = db.QueryRow(query, user.Name, user.Email, id).Scan(
-		&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt)
+// restoreUser undoes a soft delete, including the posts deleted with the user
+func restoreUser(ctx context.Context, id int) (*User, error) {
+	user := &User{}
+	var posts []Post
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var deletedAt sql.NullTime
+		err := tx.QueryRow(`SELECT deleted_at FROM users WHERE id = $1 FOR UPDATE`, id).Scan(&deletedAt)
+		if err == sql.ErrNoRows {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !deletedAt.Valid {
+			return errUserNotDeleted
+		}
+
+		query := `UPDATE users SET deleted_at = NULL WHERE id = $1 
+		          RETURNING id, name, email, username, created_at, updated_at`
+		err = tx.QueryRow(query, id).Scan(
+			&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		query = `UPDATE posts SET deleted_at = NULL WHERE user_id = $1 AND deleted_at = $2
+		         RETURNING id, user_id, title, body, created_at, updated_at`
+		rows, err := tx.Query(query, id, deletedAt.Time)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var post Post
+			if err := rows.Scan(&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt); err != nil {
+				return err
+			}
+			posts = append(posts, post)
+		}
+		return rows.Err()
+	}, func() []Event {
+		changes := []Event{newEvent("user.restored", "users", id, user)}
+		for i := range posts {
+			changes = append(changes, newEvent("post.restored", "posts", posts[i].ID, &posts[i]))
+		}
+		return changes
+	})
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-func deleteUser(id int) error {
-	query := `DELETE FROM users WHERE id = $1`
-	result, err := db.Exec(query, id)
-	if err != nil {
+// purgeUser permanently deletes a user, live or soft-deleted, and all their
+// posts
+func purgeUser(ctx context.Context, id int, cond *ifMatch) error {
+	var postIDs []int
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var updatedAt time.Time
+		err := tx.QueryRow(`SELECT updated_at FROM users WHERE id = $1 FOR UPDATE`, id).Scan(&updatedAt)
+		if err == sql.ErrNoRows {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := cond.check(updatedAt); err != nil {
+			return err
+		}
+		// ON DELETE CASCADE would remove the posts too, but without telling
+		// us which
+		rows, err := tx.Query(`DELETE FROM posts WHERE user_id = $1 RETURNING id`, id)
+		if err != nil {
+			return err
+		}
+		if postIDs, err = scanIDs(rows); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM users WHERE id = $1`, id)
 		return err
+	}, func() []Event {
+		changes := []Event{newEvent("user.deleted", "users", id, deletedEvent(id, true))}
+		return append(changes, postsDeleted(postIDs, true)...)
+	})
+	return err
+}
+
+// getUserIncludingDeleted is getUserByID for the admin view, which may return
+// a soft-deleted user with DeletedAt set
+func getUserIncludingDeleted(ctx context.Context, id int) (*User, error) {
+	user := &User{}
+	query := `SELECT id, name, email, username, created_at, updated_at, deleted_at FROM users WHERE id = $1`
+	err := traced(ctx, db).QueryRow(query, id).Scan(
+		&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
 	}
-	rows, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return user, nil
+}
+
+// listDeletedUsers returns soft-deleted users, most recently deleted first
+func listDeletedUsers(ctx context.Context, limit int) ([]User, error) {
+	query := `SELECT id, name, email, username, created_at, updated_at, deleted_at FROM users 
+	          WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id LIMIT $1`
+	rows, err := traced(ctx, db).Query(query, limit)
+	if err != nil {
+		return nil, err
 	}
-	if rows == 0 {
-		return fmt.Errorf("user not found")
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Username,
+			&user.CreatedAt, &user.UpdatedAt, &user.DeletedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
 	}
-	return nil
+	return users, rows.Err()
 }
 
 // Post database operations
 
-func getPostByID(id int) (*Post, error) {
+// getPostByID returns a live post, from postCache when it is there
+func getPostByID(ctx context.Context, id int) (*Post, error) {
+	post, err := postCache.get(ctx, id, func(ctx context.Context) (*Post, error) {
+		return queryPostByID(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	copied := *post
+	return &copied, nil
+}
+
+func queryPostByID(ctx context.Context, id int) (*Post, error) {
 	post := &Post{}
-	query := `SELECT id, user_id, title, body, created_at, updated_at FROM posts WHERE id = $1`
-	err := db.QueryRow(query, id).Scan(&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt)
+	query := `SELECT id, user_id, title, body, created_at, updated_at FROM posts WHERE id = $1 AND deleted_at IS NULL`
+	err := traced(ctx, db).QueryRow(query, id).Scan(&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("post not found")
+		return nil, errPostNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -155,26 +457,59 @@ func getPostByID(id int) (*Post, error) {
 	return post, nil
 }
 
-func createPost(userID int, title, body string) (*Post, error) {
+func createPost(ctx context.Context, userID int, title, body string) (*Post, error) {
+	var post *Post
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var err error
+		post, err = insertPost(tx, userID, title, body)
+		return err
+	}, func() []Event {
+		return []Event{newEvent("post.created", "posts", post.ID, post)}
+	})
+	return post, err
+}
+
+func insertPost(q queryer, userID int, title, body string) (*Post, error) {
 	post := &Post{}
-	query := `INSERT INTO posts (user_id, title, body) VALUES ($1, $2, $3) 
+	query := `INSERT INTO posts (user_id, title, body) 
+	          SELECT $1, $2, $3 WHERE EXISTS (SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL) 
 	          RETURNING id, user_id, title, body, created_at, updated_at`
-	err := db.QueryRow(query, userID, title, body).Scan(
+	err := q.QueryRow(query, userID, title, body).Scan(
 		&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errAuthorNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 	return post, nil
 }
 
-func updatePost(id, userID int, title, body string) (*Post, error) {
-	query := `UPDATE posts SET user_id = $1, title = $2, body = $3, updated_at = CURRENT_TIMESTAMP 
-	          WHERE id = $4 RETURNING id, user_id, title, body, created_at, updated_at`
+func updatePost(ctx context.Context, id, userID int, title, body string, cond *ifMatch) (*Post, error) {
+	var post *Post
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var err error
+		post, err = updatePostTx(tx, id, userID, title, body, cond)
+		return err
+	}, func() []Event {
+		return []Event{newEvent("post.updated", "posts", id, post)}
+	})
+	return post, err
+}
+
+func updatePostTx(tx queryer, id, userID int, title, body string, cond *ifMatch) (*Post, error) {
+	if err := lockRow(tx, "posts", id, cond); err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE posts SET user_id = $1, title = $2, body = $3, updated_at = clock_timestamp() 
+	          WHERE id = $4 AND EXISTS (SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL) 
+	          RETURNING id, user_id, title, body, created_at, updated_at`
 	post := &Post{}
-	err := db.QueryRow(query, userID, title, body, id).Scan(
+	err := tx.QueryRow(query, userID, title, body, id).Scan(
 		&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("post not found")
+		return nil, errAuthorNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -182,18 +517,417 @@ func updatePost(id, userID int, title, body string) (*Post, error) {
 	return post, nil
 }
 
-func deletePost(id int) error {
-	query := `DELETE FROM posts WHERE id = $1`
-	result, err := db.Exec(query, id)
+// patchPostDB is the post counterpart of patchUserDB
+func patchPostDB(ctx context.Context, id int, cond *ifMatch, apply func(current *Post) (*Post, error)) (*Post, error) {
+	post := &Post{}
+	err := withWriteTx(ctx, func(tx queryer) error {
+		current := &Post{}
+		query := `SELECT id, user_id, title, body, created_at, updated_at FROM posts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+		err := tx.QueryRow(query, id).Scan(
+			&current.ID, &current.UserID, &current.Title, &current.Body, &current.CreatedAt, &current.UpdatedAt)
+		if err == sql.ErrNoRows {
+			return errPostNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := cond.check(current.UpdatedAt); err != nil {
+			return err
+		}
+
+		patched, err := apply(current)
+		if err != nil {
+			return err
+		}
+
+		query = `UPDATE posts SET user_id = $1, title = $2, body = $3, updated_at = clock_timestamp() 
+		         WHERE id = $4 AND EXISTS (SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL) 
+		         RETURNING id, user_id, title, body, created_at, updated_at`
+		err = tx.QueryRow(query, patched.UserID, patched.Title, patched.Body, id).Scan(
+			&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt)
+		if err == sql.ErrNoRows {
+			return errAuthorNotFound
+		}
+		return err
+	}, func() []Event {
+		return []Event{newEvent("post.updated", "posts", id, post)}
+	})
 	if err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+func deletePost(ctx context.Context, id int, cond *ifMatch) error {
+	err := withWriteTx(ctx, func(tx queryer) error {
+		return deletePostTx(tx, id, cond)
+	}, func() []Event {
+		return []Event{newEvent("post.deleted", "posts", id, deletedEvent(id, false))}
+	})
+	return err
+}
+
+// deletePostTx soft-deletes a post
+func deletePostTx(tx queryer, id int, cond *ifMatch) error {
+	if err := lockRow(tx, "posts", id, cond); err != nil {
 		return err
 	}
-	rows, err := result.RowsAffected()
+	_, err := tx.Exec(`UPDATE posts SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	return err
+}
+
+// restorePost undoes a soft delete. A post cannot come back while its author
+// is still deleted.
+func restorePost(ctx context.Context, id int) (*Post, error) {
+	post := &Post{}
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var deletedAt sql.NullTime
+		var authorDeleted bool
+		query := `SELECT p.deleted_at, u.deleted_at IS NOT NULL FROM posts p 
+		          JOIN users u ON u.id = p.user_id WHERE p.id = $1 FOR UPDATE OF p`
+		err := tx.QueryRow(query, id).Scan(&deletedAt, &authorDeleted)
+		if err == sql.ErrNoRows {
+			return errPostNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !deletedAt.Valid {
+			return errPostNotDeleted
+		}
+		if authorDeleted {
+			return errAuthorDeleted
+		}
+
+		query = `UPDATE posts SET deleted_at = NULL WHERE id = $1 
+		         RETURNING id, user_id, title, body, created_at, updated_at`
+		return tx.QueryRow(query, id).Scan(
+			&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt)
+	}, func() []Event {
+		return []Event{newEvent("post.restored", "posts", id, post)}
+	})
 	if err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// purgePost permanently deletes a post, live or soft-deleted
+func purgePost(ctx context.Context, id int, cond *ifMatch) error {
+	err := withWriteTx(ctx, func(tx queryer) error {
+		var updatedAt time.Time
+		err := tx.QueryRow(`SELECT updated_at FROM posts WHERE id = $1 FOR UPDATE`, id).Scan(&updatedAt)
+		if err == sql.ErrNoRows {
+			return errPostNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := cond.check(updatedAt); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM posts WHERE id = $1`, id)
 		return err
+	}, func() []Event {
+		return []Event{newEvent("post.deleted", "posts", id, deletedEvent(id, true))}
+	})
+	return err
+}
+
+// getPostIncludingDeleted is getPostByID for the admin view
+func getPostIncludingDeleted(ctx context.Context, id int) (*Post, error) {
+	post := &Post{}
+	query := `SELECT id, user_id, title, body, created_at, updated_at, deleted_at FROM posts WHERE id = $1`
+	err := traced(ctx, db).QueryRow(query, id).Scan(
+		&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt, &post.DeletedAt)
+	if err == sql.ErrNoRows {
+		return nil, errPostNotFound
 	}
-	if rows == 0 {
-		return fmt.Errorf("post not found")
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return post, nil
+}
+
+// listDeletedPosts returns soft-deleted posts, most recently deleted first
+func listDeletedPosts(ctx context.Context, limit int) ([]Post, error) {
+	query := `SELECT id, user_id, title, body, created_at, updated_at, deleted_at FROM posts 
+	          WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id LIMIT $1`
+	rows, err := traced(ctx, db).Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.UserID, &post.Title, &post.Body,
+			&post.CreatedAt, &post.UpdatedAt, &post.DeletedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// lockRow locks a live (not soft-deleted) row of table for the rest of tx and
+// checks cond against its current version, so a precondition cannot go stale
+// before the write.
+func lockRow(tx queryer, table string, id int, cond *ifMatch) error {
+	var updatedAt time.Time
+	err := tx.QueryRow(`SELECT updated_at FROM `+table+` WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id).Scan(&updatedAt)
+	if err == sql.ErrNoRows {
+		if table == "posts" {
+			return errPostNotFound
+		}
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return cond.check(updatedAt)
+}
+
+// Sparse and expanded views (?fields=, ?include=)
+
+// getUserView loads the requested user fields and, with view.include, the
+// user's live posts in a single extra query. lastModified is zero when posts
+// are included, since a removed post would not advance it.
+func getUserView(ctx context.Context, id int, view resourceView) (*record, time.Time, error) {
+	values := make([]interface{}, len(view.fields)+1)
+	query := `SELECT ` + columnList("u", view.fields) + `, u.updated_at FROM users u 
+	          WHERE u.id = $1 AND u.deleted_at IS NULL`
+	err := traced(ctx, db).QueryRow(query, id).Scan(scanTargets(values)...)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, errUserNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	user := recordFromRow(view.fields, values)
+	if !view.include {
+		lastModified, _ := values[len(view.fields)].(time.Time)
+		return user, lastModified, nil
+	}
+
+	query = `SELECT ` + columnList("p", view.includeFields) + ` FROM posts p 
+	         WHERE p.user_id = $1 AND p.deleted_at IS NULL ORDER BY p.id`
+	rows, err := traced(ctx, db).Query(query, id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	posts := []*record{}
+	for rows.Next() {
+		postValues := make([]interface{}, len(view.includeFields))
+		if err := rows.Scan(scanTargets(postValues)...); err != nil {
+			return nil, time.Time{}, err
+		}
+		posts = append(posts, recordFromRow(view.includeFields, postValues))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	user.set("posts", posts)
+	return user, time.Time{}, nil
+}
+
+// getPostView loads the requested post fields and, with view.include, joins
+// the author in the same query. author is null if the author is deleted.
+func getPostView(ctx context.Context, id int, view resourceView) (*record, time.Time, error) {
+	columns := columnList("p", view.fields) + ", p.updated_at"
+	from := `posts p`
+	n := len(view.fields) + 1
+	if view.include {
+		columns += ", " + columnList("u", view.includeFields) + ", u.updated_at"
+		from += ` LEFT JOIN users u ON u.id = p.user_id AND u.deleted_at IS NULL`
+		n += len(view.includeFields) + 1
+	}
+
+	values := make([]interface{}, n)
+	query := `SELECT ` + columns + ` FROM ` + from + ` WHERE p.id = $1 AND p.deleted_at IS NULL`
+	err := traced(ctx, db).QueryRow(query, id).Scan(scanTargets(values)...)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, errPostNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	post := recordFromRow(view.fields, values)
+	lastModified, _ := values[len(view.fields)].(time.Time)
+	if view.include {
+		authorValues := values[len(view.fields)+1:]
+		authorUpdatedAt, found := authorValues[len(view.includeFields)].(time.Time)
+		if found {
+			post.set("author", recordFromRow(view.includeFields, authorValues))
+			if authorUpdatedAt.After(lastModified) {
+				lastModified = authorUpdatedAt
+			}
+		} else {
+			post.set("author", nil)
+			lastModified = time.Time{}
+		}
+	}
+	return post, lastModified, nil
+}
+
+// User search
+
+// searchUsers ranks users by trigram similarity of query against name,
+// username and email. A username or email that starts with query counts as
+// a full match so that partial addresses like "jane.sm" still rank first.
+func searchUsers(ctx context.Context, query string, minScore float64, limit int) ([]UserSearchResult, error) {
+	// The % operator uses pg_trgm.similarity_threshold and, unlike a
+	// similarity() comparison, the trigram indexes. set_config with
+	// is_local lasts until the end of the transaction.
+	sqlQuery := `SELECT id, name, email, username, created_at, updated_at,
+	                    GREATEST(
+	                        similarity(name, $1),
+	                        similarity(username, $1),
+	                        similarity(email, $1),
+	                        CASE WHEN username ILIKE $2 OR email ILIKE $2 THEN 1 ELSE 0 END
+	                    ) AS score
+	             FROM users
+	             WHERE deleted_at IS NULL
+	               AND (name % $1 OR username % $1 OR email % $1 OR username ILIKE $2 OR email ILIKE $2)
+	             ORDER BY score DESC, id
+	             LIMIT $3`
+	prefix := escapeLike(query) + "%"
+	results := []UserSearchResult{}
+	err := withTx(ctx, func(tx queryer) error {
+		threshold := strconv.FormatFloat(minScore, 'f', -1, 64)
+		if _, err := tx.Exec(`SELECT set_config('pg_trgm.similarity_threshold', $1, true)`, threshold); err != nil {
+			return err
+		}
+		rows, err := tx.Query(sqlQuery, query, prefix, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var result UserSearchResult
+			if err := rows.Scan(&result.ID, &result.Name, &result.Email, &result.Username,
+				&result.CreatedAt, &result.UpdatedAt, &result.Score); err != nil {
+				return err
+			}
+			results = append(results, result)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it only matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Pages and batched lookups, used by GraphQL
+
+// listUsers returns up to limit live users with an ID above after, in ID order
+func listUsers(ctx context.Context, after, limit int) ([]User, error) {
+	query := `SELECT id, name, email, username, created_at, updated_at FROM users 
+	          WHERE deleted_at IS NULL AND id > $1 ORDER BY id LIMIT $2`
+	rows, err := traced(ctx, db).Query(query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// listPosts returns up to limit live posts with an ID above after, in ID
+// order. A userID other than 0 only returns that user's posts.
+func listPosts(ctx context.Context, userID, after, limit int) ([]Post, error) {
+	query := `SELECT id, user_id, title, body, created_at, updated_at FROM posts 
+	          WHERE deleted_at IS NULL AND id > $1 AND ($2 = 0 OR user_id = $2) ORDER BY id LIMIT $3`
+	rows, err := traced(ctx, db).Query(query, after, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// getUsersByIDs loads many live users in one query. Missing and
+// soft-deleted users are absent from the map.
+func getUsersByIDs(ctx context.Context, ids []int) (map[int]*User, error) {
+	query := `SELECT id, name, email, username, created_at, updated_at FROM users 
+	          WHERE id = ANY($1) AND deleted_at IS NULL`
+	rows, err := traced(ctx, db).Query(query, pq.Array(int64s(ids)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int]*User, len(ids))
+	for rows.Next() {
+		user := &User{}
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Username, &user.CreatedAt, &user.UpdatedAt); err != nil {
+			return nil, err
+		}
+		users[user.ID] = user
+	}
+	return users, rows.Err()
+}
+
+// listPostsByUserIDs pages through the live posts of many users in one
+// query: for each user, up to limit posts with an ID above after, in ID order
+func listPostsByUserIDs(ctx context.Context, userIDs []int, after, limit int) (map[int][]Post, error) {
+	query := `SELECT id, user_id, title, body, created_at, updated_at FROM (
+	              SELECT id, user_id, title, body, created_at, updated_at,
+	                     ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY id) AS position
+	              FROM posts
+	              WHERE user_id = ANY($1) AND deleted_at IS NULL AND id > $2
+	          ) paged
+	          WHERE position <= $3
+	          ORDER BY user_id, id`
+	rows, err := traced(ctx, db).Query(query, pq.Array(int64s(userIDs)), after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := make(map[int][]Post, len(userIDs))
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.UserID, &post.Title, &post.Body, &post.CreatedAt, &post.UpdatedAt); err != nil {
+			return nil, err
+		}
+		posts[post.UserID] = append(posts[post.UserID], post)
+	}
+	return posts, rows.Err()
+}
+
+func int64s(ids []int) []int64 {
+	out := make([]int64, len(ids))
+	for i, id := range ids {
+		out[i] = int64(id)
+	}
+	return out
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MAX_BODY_BYTES bounds every request body. Larger bodies get a 413.
+var MAX_BODY_BYTES int64 = 1 << 20
+
+// limitBody caps the request body at MAX_BODY_BYTES before anything reads it
+func limitBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, MAX_BODY_BYTES)
+		}
+		next(w, r)
+	}
+}
+
+// decodeJSONBody decodes the request body, a single JSON value, into v. The
+// Content-Type must be application/json, or absent. Unknown fields and data
+// after the value are errors, reported with the field and byte offset.
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != mediaTypeJSON {
+			return newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content-Type must be "+mediaTypeJSON)
+		}
+	}
+	return decodeStrict(r.Body, v)
+}
+
+// decodeStrict decodes exactly one JSON value from body into v, rejecting
+// unknown fields and trailing data
+func decodeStrict(body io.Reader, v interface{}) error {
+	counted := &countingReader{r: body}
+	dec := json.NewDecoder(counted)
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return syntaxError(err, counted.n)
+	}
+	// Anything but the end of the body after the value is an error,
+	// including a second value
+	end := dec.InputOffset()
+	if err := dec.Decode(&json.RawMessage{}); err != io.EOF {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return err
+		}
+		return invalidBody("", "trailing_data", end, "unexpected data after the JSON value")
+	}
+
+	strict := json.NewDecoder(bytes.NewReader(raw))
+	strict.DisallowUnknownFields()
+	if err := strict.Decode(v); err != nil {
+		// Offsets within raw are shifted by any leading whitespace
+		return fieldError(raw, end-int64(len(raw)), err)
+	}
+	return nil
+}
+
+// syntaxError reports why the body is not JSON at all. read is how much of
+// the body was read, which is where a truncated body ends. Errors reading
+// the body, like an oversized one, are returned unchanged.
+func syntaxError(err error, read int64) error {
+	var (
+		syntax   *json.SyntaxError
+		tooLarge *http.MaxBytesError
+	)
+	switch {
+	case errors.As(err, &tooLarge):
+		return err
+	case errors.Is(err, io.EOF):
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "Request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return invalidBody("", "syntax", read, "request body ends in the middle of a JSON value")
+	case errors.As(err, &syntax):
+		return invalidBody("", "syntax", syntax.Offset, strings.TrimPrefix(syntax.Error(), "json: "))
+	}
+	return err
+}
+
+// fieldError reports a JSON value that does not fit the request type: a
+// field of the wrong type or one the type does not have
+func fieldError(raw []byte, base int64, err error) error {
+	var wrongType *json.UnmarshalTypeError
+	if errors.As(err, &wrongType) {
+		kind := jsonKind(wrongType.Type.Kind().String())
+		if wrongType.Field == "" {
+			return invalidBody("", "type", base, fmt.Sprintf("body must be a JSON %s, not %s", kind, wrongType.Value))
+		}
+		// Point at the field's key rather than past its value
+		offset := wrongType.Offset
+		if at := keyOffset(raw, strings.Split(wrongType.Field, "."), false, wrongType.Offset); at > 0 {
+			offset = at
+		}
+		return invalidBody(wrongType.Field, "type", base+offset,
+			fmt.Sprintf("%s must be a %s, not %s", wrongType.Field, kind, wrongType.Value))
+	}
+	// DisallowUnknownFields has no error type of its own
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		name, _ = strconv.Unquote(name)
+		return invalidBody(name, "unknown_field", base+keyOffset(raw, []string{name}, true, 0), fmt.Sprintf("unknown field %q", name))
+	}
+	return invalidBody("", "syntax", base, strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// keyOffset finds where an object key starts in raw, or returns 0. path is
+// the dotted field path encoding/json reports. Older releases leave array
+// indexes out of it, so the same path can occur once per array item: the
+// last one starting before limit is taken, or the first when limit is 0.
+// With anyDepth, path is a single key matched wherever it occurs.
+func keyOffset(raw []byte, path []string, anyDepth bool, limit int64) int64 {
+	// A container's path is the keys and array indexes leading to it; names
+	// is the same without the indexes
+	type container struct {
+		object, expectKey bool
+		path, names       []string
+		items             int
+	}
+	var (
+		open                  []container
+		valuePath, valueNames []string // of the value after the last key read
+		found                 int64
+	)
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	for {
+		before := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return found
+		}
+		top := len(open) - 1
+		if top >= 0 && open[top].expectKey {
+			if key, ok := tok.(string); ok {
+				valuePath = append(slices.Clip(open[top].path), key)
+				valueNames = append(slices.Clip(open[top].names), key)
+				matched := slices.Equal(valuePath, path) || slices.Equal(valueNames, path)
+				if anyDepth {
+					matched = len(path) == 1 && key == path[0]
+				}
+				if matched {
+					// The key is the first string after the comma or brace,
+					// measured in raw so escapes count as written
+					at := before + int64(bytes.IndexByte(raw[before:], '"'))
+					if limit == 0 {
+						return at
+					}
+					if at >= limit {
+						return found
+					}
+					found = at
+				}
+				open[top].expectKey = false
+				continue
+			}
+		}
+
+		switch tok {
+		case json.Delim('}'), json.Delim(']'):
+			open = open[:top]
+		default:
+			// tok starts a value, which is an array item or follows a key
+			var itemPath, itemNames []string
+			if top >= 0 && open[top].object {
+				itemPath, itemNames = valuePath, valueNames
+			} else if top >= 0 {
+				itemPath = append(slices.Clip(open[top].path), strconv.Itoa(open[top].items))
+				itemNames = open[top].names
+				open[top].items++
+			}
+			if tok == json.Delim('{') || tok == json.Delim('[') {
+				object := tok == json.Delim('{')
+				open = append(open, container{object: object, expectKey: object, path: itemPath, names: itemNames})
+				continue
+			}
+		}
+		// A complete value inside an object is followed by a key
+		if n := len(open); n > 0 && open[n-1].object {
+			open[n-1].expectKey = true
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func invalidBody(field, code string, offset int64, message string) *apiError {
+	detail := fmt.Sprintf("Invalid request body: %s at offset %d", message, offset)
+	if field == "" {
+		field = "body"
+	}
+	return &apiError{
+		status: http.StatusBadRequest,
+		code:   codeInvalidBody,
+		detail: detail,
+		fields: []FieldError{{Field: field, Code: code, Message: message, Offset: offset}},
+	}
+}
+
+// jsonKind names a Go kind the way a JSON client would
+func jsonKind(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "bool":
+		return "boolean"
+	case kind == "struct", kind == "map":
+		return "object"
+	case kind == "slice", kind == "array":
+		return "array"
+	}
+	return kind
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type decodeTarget struct {
+	Name    string `json:"name"`
+	Age     int    `json:"age"`
+	Address struct {
+		Name string `json:"name"`
+		Zip  int    `json:"zip"`
+	} `json:"address"`
+	Items []struct {
+		Qty int `json:"qty"`
+	} `json:"items"`
+}
+
+// decodeRequest runs decodeJSONBody behind limitBody, as routes do, and
+// returns how the error would be reported
+func decodeRequest(contentType, body string) *apiError {
+	var decodeErr error
+	handler := limitBody(func(w http.ResponseWriter, r *http.Request) {
+		decodeErr = decodeJSONBody(r, &decodeTarget{})
+	})
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	handler(httptest.NewRecorder(), r)
+	if decodeErr == nil {
+		return nil
+	}
+	return classifyError(decodeErr)
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	saved := MAX_BODY_BYTES
+	defer func() { MAX_BODY_BYTES = saved }()
+	MAX_BODY_BYTES = 64
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		code        string
+		field       string
+		// at is the part of body the reported offset points to
+		at string
+	}{
+		{name: "valid", contentType: "application/json", body: `{"name": "a", "items": [{"qty": 1}]}`},
+		{name: "charset parameter", contentType: "application/json; charset=utf-8", body: `{"name": "a"}`},
+		{name: "no content type", body: `{"name": "a"}`},
+		{name: "wrong type", body: `{"name": 5}`,
+			status: 400, code: "type", field: "name", at: `"name"`},
+		{name: "nested field", body: `{"address": {"zip": "x"}}`,
+			status: 400, code: "type", field: "address.zip", at: `"zip"`},
+		{name: "nested key also at the top", body: `{"name": "a", "address": {"name": 1}}`,
+			status: 400, code: "type", field: "address.name", at: `"name": 1`},
+		{name: "field in the second array item", body: `{"items": [{"qty": 1}, {"qty": "x"}]}`,
+			status: 400, code: "type", at: `"qty": "x"`},
+		{name: "escaped key", body: `{"n\u0061me": 5}`,
+			status: 400, code: "type", field: "name", at: `"n\u0061me"`},
+		{name: "leading whitespace", body: "  \n" + `{"age": "x"}`,
+			status: 400, code: "type", field: "age", at: `"age"`},
+		{name: "unknown field", body: `{"name": "a", "nope": 1}`,
+			status: 400, code: "unknown_field", field: "nope", at: `"nope"`},
+		{name: "trailing data", body: `{"name": "a"} {}`,
+			status: 400, code: "trailing_data", field: "body", at: ` {}`},
+		{name: "truncated", body: `{"name": "a"`,
+			status: 400, code: "syntax", field: "body"},
+		{name: "not an object", body: `[1]`,
+			status: 400, code: "type", field: "body", at: `[1]`},
+		{name: "empty", body: ``, status: 400},
+		{name: "unsupported media type", contentType: "text/plain", body: `{"name": "a"}`, status: 415},
+		{name: "malformed content type", contentType: "application/", body: `{"name": "a"}`, status: 415},
+		{name: "too large", body: `{"name": "` + strings.Repeat("a", 100) + `"}`, status: 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := decodeRequest(tt.contentType, tt.body)
+			if tt.status == 0 {
+				if apiErr != nil {
+					t.Fatalf("unexpected error %d %s", apiErr.status, apiErr.detail)
+				}
+				return
+			}
+			if apiErr == nil {
+				t.Fatalf("no error, want %d", tt.status)
+			}
+			if apiErr.status != tt.status {
+				t.Fatalf("status = %d (%s), want %d", apiErr.status, apiErr.detail, tt.status)
+			}
+			if tt.code == "" {
+				return
+			}
+			if len(apiErr.fields) != 1 {
+				t.Fatalf("fields = %+v, want one", apiErr.fields)
+			}
+			got := apiErr.fields[0]
+			if got.Code != tt.code || (tt.field != "" && got.Field != tt.field) {
+				t.Errorf("field error = %s %s, want %s %s", got.Field, got.Code, tt.field, tt.code)
+			}
+			if tt.at != "" {
+				if want := int64(strings.Index(tt.body, tt.at)); got.Offset != want {
+					t.Errorf("offset = %d, want %d (%q)", got.Offset, want, tt.at)
+				}
+			}
+		})
+	}
+}
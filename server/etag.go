@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errPreconditionFailed means the row changed since the client read it
+var errPreconditionFailed = errors.New("precondition failed")
+
+// resourceETag returns the strong entity tag for a row last written at
+// updatedAt. Every UPDATE sets updated_at to clock_timestamp(), so the tag
+// changes with the row, even between two updates in one transaction.
+func resourceETag(updatedAt time.Time) string {
+	return `"` + strconv.FormatInt(updatedAt.UnixMicro(), 36) + `"`
+}
+
+// ifMatch is a parsed If-Match header. A nil *ifMatch matches anything, which
+// is how unconditional writes are expressed.
+type ifMatch struct {
+	any  bool
+	tags []string
+}
+
+// check returns errPreconditionFailed unless the row written at updatedAt
+// matches. If-Match uses the strong comparison, so weak tags never match, but
+// the tag of any representation of the row does.
+func (m *ifMatch) check(updatedAt time.Time) error {
+	if m == nil || m.any {
+		return nil
+	}
+	current := resourceETag(updatedAt)
+	for _, tag := range m.tags {
+		if rowETag(tag) == current {
+			return nil
+		}
+	}
+	return errPreconditionFailed
+}
+
+// writePrecondition reads If-Match from a PUT, PATCH or DELETE request. When
+// REQUIRE_IF_MATCH is set and the header is missing it responds 428 and
+// returns ok == false.
+func writePrecondition(w http.ResponseWriter, r *http.Request) (cond *ifMatch, ok bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if REQUIRE_IF_MATCH {
+			respondWithProblem(w, r, http.StatusPreconditionRequired, codePreconditionRequired, "If-Match header is required")
+			return nil, false
+		}
+		return nil, true
+	}
+	return parseIfMatch(header), true
+}
+
+// parseIfMatch parses an If-Match value. An empty one gives nil, which
+// matches anything.
+func parseIfMatch(header string) *ifMatch {
+	switch strings.TrimSpace(header) {
+	case "":
+		return nil
+	case "*":
+		return &ifMatch{any: true}
+	}
+	return &ifMatch{tags: parseETags(header)}
+}
+
+// parseETags splits a comma separated list of entity tags. Commas inside
+// quoted tags are kept.
+func parseETags(header string) []string {
+	var tags []string
+	for header != "" {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			break
+		}
+		start := 0
+		if strings.HasPrefix(header, "W/") {
+			start = 2
+		}
+		if len(header) <= start || header[start] != '"' {
+			// Not a valid entity tag; skip to the next element
+			if i := strings.IndexByte(header, ','); i >= 0 {
+				header = header[i+1:]
+				continue
+			}
+			break
+		}
+		end := strings.IndexByte(header[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		end += start + 2
+		tags = append(tags, header[:end])
+		header = header[end:]
+	}
+	return tags
+}
+
+// notModified sets the validator and caching headers on a GET response and
+// reports whether the client's cached copy is still current. When it is, a
+// 304 has been written and the handler must not write a body. A zero
+// lastModified omits Last-Modified, for responses whose age cannot be
+// derived from updated_at.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time, cacheControl string) bool {
+	// HTTP dates have second precision, so compare at that resolution
+	lastModified = lastModified.UTC().Truncate(time.Second)
+
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+
+	// If-None-Match takes precedence; If-Modified-Since is then ignored
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if !noneMatch(header, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err == nil && !lastModified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// noneMatch evaluates If-None-Match with the weak comparison
+func noneMatch(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return false
+	}
+	etag = strings.TrimPrefix(identityETag(etag), "W/")
+	for _, tag := range parseETags(header) {
+		if strings.TrimPrefix(identityETag(tag), "W/") == etag {
+			return false
+		}
+	}
+	return true
+}
+
+// gzipETagSuffix marks the ETag of a gzipped response. The compressed bytes
+// differ from the identity ones, so they may not share a strong tag.
+const gzipETagSuffix = "-gzip"
+
+// gzipETag returns the tag of the gzipped variant of the response tagged etag
+func gzipETag(etag string) string {
+	if !strings.HasSuffix(etag, `"`) || strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + gzipETagSuffix + `"`
+}
+
+// identityETag undoes gzipETag, so preconditions compare the representation
+// a client has whatever the encoding it was sent with
+func identityETag(etag string) string {
+	if trimmed, ok := strings.CutSuffix(etag, gzipETagSuffix+`"`); ok {
+		return trimmed + `"`
+	}
+	return etag
+}
+
+// representationETag qualifies etag with the API version and format r is
+// answered in, unless that is JSON in the current shape. A cache that holds
+// one representation must not revalidate it with the tag of another.
+func representationETag(r *http.Request, etag string) string {
+	var suffix string
+	if version := requestAPIVersion(r); version.transform != nil {
+		suffix += "-v" + version.name
+	}
+	if format := responseFormat(r); format != formatJSON {
+		_, subtype, _ := strings.Cut(format, "/")
+		suffix += "-" + strings.TrimPrefix(subtype, "x-")
+	}
+	if suffix == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + suffix + `"`
+}
+
+// rowETag undoes gzipETag and representationETag, leaving the tag of the row
+// itself. resourceETag never contains a dash.
+func rowETag(etag string) string {
+	etag = identityETag(etag)
+	if i := strings.IndexByte(etag, '-'); i >= 0 {
+		return etag[:i] + `"`
+	}
+	return etag
+}
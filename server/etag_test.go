@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseETags(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{`"a"`, []string{`"a"`}},
+		{`"a", W/"b" ,"c"`, []string{`"a"`, `W/"b"`, `"c"`}},
+		{`"a,b", "c"`, []string{`"a,b"`, `"c"`}},
+		{`bogus, "a"`, []string{`"a"`}},
+		{`"unterminated`, nil},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		if got := parseETags(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseETags(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestIfMatchCheck(t *testing.T) {
+	updatedAt := time.Date(2026, 1, 2, 3, 4, 5, 678901000, time.UTC)
+	current := resourceETag(updatedAt)
+	stale := resourceETag(updatedAt.Add(-time.Microsecond))
+
+	tests := []struct {
+		name   string
+		header string
+		want   error
+	}{
+		{"no header", "", nil},
+		{"any", "*", nil},
+		{"current", current, nil},
+		{"one of several", stale + ", " + current, nil},
+		{"gzipped variant", gzipETag(current), nil},
+		{"other representation", gzipETag(current[:len(current)-1] + `-v2-csv"`), nil},
+		{"stale", stale, errPreconditionFailed},
+		{"weak tags never match", "W/" + current, errPreconditionFailed},
+		{"garbage", "nonsense", errPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := parseIfMatch(tt.header).check(updatedAt); !errors.Is(err, tt.want) {
+				t.Errorf("check = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if status := classifyError(errPreconditionFailed).status; status != http.StatusPreconditionFailed {
+		t.Errorf("errPreconditionFailed responds %d, want 412", status)
+	}
+}
+
+func TestWritePrecondition(t *testing.T) {
+	saved := REQUIRE_IF_MATCH
+	defer func() { REQUIRE_IF_MATCH = saved }()
+
+	tests := []struct {
+		name     string
+		require  bool
+		header   string
+		wantOK   bool
+		wantCond bool
+		status   int
+	}{
+		{name: "optional and missing", wantOK: true},
+		{name: "optional and sent", header: `"x"`, wantOK: true, wantCond: true},
+		{name: "required and missing", require: true, status: http.StatusPreconditionRequired},
+		{name: "required and sent", require: true, header: `"x"`, wantOK: true, wantCond: true},
+		{name: "required and any", require: true, header: `*`, wantOK: true, wantCond: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			REQUIRE_IF_MATCH = tt.require
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/users/1", nil)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+			cond, ok := writePrecondition(w, r)
+			if ok != tt.wantOK || (cond != nil) != tt.wantCond {
+				t.Fatalf("got cond %v, ok %v; want cond %v, ok %v", cond, ok, tt.wantCond, tt.wantOK)
+			}
+			if !ok && w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2026, 1, 2, 3, 4, 5, 600000000, time.UTC)
+	etag := resourceETag(lastModified)
+	other := resourceETag(lastModified.Add(time.Second))
+	at := func(t time.Time) string { return t.Format(http.TimeFormat) }
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		ifModified  string
+		want        bool
+	}{
+		{name: "unconditional"},
+		{name: "same tag", ifNoneMatch: etag, want: true},
+		{name: "weak comparison", ifNoneMatch: "W/" + etag, want: true},
+		{name: "gzipped variant", ifNoneMatch: gzipETag(etag), want: true},
+		{name: "among others", ifNoneMatch: other + ", " + etag, want: true},
+		{name: "any", ifNoneMatch: "*", want: true},
+		{name: "changed", ifNoneMatch: other},
+		{name: "not modified since", ifModified: at(lastModified), want: true},
+		{name: "modified since", ifModified: at(lastModified.Add(-time.Second))},
+		{name: "If-None-Match wins", ifNoneMatch: other, ifModified: at(lastModified)},
+		{name: "bad date", ifModified: "yesterday"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.ifModified != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModified)
+			}
+			got := notModified(w, r, etag, lastModified, "private, no-cache")
+			if got != tt.want {
+				t.Fatalf("notModified = %v, want %v", got, tt.want)
+			}
+			if got && w.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want 304", w.Code)
+			}
+			if w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") != at(lastModified) {
+				t.Errorf("validators = %q, %q", w.Header().Get("ETag"), w.Header().Get("Last-Modified"))
+			}
+		})
+	}
+}
+
+func TestRepresentationETag(t *testing.T) {
+	tests := []struct {
+		version string
+		format  string
+		etag    string
+		want    string
+	}{
+		{"1", formatJSON, `"abc"`, `"abc"`},
+		{"2", formatJSON, `"abc"`, `"abc-v2"`},
+		{"1", formatCSV, `"abc"`, `"abc-csv"`},
+		{"2", formatNDJSON, `"abc"`, `"abc-v2-ndjson"`},
+		{"1", formatXML, `W/"0f1e"`, `W/"0f1e-xml"`},
+	}
+	for _, tt := range tests {
+		ctx := context.WithValue(context.Background(), versionContextKey, findAPIVersion(tt.version))
+		ctx = context.WithValue(ctx, formatContextKey, tt.format)
+		r := httptest.NewRequest(http.MethodGet, "/users/1", nil).WithContext(ctx)
+
+		got := representationETag(r, tt.etag)
+		if got != tt.want {
+			t.Errorf("v%s %s: representationETag(%s) = %s, want %s", tt.version, tt.format, tt.etag, got, tt.want)
+		}
+		if rowETag(gzipETag(got)) != tt.etag {
+			t.Errorf("rowETag(%s) = %s, want %s", gzipETag(got), rowETag(gzipETag(got)), tt.etag)
+		}
+		if tt.want != tt.etag && !noneMatch(tt.etag, got) {
+			t.Errorf("If-None-Match %s matched %s", tt.etag, got)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// EVENT_BUFFER_SIZE is how many recent events are kept for clients that
+	// reconnect with Last-Event-ID
+	EVENT_BUFFER_SIZE = 1000
+	// EVENT_HEARTBEAT is how often an idle stream gets a comment line, which
+	// keeps proxies from closing it
+	EVENT_HEARTBEAT = 15 * time.Second
+)
+
+// eventTypes lists every event the server publishes
+var eventTypes = []string{
+	"user.created", "user.updated", "user.deleted", "user.restored",
+	"post.created", "post.updated", "post.deleted", "post.restored",
+}
+
+// eventRetry is the reconnection delay suggested to clients, in milliseconds
+const eventRetry = 3000
+
+// subscriberBuffer is how many events a slow client may fall behind before
+// it is disconnected. It reconnects and catches up from the buffer.
+const subscriberBuffer = 256
+
+// Event is a change to a user or post. Data is the resource after the change,
+// or {"id": ...} for deletes. ID numbers the events on /events; webhook
+// deliveries are queued before the event is published and go without one.
+type Event struct {
+	ID         int64       `json:"id,omitempty"`
+	Type       string      `json:"type"`
+	Resource   string      `json:"resource"`
+	ResourceID int         `json:"resourceId"`
+	Time       time.Time   `json:"time"`
+	Data       interface{} `json:"data"`
+}
+
+// eventFilter selects the events a subscriber receives. Zero values match
+// everything.
+type eventFilter struct {
+	resource string
+	id       int
+	types    []string
+}
+
+func (f eventFilter) match(e Event) bool {
+	if f.resource != "" && f.resource != e.Resource {
+		return false
+	}
+	if f.id != 0 && f.id != e.ResourceID {
+		return false
+	}
+	return len(f.types) == 0 || slices.Contains(f.types, e.Type)
+}
+
+type eventSubscription struct {
+	filter eventFilter
+	ch     chan Event
+}
+
+// eventBroker fans events out to subscribers and keeps the most recent ones
+// in a ring buffer for resuming streams. Event IDs restart at 1 with the
+// process.
+type eventBroker struct {
+	mu     sync.Mutex
+	lastID int64
+	// buffer holds up to size events; once full, start is the oldest
+	buffer      []Event
+	start       int
+	size        int
+	subscribers map[*eventSubscription]struct{}
+}
+
+func newEventBroker(size int) *eventBroker {
+	return &eventBroker{size: size, subscribers: map[*eventSubscription]struct{}{}}
+}
+
+// events is replaced in main once EVENT_BUFFER_SIZE is known
+var events = newEventBroker(EVENT_BUFFER_SIZE)
+
+// newEvent is an event for a change, numbered once it is published
+func newEvent(typ, resource string, id int, data interface{}) Event {
+	return Event{Type: typ, Resource: resource, ResourceID: id, Time: time.Now().UTC(), Data: data}
+}
+
+// publishChanges drops committed changes from the caches and publishes them
+func publishChanges(changes []Event) {
+	for _, e := range changes {
+		switch e.Resource {
+		case "users":
+			invalidateUser(e.ResourceID)
+		case "posts":
+			invalidatePost(e.ResourceID)
+		}
+		events.publish(e)
+	}
+	if len(changes) > 0 {
+		wakeWebhookWorker()
+	}
+}
+
+// publish numbers an event, records it and sends it to every matching
+// subscriber. Subscribers that are too far behind are dropped rather than
+// blocking the write that published the event.
+func (b *eventBroker) publish(e Event) {
+	b.mu.Lock()
+	b.lastID++
+	e.ID = b.lastID
+	if len(b.buffer) < b.size {
+		b.buffer = append(b.buffer, e)
+	} else if b.size > 0 {
+		b.buffer[b.start] = e
+		b.start = (b.start + 1) % b.size
+	}
+
+	for sub := range b.subscribers {
+		if !sub.filter.match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+	b.mu.Unlock()
+}
+
+// subscribe registers a subscriber. With resume set it also returns the
+// buffered events after lastID; complete is false when some of them have
+// already left the buffer, or lastID comes from before a restart.
+func (b *eventBroker) subscribe(filter eventFilter, lastID int64, resume bool) (sub *eventSubscription, backlog []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &eventSubscription{filter: filter, ch: make(chan Event, subscriberBuffer)}
+	b.subscribers[sub] = struct{}{}
+	if !resume {
+		return sub, nil, true
+	}
+
+	complete = lastID <= b.lastID
+	if b.size == 0 {
+		// Nothing is kept, so only a client that missed nothing is complete
+		complete = lastID == b.lastID
+	} else if len(b.buffer) > 0 && lastID < b.buffer[b.start].ID-1 {
+		complete = false
+	}
+	for i := range b.buffer {
+		e := b.buffer[(b.start+i)%len(b.buffer)]
+		if e.ID > lastID && filter.match(e) {
+			backlog = append(backlog, e)
+		}
+	}
+	return sub, backlog, complete
+}
+
+func (b *eventBroker) unsubscribe(sub *eventSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// eventsHandler streams events as Server-Sent Events. ?resource=users|posts,
+// ?id= and ?types= narrow the stream; Last-Event-ID resumes it.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithProblem(w, r, http.StatusInternalServerError, codeInternal, "Streaming is not supported")
+		return
+	}
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil || lastID < 0 {
+			respondWithProblem(w, r, http.StatusBadRequest, codeBadRequest, "Last-Event-ID must be an event id")
+			return
+		}
+	}
+
+	// The stream outlives WRITE_TIMEOUT; heartbeats notice dead clients
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	sub, backlog, complete := events.subscribe(filter, lastID, lastEventID != "")
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry)
+	if !complete {
+		// The client missed events and has to reload what it shows
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range backlog {
+		if err := writeEvent(w, r, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EVENT_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			// Clients reconnect to another instance and resume
+			return
+		case e, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, r, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes one event in the request's API version
+func writeEvent(w http.ResponseWriter, r *http.Request, e Event) error {
+	data, err := encodeAs(formatJSON, r, e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+func parseEventFilter(r *http.Request) (eventFilter, error) {
+	query := r.URL.Query()
+	filter := eventFilter{resource: query.Get("resource")}
+	if filter.resource != "" && filter.resource != "users" && filter.resource != "posts" {
+		return filter, newAPIError(http.StatusBadRequest, codeInvalidQuery, "resource must be users or posts")
+	}
+	if raw := query.Get("id"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil || id < 1 {
+			return filter, newAPIError(http.StatusBadRequest, codeInvalidQuery, "id must be a positive integer")
+		}
+		if filter.resource == "" {
+			return filter, newAPIError(http.StatusBadRequest, codeInvalidQuery, "id requires resource")
+		}
+		filter.id = id
+	}
+	if raw := query.Get("types"); raw != "" {
+		for _, typ := range strings.Split(raw, ",") {
+			typ = strings.TrimSpace(typ)
+			if !slices.Contains(eventTypes, typ) {
+				return filter, newAPIError(http.StatusBadRequest, codeInvalidQuery,
+					fmt.Sprintf("Unknown event type %q; known types are %s", typ, strings.Join(eventTypes, ", ")))
+			}
+			filter.types = append(filter.types, typ)
+		}
+	}
+	return filter, nil
+}
+
+// deletedEvent is the data of a delete event
+func deletedEvent(id int, hard bool) map[string]interface{} {
+	data := map[string]interface{}{"id": id}
+	if hard {
+		data["hard"] = true
+	}
+	return data
+}
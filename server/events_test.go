@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// brokerWith returns a broker keeping size events, after publishing n
+// events that alternate between users and posts
+func brokerWith(size, n int) *eventBroker {
+	b := newEventBroker(size)
+	for i := 1; i <= n; i++ {
+		if i%2 == 1 {
+			b.publish(newEvent("user.updated", "users", i, nil))
+		} else {
+			b.publish(newEvent("post.updated", "posts", i, nil))
+		}
+	}
+	return b
+}
+
+func TestEventBrokerSubscribe(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		published int
+		filter    eventFilter
+		lastID    int64
+		resume    bool
+		backlog   []int64
+		complete  bool
+	}{
+		{name: "live only", size: 3, published: 5, complete: true},
+		{name: "up to date", size: 3, published: 5, lastID: 5, resume: true, complete: true},
+		{name: "missed buffered events", size: 3, published: 5, lastID: 3, resume: true, backlog: []int64{4, 5}, complete: true},
+		{name: "missed exactly the buffer", size: 3, published: 5, lastID: 2, resume: true, backlog: []int64{3, 4, 5}, complete: true},
+		{name: "missed more than the buffer", size: 3, published: 5, lastID: 1, resume: true, backlog: []int64{3, 4, 5}},
+		{name: "from the start after overflow", size: 3, published: 5, lastID: 0, resume: true, backlog: []int64{3, 4, 5}},
+		{name: "from the start", size: 10, published: 5, lastID: 0, resume: true, backlog: []int64{1, 2, 3, 4, 5}, complete: true},
+		{name: "filtered", size: 10, published: 5, filter: eventFilter{resource: "posts"}, lastID: 1, resume: true, backlog: []int64{2, 4}, complete: true},
+		{name: "from before a restart", size: 3, published: 5, lastID: 9, resume: true},
+		{name: "nothing published yet", size: 3, lastID: 0, resume: true, complete: true},
+		{name: "nothing published since a restart", size: 3, lastID: 4, resume: true},
+		{name: "no buffer, missed nothing", size: 0, published: 2, lastID: 2, resume: true, complete: true},
+		{name: "no buffer, missed some", size: 0, published: 2, lastID: 1, resume: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := brokerWith(tt.size, tt.published)
+			sub, backlog, complete := b.subscribe(tt.filter, tt.lastID, tt.resume)
+			defer b.unsubscribe(sub)
+
+			var ids []int64
+			for _, e := range backlog {
+				ids = append(ids, e.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.backlog) || complete != tt.complete {
+				t.Errorf("backlog %v, complete %v; want %v, %v", ids, complete, tt.backlog, tt.complete)
+			}
+		})
+	}
+}
+
+func TestEventBrokerPublish(t *testing.T) {
+	b := newEventBroker(10)
+	posts, _, _ := b.subscribe(eventFilter{resource: "posts", id: 2}, 0, false)
+	slow, _, _ := b.subscribe(eventFilter{}, 0, false)
+	defer b.unsubscribe(posts)
+
+	b.publish(newEvent("post.updated", "posts", 1, nil))
+	b.publish(newEvent("post.updated", "posts", 2, nil))
+	if e := <-posts.ch; e.ID != 2 || e.ResourceID != 2 {
+		t.Errorf("filtered subscriber got event %d for post %d", e.ID, e.ResourceID)
+	}
+
+	// The unfiltered subscriber never reads, so it is dropped once its
+	// buffer is full instead of blocking publish
+	for i := 0; i < subscriberBuffer; i++ {
+		b.publish(newEvent("user.updated", "users", 1, nil))
+	}
+	received := 0
+	for range slow.ch {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before being dropped, want %d", received, subscriberBuffer)
+	}
+	b.unsubscribe(slow) // already dropped; must not close the channel again
+	if len(posts.ch) != 0 {
+		t.Errorf("filtered subscriber has %d unexpected events", len(posts.ch))
+	}
+}
+
+func TestParseEventFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    eventFilter
+		wantErr bool
+	}{
+		{query: "", want: eventFilter{}},
+		{query: "resource=users&id=3", want: eventFilter{resource: "users", id: 3}},
+		{query: "types=post.created,%20post.deleted", want: eventFilter{types: []string{"post.created", "post.deleted"}}},
+		{query: "resource=comments", wantErr: true},
+		{query: "id=3", wantErr: true},
+		{query: "resource=posts&id=0", wantErr: true},
+		{query: "types=post.archived", wantErr: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/events?"+tt.query, nil)
+		got, err := parseEventFilter(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: filter = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
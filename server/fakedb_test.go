@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is a database/sql driver that answers each statement from a
+// script, for testing code that needs a database but not Postgres. It logs
+// the statements it runs, with COMMIT and ROLLBACK.
+type fakeDB struct {
+	answer func(query string, args []driver.Value) (*fakeResult, error)
+
+	mu   sync.Mutex
+	log  []string
+	args [][]driver.Value
+}
+
+// fakeResult is the answer to one statement: rows for queries, affected for
+// Exec
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// useFakeDB points db at a fakeDB answering with answer until the test ends
+func useFakeDB(t *testing.T, answer func(query string, args []driver.Value) (*fakeResult, error)) *fakeDB {
+	t.Helper()
+	fake := &fakeDB{answer: answer}
+	saved := db
+	db = sql.OpenDB(fake)
+	t.Cleanup(func() {
+		db.Close()
+		db = saved
+	})
+	return fake
+}
+
+// statements returns the statements run so far, with whitespace collapsed
+func (f *fakeDB) statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.log...)
+}
+
+// ran reports how many statements started with prefix
+func (f *fakeDB) ran(prefix string) int {
+	n := 0
+	for _, s := range f.statements() {
+		if strings.HasPrefix(s, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeDB) record(query string, args []driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = append(f.log, strings.Join(strings.Fields(query), " "))
+	f.args = append(f.args, args)
+}
+
+func (f *fakeDB) run(query string, args []driver.Value) (*fakeResult, error) {
+	f.record(query, args)
+	result, err := f.answer(strings.Join(strings.Fields(query), " "), args)
+	if result == nil && err == nil {
+		result = &fakeResult{}
+	}
+	return result, err
+}
+
+// driver.Connector, driver.Driver, driver.Conn, driver.Tx and driver.Stmt
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return f }
+func (f *fakeDB) Open(string) (driver.Conn, error)             { return fakeConn{f}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN", nil)
+	return fakeTx{c.db}, nil
+}
+
+// Ping is answered like a statement named PING
+func (c fakeConn) Ping(context.Context) error {
+	_, err := c.db.run("PING", nil)
+	return err
+}
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	tx.db.record("COMMIT", nil)
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.db.record("ROLLBACK", nil)
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result, err := s.db.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result, err := s.db.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: result}, nil
+}
+
+type fakeRows struct {
+	result *fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+// Rows in the shape of the users and posts tables, for answering reads
+
+var fixtureTime = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+var (
+	userColumns = []string{"id", "name", "email", "username", "created_at", "updated_at"}
+	postColumns = []string{"id", "user_id", "title", "body", "created_at", "updated_at"}
+)
+
+func userRow(id int64) []driver.Value {
+	return []driver.Value{id, "Ann", "ann@example.com", "ann", fixtureTime, fixtureTime}
+}
+
+func postRow(id, userID int64) []driver.Value {
+	return []driver.Value{id, userID, "Hi", "First", fixtureTime, fixtureTime}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// fieldColumn maps a JSON field name to the column that stores it
+type fieldColumn struct {
+	name   string
+	column string
+}
+
+// resourceSchema lists the fields a resource exposes to ?fields=, in the
+// order they appear in the full representation
+type resourceSchema struct {
+	resource string
+	fields   []fieldColumn
+}
+
+var userSchema = resourceSchema{
+	resource: "user",
+	fields: []fieldColumn{
+		{"id", "id"},
+		{"name", "name"},
+		{"email", "email"},
+		{"username", "username"},
+		{"created_at", "created_at"},
+		{"updated_at", "updated_at"},
+	},
+}
+
+var postSchema = resourceSchema{
+	resource: "post",
+	fields: []fieldColumn{
+		{"id", "id"},
+		{"userId", "user_id"},
+		{"title", "title"},
+		{"body", "body"},
+		{"created_at", "created_at"},
+		{"updated_at", "updated_at"},
+	},
+}
+
+// selectFields resolves a comma separated ?fields= value against the schema.
+// An empty value selects every field.
+func (s resourceSchema) selectFields(param string) ([]fieldColumn, error) {
+	if param == "" {
+		return s.fields, nil
+	}
+	requested := map[string]bool{}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !s.has(name) {
+			return nil, fmt.Errorf("unknown %s field %q", s.resource, name)
+		}
+		requested[name] = true
+	}
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("fields must name at least one %s field", s.resource)
+	}
+
+	// Keep schema order so output does not depend on how the query was written
+	selected := make([]fieldColumn, 0, len(requested))
+	for _, field := range s.fields {
+		if requested[field.name] {
+			selected = append(selected, field)
+		}
+	}
+	return selected, nil
+}
+
+func (s resourceSchema) has(name string) bool {
+	for _, field := range s.fields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// columnList renders fields as a SELECT list with the given table alias
+func columnList(alias string, fields []fieldColumn) string {
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = alias + "." + field.column
+	}
+	return strings.Join(columns, ", ")
+}
+
+// record is a JSON object that keeps its keys in insertion order, used for
+// responses whose shape depends on ?fields= and ?include=
+type record struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newRecord() *record {
+	return &record{values: map[string]interface{}{}}
+}
+
+func (r *record) set(key string, value interface{}) {
+	if _, exists := r.values[key]; !exists {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = value
+}
+
+// rename replaces key old with key new, keeping its position
+func (r *record) rename(old, new string, value interface{}) {
+	if _, exists := r.values[new]; exists && new != old {
+		r.remove(new)
+	}
+	for i, key := range r.keys {
+		if key == old {
+			r.keys[i] = new
+		}
+	}
+	delete(r.values, old)
+	r.values[new] = value
+}
+
+func (r *record) remove(key string) {
+	for i, k := range r.keys {
+		if k == key {
+			r.keys = append(r.keys[:i], r.keys[i+1:]...)
+			break
+		}
+	}
+	delete(r.values, key)
+}
+
+func (r *record) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// recordFromRow builds a record from scanned column values
+func recordFromRow(fields []fieldColumn, values []interface{}) *record {
+	rec := newRecord()
+	for i, field := range fields {
+		rec.set(field.name, values[i])
+	}
+	return rec
+}
+
+// scanTargets returns n pointers to interface{} values for rows.Scan
+func scanTargets(values []interface{}) []interface{} {
+	targets := make([]interface{}, len(values))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	return targets
+}
+
+// resourceView is the request for a sparse or expanded representation
+type resourceView struct {
+	fields        []fieldColumn
+	include       bool
+	includeFields []fieldColumn
+}
+
+// parseView reads ?fields=, ?include= and ?fields[<include>]= for a resource
+// that can embed the related resource named relation. It responds 400 and
+// returns ok == false on invalid input.
+func parseView(w http.ResponseWriter, r *http.Request, schema, related resourceSchema, relation string) (view resourceView, ok bool) {
+	params := r.URL.Query()
+	fields, err := schema.selectFields(params.Get("fields"))
+	if err != nil {
+		respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return view, false
+	}
+	view.fields = fields
+
+	for _, name := range strings.Split(params.Get("include"), ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case relation:
+			view.include = true
+		default:
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("unknown include %q, expected %q", name, relation))
+			return view, false
+		}
+	}
+
+	includeFieldsParam := params.Get("fields[" + relation + "]")
+	if includeFieldsParam != "" && !view.include {
+		respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("fields[%s] requires include=%s", relation, relation))
+		return view, false
+	}
+	if view.includeFields, err = related.selectFields(includeFieldsParam); err != nil {
+		respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return view, false
+	}
+	return view, true
+}
+
+// wantsView reports whether the request asks for anything other than the
+// default representation
+func wantsView(r *http.Request) bool {
+	for key := range r.URL.Query() {
+		if key == "fields" || key == "include" || strings.HasPrefix(key, "fields[") {
+			return true
+		}
+	}
+	return false
+}
+
+// respondWithView writes a sparse or expanded representation. Its ETag is
+// weak and derived from the body, because the body depends on the query and,
+// with includes, on rows other than the requested one. Like any ETag it also
+// names the version and format. lastModified may be zero when it cannot be
+// determined.
+func respondWithView(w http.ResponseWriter, r *http.Request, view *record, lastModified time.Time, cacheControl string) {
+	body, err := json.Marshal(view)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := representationETag(r, `W/"`+hex.EncodeToString(sum[:12])+`"`)
+	if notModified(w, r, etag, lastModified, cacheControl) {
+		return
+	}
+	respond(w, r, http.StatusOK, view)
+}
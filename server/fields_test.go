@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectFields(t *testing.T) {
+	tests := []struct {
+		param   string
+		want    []string
+		wantErr bool
+	}{
+		{param: "", want: []string{"id", "userId", "title", "body", "created_at", "updated_at"}},
+		{param: "title", want: []string{"title"}},
+		{param: "title,id", want: []string{"id", "title"}},
+		{param: " body , userId ,,", want: []string{"userId", "body"}},
+		{param: "title,title", want: []string{"title"}},
+		{param: "user_id", wantErr: true},
+		{param: "Title", wantErr: true},
+		{param: "title,author", wantErr: true},
+		{param: ",", wantErr: true},
+	}
+	for _, tt := range tests {
+		fields, err := postSchema.selectFields(tt.param)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.param, err, tt.wantErr)
+			continue
+		}
+		var names []string
+		for _, field := range fields {
+			names = append(names, field.name)
+		}
+		if !tt.wantErr && !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%q: fields = %q, want %q", tt.param, names, tt.want)
+		}
+	}
+}
+
+func TestRecordKeepsOrder(t *testing.T) {
+	fields := []fieldColumn{{"title", "title"}, {"id", "id"}, {"body", "body"}}
+	rec := recordFromRow(fields, []interface{}{"Hi", int64(3), nil})
+	rec.set("author", nil)
+	rec.set("title", "Hello")
+	rec.rename("id", "postId", int64(3))
+	rec.remove("body")
+
+	got, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"title":"Hello","postId":3,"author":null}`; string(got) != want {
+		t.Errorf("record = %s, want %s", got, want)
+	}
+}
+
+// viewDB answers view queries with a value for each selected column. User 5
+// has post 3; author says whether the join finds post 3's author.
+func viewDB(t *testing.T, author bool) *fakeDB {
+	user := map[string]driver.Value{"id": int64(5), "name": "Ann", "email": "ann@example.com", "username": "ann", "created_at": fixtureTime, "updated_at": fixtureTime}
+	post := map[string]driver.Value{"id": int64(3), "user_id": int64(5), "title": "Hi", "body": "First", "created_at": fixtureTime, "updated_at": fixtureTime}
+	return useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		list, _, _ := strings.Cut(strings.TrimPrefix(query, "SELECT "), " FROM ")
+		result := &fakeResult{}
+		var row []driver.Value
+		for _, column := range strings.Split(list, ", ") {
+			alias, name, _ := strings.Cut(column, ".")
+			result.columns = append(result.columns, name)
+			switch {
+			case alias == "u" && strings.Contains(query, "JOIN") && !author:
+				row = append(row, nil)
+			case alias == "u":
+				row = append(row, user[name])
+			default:
+				row = append(row, post[name])
+			}
+		}
+		result.rows = [][]driver.Value{row}
+		return result, nil
+	})
+}
+
+func TestGetViews(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		author  bool
+		status  int
+		body    string
+	}{
+		{name: "sparse post", handler: getPostHandler, target: "/posts/3?fields=title,id", status: http.StatusOK,
+			body: `{"id":3,"title":"Hi"}`},
+		{name: "post with its author", handler: getPostHandler, target: "/posts/3?fields=title&include=author&fields[author]=username,name", author: true, status: http.StatusOK,
+			body: `{"title":"Hi","author":{"name":"Ann","username":"ann"}}`},
+		{name: "post with a deleted author", handler: getPostHandler, target: "/posts/3?fields=id&include=author", status: http.StatusOK,
+			body: `{"id":3,"author":null}`},
+		{name: "user with posts", handler: getUserHandler, target: "/users/5?fields=name&include=posts&fields[posts]=title,id", status: http.StatusOK,
+			body: `{"name":"Ann","posts":[{"id":3,"title":"Hi"}]}`},
+		{name: "unknown field", handler: getPostHandler, target: "/posts/3?fields=title,author", status: http.StatusBadRequest},
+		{name: "unknown include field", handler: getPostHandler, target: "/posts/3?include=author&fields[author]=password", status: http.StatusBadRequest},
+		{name: "unknown include", handler: getPostHandler, target: "/posts/3?include=posts", status: http.StatusBadRequest},
+		{name: "include of the other resource", handler: getUserHandler, target: "/users/5?include=author", status: http.StatusBadRequest},
+		{name: "fields[author] without include", handler: getPostHandler, target: "/posts/3?fields[author]=name", status: http.StatusBadRequest},
+		{name: "fields[posts] without include", handler: getUserHandler, target: "/users/5?fields[posts]=title", status: http.StatusBadRequest},
+		{name: "view with include_deleted", handler: getUserHandler, target: "/users/5?fields=name&include_deleted=true", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := viewDB(t, tt.author)
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if len(fake.statements()) != 0 {
+					t.Errorf("ran %q for a rejected view", fake.statements())
+				}
+				return
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.body {
+				t.Errorf("body = %s, want %s", got, tt.body)
+			}
+			if etag := w.Header().Get("ETag"); !strings.HasPrefix(etag, `W/"`) {
+				t.Errorf("ETag = %q, want a weak one", etag)
+			}
+		})
+	}
+}
@@ -0,0 +1,917 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var (
+	// GRAPHQL_MAX_DEPTH bounds how deeply GraphQL fields may nest
+	GRAPHQL_MAX_DEPTH = 10
+	// GRAPHQL_MAX_COMPLEXITY bounds the estimated cost of a GraphQL query:
+	// every field costs 1 and a page of N items multiplies the cost of its
+	// selection by N
+	GRAPHQL_MAX_COMPLEXITY = 1000
+)
+
+// GraphQLRequest is the body of POST /graphql, and the query parameters of
+// GET /graphql with variables as a JSON string
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	// Extensions is part of the GraphQL over HTTP request format; it is
+	// accepted so strict decoding does not reject standard clients, and
+	// ignored
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// GraphQLResponse carries the result of a GraphQL request. Data is absent
+// when the request failed before execution.
+type GraphQLResponse struct {
+	Data   interface{}     `json:"data,omitempty"`
+	Errors []*GraphQLError `json:"errors,omitempty"`
+}
+
+// GraphQLError is one error in a GraphQLResponse. Its extensions carry the
+// same code, status and field errors as the REST problem would.
+type GraphQLError struct {
+	Message    string                 `json:"message"`
+	Locations  []GraphQLLocation      `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func newGraphQLError(code, message string, locs ...GraphQLLocation) *GraphQLError {
+	return &GraphQLError{Message: message, Locations: locs, Extensions: map[string]interface{}{"code": code}}
+}
+
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if vars := query.Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				respondWithJSON(w, http.StatusBadRequest, GraphQLResponse{Errors: []*GraphQLError{
+					newGraphQLError(codeInvalidQuery, "variables must be a JSON object"),
+				}})
+				return
+			}
+		}
+	} else if err := decodeJSONBody(r, &req); err != nil {
+		apiErr := classifyError(err)
+		respondWithJSON(w, apiErr.status, GraphQLResponse{Errors: []*GraphQLError{
+			newGraphQLError(apiErr.code, apiErr.detail),
+		}})
+		return
+	}
+
+	response, status := executeGraphQL(r, req)
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", http.MethodPost)
+	}
+	respondWithJSON(w, status, response)
+}
+
+// executeGraphQL runs req against graphqlSchema. Requests that cannot be
+// executed at all get a 4xx status; errors during execution are reported in
+// the response with a 200.
+func executeGraphQL(r *http.Request, req GraphQLRequest) (*GraphQLResponse, int) {
+	fail := func(status int, errs ...*GraphQLError) (*GraphQLResponse, int) {
+		return &GraphQLResponse{Errors: errs}, status
+	}
+
+	if req.Query == "" {
+		return fail(http.StatusBadRequest, newGraphQLError(codeGraphQLParseFailed, "Must provide a query"))
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		syntaxErr := err.(*gqlSyntaxError)
+		return fail(http.StatusBadRequest, newGraphQLError(codeGraphQLParseFailed, "Syntax Error: "+syntaxErr.msg, syntaxErr.loc))
+	}
+
+	var op *gqlOperation
+	for _, candidate := range doc.operations {
+		if req.OperationName == "" || candidate.name == req.OperationName {
+			if op != nil {
+				return fail(http.StatusBadRequest, newGraphQLError(codeGraphQLValidationFailed,
+					"Must provide operationName when the document contains several operations"))
+			}
+			op = candidate
+		}
+	}
+	if op == nil {
+		return fail(http.StatusBadRequest, newGraphQLError(codeGraphQLValidationFailed,
+			fmt.Sprintf("Unknown operation named %q", req.OperationName)))
+	}
+	rootType := graphqlSchema.query
+	if op.kind == "mutation" {
+		if r.Method == http.MethodGet {
+			return fail(http.StatusMethodNotAllowed, newGraphQLError(codeMethodNotAllowed, "Mutations must use POST", op.loc))
+		}
+		rootType = graphqlSchema.mutation
+	}
+
+	vars, errs := graphqlSchema.coerceVariables(op, req.Variables)
+	if len(errs) > 0 {
+		return fail(http.StatusBadRequest, errs...)
+	}
+
+	a := &gqlAnalyzer{schema: graphqlSchema, doc: doc, vars: vars, declared: map[string]bool{}, fragments: map[string]gqlFragmentCost{}}
+	for _, def := range op.vars {
+		a.declared[def.name] = true
+	}
+	complexity := a.selections(rootType, op.selections, 1, nil)
+	if len(a.errors) > 0 {
+		return fail(http.StatusBadRequest, a.errors...)
+	}
+	if a.depth > GRAPHQL_MAX_DEPTH {
+		return fail(http.StatusBadRequest, newGraphQLError(codeQueryTooDeep,
+			fmt.Sprintf("Query depth %d exceeds the limit of %d", a.depth, GRAPHQL_MAX_DEPTH), op.loc))
+	}
+	if complexity > GRAPHQL_MAX_COMPLEXITY {
+		return fail(http.StatusBadRequest, newGraphQLError(codeQueryTooComplex,
+			fmt.Sprintf("Query complexity %d exceeds the limit of %d; request smaller pages", complexity, GRAPHQL_MAX_COMPLEXITY), op.loc))
+	}
+
+	ex := &gqlExecutor{schema: graphqlSchema, doc: doc, vars: vars, r: r}
+	data := newRecord()
+	dataNull := false
+	root := gqlSlot{set: func(interface{}) {}, null: func() { dataNull = true }}
+	ex.executeFields(rootType, []interface{}{nil}, []*record{data}, []gqlSlot{root}, op.selections)
+	if dataNull {
+		// A null from a non-null root field leaves no valid data; it is
+		// still sent, as null
+		return &GraphQLResponse{Data: json.RawMessage("null"), Errors: ex.errors}, http.StatusOK
+	}
+	return &GraphQLResponse{Data: data, Errors: ex.errors}, http.StatusOK
+}
+
+// Schema
+
+// gqlObject is an output object type
+type gqlObject struct {
+	name   string
+	fields map[string]*gqlField
+}
+
+// gqlResolver computes a field for every parent object at once, so a
+// relation costs one query per level of the response rather than one per
+// parent. It returns one value per parent; a value may be an error that
+// applies to that parent only.
+type gqlResolver func(r *http.Request, parents []interface{}, args map[string]interface{}) ([]interface{}, error)
+
+type gqlField struct {
+	typ     *gqlTypeRef
+	args    []*gqlArg
+	resolve gqlResolver
+	// paginated fields return up to "first" items, which multiplies the
+	// complexity of their selection
+	paginated bool
+}
+
+type gqlArg struct {
+	name string
+	typ  *gqlTypeRef
+	def  interface{} // used when the argument is omitted; nil for none
+}
+
+// gqlInput is an input object type
+type gqlInput struct {
+	name   string
+	fields []*gqlArg
+}
+
+type gqlSchema struct {
+	query    *gqlObject
+	mutation *gqlObject
+	objects  map[string]*gqlObject
+	inputs   map[string]*gqlInput
+}
+
+// gqlScalars are the scalar types. IDs are integers serialised as strings;
+// DateTime is an RFC 3339 string.
+var gqlScalars = map[string]bool{"ID": true, "Int": true, "Float": true, "String": true, "Boolean": true, "DateTime": true}
+
+// gqlType parses a type reference such as "[Post!]!"
+func gqlType(s string) *gqlTypeRef {
+	p := &gqlParser{lexer: &gqlLexer{src: s, line: 1, col: 1}}
+	if err := p.read(); err != nil {
+		panic(err)
+	}
+	t, err := p.typeRef()
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// namedType strips list and non-null wrappers
+func namedType(t *gqlTypeRef) string {
+	for t.elem != nil {
+		t = t.elem
+	}
+	return t.name
+}
+
+// Input coercion
+
+// coerceVariables applies defaults to the operation's variables and
+// converts the supplied JSON values to their declared types
+func (s *gqlSchema) coerceVariables(op *gqlOperation, supplied map[string]interface{}) (map[string]interface{}, []*GraphQLError) {
+	vars := map[string]interface{}{}
+	var errs []*GraphQLError
+	for _, def := range op.vars {
+		if !s.isInputType(def.typ) {
+			errs = append(errs, newGraphQLError(codeGraphQLValidationFailed,
+				fmt.Sprintf("Variable $%s cannot be of non-input type %s", def.name, def.typ), def.loc))
+			continue
+		}
+		value, ok := supplied[def.name]
+		if !ok && def.def != nil {
+			coerced, err := s.coerceLiteral(def.def, def.typ, nil)
+			if err != nil {
+				errs = append(errs, newGraphQLError(codeGraphQLValidationFailed,
+					fmt.Sprintf("Variable $%s has an invalid default value: %v", def.name, err), def.loc))
+			} else {
+				vars[def.name] = coerced
+			}
+			continue
+		}
+		if !ok || value == nil {
+			if def.typ.nonNull {
+				errs = append(errs, newGraphQLError(codeInvalidQuery,
+					fmt.Sprintf("Variable $%s of required type %s was not provided", def.name, def.typ), def.loc))
+			} else if ok {
+				vars[def.name] = nil
+			}
+			continue
+		}
+		coerced, err := s.coerceJSON(value, def.typ)
+		if err != nil {
+			errs = append(errs, newGraphQLError(codeInvalidQuery,
+				fmt.Sprintf("Variable $%s got an invalid value: %v", def.name, err), def.loc))
+			continue
+		}
+		vars[def.name] = coerced
+	}
+	return vars, errs
+}
+
+func (s *gqlSchema) isInputType(t *gqlTypeRef) bool {
+	name := namedType(t)
+	return gqlScalars[name] || s.inputs[name] != nil
+}
+
+// coerceArgs returns the arguments of a field or directive by name, with
+// defaults applied. Omitted arguments without a default are absent.
+func (s *gqlSchema) coerceArgs(defs []*gqlArg, args []*gqlArgument, vars map[string]interface{}) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, def := range defs {
+		var arg *gqlArgument
+		for _, candidate := range args {
+			if candidate.name == def.name {
+				arg = candidate
+			}
+		}
+		if arg != nil && arg.value.kind == valueVariable {
+			if _, supplied := vars[arg.value.raw]; !supplied {
+				arg = nil
+			}
+		}
+		if arg == nil {
+			if def.def != nil {
+				values[def.name] = def.def
+			} else if def.typ.nonNull {
+				return nil, fmt.Errorf("Argument %q of type %s is required", def.name, def.typ)
+			}
+			continue
+		}
+		value, err := s.coerceLiteral(arg.value, def.typ, vars)
+		if err != nil {
+			return nil, fmt.Errorf("Argument %q has an invalid value: %v", def.name, err)
+		}
+		values[def.name] = value
+	}
+	return values, nil
+}
+
+// coerceLiteral converts a value from the query text to input type t
+func (s *gqlSchema) coerceLiteral(v *gqlValue, t *gqlTypeRef, vars map[string]interface{}) (interface{}, error) {
+	if v.kind == valueVariable {
+		value := vars[v.raw]
+		if value == nil && t.nonNull {
+			return nil, fmt.Errorf("expected a non-null %s", t)
+		}
+		return value, nil
+	}
+	if v.kind == valueNull {
+		if t.nonNull {
+			return nil, fmt.Errorf("expected a non-null %s", t)
+		}
+		return nil, nil
+	}
+
+	if t.elem != nil {
+		items := v.list
+		if v.kind != valueList {
+			// A single value is accepted where a list is expected
+			items = []*gqlValue{v}
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			value, err := s.coerceLiteral(item, t.elem, vars)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	}
+
+	if input := s.inputs[t.name]; input != nil {
+		if v.kind != valueObject {
+			return nil, fmt.Errorf("expected an input object %s", t.name)
+		}
+		fields := map[string]interface{}{}
+		for _, field := range v.fields {
+			fields[field.name] = field.value
+		}
+		return s.coerceInputObject(input, fields, func(value interface{}, t *gqlTypeRef) (interface{}, error) {
+			return s.coerceLiteral(value.(*gqlValue), t, vars)
+		})
+	}
+
+	switch t.name {
+	case "ID":
+		if v.kind == valueInt || v.kind == valueString {
+			if id, err := strconv.Atoi(v.raw); err == nil {
+				return id, nil
+			}
+		}
+	case "Int":
+		if v.kind == valueInt {
+			if n, err := strconv.ParseInt(v.raw, 10, 32); err == nil {
+				return int(n), nil
+			}
+		}
+	case "Float":
+		if v.kind == valueInt || v.kind == valueFloat {
+			if f, err := strconv.ParseFloat(v.raw, 64); err == nil {
+				return f, nil
+			}
+		}
+	case "String", "DateTime":
+		if v.kind == valueString {
+			return v.raw, nil
+		}
+	case "Boolean":
+		if v.kind == valueBoolean {
+			return v.raw == "true", nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s", t.name)
+}
+
+// coerceJSON converts a variable value decoded from JSON to input type t
+func (s *gqlSchema) coerceJSON(value interface{}, t *gqlTypeRef) (interface{}, error) {
+	if value == nil {
+		if t.nonNull {
+			return nil, fmt.Errorf("expected a non-null %s", t)
+		}
+		return nil, nil
+	}
+
+	if t.elem != nil {
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			coerced, err := s.coerceJSON(item, t.elem)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = coerced
+		}
+		return list, nil
+	}
+
+	if input := s.inputs[t.name]; input != nil {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an input object %s", t.name)
+		}
+		return s.coerceInputObject(input, fields, s.coerceJSON)
+	}
+
+	switch t.name {
+	case "ID":
+		switch v := value.(type) {
+		case float64:
+			if v == math.Trunc(v) {
+				return int(v), nil
+			}
+		case string:
+			if id, err := strconv.Atoi(v); err == nil {
+				return id, nil
+			}
+		}
+	case "Int":
+		if v, ok := value.(float64); ok && v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), nil
+		}
+	case "Float":
+		if v, ok := value.(float64); ok {
+			return v, nil
+		}
+	case "String", "DateTime":
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	case "Boolean":
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s", t.name)
+}
+
+// coerceInputObject checks the fields of an input object and converts each
+// with coerce. Omitted fields without a default are absent from the result.
+func (s *gqlSchema) coerceInputObject(input *gqlInput, fields map[string]interface{}, coerce func(interface{}, *gqlTypeRef) (interface{}, error)) (map[string]interface{}, error) {
+	for name := range fields {
+		known := false
+		for _, def := range input.fields {
+			known = known || def.name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("field %q is not defined by type %s", name, input.name)
+		}
+	}
+	values := map[string]interface{}{}
+	for _, def := range input.fields {
+		value, ok := fields[def.name]
+		if !ok {
+			if def.def != nil {
+				values[def.name] = def.def
+			} else if def.typ.nonNull {
+				return nil, fmt.Errorf("field %s.%s of type %s is required", input.name, def.name, def.typ)
+			}
+			continue
+		}
+		coerced, err := coerce(value, def.typ)
+		if err != nil {
+			return nil, fmt.Errorf("field %s.%s: %v", input.name, def.name, err)
+		}
+		values[def.name] = coerced
+	}
+	return values, nil
+}
+
+// Validation and cost analysis
+
+// gqlAnalyzer validates an operation against the schema and measures its
+// depth and complexity before anything runs
+type gqlAnalyzer struct {
+	schema   *gqlSchema
+	doc      *gqlDocument
+	vars     map[string]interface{}
+	declared map[string]bool
+	errors   []*GraphQLError
+	depth    int
+	// fragments holds each fragment analyzed so far. Fragments spreading
+	// the next one twice would otherwise take exponential time.
+	fragments map[string]gqlFragmentCost
+}
+
+// gqlFragmentCost is the complexity of a fragment and how many levels of
+// fields it adds below the selection set it is spread into
+type gqlFragmentCost struct {
+	cost   int
+	levels int
+}
+
+func (a *gqlAnalyzer) fail(loc GraphQLLocation, format string, args ...interface{}) {
+	a.errors = append(a.errors, newGraphQLError(codeGraphQLValidationFailed, fmt.Sprintf(format, args...), loc))
+}
+
+// selections checks sels against obj and returns their complexity. spreading
+// lists the fragments being expanded, to reject cycles.
+func (a *gqlAnalyzer) selections(obj *gqlObject, sels []*gqlSelection, depth int, spreading []string) int {
+	cost := 0
+	for _, sel := range sels {
+		a.directives(sel.directives)
+		switch sel.kind {
+		case selectFragmentSpread:
+			fragment := a.doc.fragments[sel.name]
+			if fragment == nil {
+				a.fail(sel.loc, "Unknown fragment %q", sel.name)
+				continue
+			}
+			if slices.Contains(spreading, sel.name) {
+				a.fail(sel.loc, "Cannot spread fragment %q within itself", sel.name)
+				continue
+			}
+			if !a.typeCondition(obj, fragment.typeCondition, sel.loc) {
+				continue
+			}
+			a.directives(fragment.directives)
+			cost = saturatingAdd(cost, a.fragment(obj, sel.name, fragment, depth, spreading))
+		case selectInlineFragment:
+			if sel.typeCondition != "" && !a.typeCondition(obj, sel.typeCondition, sel.loc) {
+				continue
+			}
+			cost = saturatingAdd(cost, a.selections(obj, sel.selections, depth, spreading))
+		default:
+			cost = saturatingAdd(cost, a.field(obj, sel, depth, spreading))
+		}
+	}
+	return cost
+}
+
+// fragment analyzes a spread fragment the first time and reuses the result
+// afterwards. The type condition pins obj, so only depth varies between
+// spreads.
+func (a *gqlAnalyzer) fragment(obj *gqlObject, name string, fragment *gqlFragment, depth int, spreading []string) int {
+	if known, ok := a.fragments[name]; ok {
+		if known.levels > 0 && depth+known.levels-1 > a.depth {
+			a.depth = depth + known.levels - 1
+		}
+		return known.cost
+	}
+	outer := a.depth
+	a.depth = 0
+	known := gqlFragmentCost{cost: a.selections(obj, fragment.selections, depth, append(spreading, name))}
+	if a.depth >= depth {
+		known.levels = a.depth - depth + 1
+	}
+	a.depth = max(a.depth, outer)
+	a.fragments[name] = known
+	return known.cost
+}
+
+func (a *gqlAnalyzer) field(obj *gqlObject, sel *gqlSelection, depth int, spreading []string) int {
+	if sel.name == "__typename" {
+		if len(sel.args) > 0 || sel.selections != nil {
+			a.fail(sel.loc, "Field \"__typename\" takes no arguments or subfields")
+		}
+		return 0
+	}
+	field := obj.fields[sel.name]
+	if field == nil {
+		a.fail(sel.loc, "Cannot query field %q on type %q", sel.name, obj.name)
+		return 0
+	}
+	if depth > a.depth {
+		a.depth = depth
+	}
+
+	for _, arg := range sel.args {
+		known := false
+		for _, def := range field.args {
+			known = known || def.name == arg.name
+		}
+		if !known {
+			a.fail(arg.loc, "Unknown argument %q on field %s.%s", arg.name, obj.name, sel.name)
+		}
+		a.variables(arg.value)
+	}
+	args, err := a.schema.coerceArgs(field.args, sel.args, a.vars)
+	if err != nil {
+		a.fail(sel.loc, "%v", err)
+		return 1
+	}
+
+	child := a.schema.objects[namedType(field.typ)]
+	if child == nil {
+		if sel.selections != nil {
+			a.fail(sel.loc, "Field %q must not have a selection since type %s has no subfields", sel.name, field.typ)
+		}
+		return 1
+	}
+	if sel.selections == nil {
+		a.fail(sel.loc, "Field %q of type %s must have a selection of subfields", sel.name, field.typ)
+		return 1
+	}
+	cost := a.selections(child, sel.selections, depth+1, spreading)
+	if field.paginated {
+		if first, ok := args["first"].(int); ok && first > 0 {
+			cost = saturatingMul(cost, first)
+		}
+	}
+	return saturatingAdd(cost, 1)
+}
+
+// typeCondition reports whether a fragment on typeName applies to obj. There
+// are no interfaces or unions, so it must name obj itself.
+func (a *gqlAnalyzer) typeCondition(obj *gqlObject, typeName string, loc GraphQLLocation) bool {
+	if a.schema.objects[typeName] == nil {
+		a.fail(loc, "Unknown type %q", typeName)
+		return false
+	}
+	if typeName != obj.name {
+		a.fail(loc, "Fragment cannot be spread here as objects of type %q can never be of type %q", obj.name, typeName)
+		return false
+	}
+	return true
+}
+
+// gqlSkipIncludeArgs are the arguments of @skip and @include
+var gqlSkipIncludeArgs = []*gqlArg{{name: "if", typ: gqlType("Boolean!")}}
+
+func (a *gqlAnalyzer) directives(directives []*gqlDirective) {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			a.fail(d.loc, "Unknown directive \"@%s\"", d.name)
+			continue
+		}
+		for _, arg := range d.args {
+			a.variables(arg.value)
+		}
+		if _, err := a.schema.coerceArgs(gqlSkipIncludeArgs, d.args, a.vars); err != nil {
+			a.fail(d.loc, "@%s: %v", d.name, err)
+		}
+	}
+}
+
+// variables checks that every variable in v is declared by the operation
+func (a *gqlAnalyzer) variables(v *gqlValue) {
+	switch v.kind {
+	case valueVariable:
+		if !a.declared[v.raw] {
+			a.fail(v.loc, "Variable $%s is not defined", v.raw)
+		}
+	case valueList:
+		for _, item := range v.list {
+			a.variables(item)
+		}
+	case valueObject:
+		for _, field := range v.fields {
+			a.variables(field.value)
+		}
+	}
+}
+
+// saturatingAdd and saturatingMul keep complexity from overflowing on
+// absurd queries; anything that large is rejected anyway
+func saturatingAdd(a, b int) int {
+	if a > math.MaxInt32-b {
+		return math.MaxInt32
+	}
+	return a + b
+}
+
+func saturatingMul(a, b int) int {
+	if b != 0 && a > math.MaxInt32/b {
+		return math.MaxInt32
+	}
+	return a * b
+}
+
+// Execution
+
+// gqlExecutor resolves an operation level by level: each field is resolved
+// for all the objects at its level in one call, which is what lets
+// resolvers batch their database lookups.
+type gqlExecutor struct {
+	schema *gqlSchema
+	doc    *gqlDocument
+	vars   map[string]interface{}
+	r      *http.Request
+	errors []*GraphQLError
+}
+
+// gqlSlot is where a completed value is written: a key of a response object
+// or an index of a response list
+type gqlSlot struct {
+	set  func(value interface{})
+	path []interface{}
+	// null stands for an error or missing value here. It writes null to the
+	// slot when its type is nullable, and otherwise to the nearest nullable
+	// slot above it.
+	null func()
+}
+
+// gqlFieldGroup is the selections of one response key, merged
+type gqlFieldGroup struct {
+	key        string
+	selections []*gqlSelection
+}
+
+// executeFields resolves sels on parents, writing each parent's fields into
+// its record in outs. owners are the slots the records were written to.
+func (ex *gqlExecutor) executeFields(obj *gqlObject, parents []interface{}, outs []*record, owners []gqlSlot, sels []*gqlSelection) {
+	for _, group := range ex.collectFields(sels, nil, map[string]bool{}) {
+		first := group.selections[0]
+		key := group.key
+		if first.name == "__typename" {
+			for _, out := range outs {
+				out.set(key, obj.name)
+			}
+			continue
+		}
+
+		field := obj.fields[first.name]
+		slots := make([]gqlSlot, len(parents))
+		for i := range parents {
+			out := outs[i]
+			out.set(key, nil)
+			set := func(value interface{}) { out.set(key, value) }
+			slots[i] = gqlSlot{set: set, path: appendPath(owners[i].path, key), null: nullIn(field.typ, set, owners[i])}
+		}
+
+		args, err := ex.schema.coerceArgs(field.args, first.args, ex.vars)
+		var values []interface{}
+		if err == nil {
+			values, err = field.resolve(ex.r, parents, args)
+		}
+		if err == nil && len(values) != len(parents) {
+			err = fmt.Errorf("resolver for %s.%s returned %d values for %d parents", obj.name, first.name, len(values), len(parents))
+		}
+		if err != nil {
+			for _, slot := range slots {
+				ex.addError(err, slot.path, first.loc)
+				slot.null()
+			}
+			continue
+		}
+
+		var children []*gqlSelection
+		for _, sel := range group.selections {
+			children = append(children, sel.selections...)
+		}
+		ex.complete(obj.name+"."+first.name, field.typ, values, slots, children, first.loc)
+	}
+}
+
+// collectFields flattens fragments into the fields to resolve, grouped by
+// response key in first-seen order, leaving out @skip and @include
+// exclusions
+func (ex *gqlExecutor) collectFields(sels []*gqlSelection, groups []*gqlFieldGroup, visited map[string]bool) []*gqlFieldGroup {
+	for _, sel := range sels {
+		if !ex.included(sel.directives) {
+			continue
+		}
+		switch sel.kind {
+		case selectFragmentSpread:
+			fragment := ex.doc.fragments[sel.name]
+			if visited[sel.name] || !ex.included(fragment.directives) {
+				continue
+			}
+			visited[sel.name] = true
+			groups = ex.collectFields(fragment.selections, groups, visited)
+		case selectInlineFragment:
+			groups = ex.collectFields(sel.selections, groups, visited)
+		default:
+			key := sel.responseKey()
+			found := false
+			for _, group := range groups {
+				if group.key == key {
+					group.selections = append(group.selections, sel)
+					found = true
+				}
+			}
+			if !found {
+				groups = append(groups, &gqlFieldGroup{key: key, selections: []*gqlSelection{sel}})
+			}
+		}
+	}
+	return groups
+}
+
+func (ex *gqlExecutor) included(directives []*gqlDirective) bool {
+	for _, d := range directives {
+		args, err := ex.schema.coerceArgs(gqlSkipIncludeArgs, d.args, ex.vars)
+		if err != nil {
+			continue
+		}
+		if condition, _ := args["if"].(bool); condition == (d.name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+// complete writes the resolved values of a field of type t into their slots.
+// Objects and list items are gathered across all slots so that the next
+// level is again resolved in one batch.
+func (ex *gqlExecutor) complete(fieldName string, t *gqlTypeRef, values []interface{}, slots []gqlSlot, sels []*gqlSelection, loc GraphQLLocation) {
+	var (
+		items     []interface{}
+		itemSlots []gqlSlot
+		objects   []interface{}
+		records   []*record
+		owners    []gqlSlot
+	)
+	for i, value := range values {
+		slot := slots[i]
+		if err, ok := value.(error); ok {
+			ex.addError(err, slot.path, loc)
+			slot.null()
+			continue
+		}
+		if isNilValue(value) {
+			if t.nonNull {
+				ex.addError(newAPIError(http.StatusInternalServerError, codeInternal,
+					"Cannot return null for non-nullable field "+fieldName), slot.path, loc)
+			}
+			slot.null()
+			continue
+		}
+
+		switch {
+		case t.elem != nil:
+			rv := reflect.ValueOf(value)
+			list := make([]interface{}, rv.Len())
+			slot.set(list)
+			for j := range list {
+				j := j
+				set := func(value interface{}) { list[j] = value }
+				items = append(items, rv.Index(j).Interface())
+				itemSlots = append(itemSlots, gqlSlot{set: set, path: appendPath(slot.path, j), null: nullIn(t.elem, set, slot)})
+			}
+		case gqlScalars[t.name]:
+			slot.set(serializeScalar(t.name, value))
+		default:
+			out := newRecord()
+			slot.set(out)
+			objects = append(objects, value)
+			records = append(records, out)
+			owners = append(owners, slot)
+		}
+	}
+
+	if len(items) > 0 {
+		ex.complete(fieldName, t.elem, items, itemSlots, sels, loc)
+	}
+	if len(objects) > 0 {
+		ex.executeFields(ex.schema.objects[t.name], objects, records, owners, sels)
+	}
+}
+
+// nullIn is the null of a slot of type t that set writes to, inside owner
+func nullIn(t *gqlTypeRef, set func(value interface{}), owner gqlSlot) func() {
+	if t.nonNull {
+		return owner.null
+	}
+	return func() { set(nil) }
+}
+
+// addError records err for the field at path, reporting it the way
+// respondWithError would
+func (ex *gqlExecutor) addError(err error, path []interface{}, loc GraphQLLocation) {
+	apiErr := classifyError(err)
+	if apiErr.status == http.StatusInternalServerError {
+		logFor(ex.r).Error("graphql field failed", "path", fmt.Sprint(path), "error", err)
+	}
+	gqlErr := newGraphQLError(apiErr.code, apiErr.detail, loc)
+	gqlErr.Path = path
+	gqlErr.Extensions["status"] = apiErr.status
+	if len(apiErr.fields) > 0 {
+		gqlErr.Extensions["errors"] = apiErr.fields
+	}
+	ex.errors = append(ex.errors, gqlErr)
+}
+
+func appendPath(path []interface{}, elem interface{}) []interface{} {
+	out := make([]interface{}, len(path)+1)
+	copy(out, path)
+	out[len(path)] = elem
+	return out
+}
+
+func isNilValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(value); rv.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func serializeScalar(name string, value interface{}) interface{} {
+	if t, ok := value.(*time.Time); ok {
+		value = *t
+	}
+	switch name {
+	case "ID":
+		return fmt.Sprint(value)
+	case "DateTime":
+		if t, ok := value.(time.Time); ok {
+			return t.Format(time.RFC3339Nano)
+		}
+	}
+	return value
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file parses the executable subset of GraphQL documents: queries and
+// mutations with variables, aliases, arguments, directives and fragments.
+// Type system definitions are not accepted.
+
+// GraphQLLocation is a 1-based line and column in the query text
+type GraphQLLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // "query" or "mutation"
+	name       string
+	vars       []*gqlVarDef
+	directives []*gqlDirective
+	selections []*gqlSelection
+	loc        GraphQLLocation
+}
+
+type gqlVarDef struct {
+	name string
+	typ  *gqlTypeRef
+	def  *gqlValue // nil without a default
+	loc  GraphQLLocation
+}
+
+// gqlTypeRef is a named type, or a list when elem is set, either of which
+// may be non-null
+type gqlTypeRef struct {
+	name    string
+	elem    *gqlTypeRef
+	nonNull bool
+}
+
+func (t *gqlTypeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type gqlFragment struct {
+	name          string
+	typeCondition string
+	directives    []*gqlDirective
+	selections    []*gqlSelection
+	loc           GraphQLLocation
+}
+
+// Selection kinds
+const (
+	selectField          = "field"
+	selectFragmentSpread = "spread"
+	selectInlineFragment = "inline"
+)
+
+type gqlSelection struct {
+	kind       string
+	alias      string // fields only; empty when the field is not aliased
+	name       string // field name or spread fragment name
+	args       []*gqlArgument
+	directives []*gqlDirective
+	// typeCondition is set on inline fragments that have one
+	typeCondition string
+	selections    []*gqlSelection
+	loc           GraphQLLocation
+}
+
+// responseKey is the key a field is written under
+func (s *gqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlArgument struct {
+	name  string
+	value *gqlValue
+	loc   GraphQLLocation
+}
+
+type gqlDirective struct {
+	name string
+	args []*gqlArgument
+	loc  GraphQLLocation
+}
+
+// Value kinds
+const (
+	valueVariable = "variable"
+	valueInt      = "int"
+	valueFloat    = "float"
+	valueString   = "string"
+	valueBoolean  = "boolean"
+	valueNull     = "null"
+	valueEnum     = "enum"
+	valueList     = "list"
+	valueObject   = "object"
+)
+
+// gqlValue is a literal or variable in the query text
+type gqlValue struct {
+	kind   string
+	raw    string // the variable name, or the scalar's text (unquoted for strings)
+	list   []*gqlValue
+	fields []*gqlArgument // object fields, in order
+	loc    GraphQLLocation
+}
+
+// gqlSyntaxError is a query that cannot be parsed
+type gqlSyntaxError struct {
+	msg string
+	loc GraphQLLocation
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return fmt.Sprintf("Syntax Error: %s (line %d, column %d)", e.msg, e.loc.Line, e.loc.Column)
+}
+
+// Token kinds
+const (
+	tokEOF    = "<EOF>"
+	tokPunct  = "punctuator"
+	tokName   = "name"
+	tokInt    = "int"
+	tokFloat  = "float"
+	tokString = "string"
+)
+
+type gqlToken struct {
+	kind  string
+	value string
+	loc   GraphQLLocation
+}
+
+// gqlLexer splits a query into tokens, skipping whitespace, commas and
+// comments
+type gqlLexer struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func (l *gqlLexer) loc() GraphQLLocation { return GraphQLLocation{Line: l.line, Column: l.col} }
+
+func (l *gqlLexer) advance(n int) {
+	for i := 0; i < n; i++ {
+		if l.src[l.pos] == '\n' {
+			l.line++
+			l.col = 1
+		} else if l.src[l.pos]&0xC0 != 0x80 {
+			// Count runes, not continuation bytes
+			l.col++
+		}
+		l.pos++
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.advance(1)
+		} else if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.advance(1)
+			}
+		} else {
+			break
+		}
+	}
+
+	start := l.loc()
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: tokEOF, loc: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.advance(3)
+		return gqlToken{kind: tokPunct, value: "...", loc: start}, nil
+	case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+		l.advance(1)
+		return gqlToken{kind: tokPunct, value: string(c), loc: start}, nil
+	case c == '_' || isLetter(c):
+		begin := l.pos
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.advance(1)
+		}
+		return gqlToken{kind: tokName, value: l.src[begin:l.pos], loc: start}, nil
+	case c == '-' || isDigit(c):
+		return l.number(start)
+	case c == '"':
+		return l.string(start)
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return gqlToken{}, &gqlSyntaxError{msg: fmt.Sprintf("Unexpected character %q", r), loc: start}
+}
+
+func (l *gqlLexer) number(start GraphQLLocation) (gqlToken, error) {
+	begin := l.pos
+	kind := tokInt
+	if l.src[l.pos] == '-' {
+		l.advance(1)
+	}
+	digits := func() int {
+		n := 0
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.advance(1)
+			n++
+		}
+		return n
+	}
+	if digits() == 0 {
+		return gqlToken{}, &gqlSyntaxError{msg: "Invalid number", loc: start}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = tokFloat
+		l.advance(1)
+		if digits() == 0 {
+			return gqlToken{}, &gqlSyntaxError{msg: "Invalid number", loc: start}
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = tokFloat
+		l.advance(1)
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.advance(1)
+		}
+		if digits() == 0 {
+			return gqlToken{}, &gqlSyntaxError{msg: "Invalid number", loc: start}
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == '_' || l.src[l.pos] == '.' || isLetter(l.src[l.pos])) {
+		return gqlToken{}, &gqlSyntaxError{msg: "Invalid number", loc: start}
+	}
+	return gqlToken{kind: kind, value: l.src[begin:l.pos], loc: start}, nil
+}
+
+func (l *gqlLexer) string(start GraphQLLocation) (gqlToken, error) {
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		l.advance(3)
+		end := strings.Index(l.src[l.pos:], `"""`)
+		if end < 0 {
+			return gqlToken{}, &gqlSyntaxError{msg: "Unterminated string", loc: start}
+		}
+		raw := l.src[l.pos : l.pos+end]
+		l.advance(end + 3)
+		return gqlToken{kind: tokString, value: blockStringValue(raw), loc: start}, nil
+	}
+
+	l.advance(1)
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return gqlToken{}, &gqlSyntaxError{msg: "Unterminated string", loc: start}
+		}
+		c := l.src[l.pos]
+		if c == '"' {
+			l.advance(1)
+			return gqlToken{kind: tokString, value: b.String(), loc: start}, nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			l.advance(1)
+			continue
+		}
+		if l.pos+1 >= len(l.src) {
+			return gqlToken{}, &gqlSyntaxError{msg: "Unterminated string", loc: start}
+		}
+		escapes := map[byte]string{'"': `"`, '\\': `\`, '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}
+		if s, ok := escapes[l.src[l.pos+1]]; ok {
+			b.WriteString(s)
+			l.advance(2)
+			continue
+		}
+		if l.src[l.pos+1] == 'u' && l.pos+6 <= len(l.src) {
+			code, err := strconv.ParseUint(l.src[l.pos+2:l.pos+6], 16, 32)
+			if err == nil {
+				b.WriteRune(rune(code))
+				l.advance(6)
+				continue
+			}
+		}
+		return gqlToken{}, &gqlSyntaxError{msg: "Invalid escape sequence", loc: l.loc()}
+	}
+}
+
+// blockStringValue strips the common indentation and blank first and last
+// lines of a """block string"""
+func blockStringValue(raw string) string {
+	raw = strings.ReplaceAll(raw, `\"""`, `"""`)
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = strings.TrimLeft(lines[i], " \t")
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+// gqlParser is a recursive descent parser over the lexer's tokens with one
+// token of lookahead
+type gqlParser struct {
+	lexer *gqlLexer
+	tok   gqlToken
+}
+
+// parseGraphQL parses an executable document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lexer: &gqlLexer{src: src, line: 1, col: 1}}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.peek(tokPunct, "{"):
+			loc := p.tok.loc
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: selections, loc: loc})
+		case p.peek(tokName, "query"), p.peek(tokName, "mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(tokName, "fragment"):
+			fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := doc.fragments[fragment.name]; exists {
+				return nil, &gqlSyntaxError{msg: fmt.Sprintf("There can be only one fragment named %q", fragment.name), loc: fragment.loc}
+			}
+			doc.fragments[fragment.name] = fragment
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &gqlSyntaxError{msg: "Document contains no operations", loc: p.tok.loc}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) read() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) peek(kind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == tokEOF {
+		return &gqlSyntaxError{msg: "Unexpected <EOF>", loc: p.tok.loc}
+	}
+	return &gqlSyntaxError{msg: fmt.Sprintf("Unexpected %q", p.tok.value), loc: p.tok.loc}
+}
+
+// expect consumes the punctuator or keyword value
+func (p *gqlParser) expect(kind, value string) error {
+	if !p.peek(kind, value) {
+		return &gqlSyntaxError{msg: fmt.Sprintf("Expected %q, found %s", value, p.describe()), loc: p.tok.loc}
+	}
+	return p.read()
+}
+
+// skip consumes the punctuator value if it is next
+func (p *gqlParser) skip(value string) (bool, error) {
+	if !p.peek(tokPunct, value) {
+		return false, nil
+	}
+	return true, p.read()
+}
+
+func (p *gqlParser) describe() string {
+	if p.tok.kind == tokEOF {
+		return tokEOF
+	}
+	return strconv.Quote(p.tok.value)
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", &gqlSyntaxError{msg: "Expected a name, found " + p.describe(), loc: p.tok.loc}
+	}
+	name := p.tok.value
+	return name, p.read()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.value, loc: p.tok.loc}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.tok.kind == tokName {
+		if op.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek(tokPunct, "(") {
+		if op.vars, err = p.varDefs(); err != nil {
+			return nil, err
+		}
+	}
+	if op.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if op.selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func (p *gqlParser) varDefs() ([]*gqlVarDef, error) {
+	if err := p.expect(tokPunct, "("); err != nil {
+		return nil, err
+	}
+	var defs []*gqlVarDef
+	for !p.peek(tokPunct, ")") {
+		def := &gqlVarDef{loc: p.tok.loc}
+		if err := p.expect(tokPunct, "$"); err != nil {
+			return nil, err
+		}
+		var err error
+		if def.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokPunct, ":"); err != nil {
+			return nil, err
+		}
+		if def.typ, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.skip("="); err != nil {
+			return nil, err
+		} else if ok {
+			if def.def, err = p.value(true); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.directives(); err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+	return defs, p.read()
+}
+
+func (p *gqlParser) typeRef() (*gqlTypeRef, error) {
+	t := &gqlTypeRef{}
+	if ok, err := p.skip("["); err != nil {
+		return nil, err
+	} else if ok {
+		if t.elem, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokPunct, "]"); err != nil {
+			return nil, err
+		}
+	} else {
+		if t.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	nonNull, err := p.skip("!")
+	t.nonNull = nonNull
+	return t, err
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	f := &gqlFragment{loc: p.tok.loc}
+	if err := p.read(); err != nil {
+		return nil, err
+	}
+	var err error
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.name == "on" {
+		return nil, &gqlSyntaxError{msg: `Fragment cannot be named "on"`, loc: f.loc}
+	}
+	if err := p.expect(tokName, "on"); err != nil {
+		return nil, err
+	}
+	if f.typeCondition, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if f.selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect(tokPunct, "{"); err != nil {
+		return nil, err
+	}
+	var selections []*gqlSelection
+	for !p.peek(tokPunct, "}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, &gqlSyntaxError{msg: "Expected a selection, found \"}\"", loc: p.tok.loc}
+	}
+	return selections, p.read()
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{loc: p.tok.loc}
+	var err error
+
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == tokName && p.tok.value != "on" {
+			sel.kind = selectFragmentSpread
+			if sel.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		sel.kind = selectInlineFragment
+		if p.peek(tokName, "on") {
+			if err := p.read(); err != nil {
+				return nil, err
+			}
+			if sel.typeCondition, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	sel.kind = selectField
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek(tokPunct, "(") {
+		if sel.args, err = p.arguments(false); err != nil {
+			return nil, err
+		}
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek(tokPunct, "{") {
+		if sel.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+// arguments parses (name: value, ...). Constant argument lists, such as
+// object fields inside a default value, may not use variables.
+func (p *gqlParser) arguments(constant bool) ([]*gqlArgument, error) {
+	if err := p.expect(tokPunct, "("); err != nil {
+		return nil, err
+	}
+	var args []*gqlArgument
+	for !p.peek(tokPunct, ")") {
+		arg, err := p.argument(constant)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) == 0 {
+		return nil, &gqlSyntaxError{msg: "Expected an argument, found \")\"", loc: p.tok.loc}
+	}
+	return args, p.read()
+}
+
+func (p *gqlParser) argument(constant bool) (*gqlArgument, error) {
+	arg := &gqlArgument{loc: p.tok.loc}
+	var err error
+	if arg.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokPunct, ":"); err != nil {
+		return nil, err
+	}
+	arg.value, err = p.value(constant)
+	return arg, err
+}
+
+func (p *gqlParser) directives() ([]*gqlDirective, error) {
+	var directives []*gqlDirective
+	for p.peek(tokPunct, "@") {
+		d := &gqlDirective{loc: p.tok.loc}
+		if err := p.read(); err != nil {
+			return nil, err
+		}
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.peek(tokPunct, "(") {
+			if d.args, err = p.arguments(false); err != nil {
+				return nil, err
+			}
+		}
+		directives = append(directives, d)
+	}
+	return directives, nil
+}
+
+func (p *gqlParser) value(constant bool) (*gqlValue, error) {
+	v := &gqlValue{loc: p.tok.loc, raw: p.tok.value}
+	switch p.tok.kind {
+	case tokInt:
+		v.kind = valueInt
+	case tokFloat:
+		v.kind = valueFloat
+	case tokString:
+		v.kind = valueString
+	case tokName:
+		switch p.tok.value {
+		case "true", "false":
+			v.kind = valueBoolean
+		case "null":
+			v.kind = valueNull
+		default:
+			v.kind = valueEnum
+		}
+	case tokPunct:
+		switch p.tok.value {
+		case "$":
+			if constant {
+				return nil, &gqlSyntaxError{msg: "Variables are not allowed here", loc: v.loc}
+			}
+			v.kind = valueVariable
+			if err := p.read(); err != nil {
+				return nil, err
+			}
+			var err error
+			v.raw, err = p.name()
+			return v, err
+		case "[":
+			v.kind = valueList
+			if err := p.read(); err != nil {
+				return nil, err
+			}
+			for !p.peek(tokPunct, "]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				v.list = append(v.list, item)
+			}
+			return v, p.read()
+		case "{":
+			v.kind = valueObject
+			if err := p.read(); err != nil {
+				return nil, err
+			}
+			for !p.peek(tokPunct, "}") {
+				field, err := p.argument(constant)
+				if err != nil {
+					return nil, err
+				}
+				v.fields = append(v.fields, field)
+			}
+			return v, p.read()
+		}
+		return nil, p.unexpected()
+	default:
+		return nil, p.unexpected()
+	}
+	return v, p.read()
+}
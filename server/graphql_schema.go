@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultGraphQLPageSize = 20
+	maxGraphQLPageSize     = 100
+)
+
+// graphqlSchema is the schema served at /graphql:
+//
+//	type Query {
+//	  user(id: ID!, includeDeleted: Boolean = false): User
+//	  post(id: ID!, includeDeleted: Boolean = false): Post
+//	  users(first: Int = 20, after: String): UserConnection!
+//	  posts(first: Int = 20, after: String, userId: ID): PostConnection!
+//	}
+//
+//	type Mutation {
+//	  createUser(input: CreateUserInput!): User!
+//	  updateUser(id: ID!, input: UpdateUserInput!, ifMatch: String): User!
+//	  patchUser(id: ID!, input: PatchUserInput!, ifMatch: String): User!
+//	  deleteUser(id: ID!, hard: Boolean = false, ifMatch: String): ID!
+//	  restoreUser(id: ID!): User!
+//	  createPost(input: CreatePostInput!): Post!
+//	  updatePost(id: ID!, input: UpdatePostInput!, ifMatch: String): Post!
+//	  patchPost(id: ID!, input: PatchPostInput!, ifMatch: String): Post!
+//	  deletePost(id: ID!, hard: Boolean = false, ifMatch: String): ID!
+//	  restorePost(id: ID!): Post!
+//	}
+//
+// User has a posts connection and Post has its author.
+var graphqlSchema = newGraphQLSchema()
+
+func newGraphQLSchema() *gqlSchema {
+	page := []*gqlArg{
+		{name: "first", typ: gqlType("Int"), def: defaultGraphQLPageSize},
+		{name: "after", typ: gqlType("String")},
+	}
+	id := &gqlArg{name: "id", typ: gqlType("ID!")}
+	includeDeleted := &gqlArg{name: "includeDeleted", typ: gqlType("Boolean"), def: false}
+	hard := &gqlArg{name: "hard", typ: gqlType("Boolean"), def: false}
+	ifMatch := &gqlArg{name: "ifMatch", typ: gqlType("String")}
+	input := func(typ string) *gqlArg { return &gqlArg{name: "input", typ: gqlType(typ + "!")} }
+
+	s := &gqlSchema{objects: map[string]*gqlObject{}, inputs: map[string]*gqlInput{}}
+	object := func(name string, fields map[string]*gqlField) *gqlObject {
+		s.objects[name] = &gqlObject{name: name, fields: fields}
+		return s.objects[name]
+	}
+	inputObject := func(name string, fields ...*gqlArg) {
+		s.inputs[name] = &gqlInput{name: name, fields: fields}
+	}
+
+	object("User", map[string]*gqlField{
+		"id":        {typ: gqlType("ID!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*User).ID })},
+		"name":      {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*User).Name })},
+		"email":     {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*User).Email })},
+		"username":  {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*User).Username })},
+		"createdAt": {typ: gqlType("DateTime!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*User).CreatedAt })},
+		"updatedAt": {typ: gqlType("DateTime!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*User).UpdatedAt })},
+		"deletedAt": {typ: gqlType("DateTime"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*User).DeletedAt })},
+		"etag":      {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return resourceETag(p.(*User).UpdatedAt) })},
+		"posts":     {typ: gqlType("PostConnection!"), args: page, paginated: true, resolve: resolveUserPosts},
+	})
+	object("Post", map[string]*gqlField{
+		"id":        {typ: gqlType("ID!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*Post).ID })},
+		"userId":    {typ: gqlType("ID!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*Post).UserID })},
+		"title":     {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*Post).Title })},
+		"body":      {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*Post).Body })},
+		"createdAt": {typ: gqlType("DateTime!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*Post).CreatedAt })},
+		"updatedAt": {typ: gqlType("DateTime!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*Post).UpdatedAt })},
+		"deletedAt": {typ: gqlType("DateTime"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*Post).DeletedAt })},
+		"etag":      {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return resourceETag(p.(*Post).UpdatedAt) })},
+		"author":    {typ: gqlType("User"), resolve: resolvePostAuthor},
+	})
+	for _, node := range []string{"User", "Post"} {
+		object(node+"Connection", map[string]*gqlField{
+			"edges":    {typ: gqlType("[" + node + "Edge!]!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*gqlConnection).edges() })},
+			"nodes":    {typ: gqlType("[" + node + "!]!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*gqlConnection).nodes })},
+			"pageInfo": {typ: gqlType("PageInfo!"), resolve: gqlEach(func(p interface{}) interface{} { return p })},
+		})
+		object(node+"Edge", map[string]*gqlField{
+			"cursor": {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*gqlEdge).cursor })},
+			"node":   {typ: gqlType(node + "!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*gqlEdge).node })},
+		})
+	}
+	object("PageInfo", map[string]*gqlField{
+		"hasNextPage": {typ: gqlType("Boolean!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*gqlConnection).hasNextPage })},
+		"endCursor":   {typ: gqlType("String"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*gqlConnection).endCursor() })},
+	})
+
+	s.query = object("Query", map[string]*gqlField{
+		"user":  {typ: gqlType("User"), args: []*gqlArg{id, includeDeleted}, resolve: gqlRoot(resolveUser)},
+		"post":  {typ: gqlType("Post"), args: []*gqlArg{id, includeDeleted}, resolve: gqlRoot(resolvePost)},
+		"users": {typ: gqlType("UserConnection!"), args: page, paginated: true, resolve: gqlRoot(resolveUsers)},
+		"posts": {typ: gqlType("PostConnection!"), args: append([]*gqlArg{{name: "userId", typ: gqlType("ID")}}, page...),
+			paginated: true, resolve: gqlRoot(resolvePosts)},
+	})
+
+	inputObject("CreateUserInput",
+		&gqlArg{name: "name", typ: gqlType("String!")},
+		&gqlArg{name: "email", typ: gqlType("String!")},
+		&gqlArg{name: "username", typ: gqlType("String!")})
+	inputObject("UpdateUserInput", s.inputs["CreateUserInput"].fields...)
+	inputObject("PatchUserInput",
+		&gqlArg{name: "name", typ: gqlType("String")},
+		&gqlArg{name: "email", typ: gqlType("String")},
+		&gqlArg{name: "username", typ: gqlType("String")})
+	inputObject("CreatePostInput",
+		&gqlArg{name: "userId", typ: gqlType("ID!")},
+		&gqlArg{name: "title", typ: gqlType("String!")},
+		&gqlArg{name: "body", typ: gqlType("String!")})
+	inputObject("UpdatePostInput", s.inputs["CreatePostInput"].fields...)
+	inputObject("PatchPostInput",
+		&gqlArg{name: "userId", typ: gqlType("ID")},
+		&gqlArg{name: "title", typ: gqlType("String")},
+		&gqlArg{name: "body", typ: gqlType("String")})
+
+	s.mutation = object("Mutation", map[string]*gqlField{
+		"createUser":  {typ: gqlType("User!"), args: []*gqlArg{input("CreateUserInput")}, resolve: gqlRoot(resolveCreateUser)},
+		"updateUser":  {typ: gqlType("User!"), args: []*gqlArg{id, input("UpdateUserInput"), ifMatch}, resolve: gqlRoot(resolveUpdateUser)},
+		"patchUser":   {typ: gqlType("User!"), args: []*gqlArg{id, input("PatchUserInput"), ifMatch}, resolve: gqlRoot(resolvePatchUser)},
+		"deleteUser":  {typ: gqlType("ID!"), args: []*gqlArg{id, hard, ifMatch}, resolve: gqlRoot(resolveDeleteUser)},
+		"restoreUser": {typ: gqlType("User!"), args: []*gqlArg{id}, resolve: gqlRoot(resolveRestoreUser)},
+		"createPost":  {typ: gqlType("Post!"), args: []*gqlArg{input("CreatePostInput")}, resolve: gqlRoot(resolveCreatePost)},
+		"updatePost":  {typ: gqlType("Post!"), args: []*gqlArg{id, input("UpdatePostInput"), ifMatch}, resolve: gqlRoot(resolveUpdatePost)},
+		"patchPost":   {typ: gqlType("Post!"), args: []*gqlArg{id, input("PatchPostInput"), ifMatch}, resolve: gqlRoot(resolvePatchPost)},
+		"deletePost":  {typ: gqlType("ID!"), args: []*gqlArg{id, hard, ifMatch}, resolve: gqlRoot(resolveDeletePost)},
+		"restorePost": {typ: gqlType("Post!"), args: []*gqlArg{id}, resolve: gqlRoot(resolveRestorePost)},
+	})
+	return s
+}
+
+// gqlEach resolves a field from each parent on its own, for fields that need
+// no lookup
+func gqlEach(fn func(parent interface{}) interface{}) gqlResolver {
+	return func(r *http.Request, parents []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		values := make([]interface{}, len(parents))
+		for i, parent := range parents {
+			values[i] = fn(parent)
+		}
+		return values, nil
+	}
+}
+
+// gqlRoot resolves a Query or Mutation field, which has a single nil parent
+func gqlRoot(fn func(r *http.Request, args map[string]interface{}) (interface{}, error)) gqlResolver {
+	return func(r *http.Request, parents []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		value, err := fn(r, args)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	}
+}
+
+// Connections
+
+// gqlConnection is one page of a list. It also serves as the PageInfo.
+type gqlConnection struct {
+	nodes       []interface{}
+	hasNextPage bool
+}
+
+type gqlEdge struct {
+	cursor string
+	node   interface{}
+}
+
+// newConnection builds a page from up to first+1 rows; the extra row only
+// tells whether there is a next page
+func newConnection(nodes []interface{}, first int) *gqlConnection {
+	if len(nodes) > first {
+		return &gqlConnection{nodes: nodes[:first], hasNextPage: true}
+	}
+	return &gqlConnection{nodes: nodes}
+}
+
+func (c *gqlConnection) edges() []*gqlEdge {
+	edges := make([]*gqlEdge, len(c.nodes))
+	for i, node := range c.nodes {
+		edges[i] = &gqlEdge{cursor: encodeCursor(nodeID(node)), node: node}
+	}
+	return edges
+}
+
+func (c *gqlConnection) endCursor() *string {
+	if len(c.nodes) == 0 {
+		return nil
+	}
+	cursor := encodeCursor(nodeID(c.nodes[len(c.nodes)-1]))
+	return &cursor
+}
+
+func nodeID(node interface{}) int {
+	switch node := node.(type) {
+	case *User:
+		return node.ID
+	case *Post:
+		return node.ID
+	}
+	return 0
+}
+
+// Cursors are opaque to clients; they encode the ID of the last node seen
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(raw), "id:") {
+		if id, err := strconv.Atoi(strings.TrimPrefix(string(raw), "id:")); err == nil {
+			return id, nil
+		}
+	}
+	return 0, newAPIError(http.StatusBadRequest, codeInvalidQuery, "after is not a valid cursor")
+}
+
+// pageArgs reads first and after
+func pageArgs(args map[string]interface{}) (first, after int, err error) {
+	first, _ = args["first"].(int)
+	if first < 1 || first > maxGraphQLPageSize {
+		return 0, 0, newAPIError(http.StatusBadRequest, codeInvalidQuery, "first must be between 1 and "+strconv.Itoa(maxGraphQLPageSize))
+	}
+	if cursor, ok := args["after"].(string); ok {
+		if after, err = decodeCursor(cursor); err != nil {
+			return 0, 0, err
+		}
+	}
+	return first, after, nil
+}
+
+func userNodes(users []User) []interface{} {
+	nodes := make([]interface{}, len(users))
+	for i := range users {
+		nodes[i] = &users[i]
+	}
+	return nodes
+}
+
+func postNodes(posts []Post) []interface{} {
+	nodes := make([]interface{}, len(posts))
+	for i := range posts {
+		nodes[i] = &posts[i]
+	}
+	return nodes
+}
+
+// Queries
+
+func resolveUser(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	id := args["id"].(int)
+	if includeDeleted, _ := args["includeDeleted"].(bool); includeDeleted {
+		if !isAdmin(r) {
+			return nil, newAPIError(http.StatusForbidden, codeForbidden, "includeDeleted requires an admin token")
+		}
+		return nilIfNotFound(getUserIncludingDeleted(r.Context(), id))
+	}
+	return nilIfNotFound(getUserByID(r.Context(), id))
+}
+
+func resolvePost(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	id := args["id"].(int)
+	if includeDeleted, _ := args["includeDeleted"].(bool); includeDeleted {
+		if !isAdmin(r) {
+			return nil, newAPIError(http.StatusForbidden, codeForbidden, "includeDeleted requires an admin token")
+		}
+		return nilIfNotFound(getPostIncludingDeleted(r.Context(), id))
+	}
+	return nilIfNotFound(getPostByID(r.Context(), id))
+}
+
+// nilIfNotFound turns a missing resource into null, as GraphQL clients expect
+func nilIfNotFound[T any](value *T, err error) (interface{}, error) {
+	if errors.Is(err, errUserNotFound) || errors.Is(err, errPostNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func resolveUsers(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	first, after, err := pageArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	users, err := listUsers(r.Context(), after, first+1)
+	if err != nil {
+		return nil, err
+	}
+	return newConnection(userNodes(users), first), nil
+}
+
+func resolvePosts(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	first, after, err := pageArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	userID, _ := args["userId"].(int)
+	posts, err := listPosts(r.Context(), userID, after, first+1)
+	if err != nil {
+		return nil, err
+	}
+	return newConnection(postNodes(posts), first), nil
+}
+
+// Relations, loaded for all parents at once
+
+func resolveUserPosts(r *http.Request, parents []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	first, after, err := pageArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(parents))
+	for i, parent := range parents {
+		ids[i] = parent.(*User).ID
+	}
+	postsByUser, err := listPostsByUserIDs(r.Context(), ids, after, first+1)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(parents))
+	for i, id := range ids {
+		values[i] = newConnection(postNodes(postsByUser[id]), first)
+	}
+	return values, nil
+}
+
+func resolvePostAuthor(r *http.Request, parents []interface{}, args map[string]interface{}) ([]interface{}, error) {
+	ids := make([]int, len(parents))
+	for i, parent := range parents {
+		ids[i] = parent.(*Post).UserID
+	}
+	users, err := getUsersByIDs(r.Context(), ids)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(parents))
+	for i, id := range ids {
+		// A soft-deleted author is null, as with ?include=author
+		if user, ok := users[id]; ok {
+			values[i] = user
+		}
+	}
+	return values, nil
+}
+
+// Mutations mirror the REST handlers
+
+// gqlPrecondition reads the ifMatch argument the way writePrecondition reads
+// If-Match
+func gqlPrecondition(args map[string]interface{}) (*ifMatch, error) {
+	header, _ := args["ifMatch"].(string)
+	if header == "" {
+		if REQUIRE_IF_MATCH {
+			return nil, newAPIError(http.StatusPreconditionRequired, codePreconditionRequired, "ifMatch is required")
+		}
+		return nil, nil
+	}
+	return parseIfMatch(header), nil
+}
+
+// gqlHardDelete reads the admin-only hard argument
+func gqlHardDelete(r *http.Request, args map[string]interface{}) (bool, error) {
+	hard, _ := args["hard"].(bool)
+	if hard && !isAdmin(r) {
+		return false, newAPIError(http.StatusForbidden, codeForbidden, "hard requires an admin token")
+	}
+	return hard, nil
+}
+
+func inputString(input map[string]interface{}, name string) string {
+	s, _ := input[name].(string)
+	return s
+}
+
+func resolveCreateUser(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	input := args["input"].(map[string]interface{})
+	req := CreateUserRequest{Name: inputString(input, "name"), Email: inputString(input, "email"), Username: inputString(input, "username")}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return createUser(r.Context(), req.Name, req.Email, req.Username)
+}
+
+func resolveUpdateUser(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	cond, err := gqlPrecondition(args)
+	if err != nil {
+		return nil, err
+	}
+	input := args["input"].(map[string]interface{})
+	req := UpdateUserRequest{Name: inputString(input, "name"), Email: inputString(input, "email"), Username: inputString(input, "username")}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return updateUser(r.Context(), args["id"].(int), req.Name, req.Email, req.Username, cond)
+}
+
+// resolvePatchUser changes the fields present in the input. A null field is
+// left unchanged.
+func resolvePatchUser(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	cond, err := gqlPrecondition(args)
+	if err != nil {
+		return nil, err
+	}
+	input := args["input"].(map[string]interface{})
+	return patchUserDB(r.Context(), args["id"].(int), cond, func(current *User) (*User, error) {
+		patched := *current
+		if name, ok := input["name"].(string); ok {
+			patched.Name = name
+		}
+		if email, ok := input["email"].(string); ok {
+			patched.Email = email
+		}
+		if username, ok := input["username"].(string); ok {
+			patched.Username = username
+		}
+		if err := (UpdateUserRequest{Name: patched.Name, Email: patched.Email, Username: patched.Username}).validate(); err != nil {
+			return nil, &patchError{msg: err.Error(), err: err}
+		}
+		return &patched, nil
+	})
+}
+
+func resolveDeleteUser(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	cond, err := gqlPrecondition(args)
+	if err != nil {
+		return nil, err
+	}
+	hard, err := gqlHardDelete(r, args)
+	if err != nil {
+		return nil, err
+	}
+	id := args["id"].(int)
+	if hard {
+		err = purgeUser(r.Context(), id, cond)
+	} else {
+		err = deleteUser(r.Context(), id, cond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func resolveRestoreUser(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	return restoreUser(r.Context(), args["id"].(int))
+}
+
+func resolveCreatePost(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	input := args["input"].(map[string]interface{})
+	req := CreatePostRequest{Title: inputString(input, "title"), Body: inputString(input, "body")}
+	req.UserID, _ = input["userId"].(int)
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return createPost(r.Context(), req.UserID, req.Title, req.Body)
+}
+
+func resolveUpdatePost(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	cond, err := gqlPrecondition(args)
+	if err != nil {
+		return nil, err
+	}
+	input := args["input"].(map[string]interface{})
+	req := CreatePostRequest{Title: inputString(input, "title"), Body: inputString(input, "body")}
+	req.UserID, _ = input["userId"].(int)
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return updatePost(r.Context(), args["id"].(int), req.UserID, req.Title, req.Body, cond)
+}
+
+// resolvePatchPost changes the fields present in the input. A null field is
+// left unchanged.
+func resolvePatchPost(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	cond, err := gqlPrecondition(args)
+	if err != nil {
+		return nil, err
+	}
+	input := args["input"].(map[string]interface{})
+	return patchPostDB(r.Context(), args["id"].(int), cond, func(current *Post) (*Post, error) {
+		patched := *current
+		if userID, ok := input["userId"].(int); ok {
+			patched.UserID = userID
+		}
+		if title, ok := input["title"].(string); ok {
+			patched.Title = title
+		}
+		if body, ok := input["body"].(string); ok {
+			patched.Body = body
+		}
+		if err := (CreatePostRequest{UserID: patched.UserID, Title: patched.Title, Body: patched.Body}).validate(); err != nil {
+			return nil, &patchError{msg: err.Error(), err: err}
+		}
+		return &patched, nil
+	})
+}
+
+func resolveDeletePost(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	cond, err := gqlPrecondition(args)
+	if err != nil {
+		return nil, err
+	}
+	hard, err := gqlHardDelete(r, args)
+	if err != nil {
+		return nil, err
+	}
+	id := args["id"].(int)
+	if hard {
+		err = purgePost(r.Context(), id, cond)
+	} else {
+		err = deletePost(r.Context(), id, cond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func resolveRestorePost(r *http.Request, args map[string]interface{}) (interface{}, error) {
+	return restorePost(r.Context(), args["id"].(int))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testItem is the object type of testGraphQLSchema. A nil name breaks its
+// non-null name field.
+type testItem struct {
+	id   int
+	name *string
+}
+
+// testGraphQLSchema is a small schema with no database behind it:
+//
+//	type Query {
+//	  item(id: ID!): Item
+//	  required(id: ID!): Item!
+//	  items(ids: [ID!]!): [Item!]
+//	  failing: String!
+//	  optionalFailing: String
+//	}
+//
+//	type Mutation {
+//	  remove(id: ID!, hard: Boolean = false): Boolean!
+//	}
+//
+//	type Item { id: ID!  name: String!  nick: String  tags: [String!]! }
+func testGraphQLSchema() *gqlSchema {
+	name := "widget"
+	items := map[int]*testItem{1: {id: 1, name: &name}, 2: {id: 2}}
+	lookup := func(args map[string]interface{}) interface{} {
+		if item, ok := items[args["id"].(int)]; ok {
+			return item
+		}
+		return nil
+	}
+	fail := func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+		return nil, errors.New("boom")
+	}
+
+	s := &gqlSchema{objects: map[string]*gqlObject{}, inputs: map[string]*gqlInput{}}
+	s.objects["Item"] = &gqlObject{name: "Item", fields: map[string]*gqlField{
+		"id":   {typ: gqlType("ID!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*testItem).id })},
+		"name": {typ: gqlType("String!"), resolve: gqlEach(func(p interface{}) interface{} { return p.(*testItem).name })},
+		"nick": {typ: gqlType("String"), resolve: gqlEach(func(p interface{}) interface{} { return nil })},
+		"tags": {typ: gqlType("[String!]!"), resolve: gqlEach(func(p interface{}) interface{} { return []interface{}{"a", nil} })},
+	}}
+	id := &gqlArg{name: "id", typ: gqlType("ID!")}
+	s.query = &gqlObject{name: "Query", fields: map[string]*gqlField{
+		"item": {typ: gqlType("Item"), args: []*gqlArg{id}, resolve: gqlRoot(func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+			return lookup(args), nil
+		})},
+		"required": {typ: gqlType("Item!"), args: []*gqlArg{id}, resolve: gqlRoot(func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+			return lookup(args), nil
+		})},
+		"items": {typ: gqlType("[Item!]"), args: []*gqlArg{{name: "ids", typ: gqlType("[ID!]!")}}, resolve: gqlRoot(func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+			var list []interface{}
+			for _, id := range args["ids"].([]interface{}) {
+				list = append(list, lookup(map[string]interface{}{"id": id}))
+			}
+			return list, nil
+		})},
+		"failing":         {typ: gqlType("String!"), resolve: gqlRoot(fail)},
+		"optionalFailing": {typ: gqlType("String"), resolve: gqlRoot(fail)},
+	}}
+	hard := &gqlArg{name: "hard", typ: gqlType("Boolean"), def: false}
+	s.mutation = &gqlObject{name: "Mutation", fields: map[string]*gqlField{
+		"remove": {typ: gqlType("Boolean!"), args: []*gqlArg{id, hard}, resolve: gqlRoot(func(r *http.Request, args map[string]interface{}) (interface{}, error) {
+			return gqlHardDelete(r, args)
+		})},
+	}}
+	return s
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	saved := graphqlSchema
+	graphqlSchema = testGraphQLSchema()
+	defer func() { graphqlSchema = saved }()
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		status    int
+		data      string // JSON, or "" when data must be absent
+		errPaths  []string
+	}{
+		{
+			name:   "fields and alias",
+			query:  `{ item(id: 1) { id label: name nick } }`,
+			status: http.StatusOK,
+			data:   `{"item":{"id":"1","label":"widget","nick":null}}`,
+		},
+		{
+			name:   "missing item is null",
+			query:  `{ item(id: 9) { id } }`,
+			status: http.StatusOK,
+			data:   `{"item":null}`,
+		},
+		{
+			name:     "non-null field nulls its nullable parent",
+			query:    `{ item(id: 2) { id name } }`,
+			status:   http.StatusOK,
+			data:     `{"item":null}`,
+			errPaths: []string{`["item","name"]`},
+		},
+		{
+			name:     "non-null list item nulls the nullable list",
+			query:    `{ items(ids: [1, 2]) { id name } }`,
+			status:   http.StatusOK,
+			data:     `{"items":null}`,
+			errPaths: []string{`["items",1,"name"]`},
+		},
+		{
+			name:     "null inside a non-null list of a nullable field",
+			query:    `{ item(id: 1) { id tags } }`,
+			status:   http.StatusOK,
+			data:     `{"item":null}`,
+			errPaths: []string{`["item","tags",1]`},
+		},
+		{
+			name:     "non-null root field nulls data",
+			query:    `{ item(id: 1) { id } required(id: 2) { name } }`,
+			status:   http.StatusOK,
+			data:     `null`,
+			errPaths: []string{`["required","name"]`},
+		},
+		{
+			name:     "error in a non-null root field nulls data",
+			query:    `{ failing }`,
+			status:   http.StatusOK,
+			data:     `null`,
+			errPaths: []string{`["failing"]`},
+		},
+		{
+			name:     "error in a nullable field only nulls the field",
+			query:    `{ optionalFailing item(id: 1) { id } }`,
+			status:   http.StatusOK,
+			data:     `{"optionalFailing":null,"item":{"id":"1"}}`,
+			errPaths: []string{`["optionalFailing"]`},
+		},
+		{
+			name:      "variables, fragments and directives",
+			query:     `query Q($id: ID!, $skip: Boolean!) { item(id: $id) { ...F nick @skip(if: $skip) } } fragment F on Item { id name }`,
+			variables: map[string]interface{}{"id": "1", "skip": true},
+			status:    http.StatusOK,
+			data:      `{"item":{"id":"1","name":"widget"}}`,
+		},
+		{
+			name:   "null argument is false",
+			query:  `mutation { remove(id: 1, hard: null) }`,
+			status: http.StatusOK,
+			data:   `{"remove":false}`,
+		},
+		{
+			name:   "syntax error",
+			query:  `{ item(id: 1) { id }`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "unknown field",
+			query:  `{ item(id: 1) { color } }`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing variable",
+			query:  `query Q($id: ID!) { item(id: $id) { id } }`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "empty query",
+			query:  ``,
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+			response, status := executeGraphQL(r, GraphQLRequest{Query: tt.query, Variables: tt.variables})
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d (errors %+v)", status, tt.status, response.Errors)
+			}
+			if status != http.StatusOK {
+				if response.Data != nil || len(response.Errors) == 0 {
+					t.Fatalf("got data %v and errors %v, want errors only", response.Data, response.Errors)
+				}
+				return
+			}
+
+			body, err := json.Marshal(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Data   json.RawMessage `json:"data"`
+				Errors []struct {
+					Path json.RawMessage `json:"path"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Data) != tt.data {
+				t.Errorf("data = %s, want %s", got.Data, tt.data)
+			}
+			if len(got.Errors) != len(tt.errPaths) {
+				t.Fatalf("errors = %s, want paths %v", body, tt.errPaths)
+			}
+			for i, e := range got.Errors {
+				if string(e.Path) != tt.errPaths[i] {
+					t.Errorf("error %d path = %s, want %s", i, e.Path, tt.errPaths[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGraphQLQueryLimits(t *testing.T) {
+	savedDepth, savedComplexity := GRAPHQL_MAX_DEPTH, GRAPHQL_MAX_COMPLEXITY
+	defer func() { GRAPHQL_MAX_DEPTH, GRAPHQL_MAX_COMPLEXITY = savedDepth, savedComplexity }()
+	GRAPHQL_MAX_DEPTH, GRAPHQL_MAX_COMPLEXITY = 5, 1000
+
+	// Queries within the limits would run against the database, so only
+	// rejected ones are checked
+	tests := []struct {
+		name  string
+		query string
+		code  string
+	}{
+		{"too deep", `{ user(id: 1) { posts { nodes { author { posts { nodes { id } } } } } } }`, codeQueryTooDeep},
+		{"too complex", `{ users(first: 100) { nodes { posts(first: 100) { nodes { id } } } } }`, codeQueryTooComplex},
+		{"nested fragment spreads", nestedSpreads(26), codeQueryTooComplex},
+		{"mutation over GET", `mutation { restoreUser(id: 1) { id } }`, codeMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := http.MethodPost
+			if tt.code == codeMethodNotAllowed {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/graphql", nil)
+			response, status := executeGraphQL(r, GraphQLRequest{Query: tt.query})
+			if status == http.StatusOK || len(response.Errors) != 1 {
+				t.Fatalf("status = %d, errors = %+v, want one error", status, response.Errors)
+			}
+			if code := response.Errors[0].Extensions["code"]; code != tt.code {
+				t.Errorf("code = %v, want %s", code, tt.code)
+			}
+		})
+	}
+}
+
+// nestedSpreads returns a query of n fragments, each spreading the next
+// twice, which expands to 2^n fields
+func nestedSpreads(n int) string {
+	var b strings.Builder
+	b.WriteString("{ user(id: 1) { ...F0 } }")
+	for i := 0; i < n-1; i++ {
+		fmt.Fprintf(&b, " fragment F%d on User { ...F%d ...F%d }", i, i+1, i+1)
+	}
+	fmt.Fprintf(&b, " fragment F%d on User { id }", n-1)
+	return b.String()
+}
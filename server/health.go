@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// READINESS_TIMEOUT bounds the database checks of /readyz
+	READINESS_TIMEOUT = 2 * time.Second
+	// POOL_SATURATION_WARN is the share of the connection pool in use above
+	// which /readyz warns. Readiness does not fail on it.
+	POOL_SATURATION_WARN = 0.9
+)
+
+// SCHEMA_VERSION is the schema_migrations version this build needs. Bump it
+// together with the INSERT at the end of database/init.sql and a new entry
+// in migrations.
+const SCHEMA_VERSION = 2
+
+// Check results, from best to worst
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Name       string                 `json:"name"`
+	Status     string                 `json:"status" enum:"pass,warn,fail"`
+	DurationMS float64                `json:"durationMs"`
+	Message    string                 `json:"message,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// ReadinessReport is the body of /readyz. Checks are only listed with
+// ?verbose=true, which takes the METRICS_TOKEN or ADMIN_TOKEN since they
+// describe the database.
+type ReadinessReport struct {
+	Status string        `json:"status" enum:"ready,not_ready"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// livezHandler reports that the process is up and serving. It does not look
+// at dependencies, so a database outage does not get the server restarted.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether this instance should get traffic: it is not
+// draining, the database answers and its schema is recent enough. Warnings
+// do not make it unready.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	if verbose && !hasOperatorToken(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="readyz"`)
+		respondWithProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "verbose=true requires the metrics or admin token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), READINESS_TIMEOUT)
+	defer cancel()
+
+	checks := []HealthCheck{
+		runCheck("draining", checkDraining),
+		runCheck("database", func() (string, string, map[string]interface{}) { return checkDatabase(ctx) }),
+		runCheck("connection_pool", checkConnectionPool),
+		runCheck("schema", func() (string, string, map[string]interface{}) { return checkSchema(ctx) }),
+	}
+
+	report := ReadinessReport{Status: "ready"}
+	status := http.StatusOK
+	for _, check := range checks {
+		if check.Status == checkFail {
+			report.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if verbose {
+		report.Checks = checks
+	}
+	respondWithJSON(w, status, report)
+}
+
+// hasOperatorToken reports whether r carries the METRICS_TOKEN or the
+// ADMIN_TOKEN as bearer token. Unset tokens match nothing.
+func hasOperatorToken(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, valid := range []string{METRICS_TOKEN, ADMIN_TOKEN} {
+		if valid != "" && subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// runCheck times check and wraps its result
+func runCheck(name string, check func() (status, message string, details map[string]interface{})) HealthCheck {
+	start := time.Now()
+	status, message, details := check()
+	return HealthCheck{
+		Name:       name,
+		Status:     status,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		Message:    message,
+		Details:    details,
+	}
+}
+
+func checkDraining() (string, string, map[string]interface{}) {
+	if draining.Load() {
+		return checkFail, "Server is shutting down", nil
+	}
+	return checkPass, "", nil
+}
+
+func checkDatabase(ctx context.Context) (string, string, map[string]interface{}) {
+	if db == nil {
+		return checkFail, "Database is not initialized", nil
+	}
+	if err := db.PingContext(ctx); err != nil {
+		// The error can name internal hosts, so it is only logged
+		slog.Warn("Readiness check failed", "check", "database", "error", err)
+		return checkFail, "Database is unreachable", nil
+	}
+	return checkPass, "", nil
+}
+
+func checkConnectionPool() (string, string, map[string]interface{}) {
+	if db == nil {
+		return checkFail, "Database is not initialized", nil
+	}
+	stats := db.Stats()
+	details := map[string]interface{}{
+		"open":    stats.OpenConnections,
+		"inUse":   stats.InUse,
+		"idle":    stats.Idle,
+		"maxOpen": stats.MaxOpenConnections,
+		"waits":   stats.WaitCount,
+	}
+	if stats.MaxOpenConnections <= 0 {
+		return checkPass, "", details
+	}
+	saturation := float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	details["saturation"] = saturation
+	if saturation >= POOL_SATURATION_WARN {
+		return checkWarn, fmt.Sprintf("%d of %d connections in use", stats.InUse, stats.MaxOpenConnections), details
+	}
+	return checkPass, "", details
+}
+
+// checkSchema fails when the database has not been migrated to
+// SCHEMA_VERSION, so a new build never serves an old schema
+func checkSchema(ctx context.Context) (string, string, map[string]interface{}) {
+	if db == nil {
+		return checkFail, "Database is not initialized", nil
+	}
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		slog.Warn("Readiness check failed", "check", "schema", "error", err)
+		return checkFail, "Could not read the schema version", nil
+	}
+	details := map[string]interface{}{"version": version, "required": SCHEMA_VERSION}
+	if version < SCHEMA_VERSION {
+		return checkFail, fmt.Sprintf("Schema version %d is older than the required %d", version, SCHEMA_VERSION), details
+	}
+	return checkPass, "", details
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHasOperatorToken(t *testing.T) {
+	savedMetrics, savedAdmin := METRICS_TOKEN, ADMIN_TOKEN
+	defer func() { METRICS_TOKEN, ADMIN_TOKEN = savedMetrics, savedAdmin }()
+
+	tests := []struct {
+		name          string
+		metrics       string
+		admin         string
+		authorization string
+		want          bool
+	}{
+		{"metrics token", "m", "a", "Bearer m", true},
+		{"admin token", "m", "a", "Bearer a", true},
+		{"API token", "m", "a", "Bearer secret", false},
+		{"no header", "m", "a", "", false},
+		{"not a bearer token", "m", "a", "Basic m", false},
+		{"unset tokens match nothing", "", "", "Bearer ", false},
+		{"metrics token unset", "", "a", "Bearer a", true},
+	}
+	for _, tt := range tests {
+		METRICS_TOKEN, ADMIN_TOKEN = tt.metrics, tt.admin
+		r := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		if got := hasOperatorToken(r); got != tt.want {
+			t.Errorf("%s: hasOperatorToken = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	savedMetrics, savedAdmin := METRICS_TOKEN, ADMIN_TOKEN
+	defer func() { METRICS_TOKEN, ADMIN_TOKEN = savedMetrics, savedAdmin }()
+	METRICS_TOKEN, ADMIN_TOKEN = "metrics-token", "admin-token"
+
+	tests := []struct {
+		name     string
+		target   string
+		token    string
+		draining bool
+		pingErr  error
+		schema   int64
+		status   int
+		report   string
+		// failed are the checks that fail, when the report lists them
+		failed []string
+	}{
+		{name: "ready", target: "/readyz", schema: SCHEMA_VERSION, status: http.StatusOK, report: "ready"},
+		{name: "newer schema", target: "/readyz", schema: SCHEMA_VERSION + 1, status: http.StatusOK, report: "ready"},
+		{name: "verbose without a token", target: "/readyz?verbose=true", schema: SCHEMA_VERSION, status: http.StatusUnauthorized},
+		{name: "verbose with the API token", target: "/readyz?verbose=true", token: "secret", schema: SCHEMA_VERSION, status: http.StatusUnauthorized},
+		{name: "verbose with the metrics token", target: "/readyz?verbose=true", token: "metrics-token", schema: SCHEMA_VERSION, status: http.StatusOK, report: "ready", failed: []string{}},
+		{name: "verbose with the admin token", target: "/readyz?verbose=1", token: "admin-token", schema: SCHEMA_VERSION, status: http.StatusOK, report: "ready", failed: []string{}},
+		{name: "draining", target: "/readyz?verbose=true", token: "admin-token", draining: true, schema: SCHEMA_VERSION, status: http.StatusServiceUnavailable, report: "not_ready", failed: []string{"draining"}},
+		{name: "database down", target: "/readyz?verbose=true", token: "admin-token", pingErr: errors.New("dial tcp 10.0.0.5:5432: connection refused"), schema: SCHEMA_VERSION, status: http.StatusServiceUnavailable, report: "not_ready", failed: []string{"database"}},
+		{name: "database down, terse", target: "/readyz", pingErr: errors.New("connection refused"), schema: SCHEMA_VERSION, status: http.StatusServiceUnavailable, report: "not_ready"},
+		{name: "schema behind", target: "/readyz?verbose=true", token: "metrics-token", schema: SCHEMA_VERSION - 1, status: http.StatusServiceUnavailable, report: "not_ready", failed: []string{"schema"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+				if query == "PING" {
+					return nil, tt.pingErr
+				}
+				return &fakeResult{columns: []string{"version"}, rows: [][]driver.Value{{tt.schema}}}, nil
+			})
+			draining.Store(tt.draining)
+			defer draining.Store(false)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			readyzHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.report == "" {
+				return
+			}
+			var report ReadinessReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Status != tt.report {
+				t.Errorf("status = %q, want %q", report.Status, tt.report)
+			}
+			if tt.failed == nil {
+				if report.Checks != nil {
+					t.Errorf("checks listed without verbose=true: %+v", report.Checks)
+				}
+				return
+			}
+			if len(report.Checks) != 4 {
+				t.Fatalf("checks = %+v", report.Checks)
+			}
+			failed := []string{}
+			for _, check := range report.Checks {
+				if check.Status == checkFail {
+					failed = append(failed, check.Name)
+				}
+				if check.Name == "database" && check.Message != "" && check.Message != "Database is unreachable" {
+					t.Errorf("database check leaks %q", check.Message)
+				}
+				if check.Name == "schema" && (check.Details["version"] != float64(tt.schema) || check.Details["required"] != float64(SCHEMA_VERSION)) {
+					t.Errorf("schema details = %v", check.Details)
+				}
+			}
+			if !reflect.DeepEqual(failed, tt.failed) {
+				t.Errorf("failed checks = %q, want %q", failed, tt.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxIdempotencyKeyLength matches the idempotency_keys.idempotency_key column
+const maxIdempotencyKeyLength = 255
+
+// replayedHeaders are the response headers stored with an idempotent response
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// idempotencyRecord is the stored state of an Idempotency-Key
+type idempotencyRecord struct {
+	fingerprint string
+	status      sql.NullInt64
+	headers     []byte
+	body        []byte
+}
+
+// idempotent makes a POST handler safe to retry. A request with an
+// Idempotency-Key header runs once; repeats with the same key and body get the
+// stored response with Idempotent-Replayed: true until IDEMPOTENCY_TTL
+// passes. Reusing a key with a different body is a 422, and a repeat that
+// arrives while the first request is still running is a 409.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidIdempotencyKey, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := idempotencyScope(r)
+		fingerprint := requestFingerprint(r, body)
+		claimed, err := claimIdempotencyKey(key, scope, fingerprint)
+		if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		if !claimed {
+			replayIdempotentResponse(w, r, key, scope, fingerprint)
+			return
+		}
+
+		// A panicking handler frees the key at once rather than when the
+		// lease runs out
+		defer func() {
+			if p := recover(); p != nil {
+				if err := releaseIdempotencyKey(key, scope); err != nil {
+					logFor(r).Error("releasing idempotency key", "idempotency_key", key, "error", err)
+				}
+				panic(p)
+			}
+		}()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		// Server errors are not stored, so the client can retry them
+		if rec.status >= http.StatusInternalServerError {
+			err = releaseIdempotencyKey(key, scope)
+		} else {
+			err = saveIdempotentResponse(key, scope, rec.status, rec.Header(), rec.body.Bytes())
+		}
+		if err != nil {
+			logFor(r).Error("storing idempotent response", "idempotency_key", key, "error", err)
+		}
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, key, scope, fingerprint string) {
+	stored, err := getIdempotencyRecord(key, scope)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	if stored == nil {
+		// The first request failed and released the key in the meantime
+		respondWithProblem(w, r, http.StatusConflict, codeIdempotencyInProgress, "Retry the request")
+		return
+	}
+	if stored.fingerprint != fingerprint {
+		respondWithProblem(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused,
+			"Idempotency-Key was already used for a different request")
+		return
+	}
+	if !stored.status.Valid {
+		w.Header().Set("Retry-After", "1")
+		respondWithProblem(w, r, http.StatusConflict, codeIdempotencyInProgress,
+			"A request with this Idempotency-Key is still being processed")
+		return
+	}
+
+	var headers map[string]string
+	if err := json.Unmarshal(stored.headers, &headers); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(stored.status.Int64))
+	w.Write(stored.body)
+}
+
+// idempotencyScope keeps keys from different endpoints, API versions and
+// credentials apart
+func idempotencyScope(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return r.Method + " v" + requestAPIVersion(r).name + r.URL.Path + " " + hex.EncodeToString(sum[:8])
+}
+
+// requestFingerprint identifies the request a key was first used with
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// Idempotency key storage
+
+// claimIdempotencyKey records key as in progress for IDEMPOTENCY_LEASE. It
+// returns false when the key is held by a running request or a stored
+// response, and takes over expired ones.
+func claimIdempotencyKey(key, scope, fingerprint string) (bool, error) {
+	query := `INSERT INTO idempotency_keys (idempotency_key, scope, fingerprint, expires_at)
+	          VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')
+	          ON CONFLICT (idempotency_key, scope) DO UPDATE
+	          SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, response_headers = NULL,
+	              response_body = NULL, created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+	          WHERE idempotency_keys.expires_at <= CURRENT_TIMESTAMP
+	          RETURNING true`
+	var claimed bool
+	err := db.QueryRow(query, key, scope, fingerprint, IDEMPOTENCY_LEASE.Seconds()).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return claimed, err
+}
+
+func getIdempotencyRecord(key, scope string) (*idempotencyRecord, error) {
+	rec := &idempotencyRecord{}
+	query := `SELECT fingerprint, status_code, response_headers, response_body FROM idempotency_keys
+	          WHERE idempotency_key = $1 AND scope = $2`
+	err := db.QueryRow(query, key, scope).Scan(&rec.fingerprint, &rec.status, &rec.headers, &rec.body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func saveIdempotentResponse(key, scope string, status int, header http.Header, body []byte) error {
+	headers := map[string]string{}
+	for _, name := range replayedHeaders {
+		if value := header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	// The response is kept for the full IDEMPOTENCY_TTL from now on
+	query := `UPDATE idempotency_keys SET status_code = $1, response_headers = $2, response_body = $3,
+	              expires_at = CURRENT_TIMESTAMP + $6 * INTERVAL '1 second'
+	          WHERE idempotency_key = $4 AND scope = $5`
+	_, err = db.Exec(query, status, encoded, body, key, scope, IDEMPOTENCY_TTL.Seconds())
+	return err
+}
+
+func releaseIdempotencyKey(key, scope string) error {
+	_, err := db.Exec(`DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND scope = $2`, key, scope)
+	return err
+}
+
+// purgeExpiredIdempotencyKeys deletes expired keys every interval until stop
+// is closed
+func purgeExpiredIdempotencyKeys(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= CURRENT_TIMESTAMP`); err != nil {
+			slog.Error("purging expired idempotency keys", "error", err)
+		}
+	}
+}
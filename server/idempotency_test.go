@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const idempotentBody = `{"name":"Ann","email":"ann@example.com","username":"ann"}`
+
+// storedKey is the idempotency_keys row of a fake database; nil when the key
+// is unknown or released
+type storedKey struct {
+	fingerprint string
+	status      driver.Value
+	headers     string
+	body        string
+}
+
+// idempotencyDB answers idempotency_keys statements. The claim succeeds when
+// claimable is set; otherwise the key's row is stored.
+func idempotencyDB(t *testing.T, claimable bool, stored *storedKey) *fakeDB {
+	return useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO idempotency_keys"):
+			if !claimable {
+				return &fakeResult{columns: []string{"bool"}}, nil
+			}
+			return &fakeResult{columns: []string{"bool"}, rows: [][]driver.Value{{true}}}, nil
+		case strings.HasPrefix(query, "SELECT fingerprint"):
+			result := &fakeResult{columns: []string{"fingerprint", "status_code", "response_headers", "response_body"}}
+			if stored != nil {
+				result.rows = [][]driver.Value{{stored.fingerprint, stored.status, []byte(stored.headers), []byte(stored.body)}}
+			}
+			return result, nil
+		}
+		return &fakeResult{affected: 1}, nil
+	})
+}
+
+func TestIdempotent(t *testing.T) {
+	request := func(key, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		return r
+	}
+	fingerprint := requestFingerprint(request("", ""), []byte(idempotentBody))
+	created := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/users/7")
+		w.Header().Set("X-Request-ID", "not stored")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":7}`)
+	}
+	failed := func(w http.ResponseWriter, r *http.Request) {
+		respondWithProblem(w, r, http.StatusInternalServerError, codeInternal, "")
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		body      string
+		claimable bool
+		stored    *storedKey
+		handler   http.HandlerFunc
+		status    int
+		code      string
+		replayed  bool
+		// ran are statement prefixes that must run once, skipped ones that
+		// must not run
+		ran     []string
+		skipped []string
+	}{
+		{
+			name: "no key", body: idempotentBody, handler: created,
+			status: http.StatusCreated, skipped: []string{"INSERT", "UPDATE", "DELETE"},
+		},
+		{
+			name: "key too long", key: strings.Repeat("k", maxIdempotencyKeyLength+1), body: idempotentBody, handler: created,
+			status: http.StatusBadRequest, code: codeInvalidIdempotencyKey, skipped: []string{"INSERT"},
+		},
+		{
+			name: "first request stores its response", key: "k1", body: idempotentBody, claimable: true, handler: created,
+			status: http.StatusCreated, ran: []string{"INSERT INTO idempotency_keys", "UPDATE idempotency_keys SET status_code"},
+			skipped: []string{"DELETE"},
+		},
+		{
+			name: "server error releases the key", key: "k1", body: idempotentBody, claimable: true, handler: failed,
+			status: http.StatusInternalServerError, ran: []string{"DELETE FROM idempotency_keys"},
+			skipped: []string{"UPDATE"},
+		},
+		{
+			name: "repeat replays the stored response", key: "k1", body: idempotentBody, handler: failed,
+			stored: &storedKey{fingerprint, int64(http.StatusCreated), `{"Content-Type":"application/json","Location":"/users/7"}`, `{"id":7}`},
+			status: http.StatusCreated, replayed: true, skipped: []string{"UPDATE", "DELETE"},
+		},
+		{
+			name: "key reused with a different body", key: "k1", body: `{"name":"Bob"}`, handler: created,
+			stored: &storedKey{fingerprint, int64(http.StatusCreated), `{}`, `{"id":7}`},
+			status: http.StatusUnprocessableEntity, code: codeIdempotencyKeyReused, skipped: []string{"UPDATE", "DELETE"},
+		},
+		{
+			name: "first request still running", key: "k1", body: idempotentBody, handler: created,
+			stored: &storedKey{fingerprint, nil, "", ""},
+			status: http.StatusConflict, code: codeIdempotencyInProgress, skipped: []string{"UPDATE", "DELETE"},
+		},
+		{
+			name: "first request released the key meanwhile", key: "k1", body: idempotentBody, handler: created,
+			status: http.StatusConflict, code: codeIdempotencyInProgress, skipped: []string{"UPDATE", "DELETE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := idempotencyDB(t, tt.claimable, tt.stored)
+			w := httptest.NewRecorder()
+			idempotent(tt.handler)(w, request(tt.key, tt.body))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+				t.Errorf("body = %s, want code %s", w.Body, tt.code)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+				t.Errorf("Idempotent-Replayed = %q", w.Header().Get("Idempotent-Replayed"))
+			}
+			if tt.status == http.StatusCreated && (w.Body.String() != `{"id":7}` || w.Header().Get("Location") != "/users/7") {
+				t.Errorf("response %s, Location %q", w.Body, w.Header().Get("Location"))
+			}
+			if tt.code == codeIdempotencyInProgress && tt.stored != nil && w.Header().Get("Retry-After") != "1" {
+				t.Error("no Retry-After while the first request runs")
+			}
+			for _, prefix := range tt.ran {
+				if fake.ran(prefix) != 1 {
+					t.Errorf("%q ran %d times, want once", prefix, fake.ran(prefix))
+				}
+			}
+			for _, prefix := range tt.skipped {
+				if fake.ran(prefix) != 0 {
+					t.Errorf("%q ran", prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotentStoresResponse(t *testing.T) {
+	fake := idempotencyDB(t, true, nil)
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(idempotentBody))
+	r.Header.Set("Idempotency-Key", "k1")
+	r.Header.Set("Authorization", "Bearer a")
+	idempotent(func(w http.ResponseWriter, r *http.Request) {
+		// The handler still reads the whole body
+		if body, _ := io.ReadAll(r.Body); string(body) != idempotentBody {
+			t.Errorf("handler read %q", body)
+		}
+		w.Header().Set("Location", "/users/7")
+		w.Header().Set("X-Request-ID", "not stored")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":7}`)
+	})(httptest.NewRecorder(), r)
+
+	for i, statement := range fake.statements() {
+		switch {
+		case strings.HasPrefix(statement, "INSERT"):
+			if args := fake.args[i]; args[0] != "k1" || args[1] != idempotencyScope(r) || args[2] != requestFingerprint(r, []byte(idempotentBody)) {
+				t.Errorf("claimed with %v", args)
+			}
+		case strings.HasPrefix(statement, "UPDATE"):
+			args := fake.args[i]
+			if args[0] != int64(http.StatusCreated) || string(args[1].([]byte)) != `{"Location":"/users/7"}` || string(args[2].([]byte)) != `{"id":7}` {
+				t.Errorf("stored %v", args)
+			}
+		}
+	}
+	if fake.ran("INSERT") != 1 || fake.ran("UPDATE") != 1 {
+		t.Errorf("statements: %q", fake.statements())
+	}
+}
+
+func TestIdempotentPanicReleasesKey(t *testing.T) {
+	fake := idempotencyDB(t, true, nil)
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(idempotentBody))
+	r.Header.Set("Idempotency-Key", "k1")
+	defer func() {
+		if recover() == nil {
+			t.Error("panic swallowed")
+		}
+		if fake.ran("DELETE FROM idempotency_keys") != 1 || fake.ran("UPDATE") != 0 {
+			t.Errorf("statements after a panic: %q", fake.statements())
+		}
+	}()
+	idempotent(func(w http.ResponseWriter, r *http.Request) { panic("boom") })(httptest.NewRecorder(), r)
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	scope := func(target, token, version string) string {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r = r.WithContext(context.WithValue(r.Context(), versionContextKey, findAPIVersion(version)))
+		return idempotencyScope(r)
+	}
+	base := scope("/users", "a", "1")
+	for _, other := range []string{scope("/posts", "a", "1"), scope("/users", "b", "1"), scope("/users", "a", "2")} {
+		if other == base {
+			t.Errorf("scope %q shared", base)
+		}
+	}
+	if scope("/users", "a", "1") != base {
+		t.Error("scope is not stable")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// LOG_LEVEL is the least severe level logged: debug, info, warn or error
+	LOG_LEVEL = slog.LevelInfo
+	// LOG_FORMAT is json for one JSON object per line, or text for
+	// key=value lines
+	LOG_FORMAT = "json"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds a propagated X-Request-ID so clients cannot
+// bloat every log line
+const maxRequestIDLength = 128
+
+// requestLogContextKey holds the request's *requestLog, set by accessLog
+const requestLogContextKey contextKey = "requestLog"
+
+// requestLog is what the access log records beyond the request itself.
+// labelRoute fills in the route and authMiddleware the identity.
+type requestLog struct {
+	id       string
+	route    string
+	identity string
+}
+
+// redacted replaces secrets in log output
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are log attribute names whose values are never logged
+var sensitiveKeys = []string{"authorization", "token", "secret", "password"}
+
+// setupLogging makes slog, and through it the log package, write structured
+// lines to stderr with secrets redacted
+func setupLogging() {
+	opts := &slog.HandlerOptions{Level: LOG_LEVEL, ReplaceAttr: redactAttr}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if LOG_FORMAT == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactSecrets(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, redactSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+// redactSecrets removes the configured tokens from s
+func redactSecrets(s string) string {
+	for _, secret := range []string{VALID_TOKEN, ADMIN_TOKEN, METRICS_TOKEN} {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// describeSecret says whether a secret is configured without showing it
+func describeSecret(secret string) string {
+	if secret == "" {
+		return "not set"
+	}
+	return redacted
+}
+
+func parseLogLevel(s string) (slog.Level, bool) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+// accessLog gives every request an X-Request-ID, reusing a well-formed one
+// from the client, and logs one line per request once it is done. It also
+// feeds the HTTP metrics and records the request's server span.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpInFlight.Add(1)
+		defer httpInFlight.Add(-1)
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		entry := &requestLog{id: id}
+		r, span := traceRequest(r.WithContext(context.WithValue(r.Context(), requestLogContextKey, entry)))
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		recordRequest(r.Method, entry.route, rec.status, elapsed)
+		finishRequestSpan(span, r, entry.route, rec.status)
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		identity := entry.identity
+		if identity == "" {
+			identity = "anonymous"
+		}
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.String("request_id", id),
+			slog.String("trace_id", traceID(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", entry.route),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("identity", identity),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogOf returns the request's access log entry, or an empty one for
+// requests that did not pass through accessLog
+func requestLogOf(r *http.Request) *requestLog {
+	if entry, ok := r.Context().Value(requestLogContextKey).(*requestLog); ok {
+		return entry
+	}
+	return &requestLog{}
+}
+
+// requestID is the request's X-Request-ID
+func requestID(r *http.Request) string {
+	return requestLogOf(r).id
+}
+
+// logFor returns a logger that tags every line with the request's ID and
+// trace ID
+func logFor(r *http.Request) *slog.Logger {
+	return slog.Default().With("request_id", requestID(r), "trace_id", traceID(r))
+}
+
+// accessRecorder notes the status and size of a response. It passes Flush
+// through so event streams keep working.
+type accessRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (rec *accessRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *accessRecorder) Write(p []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *accessRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (rec *accessRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactAttr(t *testing.T) {
+	savedValid, savedAdmin, savedMetrics := VALID_TOKEN, ADMIN_TOKEN, METRICS_TOKEN
+	defer func() { VALID_TOKEN, ADMIN_TOKEN, METRICS_TOKEN = savedValid, savedAdmin, savedMetrics }()
+	VALID_TOKEN, ADMIN_TOKEN, METRICS_TOKEN = "bearer-secret", "admin-secret", ""
+
+	tests := []struct {
+		name string
+		attr slog.Attr
+		want string
+	}{
+		{"sensitive key", slog.String("Authorization", "Bearer anything"), redacted},
+		{"key containing token", slog.String("admin_token", "x"), redacted},
+		{"password key with a number", slog.Int("password", 1234), redacted},
+		{"token inside a message", slog.String("msg", "auth with bearer-secret failed"), "auth with [REDACTED] failed"},
+		{"both tokens", slog.String("detail", "admin-secret/bearer-secret"), "[REDACTED]/[REDACTED]"},
+		{"token inside an error", slog.Any("error", errors.New("dial admin-secret@db")), "dial [REDACTED]@db"},
+		{"unset token is not redacted", slog.String("path", "/users/1"), "/users/1"},
+		{"other kinds untouched", slog.Int("status", 200), "200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactAttr(nil, tt.attr)
+			if got.Key != tt.attr.Key || got.Value.String() != tt.want {
+				t.Errorf("redactAttr(%s) = %s, want %s=%s", tt.attr, got, tt.attr.Key, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	savedValid := VALID_TOKEN
+	defer func() { VALID_TOKEN = savedValid }()
+	VALID_TOKEN = "bearer-secret"
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+	logger.Info("got bearer-secret", "header", "Bearer bearer-secret", "token", "bearer-secret")
+	if strings.Contains(buf.String(), "bearer-secret") {
+		t.Errorf("log line leaks the token: %s", buf.String())
+	}
+	if strings.Count(buf.String(), redacted) != 3 {
+		t.Errorf("log line = %s, want the message and both attributes redacted", buf.String())
+	}
+}
+
+func TestDescribeSecret(t *testing.T) {
+	if got := describeSecret(""); got != "not set" {
+		t.Errorf(`describeSecret("") = %q`, got)
+	}
+	if got := describeSecret("bearer-secret"); got != redacted {
+		t.Errorf("describeSecret shows %q", got)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"a49ca2dfeba08eb45c236b37daae97d3", true},
+		{"client-id_1.2", true},
+		{"", false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{"ünicode", false},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
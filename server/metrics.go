@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// METRICS_TOKEN is the bearer token for /metrics. It is separate from the API
+// tokens so scrapers cannot call the API. /metrics is off while it is unset.
+var METRICS_TOKEN = os.Getenv("METRICS_TOKEN")
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// durationBuckets are the upper bounds, in seconds, of the request latency
+// histogram
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounterVec("http_requests_total",
+		"HTTP requests by method, route and status code.", "method", "route", "status")
+	httpDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by method and route.", durationBuckets, "method", "route")
+	httpInFlight atomic.Int64
+	authFailures = newCounterVec("http_auth_failures_total",
+		"Requests rejected by bearer authentication, by reason.", "reason")
+)
+
+// Reasons for http_auth_failures_total
+const (
+	authMissingHeader = "missing_header"
+	authInvalidFormat = "invalid_format"
+	authInvalidToken  = "invalid_token"
+)
+
+// trackedMethods are the methods that get their own label value; others are
+// counted as OTHER so clients cannot create unbounded series
+var trackedMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// recordRequest updates the HTTP metrics for a finished request. Requests no
+// route matched share the route label "unmatched".
+func recordRequest(method, route string, status int, elapsed time.Duration) {
+	if !slices.Contains(trackedMethods, method) {
+		method = "OTHER"
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.inc(method, route, strconv.Itoa(status))
+	httpDuration.observe(elapsed.Seconds(), method, route)
+}
+
+// metricsHandler writes every metric in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if METRICS_TOKEN == "" {
+		respondWithProblem(w, r, http.StatusNotFound, codeNotFound, "Metrics are disabled; set METRICS_TOKEN to enable them")
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(METRICS_TOKEN)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		respondWithProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid metrics token")
+		return
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	out := bufio.NewWriter(w)
+	httpRequests.write(out)
+	httpDuration.write(out)
+	writeGauge(out, "http_requests_in_flight", "HTTP requests being served.", float64(httpInFlight.Load()))
+	authFailures.write(out)
+	writeDBStats(out)
+	writeCacheStats(out)
+	out.Flush()
+}
+
+// writeDBStats exposes the connection pool configured in InitDB
+func writeDBStats(out io.Writer) {
+	if db == nil {
+		return
+	}
+	stats := db.Stats()
+	writeGauge(out, "db_max_open_connections", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections))
+	writeGauge(out, "db_open_connections", "Established connections, in use and idle.", float64(stats.OpenConnections))
+	writeGauge(out, "db_in_use_connections", "Connections currently in use.", float64(stats.InUse))
+	writeGauge(out, "db_idle_connections", "Idle connections.", float64(stats.Idle))
+	writeCounter(out, "db_wait_count_total", "Connections waited for because the pool was exhausted.", float64(stats.WaitCount))
+	writeCounter(out, "db_wait_duration_seconds_total", "Time spent waiting for a connection.", stats.WaitDuration.Seconds())
+	writeCounter(out, "db_max_idle_closed_total", "Connections closed because of SetMaxIdleConns.", float64(stats.MaxIdleClosed))
+	writeCounter(out, "db_max_idle_time_closed_total", "Connections closed because of SetConnMaxIdleTime.", float64(stats.MaxIdleTimeClosed))
+	writeCounter(out, "db_max_lifetime_closed_total", "Connections closed because of SetConnMaxLifetime.", float64(stats.MaxLifetimeClosed))
+}
+
+func writeGauge(out io.Writer, name, help string, value float64) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func writeCounter(out io.Writer, name, help string, value float64) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by formatted label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	key := formatLabels(c.labels, values)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(out io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedSeries(c.values) {
+		fmt.Fprintf(out, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram // by formatted label set
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := formatLabels(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(out io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedSeries(h.series) {
+		s := h.series[key]
+		// The le label goes inside the series' braces
+		prefix := "{"
+		if key != "" {
+			prefix = strings.TrimSuffix(key, "}") + ","
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(out, "%s_bucket%sle=\"%s\"} %d\n", h.name, prefix, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(out, "%s_bucket%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// formatLabels renders a label set as {name="value",...}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedSeries[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	savedMetrics, savedValid := METRICS_TOKEN, VALID_TOKEN
+	defer func() { METRICS_TOKEN, VALID_TOKEN = savedMetrics, savedValid }()
+	VALID_TOKEN = "api"
+
+	tests := []struct {
+		name          string
+		configured    string
+		authorization string
+		status        int
+	}{
+		{name: "disabled", authorization: "Bearer anything", status: http.StatusNotFound},
+		{name: "disabled ignores an empty token", status: http.StatusNotFound},
+		{name: "missing token", configured: "scrape", status: http.StatusUnauthorized},
+		{name: "wrong token", configured: "scrape", authorization: "Bearer scrap", status: http.StatusUnauthorized},
+		{name: "API token", configured: "scrape", authorization: "Bearer api", status: http.StatusUnauthorized},
+		{name: "metrics token", configured: "scrape", authorization: "Bearer scrape", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			METRICS_TOKEN = tt.configured
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			metricsHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); (got != "") != (tt.status == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %q", got)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != metricsContentType {
+				t.Errorf("Content-Type = %q", got)
+			}
+			for _, family := range []string{"http_requests_total", "http_request_duration_seconds", "http_requests_in_flight", "cache_entries"} {
+				if !strings.Contains(w.Body.String(), "# TYPE "+family+" ") {
+					t.Errorf("no %s in\n%s", family, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.observe(v, "/users/{id}")
+	}
+	h.observe(0.2, `a"b`)
+
+	var out bytes.Buffer
+	h.write(&out)
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/users/{id}",le="0.1"} 2
+latency_seconds_bucket{route="/users/{id}",le="1"} 3
+latency_seconds_bucket{route="/users/{id}",le="+Inf"} 4
+latency_seconds_sum{route="/users/{id}"} 3.65
+latency_seconds_count{route="/users/{id}"} 4
+latency_seconds_bucket{route="a\"b",le="0.1"} 0
+latency_seconds_bucket{route="a\"b",le="1"} 1
+latency_seconds_bucket{route="a\"b",le="+Inf"} 1
+latency_seconds_sum{route="a\"b"} 0.2
+latency_seconds_count{route="a\"b"} 1
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	h := newHistogramVec("wait_seconds", "Wait.", []float64{1})
+	h.observe(2)
+
+	var out bytes.Buffer
+	h.write(&out)
+	for _, line := range []string{`wait_seconds_bucket{le="1"} 0`, `wait_seconds_bucket{le="+Inf"} 1`, "wait_seconds_count 1"} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("no %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestRecordRequestLabels(t *testing.T) {
+	tests := []struct {
+		method, route         string
+		wantMethod, wantRoute string
+	}{
+		{http.MethodGet, "/users/{id}", "GET", "/users/{id}"},
+		{"BREW", "/users/{id}", "OTHER", "/users/{id}"},
+		{http.MethodGet, "", "GET", "unmatched"},
+	}
+	for _, tt := range tests {
+		before := counterValue(httpRequests, tt.wantMethod, tt.wantRoute, "200")
+		recordRequest(tt.method, tt.route, http.StatusOK, time.Millisecond)
+		if got := counterValue(httpRequests, tt.wantMethod, tt.wantRoute, "200"); got != before+1 {
+			t.Errorf("%s %q: %s %s went from %v to %v", tt.method, tt.route, tt.wantMethod, tt.wantRoute, before, got)
+		}
+	}
+}
+
+// counterValue reads one series of a counter
+func counterValue(c *counterVec, values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[formatLabels(c.labels, values)]
+}
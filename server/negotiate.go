@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response formats, in the order the server prefers them when the client
+// accepts several equally
+const (
+	formatJSON   = "application/json"
+	formatCSV    = "text/csv"
+	formatXML    = "application/xml"
+	formatNDJSON = "application/x-ndjson"
+)
+
+var supportedFormats = []string{formatJSON, formatCSV, formatXML, formatNDJSON}
+
+// formatAliases are media types accepted as another name for a format
+var formatAliases = map[string]string{
+	"text/xml":            formatXML,
+	"application/ndjson":  formatNDJSON,
+	"application/jsonl":   formatNDJSON,
+	"application/x-jsonl": formatNDJSON,
+}
+
+// formatContextKey holds the negotiated format, set by negotiateMiddleware
+const formatContextKey contextKey = "format"
+
+// mediaRange is one element of an Accept header
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// parseAccept parses an Accept header. Malformed elements are skipped.
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if alias, ok := formatAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok || (typ == "*" && subtype != "*") {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			q = parsed
+		}
+		ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+	}
+	return ranges
+}
+
+// negotiateFormat picks the response format for an Accept header. Each
+// format takes the q-value of the most specific range that matches it, and
+// ties go to the server's preference. It returns ok == false when nothing
+// supported is acceptable.
+func negotiateFormat(accept string) (format string, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return formatJSON, true
+	}
+	ranges := parseAccept(accept)
+
+	bestQ := 0.0
+	for _, candidate := range supportedFormats {
+		typ, subtype, _ := strings.Cut(candidate, "/")
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			s := -1
+			switch {
+			case mr.typ == typ && mr.subtype == subtype:
+				s = 2
+			case mr.typ == typ && mr.subtype == "*":
+				s = 1
+			case mr.typ == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+		if q > bestQ {
+			format, bestQ = candidate, q
+		}
+	}
+	return format, format != ""
+}
+
+// negotiateMiddleware chooses the response format from Accept and responds
+// 406 when none of the supported formats is acceptable. Preflight requests
+// pass straight through.
+func negotiateMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+
+		format, ok := negotiateFormat(r.Header.Get("Accept"))
+		if !ok {
+			// Nothing acceptable was negotiated, so this problem is JSON
+			respondWithProblem(w, r, http.StatusNotAcceptable, codeNotAcceptable,
+				"Acceptable formats are "+strings.Join(supportedFormats, ", "))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), formatContextKey, format)))
+	}
+}
+
+// responseFormat returns the format negotiated for r, or JSON for routes
+// that do not negotiate
+func responseFormat(r *http.Request) string {
+	if format, ok := r.Context().Value(formatContextKey).(string); ok {
+		return format
+	}
+	return formatJSON
+}
+
+// respond writes payload in the format negotiated for the request. A
+// *Problem is sent as application/problem+json or application/problem+xml.
+func respond(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	format := responseFormat(r)
+	_, isProblem := payload.(*Problem)
+
+	body, err := encodeAs(format, r, payload)
+	if err != nil {
+		logFor(r).Error("encoding response", "method", r.Method, "path", r.URL.Path, "format", format, "error", err)
+		format, isProblem = formatJSON, true
+		code = http.StatusInternalServerError
+		problem := newAPIError(code, codeInternal, "Failed to encode response").problem(r.URL.Path)
+		problem.RequestID = requestID(r)
+		body, _ = json.Marshal(problem)
+	}
+
+	contentType := format
+	if isProblem && format == formatJSON {
+		contentType = "application/problem+json"
+	} else if isProblem && format == formatXML {
+		contentType = "application/problem+xml"
+	}
+	if format != formatNDJSON {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// encodeAs renders payload in format, in the shape of the request's API version
+func encodeAs(format string, r *http.Request, payload interface{}) ([]byte, error) {
+	transform := requestAPIVersion(r).transform
+	if format == formatJSON && transform == nil {
+		return json.Marshal(payload)
+	}
+	tree, err := toTree(payload)
+	if err != nil {
+		return nil, err
+	}
+	if transform != nil {
+		tree = transform(tree)
+	}
+	var buf bytes.Buffer
+	switch format {
+	case formatJSON:
+		return json.Marshal(tree)
+	case formatCSV:
+		err = writeCSV(&buf, tree)
+	case formatXML:
+		_, isProblem := payload.(*Problem)
+		if isProblem {
+			// RFC 7807 appendix A
+			err = writeXML(&buf, "problem", "urn:ietf:rfc:7807", tree)
+		} else {
+			err = writeXML(&buf, xmlRootName(r, payload, tree), "", tree)
+		}
+	case formatNDJSON:
+		err = writeNDJSON(&buf, tree)
+	}
+	return buf.Bytes(), err
+}
+
+// toTree converts payload to its JSON form, with objects as *record so that
+// every encoder sees fields in the same order as the JSON response
+func toTree(payload interface{}) (interface{}, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		rec := newRecord()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			rec.set(key.(string), value)
+		}
+		_, err := dec.Token()
+		return rec, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// writeNDJSON writes each element of a list on its own line, or a single
+// line for anything else
+func writeNDJSON(w io.Writer, tree interface{}) error {
+	items, ok := tree.([]interface{})
+	if !ok {
+		items = []interface{}{tree}
+	}
+	for _, item := range items {
+		line, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCSV writes a list as one row per element, or an object as a single
+// row. The header is every top-level key in first-seen order; nested objects
+// and arrays are written as JSON in their cell.
+func writeCSV(w io.Writer, tree interface{}) error {
+	items, ok := tree.([]interface{})
+	if !ok {
+		items = []interface{}{tree}
+	}
+
+	var header []string
+	seen := map[string]bool{}
+	for _, item := range items {
+		rec, ok := item.(*record)
+		if !ok {
+			rec = newRecord()
+		}
+		for _, key := range rec.keys {
+			if !seen[key] {
+				seen[key] = true
+				header = append(header, key)
+			}
+		}
+	}
+	scalarRows := len(header) == 0 && len(items) > 0
+	if scalarRows {
+		header = []string{"value"}
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, item := range items {
+		row := make([]string, len(header))
+		if rec, ok := item.(*record); ok {
+			for i, key := range header {
+				cell, err := csvCell(rec.values[key])
+				if err != nil {
+					return err
+				}
+				row[i] = cell
+			}
+		} else if scalarRows {
+			cell, err := csvCell(item)
+			if err != nil {
+				return err
+			}
+			row[0] = cell
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell renders one value. Strings that a spreadsheet would evaluate as a
+// formula are prefixed with a quote so user input cannot run as one.
+func csvCell(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			return "'" + v, nil
+		}
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// xmlRootName names the document element: the resource from the path,
+// pluralised for lists, or "response" for messages
+func xmlRootName(r *http.Request, payload, tree interface{}) string {
+	if _, ok := payload.(SuccessResponse); ok {
+		return "response"
+	}
+	resource := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+	if resource == "" {
+		resource = "response"
+	}
+	if _, isList := tree.([]interface{}); isList {
+		return resource
+	}
+	return singular(resource)
+}
+
+// singular turns a collection name into the element name of its members
+func singular(name string) string {
+	if strings.HasSuffix(name, "s") && len(name) > 1 {
+		return strings.TrimSuffix(name, "s")
+	}
+	return "item"
+}
+
+// writeXML writes tree as an XML document. Object keys become elements and
+// list members are named after the singular of their parent. A non-empty
+// namespace is declared on the root element.
+func writeXML(w io.Writer, root, namespace string, tree interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	attrs := ""
+	if namespace != "" {
+		var escaped strings.Builder
+		xml.EscapeText(&escaped, []byte(namespace))
+		attrs = ` xmlns="` + escaped.String() + `"`
+	}
+	return writeXMLElement(w, xmlName(root), attrs, tree)
+}
+
+func writeXMLElement(w io.Writer, name, attrs string, value interface{}) error {
+	if value == nil {
+		_, err := fmt.Fprintf(w, "<%s%s/>", name, attrs)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "<%s%s>", name, attrs); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case *record:
+		for _, key := range v.keys {
+			if err := writeXMLElement(w, xmlName(key), "", v.values[key]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		child := xmlName(singular(name))
+		for _, item := range v {
+			if err := writeXMLElement(w, child, "", item); err != nil {
+				return err
+			}
+		}
+	default:
+		text, err := csvCellRaw(v)
+		if err != nil {
+			return err
+		}
+		if err := xml.EscapeText(w, []byte(text)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "</%s>", name)
+	return err
+}
+
+// csvCellRaw renders a scalar without the spreadsheet formula guard
+func csvCellRaw(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return csvCell(value)
+}
+
+// xmlName makes key usable as an element name, replacing characters XML does
+// not allow
+func xmlName(key string) string {
+	var b strings.Builder
+	for i, c := range key {
+		switch {
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			b.WriteRune(c)
+		case i > 0 && (c == '-' || c == '.' || c >= '0' && c <= '9'):
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	name := b.String()
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		name = "_" + name
+	}
+	return name
+}
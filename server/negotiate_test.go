@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string // empty when nothing is acceptable
+	}{
+		{"", formatJSON},
+		{"text/csv", formatCSV},
+		{"application/xml;q=0.5, text/csv;q=0.9", formatCSV},
+		{"*/*", formatJSON},
+		{"text/*", formatCSV},
+		{"text/html, */*;q=0.1", formatJSON},
+		{"application/*;q=0.8, text/csv;q=0.8", formatJSON},
+		{"application/json;q=0, */*", formatCSV},
+		{"application/json;q=0, application/*;q=0.5", formatXML},
+		{"text/xml", formatXML},
+		{"application/jsonl", formatNDJSON},
+		{"application/ndjson, application/json;q=0.5", formatNDJSON},
+		{"image/png", ""},
+		{"*/*;q=0", ""},
+		// Malformed elements are ignored
+		{"application/json;q=2", ""},
+		{"*/json", ""},
+		{"bogus, text/csv", formatCSV},
+	}
+	for _, tt := range tests {
+		got, ok := negotiateFormat(tt.accept)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("negotiateFormat(%q) = %q, %v; want %q", tt.accept, got, ok, tt.want)
+		}
+	}
+}
+
+func TestNegotiateMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		accept string
+		status int
+		format string
+		vary   bool
+	}{
+		{name: "default", method: http.MethodGet, status: 200, format: formatJSON, vary: true},
+		{name: "csv", method: http.MethodGet, accept: "text/csv", status: 200, format: formatCSV, vary: true},
+		{name: "not acceptable", method: http.MethodGet, accept: "image/png", status: 406, vary: true},
+		{name: "preflight", method: http.MethodOptions, accept: "image/png", status: 200, format: formatJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var format string
+			handler := negotiateMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				format = responseFormat(r)
+			})
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/users", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			handler(w, r)
+
+			if w.Code != tt.status || format != tt.format {
+				t.Errorf("status %d, format %q; want %d, %q", w.Code, format, tt.status, tt.format)
+			}
+			if got := w.Header().Get("Vary") == "Accept"; got != tt.vary {
+				t.Errorf("Vary = %q", w.Header().Get("Vary"))
+			}
+			if tt.status == 406 && w.Header().Get("Content-Type") != "application/problem+json; charset=utf-8" {
+				t.Errorf("406 sent as %q, want a JSON problem", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestRespond(t *testing.T) {
+	type row struct {
+		ID   int      `json:"id"`
+		Name string   `json:"name"`
+		Tags []string `json:"tags,omitempty"`
+	}
+	rows := []row{{ID: 1, Name: "=sum", Tags: []string{"a"}}, {ID: 2, Name: "Bo & co"}}
+	problem := newAPIError(http.StatusNotFound, codeUserNotFound, "User not found").problem("/users/9")
+
+	tests := []struct {
+		name        string
+		format      string
+		payload     interface{}
+		contentType string
+		body        string
+	}{
+		{name: "json", format: formatJSON, payload: rows,
+			contentType: "application/json; charset=utf-8",
+			body:        `[{"id":1,"name":"=sum","tags":["a"]},{"id":2,"name":"Bo \u0026 co"}]`},
+		{name: "csv guards formulas", format: formatCSV, payload: rows,
+			contentType: "text/csv; charset=utf-8",
+			body:        "id,name,tags\n1,'=sum,\"[\"\"a\"\"]\"\n2,Bo & co,\n"},
+		{name: "csv object", format: formatCSV, payload: rows[1],
+			contentType: "text/csv; charset=utf-8",
+			body:        "id,name\n2,Bo & co\n"},
+		{name: "xml", format: formatXML, payload: rows,
+			contentType: "application/xml; charset=utf-8",
+			body: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<users><user><id>1</id><name>=sum</name><tags><tag>a</tag></tags></user>` +
+				`<user><id>2</id><name>Bo &amp; co</name></user></users>`},
+		{name: "xml object", format: formatXML, payload: rows[1],
+			contentType: "application/xml; charset=utf-8",
+			body:        `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<user><id>2</id><name>Bo &amp; co</name></user>`},
+		{name: "ndjson", format: formatNDJSON, payload: rows,
+			contentType: "application/x-ndjson",
+			body:        `{"id":1,"name":"=sum","tags":["a"]}` + "\n" + `{"id":2,"name":"Bo \u0026 co"}` + "\n"},
+		{name: "json problem", format: formatJSON, payload: problem,
+			contentType: "application/problem+json; charset=utf-8"},
+		{name: "xml problem", format: formatXML, payload: problem,
+			contentType: "application/problem+xml; charset=utf-8"},
+		{name: "csv problem", format: formatCSV, payload: problem,
+			contentType: "text/csv; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/users", nil)
+			r = r.WithContext(context.WithValue(r.Context(), formatContextKey, tt.format))
+			respond(w, r, http.StatusOK, tt.payload)
+
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body =\n%s\nwant\n%s", w.Body, tt.body)
+			}
+			if tt.name == "xml problem" && !strings.Contains(w.Body.String(), `<problem xmlns="urn:ietf:rfc:7807">`) {
+				t.Errorf("problem is not in the RFC 7807 namespace: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, ""},
+		{"plain", "plain"},
+		{"", ""},
+		{"=1+1", "'=1+1"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tx", "'\tx"},
+		{"a=b", "a=b"},
+		{true, "true"},
+		{[]interface{}{"a", 1}, `["a",1]`},
+	}
+	for _, tt := range tests {
+		got, err := csvCell(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("csvCell(%#v) = %q, %v; want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestXMLName(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"name", "name"},
+		{"created_at", "created_at"},
+		{"user-id.2", "user-id.2"},
+		{"2fa", "_fa"},
+		{"a b", "a_b"},
+		{"", "_"},
+		{"xmlThing", "_xmlThing"},
+		{"XMLish", "_XMLish"},
+	}
+	for _, tt := range tests {
+		if got := xmlName(tt.key); got != tt.want {
+			t.Errorf("xmlName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// jsonSchema is the subset of JSON Schema 2020-12 that the OpenAPI document
+// uses and validateRequests understands
+type jsonSchema struct {
+	Ref         string                 `json:"$ref,omitempty"`
+	Type        interface{}            `json:"type,omitempty"` // a string, or []string when nullable
+	Format      string                 `json:"format,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	// AdditionalProperties describes the values of a map
+	AdditionalProperties *jsonSchema `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema `json:"items,omitempty"`
+	Enum                 []string    `json:"enum,omitempty"`
+	MinLength            *int        `json:"minLength,omitempty"`
+	Minimum              *float64    `json:"minimum,omitempty"`
+	Maximum              *float64    `json:"maximum,omitempty"`
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaBuilder turns Go types into schemas, collecting named structs as
+// components
+type schemaBuilder struct {
+	components map[string]*jsonSchema
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{components: map[string]*jsonSchema{}}
+}
+
+// schemaFor returns the schema of values of type t as encoding/json writes
+// them. Request types get minLength 1 on required strings, matching their
+// validate methods.
+func (b *schemaBuilder) schemaFor(t reflect.Type, request bool) *jsonSchema {
+	switch t {
+	case timeType:
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &jsonSchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schemaFor(t.Elem(), request)
+		if typ, ok := s.Type.(string); ok {
+			s.Type = []string{typ, "null"}
+		}
+		return s
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: b.schemaFor(t.Elem(), request)}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: b.schemaFor(t.Elem(), request)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t, request)
+		}
+		name := componentName(t)
+		if _, done := b.components[name]; !done {
+			// Reserve the name first so recursive types terminate
+			b.components[name] = &jsonSchema{}
+			*b.components[name] = *b.structSchema(t, request)
+		}
+		return &jsonSchema{Ref: "#/components/schemas/" + name}
+	}
+	// interface{} and anything else accept any JSON value
+	return &jsonSchema{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type, request bool) *jsonSchema {
+	s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}}
+	b.addFields(s, t, request)
+	return s
+}
+
+// addFields adds the JSON fields of struct t to s, flattening embedded
+// structs the way encoding/json does
+func (b *schemaBuilder) addFields(s *jsonSchema, t reflect.Type, request bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(s, field.Type, request)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		prop := b.schemaFor(field.Type, request)
+		if enum := field.Tag.Get("enum"); enum != "" {
+			prop.Enum = strings.Split(enum, ",")
+		}
+		required := !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr
+		if required {
+			s.Required = append(s.Required, name)
+			if request && prop.Type == "string" {
+				one := 1
+				prop.MinLength = &one
+			}
+		}
+		s.Properties[name] = prop
+	}
+}
+
+// componentName is the schema name of a named type, capitalised so that
+// unexported types read like the rest
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// openAPIDocument is built from the route table by registerRoutes
+var openAPIDocument []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// buildOpenAPI describes the routes as an OpenAPI 3.1 document
+func buildOpenAPI(routes []route) ([]byte, error) {
+	b := newSchemaBuilder()
+	problem := b.schemaFor(reflect.TypeOf(Problem{}), false)
+
+	paths := map[string]map[string]interface{}{}
+	for _, rt := range routes {
+		op := map[string]interface{}{
+			"operationId": operationID(rt),
+			"summary":     rt.summary,
+			"tags":        []string{rt.tag},
+		}
+		if rt.auth {
+			op["security"] = []map[string][]string{{"bearerAuth": {}}}
+		}
+
+		var params []map[string]interface{}
+		for _, p := range rt.params {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          p.in,
+				"required":    p.required,
+				"description": p.description,
+				"schema":      p.schema(),
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if rt.request != nil {
+			body := b.schemaFor(reflect.TypeOf(rt.request), true)
+			content := map[string]interface{}{}
+			if rt.method == http.MethodPatch {
+				content[mediaTypeMergePatch] = map[string]interface{}{"schema": body}
+				content[mediaTypeJSONPatch] = map[string]interface{}{
+					"schema": b.schemaFor(reflect.TypeOf([]patchOperation{}), true),
+				}
+			} else {
+				content[mediaTypeJSON] = map[string]interface{}{"schema": body}
+			}
+			op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(rt.status)}
+		if rt.response != nil {
+			schema := b.schemaFor(reflect.TypeOf(rt.response), false)
+			mediaType := formatJSON
+			if rt.mediaType != "" {
+				mediaType = rt.mediaType
+			}
+			content := map[string]interface{}{mediaType: map[string]interface{}{"schema": schema}}
+			if rt.negotiate {
+				content[formatXML] = map[string]interface{}{"schema": schema}
+				content[formatCSV] = map[string]interface{}{"schema": &jsonSchema{Type: "string"}}
+				content[formatNDJSON] = map[string]interface{}{"schema": &jsonSchema{Type: "string"}}
+			}
+			success["content"] = content
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(rt.status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/problem+json": map[string]interface{}{"schema": problem},
+				},
+			},
+		}
+
+		if paths[rt.pattern] == nil {
+			paths[rt.pattern] = map[string]interface{}{}
+		}
+		paths[rt.pattern][strings.ToLower(rt.method)] = op
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "Go REST API Lab",
+			"version": latestAPIVersion().name,
+			"description": "Every path is also served under /v1 and /v2. " +
+				"Schemas describe version 1; version 2 replaces a post's userId with an author object, " +
+				"and also accepts one in request bodies.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func (p param) schema() *jsonSchema {
+	return &jsonSchema{Type: p.kind, Minimum: p.minimum, Maximum: p.maximum}
+}
+
+// operationID names an operation after its method and path, e.g.
+// getUsersById or postUsersByIdRestore
+func operationID(rt route) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(rt.method))
+	for _, segment := range strings.Split(rt.pattern, "/") {
+		if segment == "" {
+			continue
+		}
+		if strings.HasPrefix(segment, "{") {
+			segment = "by_" + strings.Trim(segment, "{}")
+		}
+		for _, word := range strings.FieldsFunc(segment, func(c rune) bool { return c == '_' || c == '.' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch document media types accepted by PATCH handlers
+const (
+	mediaTypeJSON       = "application/json"
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+var (
+	// errUnsupportedPatchType means the Content-Type is not a patch format we understand
+	errUnsupportedPatchType = errors.New("unsupported patch media type")
+	// errPatchTestFailed means a JSON Patch "test" operation did not match
+	errPatchTestFailed = errors.New("patch test operation failed")
+)
+
+// patchError reports a patch that is well formed but cannot be applied to the
+// resource, e.g. a path that does not exist or a change to a read-only field.
+// err is set when the patched document fails validation.
+type patchError struct {
+	msg string
+	err error
+}
+
+func (e *patchError) Error() string { return e.msg }
+
+func (e *patchError) Unwrap() error { return e.err }
+
+// invalidPatchError reports a malformed patch document
+type invalidPatchError struct {
+	msg string
+}
+
+func (e *invalidPatchError) Error() string { return e.msg }
+
+// patchOperation is a single RFC 6902 operation. Value is empty when the
+// member is missing; a null value is kept as the literal null, which a
+// pointer would lose.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// patchMediaType returns the patch format named by a Content-Type header.
+// Plain JSON is treated as a merge patch, which is what PATCH accepted before.
+func patchMediaType(contentType string) (string, error) {
+	if contentType == "" {
+		return mediaTypeMergePatch, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errUnsupportedPatchType
+	}
+	switch mediaType {
+	case mediaTypeJSON, mediaTypeMergePatch:
+		return mediaTypeMergePatch, nil
+	case mediaTypeJSONPatch:
+		return mediaTypeJSONPatch, nil
+	}
+	return "", errUnsupportedPatchType
+}
+
+// applyPatch applies patch to the JSON representation of current and decodes
+// the result into patched. Fields named in readOnly must come out unchanged.
+func applyPatch(mediaType string, patch []byte, current, patched interface{}, readOnly ...string) error {
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSONValue(raw)
+	if err != nil {
+		return err
+	}
+	original, _ := deepCopy(doc).(map[string]interface{})
+
+	switch mediaType {
+	case mediaTypeMergePatch:
+		value, err := decodeJSONValue(patch)
+		if err != nil {
+			return &invalidPatchError{msg: "Invalid merge patch document"}
+		}
+		doc = mergePatch(doc, value)
+	case mediaTypeJSONPatch:
+		var ops []patchOperation
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return &invalidPatchError{msg: "Invalid JSON Patch document: expected an array of operations"}
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			return err
+		}
+	default:
+		return errUnsupportedPatchType
+	}
+
+	result, ok := doc.(map[string]interface{})
+	if !ok {
+		return &patchError{msg: "Patched document must be a JSON object"}
+	}
+	for _, field := range readOnly {
+		if !jsonEqual(original[field], result[field]) {
+			return &patchError{msg: fmt.Sprintf("Field %q is read-only", field)}
+		}
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(patched); err != nil {
+		return &patchError{msg: "Patched document is invalid: " + strings.TrimPrefix(err.Error(), "json: ")}
+	}
+	return nil
+}
+
+// mergePatch implements the MergePatch algorithm from RFC 7396
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergePatch(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
+
+// applyJSONPatch applies RFC 6902 operations in order. The first failing
+// operation aborts the whole patch.
+func applyJSONPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			if errors.Is(err, errPatchTestFailed) {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+			var invalid *invalidPatchError
+			if errors.As(err, &invalid) {
+				return nil, &invalidPatchError{msg: fmt.Sprintf("Operation %d: %s", i, invalid.msg)}
+			}
+			return nil, &patchError{msg: fmt.Sprintf("Operation %d (%s): %s", i, op.Op, err.Error())}
+		}
+	}
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	if op.Path == nil {
+		return nil, &invalidPatchError{msg: `missing "path"`}
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, &invalidPatchError{msg: err.Error()}
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, &invalidPatchError{msg: fmt.Sprintf(`%q requires "value"`, op.Op)}
+		}
+		value, err := decodeJSONValue(op.Value)
+		if err != nil {
+			return nil, &invalidPatchError{msg: "invalid value"}
+		}
+		switch op.Op {
+		case "add":
+			return addValue(doc, path, value)
+		case "replace":
+			if _, err := getValue(doc, path); err != nil {
+				return nil, err
+			}
+			if doc, err = removeValue(doc, path); err != nil {
+				return nil, err
+			}
+			return addValue(doc, path, value)
+		default:
+			current, err := getValue(doc, path)
+			if err != nil || !jsonEqual(current, value) {
+				return nil, fmt.Errorf("%w: value at %q does not match", errPatchTestFailed, *op.Path)
+			}
+			return doc, nil
+		}
+	case "remove":
+		return removeValue(doc, path)
+	case "move", "copy":
+		if op.From == nil {
+			return nil, &invalidPatchError{msg: fmt.Sprintf(`%q requires "from"`, op.Op)}
+		}
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, &invalidPatchError{msg: err.Error()}
+		}
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+				return nil, errors.New("cannot move a value into one of its children")
+			}
+			if doc, err = removeValue(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			value = deepCopy(value)
+		}
+		return addValue(doc, path, value)
+	}
+	return nil, &invalidPatchError{msg: fmt.Sprintf("unknown op %q", op.Op)}
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON Pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func getValue(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			node = child
+		case []interface{}:
+			idx, err := arrayIndex(token, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = n[idx]
+		default:
+			return nil, fmt.Errorf("cannot traverse into a scalar at %q", token)
+		}
+	}
+	return node, nil
+}
+
+// addValue sets value at path and returns the (possibly new) root
+func addValue(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, rest := path[0], path[1:]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, fmt.Errorf("path member %q does not exist", token)
+		}
+		updated, err := addValue(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		n[token] = updated
+		return n, nil
+	case []interface{}:
+		if len(rest) == 0 {
+			if token == "-" {
+				return append(n, value), nil
+			}
+			idx, err := arrayIndex(token, len(n))
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[idx+1:], n[idx:])
+			n[idx] = value
+			return n, nil
+		}
+		idx, err := arrayIndex(token, len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := addValue(n[idx], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		n[idx] = updated
+		return n, nil
+	}
+	return nil, fmt.Errorf("cannot traverse into a scalar at %q", token)
+}
+
+// removeValue deletes the value at path and returns the (possibly new) root
+func removeValue(node interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	token, rest := path[0], path[1:]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if !ok {
+			return nil, fmt.Errorf("path member %q does not exist", token)
+		}
+		if len(rest) == 0 {
+			delete(n, token)
+			return n, nil
+		}
+		updated, err := removeValue(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		n[token] = updated
+		return n, nil
+	case []interface{}:
+		idx, err := arrayIndex(token, len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return append(n[:idx], n[idx+1:]...), nil
+		}
+		updated, err := removeValue(n[idx], rest)
+		if err != nil {
+			return nil, err
+		}
+		n[idx] = updated
+		return n, nil
+	}
+	return nil, fmt.Errorf("cannot traverse into a scalar at %q", token)
+}
+
+// arrayIndex parses an array reference token no greater than max
+func arrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || idx > max {
+		return 0, fmt.Errorf("array index %q out of range", token)
+	}
+	return idx, nil
+}
+
+// decodeJSONValue decodes data keeping numbers as json.Number so integers
+// survive the round trip unchanged
+func decodeJSONValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			out[k] = deepCopy(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, child := range v {
+			out[i] = deepCopy(child)
+		}
+		return out
+	}
+	return value
+}
+
+// jsonEqual compares decoded JSON values, treating numbers by numeric value
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, errA := av.Float64()
+		bf, errB := bv.Float64()
+		return errA == nil && errB == nil && af == bf
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			other, ok := bv[k]
+			if !ok || !jsonEqual(v, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
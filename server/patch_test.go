@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func mustDecodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	value, err := decodeJSONValue([]byte(s))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", s, err)
+	}
+	return value
+}
+
+// The examples of RFC 7396 Appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got := mergePatch(mustDecodeJSON(t, tt.target), mustDecodeJSON(t, tt.patch))
+		if want := mustDecodeJSON(t, tt.want); !jsonEqual(got, want) {
+			t.Errorf("merge %s into %s = %v, want %s", tt.patch, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    []string
+		wantErr bool
+	}{
+		{pointer: "", want: []string{}},
+		{pointer: "/", want: []string{""}},
+		{pointer: "/a/0", want: []string{"a", "0"}},
+		{pointer: "/a~1b", want: []string{"a/b"}},
+		{pointer: "/m~0n", want: []string{"m~n"}},
+		// ~1 is unescaped first, so ~01 is the two characters ~1
+		{pointer: "/~01", want: []string{"~1"}},
+		{pointer: "/~10", want: []string{"/0"}},
+		{pointer: "a", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePointer(tt.pointer)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePointer(%q) error = %v, want error %v", tt.pointer, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePointer(%q) = %q, want %q", tt.pointer, got, tt.want)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	const doc = `{"name":"Ann","tags":["a","b"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1}}`
+
+	// Kinds of failure
+	const (
+		ok = iota
+		testFailed
+		invalid
+		unapplicable
+	)
+	tests := []struct {
+		name  string
+		patch string
+		want  string // the document after the patch, when it applies
+		fails int
+	}{
+		{name: "replace", patch: `[{"op":"replace","path":"/name","value":"Bo"}]`,
+			want: `{"name":"Bo","tags":["a","b"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1}}`},
+		{name: "add to object", patch: `[{"op":"add","path":"/nested/y","value":[1]}]`,
+			want: `{"name":"Ann","tags":["a","b"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1,"y":[1]}}`},
+		{name: "add inside array", patch: `[{"op":"add","path":"/tags/1","value":"z"}]`,
+			want: `{"name":"Ann","tags":["a","z","b"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1}}`},
+		{name: "append to array", patch: `[{"op":"add","path":"/tags/-","value":"z"}]`,
+			want: `{"name":"Ann","tags":["a","b","z"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1}}`},
+		{name: "remove", patch: `[{"op":"remove","path":"/tags/0"}]`,
+			want: `{"name":"Ann","tags":["b"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1}}`},
+		{name: "escaped slash", patch: `[{"op":"replace","path":"/a~1b","value":10}]`,
+			want: `{"name":"Ann","tags":["a","b"],"a/b":10,"m~n":2,"~1":3,"nested":{"x":1}}`},
+		{name: "escaped tilde", patch: `[{"op":"remove","path":"/m~0n"}]`,
+			want: `{"name":"Ann","tags":["a","b"],"a/b":1,"~1":3,"nested":{"x":1}}`},
+		{name: "escaped tilde before 1", patch: `[{"op":"test","path":"/~01","value":3},{"op":"remove","path":"/~01"}]`,
+			want: `{"name":"Ann","tags":["a","b"],"a/b":1,"m~n":2,"nested":{"x":1}}`},
+		{name: "move", patch: `[{"op":"move","from":"/nested/x","path":"/x"}]`,
+			want: `{"name":"Ann","tags":["a","b"],"a/b":1,"m~n":2,"~1":3,"nested":{},"x":1}`},
+		{name: "copy", patch: `[{"op":"copy","from":"/tags","path":"/copy"}]`,
+			want: `{"name":"Ann","tags":["a","b"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1},"copy":["a","b"]}`},
+		{name: "test passes", patch: `[{"op":"test","path":"/nested","value":{"x":1}},{"op":"replace","path":"/name","value":"Bo"}]`,
+			want: `{"name":"Bo","tags":["a","b"],"a/b":1,"m~n":2,"~1":3,"nested":{"x":1}}`},
+		{name: "test compares numbers by value", patch: `[{"op":"test","path":"/a~1b","value":1.0}]`,
+			want: doc},
+		{name: "test fails", patch: `[{"op":"replace","path":"/name","value":"Bo"},{"op":"test","path":"/name","value":"Ann"}]`,
+			fails: testFailed},
+		{name: "test of a missing path fails", patch: `[{"op":"test","path":"/missing","value":null}]`,
+			fails: testFailed},
+		{name: "unescaped slash is a path", patch: `[{"op":"replace","path":"/a/b","value":1}]`,
+			fails: unapplicable},
+		{name: "replace missing", patch: `[{"op":"replace","path":"/missing","value":1}]`,
+			fails: unapplicable},
+		{name: "index out of range", patch: `[{"op":"add","path":"/tags/5","value":"z"}]`,
+			fails: unapplicable},
+		{name: "move into own child", patch: `[{"op":"move","from":"/nested","path":"/nested/inner"}]`,
+			fails: unapplicable},
+		{name: "unknown op", patch: `[{"op":"frobnicate","path":"/name"}]`,
+			fails: invalid},
+		{name: "missing value", patch: `[{"op":"add","path":"/name"}]`,
+			fails: invalid},
+		{name: "missing path", patch: `[{"op":"remove"}]`,
+			fails: invalid},
+		{name: "pointer without slash", patch: `[{"op":"remove","path":"name"}]`,
+			fails: invalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []patchOperation
+			if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyJSONPatch(mustDecodeJSON(t, doc), ops)
+
+			var (
+				invalidErr *invalidPatchError
+				patchErr   *patchError
+			)
+			switch tt.fails {
+			case ok:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if want := mustDecodeJSON(t, tt.want); !jsonEqual(got, want) {
+					t.Errorf("got %v, want %s", got, tt.want)
+				}
+			case testFailed:
+				if !errors.Is(err, errPatchTestFailed) {
+					t.Errorf("error = %v, want a failed test", err)
+				}
+			case invalid:
+				if !errors.As(err, &invalidErr) {
+					t.Errorf("error = %v, want an invalid patch", err)
+				}
+			case unapplicable:
+				if !errors.As(err, &patchErr) {
+					t.Errorf("error = %v, want a patch that does not apply", err)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	type resource struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	current := resource{ID: 1, Name: "Ann"}
+
+	tests := []struct {
+		name        string
+		contentType string
+		patch       string
+		want        resource
+		wantErr     bool
+	}{
+		{name: "merge patch", contentType: "application/merge-patch+json", patch: `{"name":"Bo"}`,
+			want: resource{ID: 1, Name: "Bo"}},
+		{name: "plain JSON is a merge patch", contentType: "application/json; charset=utf-8", patch: `{"name":"Bo"}`,
+			want: resource{ID: 1, Name: "Bo"}},
+		{name: "JSON patch", contentType: "application/json-patch+json", patch: `[{"op":"replace","path":"/name","value":"Bo"}]`,
+			want: resource{ID: 1, Name: "Bo"}},
+		{name: "read-only field", contentType: "application/merge-patch+json", patch: `{"id":2}`, wantErr: true},
+		{name: "read-only field unchanged", contentType: "application/merge-patch+json", patch: `{"id":1,"name":"Bo"}`,
+			want: resource{ID: 1, Name: "Bo"}},
+		{name: "unknown field", contentType: "application/json-patch+json", patch: `[{"op":"add","path":"/color","value":"red"}]`, wantErr: true},
+		{name: "wrong type", contentType: "application/merge-patch+json", patch: `{"name":5}`, wantErr: true},
+		{name: "not an object", contentType: "application/merge-patch+json", patch: `[]`, wantErr: true},
+		{name: "JSON patch that is not an array", contentType: "application/json-patch+json", patch: `{}`, wantErr: true},
+		{name: "unsupported type", contentType: "text/plain", patch: `{}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mediaType, err := patchMediaType(tt.contentType)
+			var got resource
+			if err == nil {
+				err = applyPatch(mediaType, []byte(tt.patch), current, &got, "id")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
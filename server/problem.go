@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// Error codes are stable identifiers clients can switch on. Each one is also
+// the last segment of the problem's type URI.
+const (
+	codeBadRequest              = "bad_request"
+	codeInvalidBody             = "invalid_body"
+	codeInvalidQuery            = "invalid_query"
+	codeValidationFailed        = "validation_failed"
+	codeInvalidPatch            = "invalid_patch"
+	codePatchNotApplicable      = "patch_not_applicable"
+	codePatchTestFailed         = "patch_test_failed"
+	codeUnauthorized            = "unauthorized"
+	codeForbidden               = "forbidden"
+	codeCORSRejected            = "cors_rejected"
+	codeMethodNotAllowed        = "method_not_allowed"
+	codeNotAcceptable           = "not_acceptable"
+	codeUnsupportedMediaType    = "unsupported_media_type"
+	codePayloadTooLarge         = "payload_too_large"
+	codeNotFound                = "not_found"
+	codeUserNotFound            = "user_not_found"
+	codePostNotFound            = "post_not_found"
+	codeAuthorNotFound          = "author_not_found"
+	codeAuthorDeleted           = "author_deleted"
+	codeDuplicateEmail          = "duplicate_email"
+	codeDuplicateUsername       = "duplicate_username"
+	codeConflict                = "conflict"
+	codeUserNotDeleted          = "user_not_deleted"
+	codePostNotDeleted          = "post_not_deleted"
+	codePreconditionFailed      = "precondition_failed"
+	codePreconditionRequired    = "precondition_required"
+	codeNotExecuted             = "not_executed"
+	codeInvalidIdempotencyKey   = "invalid_idempotency_key"
+	codeIdempotencyKeyReused    = "idempotency_key_reused"
+	codeIdempotencyInProgress   = "idempotency_in_progress"
+	codeUnsupportedVersion      = "unsupported_version"
+	codeGraphQLParseFailed      = "graphql_parse_failed"
+	codeGraphQLValidationFailed = "graphql_validation_failed"
+	codeQueryTooDeep            = "query_too_deep"
+	codeQueryTooComplex         = "query_too_complex"
+	codeWebhookNotFound         = "webhook_not_found"
+	codeDeliveryNotFound        = "delivery_not_found"
+	codeInternal                = "internal_error"
+)
+
+// problemTitles is the fixed, human-readable summary of each code
+var problemTitles = map[string]string{
+	codeBadRequest:              "Bad request",
+	codeInvalidBody:             "Malformed request body",
+	codeInvalidQuery:            "Invalid query parameter",
+	codeValidationFailed:        "Validation failed",
+	codeInvalidPatch:            "Malformed patch document",
+	codePatchNotApplicable:      "Patch cannot be applied",
+	codePatchTestFailed:         "Patch test failed",
+	codeUnauthorized:            "Unauthorized",
+	codeForbidden:               "Forbidden",
+	codeCORSRejected:            "Cross-origin request rejected",
+	codeMethodNotAllowed:        "Method not allowed",
+	codeNotAcceptable:           "Not acceptable",
+	codeUnsupportedMediaType:    "Unsupported media type",
+	codePayloadTooLarge:         "Payload too large",
+	codeNotFound:                "Not found",
+	codeUserNotFound:            "User not found",
+	codePostNotFound:            "Post not found",
+	codeAuthorNotFound:          "Author does not exist",
+	codeAuthorDeleted:           "Author is deleted",
+	codeDuplicateEmail:          "Email already in use",
+	codeDuplicateUsername:       "Username already in use",
+	codeConflict:                "Conflict",
+	codeUserNotDeleted:          "User is not deleted",
+	codePostNotDeleted:          "Post is not deleted",
+	codePreconditionFailed:      "Precondition failed",
+	codePreconditionRequired:    "Precondition required",
+	codeNotExecuted:             "Operation not executed",
+	codeInvalidIdempotencyKey:   "Invalid Idempotency-Key",
+	codeIdempotencyKeyReused:    "Idempotency-Key reused",
+	codeIdempotencyInProgress:   "Request in progress",
+	codeUnsupportedVersion:      "Unsupported API version",
+	codeGraphQLParseFailed:      "GraphQL syntax error",
+	codeGraphQLValidationFailed: "GraphQL query is invalid",
+	codeQueryTooDeep:            "GraphQL query too deep",
+	codeQueryTooComplex:         "GraphQL query too complex",
+	codeWebhookNotFound:         "Webhook not found",
+	codeDeliveryNotFound:        "Delivery not found",
+	codeInternal:                "Internal server error",
+}
+
+// problemTypeBase prefixes the code to form a problem's type URI
+const problemTypeBase = "/problems/"
+
+// Problem is an RFC 7807 problem details body, extended with the error code
+// and, for validation failures, the offending fields
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	// RequestID matches the X-Request-ID header and the server's log lines
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// FieldError is one invalid field in a request body. Offset is the byte
+// position in the body for errors found while decoding it.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Offset  int64  `json:"offset,omitempty"`
+}
+
+// apiError is an error that knows the status and code it is reported with
+type apiError struct {
+	status int
+	code   string
+	detail string
+	fields []FieldError
+}
+
+func (e *apiError) Error() string { return e.detail }
+
+func newAPIError(status int, code, detail string) *apiError {
+	return &apiError{status: status, code: code, detail: detail}
+}
+
+// problem renders e for the request at instance
+func (e *apiError) problem(instance string) *Problem {
+	return &Problem{
+		Type:     problemTypeBase + e.code,
+		Title:    problemTitles[e.code],
+		Status:   e.status,
+		Detail:   e.detail,
+		Instance: instance,
+		Code:     e.code,
+		Errors:   e.fields,
+	}
+}
+
+// Unique constraints whose violations get their own error code
+var duplicateCodes = map[string]*apiError{
+	"users_email_key":    {status: http.StatusConflict, code: codeDuplicateEmail, detail: "A user with this email already exists"},
+	"users_username_key": {status: http.StatusConflict, code: codeDuplicateUsername, detail: "A user with this username already exists"},
+}
+
+// classifyError maps an error from validation, patching or the database to
+// the apiError it is reported as. Errors it does not recognise become a 500.
+func classifyError(err error) *apiError {
+	var (
+		known         *apiError
+		invalid       *validationError
+		invalidPatch  *invalidPatchError
+		unprocessable *patchError
+		tooLarge      *http.MaxBytesError
+		pqErr         *pq.Error
+	)
+	switch {
+	case errors.As(err, &known):
+		return known
+	case errors.As(err, &unprocessable):
+		// A patch whose result fails validation reports the fields
+		if errors.As(unprocessable.err, &invalid) {
+			return &apiError{status: http.StatusUnprocessableEntity, code: codeValidationFailed, detail: invalid.msg, fields: invalid.fields}
+		}
+		return newAPIError(http.StatusUnprocessableEntity, codePatchNotApplicable, unprocessable.msg)
+	case errors.As(err, &invalid):
+		return &apiError{status: http.StatusBadRequest, code: codeValidationFailed, detail: invalid.msg, fields: invalid.fields}
+	case errors.As(err, &tooLarge):
+		return newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit))
+	case errors.As(err, &invalidPatch):
+		return newAPIError(http.StatusBadRequest, codeInvalidPatch, invalidPatch.msg)
+	case errors.Is(err, errPatchTestFailed):
+		return newAPIError(http.StatusConflict, codePatchTestFailed, err.Error())
+	case errors.Is(err, errPreconditionFailed):
+		return newAPIError(http.StatusPreconditionFailed, codePreconditionFailed, "The resource was modified since it was read")
+	case errors.Is(err, errUserNotFound):
+		return newAPIError(http.StatusNotFound, codeUserNotFound, "User not found")
+	case errors.Is(err, errPostNotFound):
+		return newAPIError(http.StatusNotFound, codePostNotFound, "Post not found")
+	case errors.Is(err, errAuthorNotFound):
+		return newAPIError(http.StatusUnprocessableEntity, codeAuthorNotFound, "User does not exist")
+	case errors.Is(err, errAuthorDeleted):
+		return newAPIError(http.StatusConflict, codeAuthorDeleted, "Restore the post's author first")
+	case errors.Is(err, errUserNotDeleted):
+		return newAPIError(http.StatusConflict, codeUserNotDeleted, "User is not deleted")
+	case errors.Is(err, errPostNotDeleted):
+		return newAPIError(http.StatusConflict, codePostNotDeleted, "Post is not deleted")
+	case errors.Is(err, errWebhookNotFound):
+		return newAPIError(http.StatusNotFound, codeWebhookNotFound, "Webhook not found")
+	case errors.Is(err, errDeliveryNotFound):
+		return newAPIError(http.StatusNotFound, codeDeliveryNotFound, "Delivery not found")
+	case errors.Is(err, sql.ErrNoRows):
+		// A lookup the storage layer did not name a resource for
+		return newAPIError(http.StatusNotFound, codeNotFound, "Resource not found")
+	case errors.As(err, &pqErr):
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			if dup, ok := duplicateCodes[pqErr.Constraint]; ok {
+				return dup
+			}
+			return newAPIError(http.StatusConflict, codeConflict, "The request conflicts with an existing resource")
+		case "foreign_key_violation":
+			return newAPIError(http.StatusUnprocessableEntity, codeAuthorNotFound, "User does not exist")
+		}
+	}
+	return newAPIError(http.StatusInternalServerError, codeInternal, "An unexpected error occurred")
+}
+
+// respondWithError writes err as a problem in the format negotiated for the
+// request. Unexpected errors are logged and reported without their message.
+func respondWithError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := classifyError(err)
+	if apiErr.status == http.StatusInternalServerError {
+		logFor(r).Error("request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+	problem := apiErr.problem(r.URL.Path)
+	problem.RequestID = requestID(r)
+	respond(w, r, apiErr.status, problem)
+}
+
+// respondWithProblem writes a problem that does not come from an error value
+func respondWithProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	respondWithError(w, r, newAPIError(status, code, detail))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestClassifyError(t *testing.T) {
+	invalid := &validationError{msg: "Invalid user", fields: []FieldError{{Field: "email", Code: "required"}}}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		fields int
+	}{
+		{"apiError", newAPIError(http.StatusTeapot, codeBadRequest, "short and stout"), http.StatusTeapot, codeBadRequest, 0},
+		{"wrapped apiError", fmt.Errorf("decoding: %w", newAPIError(http.StatusBadRequest, codeInvalidBody, "x")), http.StatusBadRequest, codeInvalidBody, 0},
+		{"validation", invalid, http.StatusBadRequest, codeValidationFailed, 1},
+		{"patch result fails validation", &patchError{msg: "invalid", err: invalid}, http.StatusUnprocessableEntity, codeValidationFailed, 1},
+		{"patch not applicable", &patchError{msg: "no such path"}, http.StatusUnprocessableEntity, codePatchNotApplicable, 0},
+		{"malformed patch", &invalidPatchError{msg: "op is required"}, http.StatusBadRequest, codeInvalidPatch, 0},
+		{"patch test failed", errPatchTestFailed, http.StatusConflict, codePatchTestFailed, 0},
+		{"body too large", &http.MaxBytesError{Limit: 1024}, http.StatusRequestEntityTooLarge, codePayloadTooLarge, 0},
+		{"wrapped body too large", fmt.Errorf("reading: %w", &http.MaxBytesError{Limit: 1024}), http.StatusRequestEntityTooLarge, codePayloadTooLarge, 0},
+		{"precondition", errPreconditionFailed, http.StatusPreconditionFailed, codePreconditionFailed, 0},
+		{"user not found", errUserNotFound, http.StatusNotFound, codeUserNotFound, 0},
+		{"post not found", fmt.Errorf("update: %w", errPostNotFound), http.StatusNotFound, codePostNotFound, 0},
+		{"author not found", errAuthorNotFound, http.StatusUnprocessableEntity, codeAuthorNotFound, 0},
+		{"author deleted", errAuthorDeleted, http.StatusConflict, codeAuthorDeleted, 0},
+		{"user not deleted", errUserNotDeleted, http.StatusConflict, codeUserNotDeleted, 0},
+		{"post not deleted", errPostNotDeleted, http.StatusConflict, codePostNotDeleted, 0},
+		{"webhook not found", errWebhookNotFound, http.StatusNotFound, codeWebhookNotFound, 0},
+		{"delivery not found", errDeliveryNotFound, http.StatusNotFound, codeDeliveryNotFound, 0},
+		{"no rows", sql.ErrNoRows, http.StatusNotFound, codeNotFound, 0},
+		{"wrapped no rows", fmt.Errorf("get: %w", sql.ErrNoRows), http.StatusNotFound, codeNotFound, 0},
+		{"duplicate email", &pq.Error{Code: "23505", Constraint: "users_email_key"}, http.StatusConflict, codeDuplicateEmail, 0},
+		{"duplicate username", &pq.Error{Code: "23505", Constraint: "users_username_key"}, http.StatusConflict, codeDuplicateUsername, 0},
+		{"other unique violation", &pq.Error{Code: "23505", Constraint: "idempotency_keys_pkey"}, http.StatusConflict, codeConflict, 0},
+		{"foreign key violation", &pq.Error{Code: "23503", Constraint: "posts_user_id_fkey"}, http.StatusUnprocessableEntity, codeAuthorNotFound, 0},
+		{"other database error", &pq.Error{Code: "57014"}, http.StatusInternalServerError, codeInternal, 0},
+		{"unknown error", errors.New("disk on fire"), http.StatusInternalServerError, codeInternal, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyError(tt.err)
+			if got.status != tt.status || got.code != tt.code || len(got.fields) != tt.fields {
+				t.Errorf("classifyError = %d %s with %d fields, want %d %s with %d",
+					got.status, got.code, len(got.fields), tt.status, tt.code, tt.fields)
+			}
+			if problemTitles[got.code] == "" {
+				t.Errorf("code %s has no title", got.code)
+			}
+		})
+	}
+}
+
+func TestRespondWithError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		detail string
+	}{
+		{"known error", errUserNotFound, http.StatusNotFound, "User not found"},
+		{"unexpected error hides its message", errors.New("pq: password authentication failed for user admin"),
+			http.StatusInternalServerError, "An unexpected error occurred"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/users/9", nil)
+			respondWithError(w, r, tt.err)
+
+			if w.Code != tt.status || w.Header().Get("Content-Type") != "application/problem+json; charset=utf-8" {
+				t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+			}
+			if strings.Contains(w.Body.String(), "password") {
+				t.Errorf("error message leaked: %s", w.Body)
+			}
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			code := classifyError(tt.err).code
+			if problem.Status != tt.status || problem.Code != code || problem.Type != problemTypeBase+code ||
+				problem.Title != problemTitles[code] || problem.Detail != tt.detail || problem.Instance != "/users/9" {
+				t.Errorf("problem = %+v", problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/yourusername/go-rest-api-lab/tracing"
+)
+
+// route is one operation of the API. The route table is the single source
+// for request routing and for the OpenAPI document at /openapi.json.
+type route struct {
+	method  string
+	pattern string // path with {name} placeholders, e.g. /users/{id}
+	tag     string
+	summary string
+	handler http.HandlerFunc
+
+	// auth requires a bearer token; negotiate enables Accept negotiation
+	auth      bool
+	negotiate bool
+
+	// request is a zero value of the JSON body type, or nil for no body.
+	// PATCH routes take it as a merge patch and also accept a JSON Patch.
+	request interface{}
+	// response is a zero value of the success body type, sent with status.
+	// mediaType overrides application/json, e.g. for an event stream.
+	response  interface{}
+	status    int
+	mediaType string
+
+	params []param
+
+	// cors overrides the CORS_* policy, e.g. publicCORS for /health
+	cors *corsPolicy
+}
+
+// param is a path, query or header parameter
+type param struct {
+	name        string
+	in          string // "path", "query" or "header"
+	kind        string // JSON Schema type: "integer", "number", "string" or "boolean"
+	description string
+	required    bool
+	minimum     *float64
+	maximum     *float64
+}
+
+func bound(v float64) *float64 { return &v }
+
+var (
+	idParam      = param{name: "id", in: "path", kind: "integer", required: true, minimum: bound(1)}
+	ifMatchParam = param{name: "If-Match", in: "header", kind: "string",
+		description: "ETag from a previous response; the write fails with 412 if the resource changed"}
+	idempotencyKeyParam = param{name: "Idempotency-Key", in: "header", kind: "string",
+		description: "Makes retries of this request return the first response instead of creating again"}
+	hardParam = param{name: "hard", in: "query", kind: "boolean",
+		description: "Delete permanently instead of moving to the trash (admin only)"}
+	includeDeletedParam = param{name: "include_deleted", in: "query", kind: "boolean",
+		description: "Also return a soft-deleted resource (admin only)"}
+	trashLimitParam = param{name: "limit", in: "query", kind: "integer", minimum: bound(1), maximum: bound(maxTrashLimit)}
+)
+
+// viewParams are the ?fields= and ?include= parameters of a single-resource GET
+func viewParams(relation string) []param {
+	return []param{
+		{name: "fields", in: "query", kind: "string", description: "Comma separated fields to return"},
+		{name: "include", in: "query", kind: "string", description: "Embed the related " + relation},
+		{name: "fields[" + relation + "]", in: "query", kind: "string", description: "Comma separated fields of the embedded " + relation},
+	}
+}
+
+var routes = []route{
+	{method: http.MethodGet, pattern: "/health", tag: "health", summary: "Health check",
+		handler: healthHandler, response: map[string]string{}, status: http.StatusOK, cors: publicCORS},
+	{method: http.MethodGet, pattern: "/livez", tag: "health", summary: "Liveness: the process is serving",
+		handler: livezHandler, response: map[string]string{}, status: http.StatusOK, cors: publicCORS},
+	{method: http.MethodGet, pattern: "/readyz", tag: "health", summary: "Readiness: not draining, database reachable and migrated; 503 otherwise",
+		handler: readyzHandler, response: ReadinessReport{}, status: http.StatusOK, cors: publicCORS,
+		params: []param{{name: "verbose", in: "query", kind: "boolean", description: "List every check with its result and latency; requires the METRICS_TOKEN or ADMIN_TOKEN as bearer token"}}},
+	{method: http.MethodGet, pattern: "/config", tag: "health", summary: "Frontend configuration",
+		handler: configHandler, response: map[string]string{}, status: http.StatusOK},
+	{method: http.MethodGet, pattern: "/openapi.json", tag: "health", summary: "This OpenAPI document",
+		handler: openAPIHandler, response: map[string]interface{}{}, status: http.StatusOK, cors: publicCORS},
+	{method: http.MethodGet, pattern: "/metrics", tag: "health", summary: "Prometheus metrics; requires the METRICS_TOKEN as bearer token",
+		handler: metricsHandler, response: "", status: http.StatusOK, mediaType: metricsContentType, cors: noCORS},
+
+	{method: http.MethodPost, pattern: "/users", tag: "users", summary: "Create a user",
+		handler: idempotent(createUserHandler), auth: true, negotiate: true,
+		request: CreateUserRequest{}, response: User{}, status: http.StatusCreated,
+		params: []param{idempotencyKeyParam}},
+	{method: http.MethodGet, pattern: "/users/search", tag: "users", summary: "Fuzzy search users by name, username and email",
+		handler: searchUsersHandler, auth: true, negotiate: true,
+		response: []UserSearchResult{}, status: http.StatusOK,
+		params: []param{
+			{name: "q", in: "query", kind: "string", required: true},
+			{name: "min_score", in: "query", kind: "number", minimum: bound(0), maximum: bound(1)},
+			{name: "limit", in: "query", kind: "integer", minimum: bound(1), maximum: bound(maxSearchLimit)},
+		}},
+	{method: http.MethodGet, pattern: "/users/trash", tag: "users", summary: "List soft-deleted users (admin only)",
+		handler: listDeletedUsersHandler, auth: true, negotiate: true,
+		response: []User{}, status: http.StatusOK, params: []param{trashLimitParam}},
+	{method: http.MethodGet, pattern: "/users/{id}", tag: "users", summary: "Get a user",
+		handler: getUserHandler, auth: true, negotiate: true,
+		response: User{}, status: http.StatusOK,
+		params: append([]param{idParam, includeDeletedParam}, viewParams("posts")...)},
+	{method: http.MethodPut, pattern: "/users/{id}", tag: "users", summary: "Replace a user",
+		handler: updateUserHandler, auth: true, negotiate: true,
+		request: UpdateUserRequest{}, response: User{}, status: http.StatusOK,
+		params: []param{idParam, ifMatchParam}},
+	{method: http.MethodPatch, pattern: "/users/{id}", tag: "users", summary: "Update a user partially",
+		handler: patchUserHandler, auth: true, negotiate: true,
+		request: PatchUserRequest{}, response: User{}, status: http.StatusOK,
+		params: []param{idParam, ifMatchParam}},
+	{method: http.MethodDelete, pattern: "/users/{id}", tag: "users", summary: "Delete a user and their posts",
+		handler: deleteUserHandler, auth: true, negotiate: true,
+		response: SuccessResponse{}, status: http.StatusOK,
+		params: []param{idParam, ifMatchParam, hardParam}},
+	{method: http.MethodPost, pattern: "/users/{id}/restore", tag: "users", summary: "Restore a soft-deleted user",
+		handler: restoreUserHandler, auth: true, negotiate: true,
+		response: User{}, status: http.StatusOK, params: []param{idParam}},
+
+	{method: http.MethodPost, pattern: "/posts", tag: "posts", summary: "Create a post",
+		handler: idempotent(createPostHandler), auth: true, negotiate: true,
+		request: CreatePostRequest{}, response: Post{}, status: http.StatusCreated,
+		params: []param{idempotencyKeyParam}},
+	{method: http.MethodGet, pattern: "/posts/trash", tag: "posts", summary: "List soft-deleted posts (admin only)",
+		handler: listDeletedPostsHandler, auth: true, negotiate: true,
+		response: []Post{}, status: http.StatusOK, params: []param{trashLimitParam}},
+	{method: http.MethodGet, pattern: "/posts/{id}", tag: "posts", summary: "Get a post",
+		handler: getPostHandler, auth: true, negotiate: true,
+		response: Post{}, status: http.StatusOK,
+		params: append([]param{idParam, includeDeletedParam}, viewParams("author")...)},
+	{method: http.MethodPut, pattern: "/posts/{id}", tag: "posts", summary: "Replace a post",
+		handler: updatePostHandler, auth: true, negotiate: true,
+		request: CreatePostRequest{}, response: Post{}, status: http.StatusOK,
+		params: []param{idParam, ifMatchParam}},
+	{method: http.MethodPatch, pattern: "/posts/{id}", tag: "posts", summary: "Update a post partially",
+		handler: patchPostHandler, auth: true, negotiate: true,
+		request: PatchPostRequest{}, response: Post{}, status: http.StatusOK,
+		params: []param{idParam, ifMatchParam}},
+	{method: http.MethodDelete, pattern: "/posts/{id}", tag: "posts", summary: "Delete a post",
+		handler: deletePostHandler, auth: true, negotiate: true,
+		response: SuccessResponse{}, status: http.StatusOK,
+		params: []param{idParam, ifMatchParam, hardParam}},
+	{method: http.MethodPost, pattern: "/posts/{id}/restore", tag: "posts", summary: "Restore a soft-deleted post",
+		handler: restorePostHandler, auth: true, negotiate: true,
+		response: Post{}, status: http.StatusOK, params: []param{idParam}},
+
+	{method: http.MethodPost, pattern: "/batch", tag: "batch", summary: "Run many writes in one transaction",
+		handler: batchHandler, auth: true,
+		request: BatchRequest{}, response: BatchResponse{}, status: http.StatusOK},
+
+	{method: http.MethodPost, pattern: "/graphql", tag: "graphql", summary: "Run a GraphQL query or mutation",
+		handler: graphqlHandler, auth: true,
+		request: GraphQLRequest{}, response: GraphQLResponse{}, status: http.StatusOK},
+	{method: http.MethodGet, pattern: "/graphql", tag: "graphql", summary: "Run a GraphQL query",
+		handler: graphqlHandler, auth: true,
+		response: GraphQLResponse{}, status: http.StatusOK,
+		params: []param{
+			{name: "query", in: "query", kind: "string", required: true},
+			{name: "operationName", in: "query", kind: "string"},
+			{name: "variables", in: "query", kind: "string", description: "Variables as a JSON object"},
+		}},
+
+	{method: http.MethodPost, pattern: "/webhooks", tag: "webhooks", summary: "Subscribe a URL to events (admin)",
+		handler: createWebhookHandler, auth: true, negotiate: true,
+		request: CreateWebhookRequest{}, response: Webhook{}, status: http.StatusCreated},
+	{method: http.MethodGet, pattern: "/webhooks", tag: "webhooks", summary: "List webhooks (admin)",
+		handler: listWebhooksHandler, auth: true, negotiate: true,
+		response: []Webhook{}, status: http.StatusOK},
+	{method: http.MethodGet, pattern: "/webhooks/{id}", tag: "webhooks", summary: "Get a webhook (admin)",
+		handler: getWebhookHandler, auth: true, negotiate: true,
+		response: Webhook{}, status: http.StatusOK, params: []param{idParam}},
+	{method: http.MethodDelete, pattern: "/webhooks/{id}", tag: "webhooks", summary: "Delete a webhook and its delivery log (admin)",
+		handler: deleteWebhookHandler, auth: true, negotiate: true,
+		response: SuccessResponse{}, status: http.StatusOK, params: []param{idParam}},
+	{method: http.MethodGet, pattern: "/webhooks/{id}/deliveries", tag: "webhooks", summary: "Delivery log of a webhook, newest first (admin)",
+		handler: listDeliveriesHandler, auth: true, negotiate: true,
+		response: []WebhookDelivery{}, status: http.StatusOK,
+		params: []param{
+			idParam,
+			{name: "status", in: "query", kind: "string", description: "pending, succeeded or dead"},
+			{name: "limit", in: "query", kind: "integer", minimum: bound(1), maximum: bound(maxDeliveryLimit)},
+		}},
+	{method: http.MethodPost, pattern: "/webhooks/{id}/deliveries/{deliveryId}/redeliver", tag: "webhooks",
+		summary: "Send a delivery again as a new delivery (admin)",
+		handler: redeliverHandler, auth: true, negotiate: true,
+		response: WebhookDelivery{}, status: http.StatusAccepted,
+		params: []param{idParam, {name: "deliveryId", in: "path", kind: "integer", required: true, minimum: bound(1)}}},
+
+	{method: http.MethodGet, pattern: "/events", tag: "events", summary: "Stream user and post changes as Server-Sent Events",
+		handler: eventsHandler, auth: true,
+		response: Event{}, status: http.StatusOK, mediaType: "text/event-stream",
+		params: []param{
+			{name: "resource", in: "query", kind: "string", description: "Only events about users or posts"},
+			{name: "id", in: "query", kind: "integer", minimum: bound(1), description: "Only events about this resource; requires resource"},
+			{name: "types", in: "query", kind: "string", description: "Comma separated event types, e.g. user.created,post.deleted"},
+			{name: "Last-Event-ID", in: "header", kind: "integer", minimum: bound(0),
+				description: "Resume after this event id; also accepted as ?lastEventId="},
+		}},
+}
+
+// muxPath is the ServeMux pattern that serves p: the path up to its first
+// placeholder, as a subtree, or the path itself
+func (rt route) muxPath() string {
+	if i := strings.Index(rt.pattern, "{"); i >= 0 {
+		return rt.pattern[:i]
+	}
+	return rt.pattern
+}
+
+// match reports whether path matches the route's pattern
+func (rt route) match(path string) bool {
+	want := strings.Split(rt.pattern, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if !strings.HasPrefix(want[i], "{") && want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// registerRoutes installs the route table on mux. Routes sharing a ServeMux
+// pattern share one handler that picks the route by path and method, so auth
+// and CORS run before a 404 or 405.
+func registerRoutes(mux *http.ServeMux) {
+	doc, err := buildOpenAPI(routes)
+	if err != nil {
+		log.Fatalf("Failed to build the OpenAPI document: %v", err)
+	}
+	openAPIDocument = doc
+
+	var order []string
+	groups := map[string][]route{}
+	for _, rt := range routes {
+		path := rt.muxPath()
+		if _, seen := groups[path]; !seen {
+			order = append(order, path)
+		}
+		groups[path] = append(groups[path], rt)
+	}
+
+	for _, path := range order {
+		group := groups[path]
+		handler := dispatch(group)
+		if REQUEST_VALIDATION {
+			handler = validateRequests(group, handler)
+		}
+		handler = upgradeRequests(group, handler)
+		// Every route under one ServeMux pattern has the same auth,
+		// negotiation and CORS settings
+		if group[0].auth {
+			handler = authMiddleware(handler)
+		}
+		if group[0].negotiate {
+			handler = negotiateMiddleware(handler)
+		}
+		// CORS comes before auth so preflight requests, which carry no
+		// credentials, are answered
+		policy := group[0].cors
+		if policy == nil {
+			policy = defaultCORS()
+		}
+		handler = corsMiddleware(policy, groupMethods(group), limitBody(handler))
+		mux.HandleFunc(path, labelRoute(group, handler))
+	}
+}
+
+// groupMethods lists the methods served by a group, without duplicates
+func groupMethods(group []route) []string {
+	var methods []string
+	for _, rt := range group {
+		if !slices.Contains(methods, rt.method) {
+			methods = append(methods, rt.method)
+		}
+	}
+	return methods
+}
+
+// dispatch picks the route for the request's path and method
+func dispatch(group []route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, rt := range group {
+			if !rt.match(r.URL.Path) {
+				continue
+			}
+			if rt.method == r.Method {
+				// A span of its own separates the handler's time from the
+				// middleware's
+				ctx, span := tracing.Start(r.Context(), "handler "+rt.pattern, tracing.KindInternal)
+				rt.handler(w, r.WithContext(ctx))
+				span.Finish(nil)
+				return
+			}
+			allowed = append(allowed, rt.method)
+		}
+		if len(allowed) == 0 {
+			respondWithProblem(w, r, http.StatusNotFound, codeNotFound, "No route matches "+r.URL.Path)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		respondWithProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// labelRoute records the matched route for the access log and metrics
+// before auth runs, so rejected requests are attributed to their route too
+func labelRoute(group []route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rt, ok := findRoute(group, r); ok {
+			requestLogOf(r).route = rt.pattern
+		}
+		next(w, r)
+	}
+}
+
+// findRoute returns the route in group serving the request, if any
+func findRoute(group []route, r *http.Request) (route, bool) {
+	for _, rt := range group {
+		if rt.method == r.Method && rt.match(r.URL.Path) {
+			return rt, true
+		}
+	}
+	return route{}, false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchUsersHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		// args are the threshold, the search term, its prefix pattern and
+		// the limit the database gets
+		args []driver.Value
+	}{
+		{name: "defaults", query: "q=ann", status: http.StatusOK, args: []driver.Value{"0.3", "ann", "ann%", int64(defaultSearchLimit)}},
+		{name: "trimmed", query: "q=%20jane.sm%20", status: http.StatusOK, args: []driver.Value{"0.3", "jane.sm", "jane.sm%", int64(defaultSearchLimit)}},
+		{name: "wildcards are literal", query: "q=50%25_off", status: http.StatusOK, args: []driver.Value{"0.3", "50%_off", `50\%\_off%`, int64(defaultSearchLimit)}},
+		{name: "bounds", query: "q=ann&min_score=1&limit=100", status: http.StatusOK, args: []driver.Value{"1", "ann", "ann%", int64(maxSearchLimit)}},
+		{name: "lowest bounds", query: "q=ann&min_score=0&limit=1", status: http.StatusOK, args: []driver.Value{"0", "ann", "ann%", int64(1)}},
+		{name: "q missing", query: "", status: http.StatusBadRequest},
+		{name: "q blank", query: "q=%20%20", status: http.StatusBadRequest},
+		{name: "min_score too high", query: "q=ann&min_score=1.01", status: http.StatusBadRequest},
+		{name: "min_score negative", query: "q=ann&min_score=-0.1", status: http.StatusBadRequest},
+		{name: "min_score not a number", query: "q=ann&min_score=high", status: http.StatusBadRequest},
+		{name: "limit zero", query: "q=ann&limit=0", status: http.StatusBadRequest},
+		{name: "limit too high", query: "q=ann&limit=101", status: http.StatusBadRequest},
+		{name: "limit not an integer", query: "q=ann&limit=2.5", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+				if strings.HasPrefix(query, "SELECT set_config") {
+					return &fakeResult{affected: 1}, nil
+				}
+				return &fakeResult{
+					columns: []string{"id", "name", "email", "username", "created_at", "updated_at", "score"},
+					rows:    [][]driver.Value{append(userRow(5), 0.8)},
+				}, nil
+			})
+			w := httptest.NewRecorder()
+			searchUsersHandler(w, httptest.NewRequest(http.MethodGet, "/users/search?"+tt.query, nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if fake.ran("SELECT") != 0 {
+					t.Errorf("searched after a bad query: %q", fake.statements())
+				}
+				return
+			}
+			var args []driver.Value
+			for i, statement := range fake.statements() {
+				if strings.HasPrefix(statement, "SELECT") {
+					args = append(args, fake.args[i]...)
+				}
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %#v, want %#v", args, tt.args)
+			}
+			if !strings.Contains(w.Body.String(), `"score":0.8`) {
+				t.Errorf("body = %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"ann", "ann"},
+		{"100%", `100\%`},
+		{"first_last", `first\_last`},
+		{`C:\dir`, `C:\\dir`},
+		{`\%_`, `\\\%\_`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
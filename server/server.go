@@ -1,40 +1,76 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var (
 	PORT        = "8080"
 	VALID_TOKEN = os.Getenv("BEARER_TOKEN")
+
+	// ADMIN_TOKEN unlocks the trash, ?include_deleted=true and ?hard=true.
+	// Admin features are disabled when it is empty.
+	ADMIN_TOKEN = os.Getenv("ADMIN_TOKEN")
+
+	// REQUIRE_IF_MATCH rejects PUT, PATCH and DELETE without If-Match (428)
+	REQUIRE_IF_MATCH = false
+
+	// IDEMPOTENCY_TTL is how long a response to a POST with an
+	// Idempotency-Key is kept for replay
+	IDEMPOTENCY_TTL = 24 * time.Hour
+	// IDEMPOTENCY_LEASE is how long a key is held while its first request
+	// runs. A request that dies without answering frees the key after that.
+	IDEMPOTENCY_LEASE = 2 * time.Minute
+
+	// REQUEST_VALIDATION checks requests against the OpenAPI document
+	// before they reach a handler
+	REQUEST_VALIDATION = false
+
+	// CACHE_CONTROL is the Cache-Control header sent by GET routes. The
+	// default lets clients cache but makes them revalidate with the ETag.
+	CACHE_CONTROL = map[string]string{
+		"/users/": "private, no-cache",
+		"/posts/": "private, no-cache",
+	}
 )
 
 type User struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Username  string    `json:"username"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Username  string     `json:"username"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Post struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"userId"`
-	Title     string    `json:"title"`
-	Body      string    `json:"body"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id"`
+	UserID    int        `json:"userId"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+// UserSearchResult is a user matched by GET /users/search with its similarity score
+type UserSearchResult struct {
+	User
+	Score float64 `json:"score"`
 }
 
 type SuccessResponse struct {
@@ -55,8 +91,15 @@ type UpdateUserRequest struct {
 }
 
 type PatchUserRequest struct {
-	Name  *string `json:"name,omitempty"`
-	Email *string `json:"email,omitempty"`
+	Name     *string `json:"name,omitempty"`
+	Email    *string `json:"email,omitempty"`
+	Username *string `json:"username,omitempty"`
+}
+
+type PatchPostRequest struct {
+	UserID *int    `json:"userId,omitempty"`
+	Title  *string `json:"title,omitempty"`
+	Body   *string `json:"body,omitempty"`
 }
 
 type CreatePostRequest struct {
@@ -65,60 +108,96 @@ type CreatePostRequest struct {
 	Body   string `json:"body"`
 }
 
-// CORS middleware to allow browser requests
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-		
-		// Handle preflight requests
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		
-		next(w, r)
+// validationError is a request body with invalid fields
+type validationError struct {
+	msg    string
+	fields []FieldError
+}
+
+func (e *validationError) Error() string { return e.msg }
+
+// require records a FieldError when a required field is empty
+func (e *validationError) require(field, value string) {
+	if value == "" {
+		e.fields = append(e.fields, FieldError{Field: field, Code: "required", Message: field + " is required"})
+	}
+}
+
+func (req CreateUserRequest) validate() error {
+	invalid := &validationError{msg: "Name, email, and username are required"}
+	invalid.require("name", req.Name)
+	invalid.require("email", req.Email)
+	invalid.require("username", req.Username)
+	if len(invalid.fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+func (req UpdateUserRequest) validate() error {
+	return CreateUserRequest(req).validate()
+}
+
+func (req CreatePostRequest) validate() error {
+	invalid := &validationError{msg: "Title and body are required"}
+	invalid.require("title", req.Title)
+	invalid.require("body", req.Body)
+	if len(invalid.fields) > 0 {
+		return invalid
 	}
+	return nil
+}
+
+type contextKey string
+
+// roleContextKey holds the caller's role, set by authMiddleware
+const roleContextKey contextKey = "role"
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// isAdmin reports whether the request was authenticated with ADMIN_TOKEN
+func isAdmin(r *http.Request) bool {
+	role, _ := r.Context().Value(roleContextKey).(string)
+	return role == roleAdmin
 }
 
 // Middleware to check Bearer token
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Apply CORS first
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-		
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		
 		authHeader := r.Header.Get("Authorization")
-		
+
 		if authHeader == "" {
-			respondWithError(w, http.StatusUnauthorized, "Missing Authorization header")
+			authFailures.inc(authMissingHeader)
+			respondWithProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Missing Authorization header")
 			return
 		}
-		
+
 		// Check if it starts with "Bearer "
 		if !strings.HasPrefix(authHeader, "Bearer ") {
-			respondWithError(w, http.StatusUnauthorized, "Invalid Authorization format. Use: Bearer <token>")
+			authFailures.inc(authInvalidFormat)
+			respondWithProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid Authorization format. Use: Bearer <token>")
 			return
 		}
-		
+
 		// Extract token
 		token := strings.TrimPrefix(authHeader, "Bearer ")
-		
+
 		// Validate token
-		if token != VALID_TOKEN {
-			respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		role := roleUser
+		if ADMIN_TOKEN != "" && token == ADMIN_TOKEN {
+			role = roleAdmin
+		} else if token != VALID_TOKEN {
+			authFailures.inc(authInvalidToken)
+			respondWithProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid token")
 			return
 		}
-		
+
 		// Token is valid, proceed
-		next(w, r)
+		requestLogOf(r).identity = role
+		next(w, r.WithContext(context.WithValue(r.Context(), roleContextKey, role)))
 	}
 }
 
@@ -128,228 +207,426 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	// This is a simple implementation - in production use a router like gorilla/mux
 	pathParts := strings.Split(r.URL.Path, "/")
 	if len(pathParts) < 3 {
-		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		respondWithProblem(w, r, http.StatusBadRequest, codeBadRequest, "Invalid user ID")
 		return
 	}
-	
+
 	var id int
 	fmt.Sscanf(pathParts[2], "%d", &id)
-	
-	user, err := getUserByID(id)
+
+	includeDeleted, ok := adminFlag(w, r, "include_deleted")
+	if !ok {
+		return
+	}
+
+	if wantsView(r) {
+		if includeDeleted {
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "include_deleted cannot be combined with fields or include")
+			return
+		}
+		view, ok := parseView(w, r, userSchema, postSchema, "posts")
+		if !ok {
+			return
+		}
+		rec, lastModified, err := getUserView(r.Context(), id, view)
+		if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		respondWithView(w, r, rec, lastModified, CACHE_CONTROL["/users/"])
+		return
+	}
+
+	var user *User
+	var err error
+	if includeDeleted {
+		user, err = getUserIncludingDeleted(r.Context(), id)
+	} else {
+		user, err = getUserByID(r.Context(), id)
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "User not found")
+		respondWithError(w, r, err)
+		return
+	}
+
+	if notModified(w, r, representationETag(r, resourceETag(user.UpdatedAt)), user.UpdatedAt, CACHE_CONTROL["/users/"]) {
 		return
 	}
-	
-	respondWithJSON(w, http.StatusOK, user)
+	respond(w, r, http.StatusOK, user)
 }
 
 func getPostHandler(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	var id int
 	fmt.Sscanf(pathParts[2], "%d", &id)
-	
-	post, err := getPostByID(id)
+
+	includeDeleted, ok := adminFlag(w, r, "include_deleted")
+	if !ok {
+		return
+	}
+
+	if wantsView(r) {
+		if includeDeleted {
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "include_deleted cannot be combined with fields or include")
+			return
+		}
+		view, ok := parseView(w, r, postSchema, userSchema, "author")
+		if !ok {
+			return
+		}
+		rec, lastModified, err := getPostView(r.Context(), id, view)
+		if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		respondWithView(w, r, rec, lastModified, CACHE_CONTROL["/posts/"])
+		return
+	}
+
+	var post *Post
+	var err error
+	if includeDeleted {
+		post, err = getPostIncludingDeleted(r.Context(), id)
+	} else {
+		post, err = getPostByID(r.Context(), id)
+	}
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	if notModified(w, r, representationETag(r, resourceETag(post.UpdatedAt)), post.UpdatedAt, CACHE_CONTROL["/posts/"]) {
+		return
+	}
+	respond(w, r, http.StatusOK, post)
+}
+
+const (
+	defaultSearchMinScore = 0.3
+	defaultSearchLimit    = 20
+	maxSearchLimit        = 100
+)
+
+func searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Query parameter q is required")
+		return
+	}
+
+	minScore := defaultSearchMinScore
+	if v := params.Get("min_score"); v != "" {
+		score, err := strconv.ParseFloat(v, 64)
+		if err != nil || score < 0 || score > 1 {
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "min_score must be a number between 0 and 1")
+			return
+		}
+		minScore = score
+	}
+
+	limit := defaultSearchLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit))
+			return
+		}
+		limit = n
+	}
+
+	results, err := searchUsers(r.Context(), q, minScore, limit)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Post not found")
+		respondWithError(w, r, err)
 		return
 	}
-	
-	respondWithJSON(w, http.StatusOK, post)
+
+	respond(w, r, http.StatusOK, results)
 }
 
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	var req CreateUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSONBody(r, &req); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	// Validate required fields
-	if req.Name == "" || req.Email == "" || req.Username == "" {
-		respondWithError(w, http.StatusBadRequest, "Name, email, and username are required")
+	if err := req.validate(); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	// Create user in database
-	user, err := createUser(req.Name, req.Email, req.Username)
+	user, err := createUser(r.Context(), req.Name, req.Email, req.Username)
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate") || strings.Contains(err.Error(), "unique") {
-			respondWithError(w, http.StatusConflict, "User with this email or username already exists")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Failed to create user")
-		}
+		respondWithError(w, r, err)
 		return
 	}
-	
-	respondWithJSON(w, http.StatusCreated, user)
+
+	respond(w, r, http.StatusCreated, user)
 }
 
 func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	var id int
 	fmt.Sscanf(pathParts[2], "%d", &id)
-	
+
+	cond, ok := writePrecondition(w, r)
+	if !ok {
+		return
+	}
+
 	var req UpdateUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSONBody(r, &req); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	// Validate required fields
-	if req.Name == "" || req.Email == "" || req.Username == "" {
-		respondWithError(w, http.StatusBadRequest, "Name, email, and username are required")
+	if err := req.validate(); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	// Update user in database
-	user, err := updateUser(id, req.Name, req.Email, req.Username)
+	user, err := updateUser(r.Context(), id, req.Name, req.Email, req.Username, cond)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			respondWithError(w, http.StatusNotFound, "User not found")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Failed to update user")
-		}
+		respondWithError(w, r, err)
 		return
 	}
-	
-	respondWithJSON(w, http.StatusOK, user)
+
+	w.Header().Set("ETag", representationETag(r, resourceETag(user.UpdatedAt)))
+	respond(w, r, http.StatusOK, user)
 }
 
 func patchUserHandler(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	var id int
 	fmt.Sscanf(pathParts[2], "%d", &id)
-	
-	var req PatchUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+
+	cond, ok := writePrecondition(w, r)
+	if !ok {
 		return
 	}
-	
-	// Update user in database
-	user, err := patchUserDB(id, req.Name, req.Email)
+
+	mediaType, err := patchMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithProblem(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content-Type must be application/merge-patch+json or application/json-patch+json")
+		return
+	}
+	patch, err := io.ReadAll(r.Body)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			respondWithError(w, http.StatusNotFound, "User not found")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Failed to update user")
+		respondWithError(w, r, err)
+		return
+	}
+
+	// Apply the patch to the locked row and update it in one transaction
+	user, err := patchUserDB(r.Context(), id, cond, func(current *User) (*User, error) {
+		patched := &User{}
+		if err := applyPatch(mediaType, patch, current, patched, "id", "created_at", "updated_at", "deleted_at"); err != nil {
+			return nil, err
+		}
+		if err := (UpdateUserRequest{Name: patched.Name, Email: patched.Email, Username: patched.Username}).validate(); err != nil {
+			return nil, &patchError{msg: err.Error(), err: err}
 		}
+		return patched, nil
+	})
+	if err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
-	respondWithJSON(w, http.StatusOK, user)
+
+	w.Header().Set("ETag", representationETag(r, resourceETag(user.UpdatedAt)))
+	respond(w, r, http.StatusOK, user)
 }
 
 func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	var id int
 	fmt.Sscanf(pathParts[2], "%d", &id)
-	
-	err := deleteUser(id)
+
+	cond, ok := writePrecondition(w, r)
+	if !ok {
+		return
+	}
+
+	// Soft delete unless an admin asks for a permanent purge
+	hard, ok := adminFlag(w, r, "hard")
+	if !ok {
+		return
+	}
+
+	var err error
+	if hard {
+		err = purgeUser(r.Context(), id, cond)
+	} else {
+		err = deleteUser(r.Context(), id, cond)
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			respondWithError(w, http.StatusNotFound, "User not found")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Failed to delete user")
-		}
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	response := SuccessResponse{
 		Message: "User deleted successfully",
 		Data: map[string]int{
 			"id": id,
 		},
 	}
-	
-	respondWithJSON(w, http.StatusOK, response)
+
+	respond(w, r, http.StatusOK, response)
 }
 
 func createPostHandler(w http.ResponseWriter, r *http.Request) {
 	var req CreatePostRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSONBody(r, &req); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	// Validate required fields
-	if req.Title == "" || req.Body == "" {
-		respondWithError(w, http.StatusBadRequest, "Title and body are required")
+	if err := req.validate(); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	// Create post in database
-	post, err := createPost(req.UserID, req.Title, req.Body)
+	post, err := createPost(r.Context(), req.UserID, req.Title, req.Body)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create post")
+		respondWithError(w, r, err)
 		return
 	}
-	
-	respondWithJSON(w, http.StatusCreated, post)
+
+	respond(w, r, http.StatusCreated, post)
 }
 
 func updatePostHandler(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	var id int
 	fmt.Sscanf(pathParts[2], "%d", &id)
-	
+
+	cond, ok := writePrecondition(w, r)
+	if !ok {
+		return
+	}
+
 	var req CreatePostRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSONBody(r, &req); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	// Validate required fields
+	if err := req.validate(); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	// Update post in database
-	post, err := updatePost(id, req.UserID, req.Title, req.Body)
+	post, err := updatePost(r.Context(), id, req.UserID, req.Title, req.Body, cond)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			respondWithError(w, http.StatusNotFound, "Post not found")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Failed to update post")
-		}
+		respondWithError(w, r, err)
 		return
 	}
-	
-	respondWithJSON(w, http.StatusOK, post)
+
+	w.Header().Set("ETag", representationETag(r, resourceETag(post.UpdatedAt)))
+	respond(w, r, http.StatusOK, post)
 }
 
 func deletePostHandler(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	var id int
 	fmt.Sscanf(pathParts[2], "%d", &id)
-	
-	err := deletePost(id)
+
+	cond, ok := writePrecondition(w, r)
+	if !ok {
+		return
+	}
+
+	// Soft delete unless an admin asks for a permanent purge
+	hard, ok := adminFlag(w, r, "hard")
+	if !ok {
+		return
+	}
+
+	var err error
+	if hard {
+		err = purgePost(r.Context(), id, cond)
+	} else {
+		err = deletePost(r.Context(), id, cond)
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			respondWithError(w, http.StatusNotFound, "Post not found")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Failed to delete post")
-		}
+		respondWithError(w, r, err)
 		return
 	}
-	
+
 	response := SuccessResponse{
 		Message: "Post deleted successfully",
 		Data: map[string]int{
 			"id": id,
 		},
 	}
-	
-	respondWithJSON(w, http.StatusOK, response)
+
+	respond(w, r, http.StatusOK, response)
+}
+
+func patchPostHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	var id int
+	fmt.Sscanf(pathParts[2], "%d", &id)
+
+	cond, ok := writePrecondition(w, r)
+	if !ok {
+		return
+	}
+
+	mediaType, err := patchMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithProblem(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content-Type must be application/merge-patch+json or application/json-patch+json")
+		return
+	}
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	post, err := patchPostDB(r.Context(), id, cond, func(current *Post) (*Post, error) {
+		patched := &Post{}
+		if err := applyPatch(mediaType, patch, current, patched, "id", "created_at", "updated_at", "deleted_at"); err != nil {
+			return nil, err
+		}
+		if err := (CreatePostRequest{UserID: patched.UserID, Title: patched.Title, Body: patched.Body}).validate(); err != nil {
+			return nil, &patchError{msg: err.Error(), err: err}
+		}
+		return patched, nil
+	})
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", representationETag(r, resourceETag(post.UpdatedAt)))
+	respond(w, r, http.StatusOK, post)
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if draining.Load() {
+		respondWithJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status":  "draining",
+			"message": "Server is shutting down",
+		})
+		return
+	}
 	response := map[string]string{
-		"status": "ok",
+		"status":  "ok",
 		"message": "Server is running",
 	}
 	respondWithJSON(w, http.StatusOK, response)
 }
 
 func configHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	response := map[string]string{
 		"bearerToken": VALID_TOKEN,
 	}
@@ -363,10 +640,6 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, ErrorResponse{Error: message})
-}
-
 func main() {
 	// Load environment variables
 	if port := os.Getenv("PORT"); port != "" {
@@ -375,93 +648,261 @@ func main() {
 	if token := os.Getenv("BEARER_TOKEN"); token != "" {
 		VALID_TOKEN = token
 	}
-	
-	// Initialize database
-	if err := InitDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	if require, err := strconv.ParseBool(os.Getenv("REQUIRE_IF_MATCH")); err == nil {
+		REQUIRE_IF_MATCH = require
 	}
-	defer CloseDB()
-	
-	// Routes - Health check (no auth)
-	http.HandleFunc("/health", healthHandler)
-	
-	// Config endpoint (no auth) - returns bearer token for frontend
-	http.HandleFunc("/config", configHandler)
-	
-	// User routes (with auth)
-	// Handle /users (no trailing slash) for POST
-	http.HandleFunc("/users", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			createUserHandler(w, r)
-		} else {
-			respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	if validate, err := strconv.ParseBool(os.Getenv("VALIDATE_REQUESTS")); err == nil {
+		REQUEST_VALIDATION = validate
+	}
+	if level, ok := parseLogLevel(os.Getenv("LOG_LEVEL")); ok {
+		LOG_LEVEL = level
+	}
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		LOG_FORMAT = format
+	}
+	setupLogging()
+	if dest := os.Getenv("TRACE_EXPORT"); dest != "" {
+		TRACE_EXPORT = dest
+	}
+	if err := setupTracing(); err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	if version := os.Getenv("DEFAULT_API_VERSION"); version != "" {
+		if findAPIVersion(version) == nil {
+			log.Fatalf("Unknown DEFAULT_API_VERSION %q", version)
+		}
+		DEFAULT_API_VERSION = version
+	}
+	if date := os.Getenv("API_V1_DEPRECATION"); date != "" {
+		deprecated, err := parseAnnouncedDate(date)
+		if err != nil {
+			log.Fatalf("Invalid API_V1_DEPRECATION %q: %v", date, err)
 		}
-	}))
-	
-	// Handle /users/{id} (with trailing slash)
-	http.HandleFunc("/users/", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		// Handle /users/{id}
-		switch r.Method {
-		case http.MethodGet:
-			getUserHandler(w, r)
-		case http.MethodPut:
-			updateUserHandler(w, r)
-		case http.MethodPatch:
-			patchUserHandler(w, r)
-		case http.MethodDelete:
-			deleteUserHandler(w, r)
-		default:
-			respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		findAPIVersion("1").deprecated = deprecated
+	}
+	if date := os.Getenv("API_V1_SUNSET"); date != "" {
+		sunset, err := parseAnnouncedDate(date)
+		if err != nil {
+			log.Fatalf("Invalid API_V1_SUNSET %q: %v", date, err)
 		}
-	}))
-	
-	// Post routes (with auth)
-	// Handle /posts (no trailing slash) for POST
-	http.HandleFunc("/posts", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			createPostHandler(w, r)
-		} else {
-			respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		findAPIVersion("1").sunset = sunset
+	}
+	if depth, err := strconv.Atoi(os.Getenv("GRAPHQL_MAX_DEPTH")); err == nil && depth > 0 {
+		GRAPHQL_MAX_DEPTH = depth
+	}
+	if complexity, err := strconv.Atoi(os.Getenv("GRAPHQL_MAX_COMPLEXITY")); err == nil && complexity > 0 {
+		GRAPHQL_MAX_COMPLEXITY = complexity
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil && ttl > 0 {
+		IDEMPOTENCY_TTL = ttl
+	}
+	if lease, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_LEASE")); err == nil && lease > 0 {
+		IDEMPOTENCY_LEASE = lease
+	}
+	if size, err := strconv.Atoi(os.Getenv("EVENT_BUFFER_SIZE")); err == nil && size >= 0 {
+		EVENT_BUFFER_SIZE = size
+		events = newEventBroker(size)
+	}
+	if interval, err := time.ParseDuration(os.Getenv("EVENT_HEARTBEAT")); err == nil && interval > 0 {
+		EVENT_HEARTBEAT = interval
+	}
+	if attempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		WEBHOOK_MAX_ATTEMPTS = attempts
+	}
+	if base, err := time.ParseDuration(os.Getenv("WEBHOOK_RETRY_BASE")); err == nil && base > 0 {
+		WEBHOOK_RETRY_BASE = base
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("WEBHOOK_TIMEOUT")); err == nil && timeout > 0 {
+		WEBHOOK_TIMEOUT = timeout
+	}
+	if limit, err := strconv.ParseInt(os.Getenv("MAX_BODY_BYTES"), 10, 64); err == nil && limit > 0 {
+		MAX_BODY_BYTES = limit
+	}
+	if enabled, err := strconv.ParseBool(os.Getenv("COMPRESSION")); err == nil {
+		COMPRESSION = enabled
+	}
+	if size, err := strconv.Atoi(os.Getenv("COMPRESSION_MIN_SIZE")); err == nil && size >= 0 {
+		COMPRESSION_MIN_SIZE = size
+	}
+	if level, err := strconv.Atoi(os.Getenv("COMPRESSION_LEVEL")); err == nil {
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			log.Fatalf("COMPRESSION_LEVEL must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
 		}
-	}))
-	
-	// Handle /posts/{id} (with trailing slash)
-	http.HandleFunc("/posts/", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		// Handle /posts/{id}
-		switch r.Method {
-		case http.MethodGet:
-			getPostHandler(w, r)
-		case http.MethodPut:
-			updatePostHandler(w, r)
-		case http.MethodDelete:
-			deletePostHandler(w, r)
-		default:
-			respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		COMPRESSION_LEVEL = level
+	}
+	if types := os.Getenv("COMPRESSION_TYPES"); types != "" {
+		COMPRESSION_TYPES = parseMediaTypes(types)
+	}
+	if origins := os.Getenv("CORS_ALLOWED_ORIGINS"); origins != "" {
+		CORS_ALLOWED_ORIGINS = parseOrigins(origins)
+	}
+	if credentials, err := strconv.ParseBool(os.Getenv("CORS_ALLOW_CREDENTIALS")); err == nil {
+		CORS_ALLOW_CREDENTIALS = credentials
+	}
+	if maxAge, err := time.ParseDuration(os.Getenv("CORS_MAX_AGE")); err == nil && maxAge >= 0 {
+		CORS_MAX_AGE = maxAge
+	}
+	if err := defaultCORS().validate(); err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	TLS_CERT_FILE = os.Getenv("TLS_CERT_FILE")
+	TLS_KEY_FILE = os.Getenv("TLS_KEY_FILE")
+	if version := os.Getenv("TLS_MIN_VERSION"); version != "" {
+		v, ok := tlsVersions[version]
+		if !ok {
+			log.Fatalf("Unknown TLS_MIN_VERSION %q; use 1.0, 1.1, 1.2 or 1.3", version)
 		}
-	}))
-	
+		TLS_MIN_VERSION = v
+	}
+	if interval, err := time.ParseDuration(os.Getenv("TLS_RELOAD_INTERVAL")); err == nil && interval > 0 {
+		TLS_RELOAD_INTERVAL = interval
+	}
+	HTTP_REDIRECT_PORT = os.Getenv("HTTP_REDIRECT_PORT")
+	if maxAge, err := time.ParseDuration(os.Getenv("HSTS_MAX_AGE")); err == nil && maxAge >= 0 {
+		HSTS_MAX_AGE = maxAge
+	}
+	if include, err := strconv.ParseBool(os.Getenv("HSTS_INCLUDE_SUBDOMAINS")); err == nil {
+		HSTS_INCLUDE_SUBDOMAINS = include
+	}
+	var certs *certReloader
+	if tlsEnabled() {
+		var err error
+		if certs, err = newCertReloader(TLS_CERT_FILE, TLS_KEY_FILE); err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("READINESS_TIMEOUT")); err == nil && timeout > 0 {
+		READINESS_TIMEOUT = timeout
+	}
+	if delay, err := time.ParseDuration(os.Getenv("SHUTDOWN_DELAY")); err == nil && delay >= 0 {
+		SHUTDOWN_DELAY = delay
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && timeout > 0 {
+		SHUTDOWN_TIMEOUT = timeout
+	}
+	if size, err := strconv.Atoi(os.Getenv("CACHE_SIZE")); err == nil && size >= 0 {
+		CACHE_SIZE = size
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("CACHE_TTL")); err == nil && ttl > 0 {
+		CACHE_TTL = ttl
+	}
+	userCache = newLRUCache[*User]("users", CACHE_SIZE, CACHE_TTL)
+	postCache = newLRUCache[*Post]("posts", CACHE_SIZE, CACHE_TTL)
+	if cc := os.Getenv("USERS_CACHE_CONTROL"); cc != "" {
+		CACHE_CONTROL["/users/"] = cc
+	}
+	if cc := os.Getenv("POSTS_CACHE_CONTROL"); cc != "" {
+		CACHE_CONTROL["/posts/"] = cc
+	}
+
+	// Initialize database
+	if err := InitDB(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	if err := migrateDB(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	goWorker(func(stop <-chan struct{}) { purgeExpiredIdempotencyKeys(time.Hour, stop) })
+	goWorker(deliverWebhooks)
+
+	// Routes are listed in routes.go, which also generates /openapi.json
+	registerRoutes(http.DefaultServeMux)
+
 	fmt.Println("========================================")
 	fmt.Println("🚀 REST API Server Started")
 	fmt.Println("========================================")
-	fmt.Printf("Server running on: http://localhost:%s\n", PORT)
-	fmt.Printf("Valid Bearer Token: %s\n", VALID_TOKEN)
-	fmt.Println("\n📋 Available Endpoints:")
+	scheme := "http"
+	if tlsEnabled() {
+		scheme = "https"
+	}
+	fmt.Printf("Server running on: %s://localhost:%s\n", scheme, PORT)
+	if tlsEnabled() && HTTP_REDIRECT_PORT != "" {
+		fmt.Printf("Redirecting HTTP from port %s\n", HTTP_REDIRECT_PORT)
+	}
+	fmt.Printf("Bearer Token: %s\n", describeSecret(VALID_TOKEN))
+	fmt.Printf("Admin Token: %s\n", describeSecret(ADMIN_TOKEN))
+	fmt.Printf("Metrics Token: %s\n", describeSecret(METRICS_TOKEN))
+	fmt.Printf("Trace Export: %s\n", TRACE_EXPORT)
+	fmt.Printf("CORS Origins: %s\n", strings.Join(CORS_ALLOWED_ORIGINS, ", "))
+	if CACHE_SIZE > 0 {
+		fmt.Printf("Cache: %d users and %d posts for %s\n", CACHE_SIZE, CACHE_SIZE, CACHE_TTL)
+	} else {
+		fmt.Println("Cache: off")
+	}
+	if COMPRESSION {
+		fmt.Printf("Compression: gzip from %d bytes\n", COMPRESSION_MIN_SIZE)
+	} else {
+		fmt.Println("Compression: off")
+	}
+	fmt.Println("\n📋 Available Endpoints (also under /v1 and /v2):")
 	fmt.Println("\n  Health:")
 	fmt.Println("    GET    /health              - No auth required")
+	fmt.Println("    GET    /livez               - Liveness, no auth required")
+	fmt.Println("    GET    /readyz              - Readiness with dependency checks (?verbose=true needs metrics or admin token)")
+	fmt.Println("    GET    /openapi.json        - OpenAPI 3.1 document, no auth required")
+	fmt.Println("    GET    /metrics             - Prometheus metrics, requires METRICS_TOKEN")
 	fmt.Println("\n  Users:")
 	fmt.Println("    GET    /users/{id}          - Get user by ID")
+	fmt.Println("    GET    /users/search?q=     - Fuzzy search by name, username, email")
 	fmt.Println("    POST   /users               - Create user")
 	fmt.Println("    PUT    /users/{id}          - Update user (full)")
 	fmt.Println("    PATCH  /users/{id}          - Update user (partial)")
-	fmt.Println("    DELETE /users/{id}          - Delete user")
+	fmt.Println("    DELETE /users/{id}          - Delete user (soft, ?hard=true for admins)")
+	fmt.Println("    POST   /users/{id}/restore  - Restore a deleted user")
+	fmt.Println("    GET    /users/trash         - List deleted users (admin)")
 	fmt.Println("\n  Posts:")
 	fmt.Println("    GET    /posts/{id}          - Get post by ID")
 	fmt.Println("    POST   /posts               - Create post")
 	fmt.Println("    PUT    /posts/{id}          - Update post")
-	fmt.Println("    DELETE /posts/{id}          - Delete post")
+	fmt.Println("    PATCH  /posts/{id}          - Update post (partial)")
+	fmt.Println("    DELETE /posts/{id}          - Delete post (soft, ?hard=true for admins)")
+	fmt.Println("    POST   /posts/{id}/restore  - Restore a deleted post")
+	fmt.Println("    GET    /posts/trash         - List deleted posts (admin)")
+	fmt.Println("\n  Batch:")
+	fmt.Println("    POST   /batch               - Run operations in one transaction")
+	fmt.Println("\n  GraphQL:")
+	fmt.Println("    POST   /graphql             - Queries and mutations over users and posts")
+	fmt.Println("\n  Events:")
+	fmt.Println("    GET    /events              - Server-Sent Events for user and post changes")
+	fmt.Println("\n  Webhooks (admin):")
+	fmt.Println("    POST   /webhooks            - Subscribe a URL to events")
+	fmt.Println("    GET    /webhooks            - List webhooks")
+	fmt.Println("    DELETE /webhooks/{id}       - Delete a webhook")
+	fmt.Println("    GET    /webhooks/{id}/deliveries - Delivery log")
+	fmt.Println("    POST   /webhooks/{id}/deliveries/{deliveryId}/redeliver - Send again")
 	fmt.Println("\n🔐 All endpoints (except /health) require:")
-	fmt.Println("    Authorization: Bearer secret_token_12345")
+	fmt.Println("    Authorization: Bearer <BEARER_TOKEN>")
 	fmt.Println("========================================")
-	
-	log.Fatal(http.ListenAndServe(":"+PORT, nil))
+
+	// Every route is also served under /v1 and /v2; see version.go
+	srv := newServer(":"+PORT, accessLog(compress(versionMiddleware(http.DefaultServeMux))))
+	servers := []*http.Server{srv}
+	serveErr := make(chan error, 2)
+	if certs != nil {
+		srv.TLSConfig = tlsConfig(certs)
+		if HSTS_MAX_AGE > 0 {
+			srv.Handler = strictTransportSecurity(srv.Handler)
+		}
+		goWorker(certs.watch)
+		go func() { serveErr <- srv.ListenAndServeTLS("", "") }()
+
+		if HTTP_REDIRECT_PORT != "" {
+			redirect := newServer(":"+HTTP_REDIRECT_PORT, http.HandlerFunc(redirectToHTTPS))
+			servers = append(servers, redirect)
+			go func() { serveErr <- redirect.ListenAndServe() }()
+		}
+	} else {
+		go func() { serveErr <- srv.ListenAndServe() }()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		CloseDB()
+		log.Fatal(err)
+	case sig := <-signals:
+		slog.Info("Received signal", "signal", sig.String())
+	}
+	shutdown(servers...)
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// READ_HEADER_TIMEOUT and READ_TIMEOUT bound how long a client may take
+	// to send its request
+	READ_HEADER_TIMEOUT = 5 * time.Second
+	READ_TIMEOUT        = 30 * time.Second
+	// WRITE_TIMEOUT bounds a response, except for /events streams, which
+	// lift it
+	WRITE_TIMEOUT = 60 * time.Second
+	// IDLE_TIMEOUT closes keep-alive connections without a request
+	IDLE_TIMEOUT = 120 * time.Second
+	// SHUTDOWN_DELAY is how long /health and /readyz report draining before
+	// the server stops accepting connections, so load balancers can take it
+	// out first
+	SHUTDOWN_DELAY = 5 * time.Second
+	// SHUTDOWN_TIMEOUT bounds draining in-flight requests and stopping the
+	// background workers
+	SHUTDOWN_TIMEOUT = 20 * time.Second
+)
+
+var (
+	// draining is set once shutdown begins
+	draining atomic.Bool
+	// stopping is closed when connections start draining, so long-lived
+	// responses like event streams end instead of holding shutdown up
+	stopping = make(chan struct{})
+
+	// Background workers stop when stopWorkers is closed
+	stopWorkers = make(chan struct{})
+	workers     sync.WaitGroup
+)
+
+// goWorker runs fn in the background until shutdown
+func goWorker(fn func(stop <-chan struct{})) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		fn(stopWorkers)
+	}()
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: READ_HEADER_TIMEOUT,
+		ReadTimeout:       READ_TIMEOUT,
+		WriteTimeout:      WRITE_TIMEOUT,
+		IdleTimeout:       IDLE_TIMEOUT,
+	}
+}
+
+// shutdown fails /health and /readyz, waits SHUTDOWN_DELAY, drains the
+// servers, stops the background workers and closes the database and trace
+// file, in that order. Whatever is still running when SHUTDOWN_TIMEOUT passes
+// is cut off.
+func shutdown(servers ...*http.Server) {
+	draining.Store(true)
+	slog.Info("Shutting down", "drain_delay", SHUTDOWN_DELAY.String())
+	time.Sleep(SHUTDOWN_DELAY)
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	close(stopping)
+	var drained sync.WaitGroup
+	for _, srv := range servers {
+		drained.Add(1)
+		go func(srv *http.Server) {
+			defer drained.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("Closing connections that did not finish", "addr", srv.Addr, "error", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	drained.Wait()
+
+	close(stopWorkers)
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Background workers did not stop in time")
+	}
+
+	CloseDB()
+	traceCloser.Close()
+	slog.Info("Server stopped")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resetShutdown gives a test a fresh shutdown state and restores the
+// process-wide one afterwards, since shutdown closes its channels
+func resetShutdown(t *testing.T, delay, timeout time.Duration) {
+	savedDelay, savedTimeout := SHUTDOWN_DELAY, SHUTDOWN_TIMEOUT
+	savedStopping, savedStopWorkers := stopping, stopWorkers
+	SHUTDOWN_DELAY, SHUTDOWN_TIMEOUT = delay, timeout
+	stopping, stopWorkers = make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() {
+		SHUTDOWN_DELAY, SHUTDOWN_TIMEOUT = savedDelay, savedTimeout
+		stopping, stopWorkers = savedStopping, savedStopWorkers
+		draining.Store(false)
+	})
+}
+
+// serve starts srv on a local port and returns its URL
+func serve(t *testing.T, srv *http.Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	return "http://" + listener.Addr().String()
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	srv := newServer(":8080", http.NotFoundHandler())
+	if srv.ReadHeaderTimeout != READ_HEADER_TIMEOUT || srv.ReadTimeout != READ_TIMEOUT ||
+		srv.WriteTimeout != WRITE_TIMEOUT || srv.IdleTimeout != IDLE_TIMEOUT {
+		t.Errorf("timeouts = %v, %v, %v, %v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+	if srv.ReadHeaderTimeout == 0 || srv.WriteTimeout == 0 {
+		t.Error("a zero timeout lets a client hold a connection forever")
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	resetShutdown(t, 50*time.Millisecond, 5*time.Second)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := newServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}))
+	url := serve(t, srv)
+
+	workerStopped := make(chan struct{})
+	goWorker(func(stop <-chan struct{}) {
+		<-stop
+		close(workerStopped)
+	})
+
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(srv)
+		close(stopped)
+	}()
+
+	// Health checks fail during the delay, while requests are still served
+	time.Sleep(10 * time.Millisecond)
+	if !draining.Load() {
+		t.Error("not draining during the shutdown delay")
+	}
+	select {
+	case <-stopping:
+		t.Error("connections drained before the shutdown delay passed")
+	default:
+	}
+
+	<-stopping
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned with a request in flight")
+	case <-workerStopped:
+		t.Fatal("workers stopped before the servers drained")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+
+	if body := <-response; body != "done" {
+		t.Errorf("in-flight request got %q", body)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return")
+	}
+	select {
+	case <-workerStopped:
+	default:
+		t.Error("worker still running after shutdown")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("server still accepts requests")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	resetShutdown(t, 0, 100*time.Millisecond)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	srv := newServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	url := serve(t, srv)
+	go http.Get(url)
+	<-started
+
+	begin := time.Now()
+	shutdown(srv)
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v with a stuck request, want about SHUTDOWN_TIMEOUT", elapsed)
+	}
+}
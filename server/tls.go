@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// TLS_CERT_FILE and TLS_KEY_FILE are PEM files. Setting both serves
+	// HTTPS on PORT.
+	TLS_CERT_FILE = ""
+	TLS_KEY_FILE  = ""
+	// TLS_MIN_VERSION is the oldest protocol version clients may use
+	TLS_MIN_VERSION uint16 = tls.VersionTLS12
+	// TLS_RELOAD_INTERVAL is how often the certificate files are checked for
+	// changes
+	TLS_RELOAD_INTERVAL = 30 * time.Second
+	// HTTP_REDIRECT_PORT, when set, serves plain HTTP on that port, redirecting
+	// every request to HTTPS
+	HTTP_REDIRECT_PORT = ""
+	// HSTS_MAX_AGE, when positive, sends Strict-Transport-Security so
+	// browsers only use HTTPS for that long
+	HSTS_MAX_AGE            time.Duration
+	HSTS_INCLUDE_SUBDOMAINS = false
+)
+
+// tlsVersions are the accepted TLS_MIN_VERSION values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsEnabled() bool {
+	return TLS_CERT_FILE != "" || TLS_KEY_FILE != ""
+}
+
+// certReloader serves the certificate from disk and picks up a new one when
+// either file changes, so renewing a certificate needs no restart
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+
+	// Modification times of the loaded files; only the watch goroutine
+	// touches them after startup
+	certModTime, keyModTime time.Time
+}
+
+// newCertReloader loads the key pair, failing if it cannot be used
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) load() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key: %w", err)
+	}
+	pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	c.cert.Store(&pair)
+	c.certModTime, c.keyModTime = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// changed reports whether either file was modified since it was loaded.
+// Stat follows symlinks, so swapped Kubernetes secret mounts count too.
+func (c *certReloader) changed() bool {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(c.certModTime) || !keyInfo.ModTime().Equal(c.keyModTime)
+}
+
+// watch reloads the key pair whenever the files change, until stop closes.
+// A pair that fails to load, e.g. because only the certificate has been
+// replaced so far, keeps the current one in use and is retried on the next
+// tick.
+func (c *certReloader) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(TLS_RELOAD_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !c.changed() {
+			continue
+		}
+		if err := c.load(); err != nil {
+			slog.Error("Keeping the current TLS certificate", "error", err)
+			continue
+		}
+		slog.Info("Reloaded TLS certificate", "cert_file", c.certFile)
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+func tlsConfig(certs *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     TLS_MIN_VERSION,
+		GetCertificate: certs.getCertificate,
+	}
+}
+
+// strictTransportSecurity adds the HSTS header to responses sent over TLS
+func strictTransportSecurity(next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int(HSTS_MAX_AGE.Seconds()))
+	if HSTS_INCLUDE_SUBDOMAINS {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends a plain HTTP request to the same URL on the HTTPS
+// port. Methods other than GET and HEAD get 308 so the body is sent again.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		http.Error(w, "Host header required", http.StatusBadRequest)
+		return
+	}
+	if PORT != "443" {
+		host = net.JoinHostPort(host, PORT)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	saved := PORT
+	defer func() { PORT = saved }()
+
+	tests := []struct {
+		name     string
+		port     string
+		method   string
+		host     string
+		target   string
+		status   int
+		location string
+	}{
+		{"default port", "443", http.MethodGet, "api.example.com", "/users/1?fields=id", http.StatusMovedPermanently, "https://api.example.com/users/1?fields=id"},
+		{"client's port replaced", "443", http.MethodGet, "api.example.com:80", "/", http.StatusMovedPermanently, "https://api.example.com/"},
+		{"other HTTPS port", "8443", http.MethodHead, "localhost:8080", "/health", http.StatusMovedPermanently, "https://localhost:8443/health"},
+		{"IPv6 on the default port", "443", http.MethodGet, "[::1]:80", "/", http.StatusMovedPermanently, "https://[::1]/"},
+		{"IPv6 on another port", "8443", http.MethodGet, "[::1]", "/", http.StatusMovedPermanently, "https://[::1]:8443/"},
+		{"POST keeps its method", "443", http.MethodPost, "api.example.com", "/users", http.StatusPermanentRedirect, "https://api.example.com/users"},
+		{"missing host", "443", http.MethodGet, "", "/", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			PORT = tt.port
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Host = tt.host
+			redirectToHTTPS(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestStrictTransportSecurity(t *testing.T) {
+	savedAge, savedSub := HSTS_MAX_AGE, HSTS_INCLUDE_SUBDOMAINS
+	defer func() { HSTS_MAX_AGE, HSTS_INCLUDE_SUBDOMAINS = savedAge, savedSub }()
+	HSTS_MAX_AGE, HSTS_INCLUDE_SUBDOMAINS = 24*time.Hour, true
+
+	handler := strictTransportSecurity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, overTLS := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if overTLS {
+			r.TLS = &tls.ConnectionState{}
+		}
+		handler.ServeHTTP(w, r)
+
+		want := ""
+		if overTLS {
+			want = "max-age=86400; includeSubDomains"
+		}
+		if got := w.Header().Get("Strict-Transport-Security"); got != want {
+			t.Errorf("over TLS %v: Strict-Transport-Security = %q, want %q", overTLS, got, want)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "first")
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.changed() {
+		t.Error("changed right after loading")
+	}
+	if name := servedName(t, c); name != "first" {
+		t.Errorf("serving %q, want first", name)
+	}
+
+	// A renewal rewrites both files; make sure the times differ from the
+	// first write on coarse filesystem clocks
+	writeKeyPair(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.changed() {
+		t.Fatal("renewed files not noticed")
+	}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if c.changed() || servedName(t, c) != "second" {
+		t.Errorf("after reload: changed %v, serving %q", c.changed(), servedName(t, c))
+	}
+
+	// Only the certificate replaced so far: the pair does not match, so the
+	// current one stays in use
+	writeKeyPair(t, certFile, filepath.Join(dir, "other.key"), "third")
+	if err := c.load(); err == nil {
+		t.Error("loaded a certificate with the wrong key")
+	}
+	if name := servedName(t, c); name != "second" {
+		t.Errorf("serving %q after a failed reload, want second", name)
+	}
+
+	// A file that disappears mid-renewal is not a change
+	os.Remove(keyFile)
+	if c.changed() {
+		t.Error("missing key counted as a change")
+	}
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "only")
+
+	tests := []struct {
+		name              string
+		certFile, keyFile string
+	}{
+		{"key missing from config", certFile, ""},
+		{"cert missing from config", "", keyFile},
+		{"no such certificate", filepath.Join(dir, "none.crt"), keyFile},
+		{"no such key", certFile, filepath.Join(dir, "none.key")},
+		{"swapped files", keyFile, certFile},
+	}
+	for _, tt := range tests {
+		if _, err := newCertReloader(tt.certFile, tt.keyFile); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+// writeKeyPair writes a self-signed certificate for commonName and its key
+func writeKeyPair(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName is the common name of the certificate c hands to clients
+func servedName(t *testing.T, c *certReloader) string {
+	t.Helper()
+	cert, err := c.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
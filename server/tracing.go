@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/yourusername/go-rest-api-lab/tracing"
+)
+
+// TRACE_EXPORT is where finished spans are written as JSON lines: stdout,
+// stderr, a file path, or off to drop them. Trace IDs are assigned and
+// logged either way.
+var TRACE_EXPORT = "stdout"
+
+// traceCloser releases the trace file opened by setupTracing
+var traceCloser io.Closer = io.NopCloser(nil)
+
+// setupTracing installs the exporter named by TRACE_EXPORT
+func setupTracing() error {
+	exporter, closer, err := tracing.OpenExporter(TRACE_EXPORT)
+	if err != nil {
+		return err
+	}
+	tracing.SetExporter(exporter)
+	traceCloser = closer
+	return nil
+}
+
+// traceRequest starts the server span for r, continuing the caller's trace
+// when it sent a valid traceparent header
+func traceRequest(r *http.Request) (*http.Request, *tracing.Span) {
+	ctx := r.Context()
+	if parent, ok := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader)); ok {
+		ctx = tracing.ContextWithRemoteParent(ctx, parent)
+	}
+	ctx, span := tracing.Start(ctx, "HTTP "+r.Method, tracing.KindServer)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.Path)
+	return r.WithContext(ctx), span
+}
+
+// finishRequestSpan names the span after the matched route and records the
+// response status. 5xx responses mark the span failed.
+func finishRequestSpan(span *tracing.Span, r *http.Request, route string, status int) {
+	if route != "" {
+		span.SetName(r.Method + " " + route)
+		span.SetAttribute("http.route", route)
+	}
+	span.SetAttribute("http.status_code", status)
+	span.SetAttribute("request_id", requestID(r))
+	var err error
+	if status >= http.StatusInternalServerError {
+		err = httpStatusError(status)
+	}
+	span.Finish(err)
+}
+
+type httpStatusError int
+
+func (e httpStatusError) Error() string { return http.StatusText(int(e)) }
+
+// traceID is the ID of the trace r belongs to, or "" outside one
+func traceID(r *http.Request) string {
+	if sc, ok := tracing.SpanContextFromContext(r.Context()); ok {
+		return sc.TraceIDString()
+	}
+	return ""
+}
+
+// traced wraps q so that every statement records a span under the one in ctx
+func traced(ctx context.Context, q sqlQueryer) queryer {
+	return tracedQueryer{ctx: ctx, q: q}
+}
+
+type tracedQueryer struct {
+	ctx context.Context
+	q   sqlQueryer
+}
+
+func (t tracedQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	span := t.start(query)
+	result, err := t.q.Exec(query, args...)
+	if err == nil {
+		if n, rowsErr := result.RowsAffected(); rowsErr == nil {
+			span.SetAttribute("db.rows_affected", n)
+		}
+	}
+	span.Finish(err)
+	return result, err
+}
+
+// Query's span lasts until the rows are closed, so it covers streaming the
+// results as well as running the statement
+func (t tracedQueryer) Query(query string, args ...interface{}) (rows, error) {
+	span := t.start(query)
+	result, err := t.q.Query(query, args...)
+	if err != nil {
+		span.Finish(err)
+		return nil, err
+	}
+	return &tracedRows{Rows: result, span: span}, nil
+}
+
+func (t tracedQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	span := t.start(query)
+	row := t.q.QueryRow(query, args...)
+	span.Finish(row.Err())
+	return row
+}
+
+// tracedRows finishes the span of its query when closed, with the error
+// that ended the iteration if any
+type tracedRows struct {
+	*sql.Rows
+	span *tracing.Span
+	read int64
+	done bool
+}
+
+func (r *tracedRows) Next() bool {
+	if r.Rows.Next() {
+		r.read++
+		return true
+	}
+	return false
+}
+
+func (r *tracedRows) Close() error {
+	err := r.Rows.Close()
+	if !r.done {
+		r.done = true
+		r.span.SetAttribute("db.rows_read", r.read)
+		if iterErr := r.Rows.Err(); iterErr != nil {
+			r.span.Finish(iterErr)
+		} else {
+			r.span.Finish(err)
+		}
+	}
+	return err
+}
+
+func (t tracedQueryer) start(query string) *tracing.Span {
+	statement := strings.Join(strings.Fields(query), " ")
+	operation, _, _ := strings.Cut(statement, " ")
+	_, span := tracing.Start(t.ctx, "db "+strings.ToUpper(operation), tracing.KindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", statement)
+	return span
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yourusername/go-rest-api-lab/tracing"
+)
+
+// exportedSpans collects the spans finished while the test runs
+func exportedSpans(t *testing.T) func() []*tracing.Span {
+	var buf bytes.Buffer
+	tracing.SetExporter(tracing.NewJSONExporter(&buf))
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+	return func() []*tracing.Span {
+		var spans []*tracing.Span
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			span := new(tracing.Span)
+			if err := dec.Decode(span); err != nil {
+				t.Fatal(err)
+			}
+			spans = append(spans, span)
+		}
+		return spans
+	}
+}
+
+func TestTraceRequest(t *testing.T) {
+	const (
+		callerTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		callerSpan  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name        string
+		traceparent string
+		status      int
+		// parent is the remote span continued, empty for a new trace
+		parent   string
+		exported bool
+		failed   bool
+	}{
+		{name: "new trace", status: 200, exported: true},
+		{name: "continued", traceparent: "00-" + callerTrace + "-" + callerSpan + "-01", status: 200, parent: callerSpan, exported: true},
+		{name: "caller did not sample", traceparent: "00-" + callerTrace + "-" + callerSpan + "-00", status: 200},
+		{name: "malformed header starts a trace", traceparent: "00-" + callerTrace + "-xyz-01", status: 200, exported: true},
+		{name: "server error", status: 503, exported: true, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := exportedSpans(t)
+			r := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+			if tt.traceparent != "" {
+				r.Header.Set(tracing.TraceparentHeader, tt.traceparent)
+			}
+			r, span := traceRequest(r)
+			finishRequestSpan(span, r, "/users/{id}", tt.status)
+
+			got := spans()
+			if !tt.exported {
+				if len(got) != 0 {
+					t.Errorf("exported %d spans, want none", len(got))
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("exported %d spans, want 1", len(got))
+			}
+			s := got[0]
+			if s.Name != "GET /users/{id}" || s.Kind != tracing.KindServer || s.ParentSpanID != tt.parent {
+				t.Errorf("span %q (%s) with parent %q", s.Name, s.Kind, s.ParentSpanID)
+			}
+			if tt.parent != "" && s.TraceID != callerTrace {
+				t.Errorf("trace %s, want the caller's %s", s.TraceID, callerTrace)
+			}
+			if (s.Status == "error") != tt.failed {
+				t.Errorf("status %q", s.Status)
+			}
+			if s.TraceID != traceID(r) {
+				t.Errorf("logged trace ID %q differs from the span's %q", traceID(r), s.TraceID)
+			}
+		})
+	}
+}
+
+func TestTracedQueryer(t *testing.T) {
+	spans := exportedSpans(t)
+	useFakeDB(t, func(string, []driver.Value) (*fakeResult, error) { return nil, nil })
+
+	ctx, parent := tracing.Start(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "handler", tracing.KindInternal)
+	if _, err := traced(ctx, db).Exec("UPDATE users\n   SET name = $1 WHERE id = $2", "Ann", 1); err != nil {
+		t.Fatal(err)
+	}
+	parent.Finish(nil)
+
+	got := spans()
+	if len(got) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(got))
+	}
+	s := got[0]
+	if s.Name != "db UPDATE" || s.ParentSpanID != parent.SpanID || s.Attributes["db.statement"] != "UPDATE users SET name = $1 WHERE id = $2" {
+		t.Errorf("statement span = %+v", s)
+	}
+}
+
+func TestTracedQueryRows(t *testing.T) {
+	spans := exportedSpans(t)
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		if query == "SELECT missing" {
+			return nil, errors.New("relation does not exist")
+		}
+		return &fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+	})
+	q := traced(context.Background(), db)
+
+	rows, err := q.Query("SELECT id FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		if got := spans(); len(got) != 0 {
+			t.Fatalf("span finished while rows were read: %+v", got[0])
+		}
+	}
+	rows.Close()
+	rows.Close()
+
+	got := spans()
+	if len(got) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(got))
+	}
+	if s := got[0]; s.Name != "db SELECT" || s.Attributes["db.rows_read"] != float64(2) || s.Status != "ok" {
+		t.Errorf("query span = %+v", s)
+	}
+
+	if _, err := q.Query("SELECT missing"); err == nil {
+		t.Fatal("no error")
+	}
+	if got := spans(); len(got) != 1 || got[0].Error == "" {
+		t.Errorf("failed query spans = %+v", got)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultTrashLimit = 100
+	maxTrashLimit     = 1000
+)
+
+// adminFlag reads a boolean query parameter that only admins may set. It
+// responds 400 for a malformed value and 403 for a non-admin caller, and
+// returns ok == false in both cases.
+func adminFlag(w http.ResponseWriter, r *http.Request, name string) (value bool, ok bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return false, true
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("%s must be true or false", name))
+		return false, false
+	}
+	if value && !isAdmin(r) {
+		respondWithProblem(w, r, http.StatusForbidden, codeForbidden, fmt.Sprintf("%s requires an admin token", name))
+		return false, false
+	}
+	return value, true
+}
+
+func restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	var id int
+	fmt.Sscanf(pathParts[2], "%d", &id)
+
+	user, err := restoreUser(r.Context(), id)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, user)
+}
+
+func restorePostHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	var id int
+	fmt.Sscanf(pathParts[2], "%d", &id)
+
+	post, err := restorePost(r.Context(), id)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, post)
+}
+
+// trashLimit reads ?limit= for the trash listings
+func trashLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit := defaultTrashLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTrashLimit {
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("limit must be between 1 and %d", maxTrashLimit))
+			return 0, false
+		}
+		limit = n
+	}
+	return limit, true
+}
+
+func listDeletedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondWithProblem(w, r, http.StatusForbidden, codeForbidden, "The trash requires an admin token")
+		return
+	}
+	limit, ok := trashLimit(w, r)
+	if !ok {
+		return
+	}
+
+	users, err := listDeletedUsers(r.Context(), limit)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, users)
+}
+
+func listDeletedPostsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondWithProblem(w, r, http.StatusForbidden, codeForbidden, "The trash requires an admin token")
+		return
+	}
+	limit, ok := trashLimit(w, r)
+	if !ok {
+		return
+	}
+
+	posts, err := listDeletedPosts(r.Context(), limit)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, posts)
+}
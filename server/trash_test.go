@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// asAdmin marks r as authenticated with ADMIN_TOKEN
+func asAdmin(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), roleContextKey, roleAdmin))
+}
+
+func TestReadsExcludeSoftDeleted(t *testing.T) {
+	ctx := context.Background()
+	userView := resourceView{fields: userSchema.fields, include: true, includeFields: postSchema.fields}
+	postView := resourceView{fields: postSchema.fields, include: true, includeFields: userSchema.fields}
+
+	tests := []struct {
+		name string
+		read func() error
+		// filters are the deleted_at checks each statement must make
+		filters []string
+	}{
+		{"user by ID", func() error { _, err := queryUserByID(ctx, 1); return err }, []string{"deleted_at IS NULL"}},
+		{"post by ID", func() error { _, err := queryPostByID(ctx, 1); return err }, []string{"deleted_at IS NULL"}},
+		{"user view with posts", func() error { _, _, err := getUserView(ctx, 1, userView); return err }, []string{"deleted_at IS NULL"}},
+		{"post view with author", func() error { _, _, err := getPostView(ctx, 1, postView); return err }, []string{"p.deleted_at IS NULL", "u.deleted_at IS NULL"}},
+		{"user search", func() error { _, err := searchUsers(ctx, "ann", 0.3, 10); return err }, []string{"deleted_at IS NULL"}},
+		{"user page", func() error { _, err := listUsers(ctx, 0, 10); return err }, []string{"deleted_at IS NULL"}},
+		{"post page", func() error { _, err := listPosts(ctx, 1, 0, 10); return err }, []string{"deleted_at IS NULL"}},
+		{"users by IDs", func() error { _, err := getUsersByIDs(ctx, []int{1, 2}); return err }, []string{"deleted_at IS NULL"}},
+		{"posts by user IDs", func() error { _, err := listPostsByUserIDs(ctx, []int{1, 2}, 0, 10); return err }, []string{"deleted_at IS NULL"}},
+		{"author check on create", func() error { _, err := insertPost(traced(ctx, db), 1, "Hi", "First"); return err }, []string{"deleted_at IS NULL"}},
+		{"row lock before a write", func() error { return lockRow(traced(ctx, db), "users", 1, nil) }, []string{"deleted_at IS NULL"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+				return nil, nil
+			})
+			tt.read()
+
+			ran := 0
+			for _, statement := range fake.statements() {
+				if !strings.Contains(statement, "FROM users") && !strings.Contains(statement, "FROM posts") {
+					continue
+				}
+				ran++
+				for _, filter := range tt.filters {
+					if !strings.Contains(statement, filter) {
+						t.Errorf("%s does not filter %s", statement, filter)
+					}
+				}
+			}
+			if ran == 0 {
+				t.Fatalf("no read among %q", fake.statements())
+			}
+		})
+	}
+}
+
+// trashDB answers the statements of deletes, purges and restores. User 5 has
+// posts 1 and 2; deleted says whether user 5 and post 3 are in the trash,
+// and authorDeleted whether post 3's author is.
+func trashDB(t *testing.T, deleted, authorDeleted bool) *fakeDB {
+	var deletedAt driver.Value
+	if deleted {
+		deletedAt = fixtureTime
+	}
+	return useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT updated_at FROM"):
+			return &fakeResult{columns: []string{"updated_at"}, rows: [][]driver.Value{{fixtureTime}}}, nil
+		case strings.HasPrefix(query, "SELECT deleted_at FROM users"):
+			return &fakeResult{columns: []string{"deleted_at"}, rows: [][]driver.Value{{deletedAt}}}, nil
+		case strings.HasPrefix(query, "SELECT p.deleted_at"):
+			return &fakeResult{columns: []string{"deleted_at", "author_deleted"}, rows: [][]driver.Value{{deletedAt, authorDeleted}}}, nil
+		case strings.HasPrefix(query, "UPDATE posts SET deleted_at = CURRENT_TIMESTAMP WHERE user_id"),
+			strings.HasPrefix(query, "DELETE FROM posts WHERE user_id"):
+			return &fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+		case strings.HasPrefix(query, "UPDATE users SET deleted_at = NULL"):
+			return &fakeResult{columns: userColumns, rows: [][]driver.Value{userRow(5)}}, nil
+		case strings.HasPrefix(query, "UPDATE posts SET deleted_at = NULL WHERE user_id"):
+			return &fakeResult{columns: postColumns, rows: [][]driver.Value{postRow(1, 5)}}, nil
+		case strings.HasPrefix(query, "UPDATE posts SET deleted_at = NULL"):
+			return &fakeResult{columns: postColumns, rows: [][]driver.Value{postRow(3, 5)}}, nil
+		}
+		return &fakeResult{affected: 1}, nil
+	})
+}
+
+// publishedEvents collects the events published while the test runs
+func publishedEvents(t *testing.T) func() []string {
+	saved := events
+	events = newEventBroker(16)
+	t.Cleanup(func() { events = saved })
+	sub, _, _ := events.subscribe(eventFilter{}, 0, false)
+	return func() []string {
+		var types []string
+		for len(sub.ch) > 0 {
+			e := <-sub.ch
+			types = append(types, e.Type+" "+e.Resource)
+		}
+		return types
+	}
+}
+
+func TestDeleteHandlers(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		admin   bool
+		status  int
+		// ran are statement prefixes that must run, skipped ones that must not
+		ran     []string
+		skipped []string
+		events  []string
+	}{
+		{
+			name: "user is soft-deleted with their posts", handler: deleteUserHandler, target: "/users/5",
+			status:  http.StatusOK,
+			ran:     []string{"UPDATE users SET deleted_at = CURRENT_TIMESTAMP", "UPDATE posts SET deleted_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND deleted_at IS NULL"},
+			skipped: []string{"DELETE FROM"},
+			events:  []string{"user.deleted users", "post.deleted posts", "post.deleted posts"},
+		},
+		{
+			name: "post is soft-deleted", handler: deletePostHandler, target: "/posts/3",
+			status:  http.StatusOK,
+			ran:     []string{"UPDATE posts SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1"},
+			skipped: []string{"DELETE FROM"},
+			events:  []string{"post.deleted posts"},
+		},
+		{
+			name: "hard delete needs the admin token", handler: deleteUserHandler, target: "/users/5?hard=true",
+			status:  http.StatusForbidden,
+			skipped: []string{"UPDATE", "DELETE"},
+		},
+		{
+			name: "malformed hard", handler: deleteUserHandler, target: "/users/5?hard=yes", admin: true,
+			status:  http.StatusBadRequest,
+			skipped: []string{"UPDATE", "DELETE"},
+		},
+		{
+			name: "admin purges a user", handler: deleteUserHandler, target: "/users/5?hard=true", admin: true,
+			status:  http.StatusOK,
+			ran:     []string{"DELETE FROM posts WHERE user_id = $1", "DELETE FROM users WHERE id = $1"},
+			skipped: []string{"UPDATE"},
+			events:  []string{"user.deleted users", "post.deleted posts", "post.deleted posts"},
+		},
+		{
+			name: "admin purges a post", handler: deletePostHandler, target: "/posts/3?hard=true", admin: true,
+			status:  http.StatusOK,
+			ran:     []string{"DELETE FROM posts WHERE id = $1"},
+			skipped: []string{"UPDATE"},
+			events:  []string{"post.deleted posts"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := trashDB(t, false, false)
+			published := publishedEvents(t)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, tt.target, nil)
+			if tt.admin {
+				r = asAdmin(r)
+			}
+			tt.handler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			for _, prefix := range tt.ran {
+				if fake.ran(prefix) != 1 {
+					t.Errorf("%q ran %d times, want once", prefix, fake.ran(prefix))
+				}
+			}
+			for _, prefix := range tt.skipped {
+				if fake.ran(prefix) != 0 {
+					t.Errorf("%q ran", prefix)
+				}
+			}
+			if got := published(); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("published %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestRestoreUser(t *testing.T) {
+	fake := trashDB(t, true, false)
+	published := publishedEvents(t)
+
+	user, err := restoreUser(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 5 {
+		t.Errorf("restored user %d", user.ID)
+	}
+	// Only the posts deleted at the same moment as the user come back
+	for i, statement := range fake.statements() {
+		if strings.HasPrefix(statement, "UPDATE posts SET deleted_at = NULL") {
+			if !strings.Contains(statement, "deleted_at = $2") || fake.args[i][1] != fixtureTime {
+				t.Errorf("restored posts with %s %v", statement, fake.args[i])
+			}
+		}
+	}
+	if got, want := published(), []string{"user.restored users", "post.restored posts"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		restore       func(ctx context.Context) error
+		deleted       bool
+		authorDeleted bool
+		want          error
+	}{
+		{"live user", func(ctx context.Context) error { _, err := restoreUser(ctx, 5); return err }, false, false, errUserNotDeleted},
+		{"live post", func(ctx context.Context) error { _, err := restorePost(ctx, 3); return err }, false, false, errPostNotDeleted},
+		{"post of a deleted author", func(ctx context.Context) error { _, err := restorePost(ctx, 3); return err }, true, true, errAuthorDeleted},
+		{"post", func(ctx context.Context) error { _, err := restorePost(ctx, 3); return err }, true, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := trashDB(t, tt.deleted, tt.authorDeleted)
+			publishedEvents(t)
+			if err := tt.restore(context.Background()); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if restored := fake.ran("UPDATE") > 0; restored != (tt.want == nil) {
+				t.Errorf("restored %v: %q", restored, fake.statements())
+			}
+		})
+	}
+}
+
+func TestAdminOnlyReads(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+	}{
+		{"user including deleted", getUserHandler, "/users/5?include_deleted=true"},
+		{"post including deleted", getPostHandler, "/posts/3?include_deleted=true"},
+		{"user trash", listDeletedUsersHandler, "/users/trash"},
+		{"post trash", listDeletedPostsHandler, "/posts/trash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+				if strings.Contains(query, "FROM users") {
+					return &fakeResult{columns: append(userColumns, "deleted_at"), rows: [][]driver.Value{append(userRow(5), fixtureTime)}}, nil
+				}
+				return &fakeResult{columns: append(postColumns, "deleted_at"), rows: [][]driver.Value{append(postRow(3, 5), fixtureTime)}}, nil
+			})
+
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != http.StatusForbidden || len(fake.statements()) != 0 {
+				t.Fatalf("without the admin token: status %d after %q", w.Code, fake.statements())
+			}
+
+			w = httptest.NewRecorder()
+			tt.handler(w, asAdmin(httptest.NewRequest(http.MethodGet, tt.target, nil)))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"deleted_at"`) {
+				t.Errorf("as admin: status %d, body %s", w.Code, w.Body)
+			}
+			for _, statement := range fake.statements() {
+				if strings.Contains(statement, "deleted_at IS NULL") {
+					t.Errorf("admin read hides deleted rows: %s", statement)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// requestValidator checks requests against the same schemas the OpenAPI
+// document publishes
+type requestValidator struct {
+	schemas map[string]*jsonSchema
+	fields  []FieldError
+}
+
+// validateRequests rejects requests to group that do not match their route's
+// parameters or body schema with a 400 listing every problem, and bodies in
+// an unsupported media type with a 415. Requests no route matches are left
+// for dispatch to answer.
+func validateRequests(group []route, next http.HandlerFunc) http.HandlerFunc {
+	b := newSchemaBuilder()
+	// Body schemas by method and pattern, then by media type
+	bodies := map[string]map[string]*jsonSchema{}
+	for _, rt := range group {
+		if rt.request == nil {
+			continue
+		}
+		body := b.schemaFor(reflect.TypeOf(rt.request), true)
+		if rt.method == http.MethodPatch {
+			bodies[rt.method+" "+rt.pattern] = map[string]*jsonSchema{
+				mediaTypeMergePatch: body,
+				mediaTypeJSONPatch:  b.schemaFor(reflect.TypeOf([]patchOperation{}), true),
+			}
+		} else {
+			bodies[rt.method+" "+rt.pattern] = map[string]*jsonSchema{mediaTypeJSON: body}
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt, ok := findRoute(group, r)
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		v := &requestValidator{schemas: b.components}
+		v.checkParams(rt, r)
+
+		if schemas, ok := bodies[rt.method+" "+rt.pattern]; ok {
+			mediaType, schema, ok := bodySchema(rt, schemas, r.Header.Get("Content-Type"))
+			if !ok {
+				respondWithProblem(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+					"Content-Type must be "+strings.Join(sortedKeys(schemas), " or "))
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				respondWithError(w, r, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			var value interface{}
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+			if err := dec.Decode(&value); err != nil {
+				respondWithProblem(w, r, http.StatusBadRequest, codeInvalidBody, "Request body is not valid "+mediaType)
+				return
+			}
+			v.check(schema, value, "body")
+		}
+
+		if len(v.fields) > 0 {
+			respondWithError(w, r, &apiError{
+				status: http.StatusBadRequest,
+				code:   codeValidationFailed,
+				detail: "The request does not match the API description at /openapi.json",
+				fields: v.fields,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bodySchema picks the body schema for a Content-Type. A missing
+// Content-Type is read as JSON, or as a merge patch on PATCH routes.
+func bodySchema(rt route, schemas map[string]*jsonSchema, contentType string) (string, *jsonSchema, bool) {
+	if rt.method == http.MethodPatch {
+		mediaType, err := patchMediaType(contentType)
+		if err != nil {
+			return "", nil, false
+		}
+		return mediaType, schemas[mediaType], true
+	}
+	if contentType == "" {
+		return mediaTypeJSON, schemas[mediaTypeJSON], true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || schemas[mediaType] == nil {
+		return "", nil, false
+	}
+	return mediaType, schemas[mediaType], true
+}
+
+func sortedKeys(m map[string]*jsonSchema) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *requestValidator) fail(field, code, format string, args ...interface{}) {
+	v.fields = append(v.fields, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// checkParams checks the path, query and header parameters of rt
+func (v *requestValidator) checkParams(rt route, r *http.Request) {
+	segments := strings.Split(r.URL.Path, "/")
+	query := r.URL.Query()
+	for i, pattern := range strings.Split(rt.pattern, "/") {
+		if !strings.HasPrefix(pattern, "{") {
+			continue
+		}
+		name := strings.Trim(pattern, "{}")
+		for _, p := range rt.params {
+			if p.in == "path" && p.name == name {
+				v.checkParam(p, segments[i], true)
+			}
+		}
+	}
+	for _, p := range rt.params {
+		switch p.in {
+		case "query":
+			v.checkParam(p, query.Get(p.name), query.Has(p.name))
+		case "header":
+			v.checkParam(p, r.Header.Get(p.name), r.Header.Get(p.name) != "")
+		}
+	}
+}
+
+func (v *requestValidator) checkParam(p param, raw string, present bool) {
+	field := p.in + "." + p.name
+	if !present || (raw == "" && p.in == "path") {
+		if p.required {
+			v.fail(field, "required", "%s is required", p.name)
+		}
+		return
+	}
+
+	var n float64
+	switch p.kind {
+	case "boolean":
+		if _, err := strconv.ParseBool(raw); err != nil {
+			v.fail(field, "type", "%s must be true or false", p.name)
+		}
+		return
+	case "integer":
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			v.fail(field, "type", "%s must be an integer", p.name)
+			return
+		}
+		n = float64(i)
+	case "number":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			v.fail(field, "type", "%s must be a number", p.name)
+			return
+		}
+		n = f
+	default:
+		return
+	}
+	v.checkRange(field, p.name, n, p.minimum, p.maximum)
+}
+
+func (v *requestValidator) checkRange(field, name string, n float64, minimum, maximum *float64) {
+	if minimum != nil && n < *minimum {
+		v.fail(field, "minimum", "%s must be at least %v", name, *minimum)
+	}
+	if maximum != nil && n > *maximum {
+		v.fail(field, "maximum", "%s must be at most %v", name, *maximum)
+	}
+}
+
+// check validates a decoded JSON value against s, naming problems after
+// field, e.g. body.operations[2].action
+func (v *requestValidator) check(s *jsonSchema, value interface{}, field string) {
+	if s.Ref != "" {
+		s = v.schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	name := field[strings.LastIndexAny(field, ".[")+1:]
+	name = strings.TrimSuffix(name, "]")
+
+	if s.Type != nil && !typeMatches(s.Type, value) {
+		v.fail(field, "type", "%s must be %s", name, describeType(s.Type))
+		return
+	}
+	if len(s.Enum) > 0 {
+		str, _ := value.(string)
+		if !slices.Contains(s.Enum, str) {
+			v.fail(field, "enum", "%s must be one of %s", name, strings.Join(s.Enum, ", "))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		if s.MinLength != nil && utf8.RuneCountInString(value) < *s.MinLength {
+			v.fail(field, "required", "%s is required", name)
+		}
+	case json.Number:
+		if n, err := value.Float64(); err == nil {
+			v.checkRange(field, name, n, s.Minimum, s.Maximum)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				v.check(s.Items, item, fmt.Sprintf("%s[%d]", field, i))
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := value[key]; !ok {
+				v.fail(field+"."+key, "required", "%s is required", key)
+			}
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			item := value[key]
+			if prop, ok := s.Properties[key]; ok {
+				v.check(prop, item, field+"."+key)
+			} else if s.AdditionalProperties != nil {
+				v.check(s.AdditionalProperties, item, field+"."+key)
+			}
+		}
+	}
+}
+
+// jsonType is the JSON Schema type of a value decoded with UseNumber
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func typeMatches(want interface{}, value interface{}) bool {
+	got := jsonType(value)
+	var types []string
+	switch want := want.(type) {
+	case string:
+		types = []string{want}
+	case []string:
+		types = want
+	}
+	for _, typ := range types {
+		if typ == got || (typ == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func describeType(want interface{}) string {
+	names := map[string]string{
+		"null": "null", "boolean": "a boolean", "string": "a string", "integer": "an integer",
+		"number": "a number", "array": "an array", "object": "an object",
+	}
+	switch want := want.(type) {
+	case string:
+		return names[want]
+	case []string:
+		described := make([]string, len(want))
+		for i, typ := range want {
+			described[i] = names[typ]
+		}
+		return strings.Join(described, " or ")
+	}
+	return ""
+}
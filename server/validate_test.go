@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		status      int
+		// fields are the reported fields, in order, when the status is 400
+		fields []string
+	}{
+		{name: "valid create", method: http.MethodPost, target: "/users", body: `{"name":"Ann","email":"a@b.c","username":"ann"}`, status: http.StatusOK},
+		{name: "JSON with a charset", method: http.MethodPost, target: "/users", contentType: "application/json; charset=utf-8", body: `{"name":"Ann","email":"a@b.c","username":"ann"}`, status: http.StatusOK},
+		{name: "wrong Content-Type", method: http.MethodPost, target: "/users", contentType: "text/plain", body: `{}`, status: http.StatusUnsupportedMediaType},
+		{name: "JSON Patch on a POST", method: http.MethodPost, target: "/users", contentType: mediaTypeJSONPatch, body: `[]`, status: http.StatusUnsupportedMediaType},
+		{name: "malformed body", method: http.MethodPost, target: "/users", body: `{"name":`, status: http.StatusBadRequest},
+		{name: "required field missing", method: http.MethodPost, target: "/users", body: `{"name":"Ann","email":"a@b.c"}`, status: http.StatusBadRequest, fields: []string{"body.username"}},
+		{name: "required field empty", method: http.MethodPost, target: "/users", body: `{"name":"","email":"a@b.c","username":"ann"}`, status: http.StatusBadRequest, fields: []string{"body.name"}},
+		{name: "string for a string field", method: http.MethodPost, target: "/users", body: `{"name":1,"email":"a@b.c","username":"ann"}`, status: http.StatusBadRequest, fields: []string{"body.name"}},
+		{name: "number for an integer", method: http.MethodPost, target: "/posts", body: `{"userId":1.5,"title":"t","body":"b"}`, status: http.StatusBadRequest, fields: []string{"body.userId"}},
+		{name: "merge patch by default", method: http.MethodPatch, target: "/posts/1", body: `{"title":"t"}`, status: http.StatusOK},
+		{name: "plain JSON is a merge patch", method: http.MethodPatch, target: "/posts/1", contentType: mediaTypeJSON, body: `{"title":"t"}`, status: http.StatusOK},
+		{name: "null for a nullable field", method: http.MethodPatch, target: "/posts/1", contentType: mediaTypeMergePatch, body: `{"userId":null}`, status: http.StatusOK},
+		{name: "string for a nullable integer", method: http.MethodPatch, target: "/posts/1", contentType: mediaTypeMergePatch, body: `{"userId":"1"}`, status: http.StatusBadRequest, fields: []string{"body.userId"}},
+		{name: "JSON Patch", method: http.MethodPatch, target: "/posts/1", contentType: mediaTypeJSONPatch, body: `[{"op":"replace","path":"/title","value":"t"}]`, status: http.StatusOK},
+		{name: "merge patch body as JSON Patch", method: http.MethodPatch, target: "/posts/1", contentType: mediaTypeJSONPatch, body: `{"title":"t"}`, status: http.StatusBadRequest, fields: []string{"body"}},
+		{name: "JSON Patch operation without op", method: http.MethodPatch, target: "/posts/1", contentType: mediaTypeJSONPatch, body: `[{"op":"test","path":"/title"},{"path":"/title"}]`, status: http.StatusBadRequest, fields: []string{"body[1].op"}},
+		{name: "unsupported patch type", method: http.MethodPatch, target: "/posts/1", contentType: "text/plain", body: `{}`, status: http.StatusUnsupportedMediaType},
+		{
+			name: "nested paths", method: http.MethodPost, target: "/batch",
+			body: `{"operations":[
+				{"action":"create","resource":"users"},
+				{"action":"update","resource":"posts"},
+				{"action":"archive","resource":"comments"}]}`,
+			status: http.StatusBadRequest, fields: []string{"body.operations[2].action", "body.operations[2].resource"},
+		},
+		{name: "path param below its minimum", method: http.MethodGet, target: "/users/0", status: http.StatusBadRequest, fields: []string{"path.id"}},
+		{name: "path param not an integer", method: http.MethodGet, target: "/users/abc", status: http.StatusBadRequest, fields: []string{"path.id"}},
+		{name: "query params in range", method: http.MethodGet, target: "/users/search?q=ann&min_score=0.5&limit=100", status: http.StatusOK},
+		{name: "query params out of range", method: http.MethodGet, target: "/users/search?q=ann&min_score=1.5&limit=0", status: http.StatusBadRequest, fields: []string{"query.min_score", "query.limit"}},
+		{name: "required query param missing", method: http.MethodGet, target: "/users/search?limit=x", status: http.StatusBadRequest, fields: []string{"query.q", "query.limit"}},
+		{name: "boolean query param", method: http.MethodGet, target: "/users/1?include_deleted=maybe", status: http.StatusBadRequest, fields: []string{"query.include_deleted"}},
+		{name: "optional params absent", method: http.MethodGet, target: "/events", status: http.StatusOK},
+		{name: "unknown route", method: http.MethodGet, target: "/nowhere/0", status: http.StatusOK},
+	}
+	handler := validateRequests(routes, func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			handler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.fields == nil {
+				return
+			}
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for _, field := range problem.Errors {
+				fields = append(fields, field.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("fields = %q, want %q", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestValidateRequestsLastEventID(t *testing.T) {
+	handler := validateRequests(routes, func(w http.ResponseWriter, r *http.Request) {})
+	for value, status := range map[string]int{"0": http.StatusOK, "-1": http.StatusBadRequest, "x": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/events", nil)
+		r.Header.Set("Last-Event-ID", value)
+		handler(w, r)
+		if w.Code != status {
+			t.Errorf("Last-Event-ID %q: status = %d, want %d", value, w.Code, status)
+		}
+	}
+}
+
+func TestValidatorMessages(t *testing.T) {
+	b := newSchemaBuilder()
+	schema := b.schemaFor(reflect.TypeOf(BatchRequest{}), true)
+	v := &requestValidator{schemas: b.components}
+	var body interface{}
+	dec := json.NewDecoder(strings.NewReader(`{"atomic":"yes","operations":[{"action":"delete","resource":"posts","ifMatch":1}]}`))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	v.check(schema, body, "body")
+
+	want := []FieldError{
+		{Field: "body.atomic", Code: "type", Message: "atomic must be a boolean"},
+		{Field: "body.operations[0].ifMatch", Code: "type", Message: "ifMatch must be a string"},
+	}
+	if !reflect.DeepEqual(v.fields, want) {
+		t.Errorf("fields = %+v, want %+v", v.fields, want)
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	type sample struct {
+		ID       int               `json:"id"`
+		Score    float64           `json:"score"`
+		Name     string            `json:"name"`
+		Nickname string            `json:"nickname,omitempty"`
+		Parent   *int              `json:"parent"`
+		Tags     []string          `json:"tags"`
+		Labels   map[string]string `json:"labels"`
+		Kind     string            `json:"kind" enum:"a,b"`
+		Skipped  string            `json:"-"`
+	}
+	tests := []struct {
+		request  bool
+		property string
+		want     *jsonSchema
+	}{
+		{false, "id", &jsonSchema{Type: "integer"}},
+		{false, "score", &jsonSchema{Type: "number"}},
+		{false, "name", &jsonSchema{Type: "string"}},
+		{true, "name", &jsonSchema{Type: "string", MinLength: new(int)}},
+		{true, "nickname", &jsonSchema{Type: "string"}},
+		{true, "parent", &jsonSchema{Type: []string{"integer", "null"}}},
+		{false, "tags", &jsonSchema{Type: "array", Items: &jsonSchema{Type: "string"}}},
+		{false, "labels", &jsonSchema{Type: "object", AdditionalProperties: &jsonSchema{Type: "string"}}},
+		{false, "kind", &jsonSchema{Type: "string", Enum: []string{"a", "b"}}},
+	}
+	*tests[3].want.MinLength = 1
+	for _, tt := range tests {
+		b := newSchemaBuilder()
+		ref := b.schemaFor(reflect.TypeOf(sample{}), tt.request)
+		if ref.Ref != "#/components/schemas/Sample" {
+			t.Fatalf("ref = %q", ref.Ref)
+		}
+		s := b.components["Sample"]
+		if got := s.Properties[tt.property]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("request %v: %s = %+v, want %+v", tt.request, tt.property, got, tt.want)
+		}
+		if _, ok := s.Properties["Skipped"]; ok {
+			t.Error(`json:"-" field in the schema`)
+		}
+		if want := []string{"id", "score", "name", "tags", "labels", "kind"}; !reflect.DeepEqual(s.Required, want) {
+			t.Errorf("required = %q, want %q", s.Required, want)
+		}
+	}
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	saved := openAPIDocument
+	defer func() { openAPIDocument = saved }()
+	doc, err := buildOpenAPI(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openAPIDocument = doc
+
+	w := httptest.NewRecorder()
+	openAPIHandler(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var served struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+
+	operations := 0
+	seen := map[string]bool{}
+	for _, rt := range routes {
+		op, ok := served.Paths[rt.pattern][strings.ToLower(rt.method)]
+		if !ok {
+			t.Errorf("%s %s missing from /openapi.json", rt.method, rt.pattern)
+			continue
+		}
+		if op.OperationID != operationID(rt) || seen[op.OperationID] {
+			t.Errorf("%s %s: operationId %q is wrong or not unique", rt.method, rt.pattern, op.OperationID)
+		}
+		seen[op.OperationID] = true
+	}
+	for _, methods := range served.Paths {
+		operations += len(methods)
+	}
+	if operations != len(routes) {
+		t.Errorf("/openapi.json has %d operations, the route table %d", operations, len(routes))
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiVersion is one version of the JSON shapes the API returns
+type apiVersion struct {
+	name string
+	// transform rewrites a response tree (see toTree) from the current
+	// internal shape into this version's shape. nil means no change.
+	transform func(tree interface{}) interface{}
+	// upgrade rewrites a request body for rt, decoded with UseNumber, from
+	// this version's shape into the current internal one. nil means no
+	// change.
+	upgrade func(rt route, body interface{}) interface{}
+	// deprecated and sunset are announced with the Deprecation and Sunset
+	// headers when set. They come from configuration, since the dates are
+	// the operator's promise to clients.
+	deprecated time.Time
+	sunset     time.Time
+}
+
+// apiVersions lists every supported version, oldest first
+var apiVersions = []*apiVersion{
+	{
+		name: "1",
+	},
+	{
+		name:      "2",
+		transform: nestAuthors,
+		upgrade:   flattenAuthors,
+	},
+}
+
+// DEFAULT_API_VERSION serves requests that name no version, including the
+// unversioned paths
+var DEFAULT_API_VERSION = "1"
+
+// versionContextKey holds the *apiVersion of the request, set by
+// versionMiddleware
+const versionContextKey contextKey = "version"
+
+// parseAnnouncedDate parses API_V1_DEPRECATION or API_V1_SUNSET, either a
+// date, taken as midnight UTC, or an RFC 3339 time
+func parseAnnouncedDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func findAPIVersion(name string) *apiVersion {
+	name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "v")
+	for _, version := range apiVersions {
+		if version.name == name {
+			return version
+		}
+	}
+	return nil
+}
+
+// latestAPIVersion is the version successor-version links point to
+func latestAPIVersion() *apiVersion {
+	return apiVersions[len(apiVersions)-1]
+}
+
+// versionMiddleware selects the API version from a /v<n> path prefix, which
+// it strips before routing, or else from the API-Version header, or else
+// DEFAULT_API_VERSION. It announces the version, and any deprecation, in the
+// response headers.
+func versionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "API-Version")
+
+		version, path, fromPath := versionFromPath(r.URL.Path)
+		if !fromPath {
+			name := r.Header.Get("API-Version")
+			if name == "" {
+				name = DEFAULT_API_VERSION
+			}
+			if version = findAPIVersion(name); version == nil {
+				respondWithProblem(w, r, http.StatusBadRequest, codeUnsupportedVersion, "Supported API versions are "+supportedVersionNames())
+				return
+			}
+		}
+		if version == nil {
+			respondWithProblem(w, r, http.StatusNotFound, codeUnsupportedVersion, "Supported API versions are "+supportedVersionNames())
+			return
+		}
+
+		w.Header().Set("API-Version", version.name)
+		if !version.deprecated.IsZero() {
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(version.deprecated.Unix(), 10))
+			latest := latestAPIVersion()
+			w.Header().Add("Link", `</v`+latest.name+path+`>; rel="successor-version"`)
+		}
+		if !version.sunset.IsZero() {
+			w.Header().Set("Sunset", version.sunset.UTC().Format(http.TimeFormat))
+		}
+
+		if fromPath {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = path
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), versionContextKey, version)))
+	})
+}
+
+// versionFromPath splits a /v<n>/... path. fromPath is false when the path
+// has no version prefix; version is nil when it names an unknown version.
+func versionFromPath(path string) (version *apiVersion, rest string, fromPath bool) {
+	if len(path) < 3 || path[1] != 'v' || path[2] < '0' || path[2] > '9' {
+		return nil, path, false
+	}
+	prefix, rest, _ := strings.Cut(path[1:], "/")
+	if _, err := strconv.Atoi(prefix[1:]); err != nil {
+		return nil, path, false
+	}
+	return findAPIVersion(prefix), "/" + rest, true
+}
+
+// requestAPIVersion returns the version selected for r
+func requestAPIVersion(r *http.Request) *apiVersion {
+	if version, ok := r.Context().Value(versionContextKey).(*apiVersion); ok {
+		return version
+	}
+	return findAPIVersion(DEFAULT_API_VERSION)
+}
+
+func supportedVersionNames() string {
+	names := make([]string, len(apiVersions))
+	for i, version := range apiVersions {
+		names[i] = version.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// nestAuthors is the v2 transform: a post's userId becomes an author object,
+// {"author": {"id": 1}}, in the same position. A post that already embeds
+// its author (?include=author) keeps that object.
+func nestAuthors(tree interface{}) interface{} {
+	switch v := tree.(type) {
+	case []interface{}:
+		for i, item := range v {
+			v[i] = nestAuthors(item)
+		}
+	case *record:
+		for _, key := range v.keys {
+			v.values[key] = nestAuthors(v.values[key])
+		}
+		// Only posts have a userId field
+		if userID, ok := v.values["userId"]; ok {
+			author, embedded := v.values["author"].(*record)
+			if !embedded {
+				author = newRecord()
+				author.set("id", userID)
+			}
+			v.rename("userId", "author", author)
+		}
+	}
+	return tree
+}
+
+// upgradeRequests rewrites the JSON request bodies of group from the
+// request's API version into the current shape, so validation and handlers
+// only ever see one shape. Bodies that are not JSON are left for them to
+// reject.
+func upgradeRequests(group []route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := requestAPIVersion(r)
+		rt, ok := findRoute(group, r)
+		if version.upgrade == nil || !ok || rt.request == nil || r.Body == nil || r.Body == http.NoBody {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		var value interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if dec.Decode(&value) == nil && !dec.More() {
+			if upgraded, err := json.Marshal(version.upgrade(rt, value)); err == nil {
+				body = upgraded
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	}
+}
+
+// flattenAuthors is the v2 request upgrade, the reverse of nestAuthors: a
+// post's author object becomes its userId. It applies to post bodies,
+// merge patches and JSON Patch paths like /author/id, and to the post
+// bodies of a batch. A body that already has a userId is left alone.
+func flattenAuthors(rt route, body interface{}) interface{} {
+	switch rt.pattern {
+	case "/posts", "/posts/{id}":
+		if ops, ok := body.([]interface{}); ok && rt.method == http.MethodPatch {
+			for _, op := range ops {
+				if op, ok := op.(map[string]interface{}); ok {
+					flattenAuthorPatch(op)
+				}
+			}
+			return ops
+		}
+		return flattenAuthor(body)
+	case "/batch":
+		batch, _ := body.(map[string]interface{})
+		ops, _ := batch["operations"].([]interface{})
+		for _, op := range ops {
+			if op, ok := op.(map[string]interface{}); ok && op["resource"] == "posts" {
+				if _, ok := op["body"]; ok {
+					op["body"] = flattenAuthor(op["body"])
+				}
+			}
+		}
+	}
+	return body
+}
+
+// flattenAuthor replaces {"author": {"id": 1}} with {"userId": 1}. Other
+// fields of the author, as in a post fetched with ?include=author, are
+// dropped, since a post can only change which user it belongs to.
+func flattenAuthor(body interface{}) interface{} {
+	post, ok := body.(map[string]interface{})
+	if !ok {
+		return body
+	}
+	if _, ok := post["userId"]; ok {
+		return body
+	}
+	switch author := post["author"].(type) {
+	case nil:
+		if _, ok := post["author"]; ok {
+			delete(post, "author")
+			post["userId"] = nil
+		}
+	case map[string]interface{}:
+		if id, ok := author["id"]; ok {
+			delete(post, "author")
+			post["userId"] = id
+		}
+	}
+	return body
+}
+
+// flattenAuthorPatch rewrites the paths of a JSON Patch operation that
+// point into the author to /userId
+func flattenAuthorPatch(op map[string]interface{}) {
+	for _, key := range []string{"path", "from"} {
+		switch op[key] {
+		case "/author/id":
+			op[key] = "/userId"
+		case "/author":
+			op[key] = "/userId"
+			if author, ok := op["value"].(map[string]interface{}); ok && key == "path" {
+				op["value"] = author["id"]
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionMiddleware(t *testing.T) {
+	v1 := apiVersions[0]
+	savedDeprecated, savedSunset := v1.deprecated, v1.sunset
+	defer func() { v1.deprecated, v1.sunset = savedDeprecated, savedSunset }()
+	v1.deprecated = time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	v1.sunset = time.Date(2027, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		target  string
+		header  string
+		status  int
+		version string
+		path    string
+	}{
+		{name: "unversioned alias", target: "/users/1", status: http.StatusOK, version: "1", path: "/users/1"},
+		{name: "header on an alias", target: "/users/1", header: "2", status: http.StatusOK, version: "2", path: "/users/1"},
+		{name: "header with a v", target: "/users/1", header: "v2", status: http.StatusOK, version: "2", path: "/users/1"},
+		{name: "path prefix", target: "/v2/users/1", status: http.StatusOK, version: "2", path: "/users/1"},
+		{name: "path wins over the header", target: "/v1/users/1", header: "2", status: http.StatusOK, version: "1", path: "/users/1"},
+		{name: "path wins over a bad header", target: "/v2/users/1", header: "9", status: http.StatusOK, version: "2", path: "/users/1"},
+		{name: "version root", target: "/v2", status: http.StatusOK, version: "2", path: "/"},
+		{name: "unknown version in the header", target: "/users/1", header: "3", status: http.StatusBadRequest},
+		{name: "unknown version in the path", target: "/v3/users/1", status: http.StatusNotFound},
+		{name: "path that only starts like a version", target: "/videos", status: http.StatusOK, version: "1", path: "/videos"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var version *apiVersion
+			var path string
+			handler := versionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				version, path = requestAPIVersion(r), r.URL.Path
+			}))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("API-Version", tt.header)
+			}
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if version != nil {
+					t.Error("handler reached with an unknown version")
+				}
+				return
+			}
+			if version.name != tt.version || path != tt.path {
+				t.Errorf("routed %q as version %s, want %q as %s", path, version.name, tt.path, tt.version)
+			}
+			header := w.Header()
+			if header.Get("API-Version") != tt.version {
+				t.Errorf("API-Version = %q", header.Get("API-Version"))
+			}
+			deprecated := tt.version == "1"
+			if got := header.Get("Deprecation"); (got == "@1798761600") != deprecated {
+				t.Errorf("Deprecation = %q", got)
+			}
+			if got := header.Get("Sunset"); (got == "Thu, 01 Jul 2027 00:00:00 GMT") != deprecated {
+				t.Errorf("Sunset = %q", got)
+			}
+			if got := header.Get("Link"); deprecated && got != `</v2`+tt.path+`>; rel="successor-version"` {
+				t.Errorf("Link = %q", got)
+			}
+		})
+	}
+}
+
+func TestUpgradeRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     string
+		method      string
+		target      string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name: "v2 create", version: "2", method: http.MethodPost, target: "/posts",
+			body: `{"author":{"id":3},"title":"t","body":"b"}`,
+			want: `{"body":"b","title":"t","userId":3}`,
+		},
+		{
+			name: "v2 replace with an embedded author", version: "2", method: http.MethodPut, target: "/posts/1",
+			body: `{"author":{"id":3,"name":"Ann"},"title":"t","body":"b"}`,
+			want: `{"body":"b","title":"t","userId":3}`,
+		},
+		{
+			name: "v2 merge patch", version: "2", method: http.MethodPatch, target: "/posts/1",
+			contentType: mediaTypeMergePatch, body: `{"author":{"id":4}}`,
+			want: `{"userId":4}`,
+		},
+		{
+			name: "v2 JSON Patch", version: "2", method: http.MethodPatch, target: "/posts/1",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op":"test","path":"/author","value":{"id":3}},{"op":"replace","path":"/author/id","value":4}]`,
+			want:        `[{"op":"test","path":"/userId","value":3},{"op":"replace","path":"/userId","value":4}]`,
+		},
+		{
+			name: "v2 batch", version: "2", method: http.MethodPost, target: "/batch",
+			body: `{"operations":[{"action":"create","resource":"posts","body":{"author":{"id":{"$ref":"u"}},"title":"t","body":"b"}},{"action":"create","resource":"users","body":{"author":1}}]}`,
+			want: `{"operations":[{"action":"create","body":{"body":"b","title":"t","userId":{"$ref":"u"}},"resource":"posts"},{"action":"create","body":{"author":1},"resource":"users"}]}`,
+		},
+		{
+			name: "v2 body that uses userId", version: "2", method: http.MethodPost, target: "/posts",
+			body: `{"userId":3,"title":"t","body":"b"}`,
+			want: `{"body":"b","title":"t","userId":3}`,
+		},
+		{
+			name: "v2 user body", version: "2", method: http.MethodPost, target: "/users",
+			body: `{"author":{"id":3}}`,
+			want: `{"author":{"id":3}}`,
+		},
+		{
+			name: "v1 keeps an author field", version: "1", method: http.MethodPost, target: "/posts",
+			body: `{"author":{"id":3}}`,
+			want: `{"author":{"id":3}}`,
+		},
+		{
+			name: "malformed JSON is passed on", version: "2", method: http.MethodPost, target: "/posts",
+			body: `{"author":`,
+			want: `{"author":`,
+		},
+		{
+			name: "trailing data is passed on", version: "2", method: http.MethodPost, target: "/posts",
+			body: `{"author":{"id":3}} {}`,
+			want: `{"author":{"id":3}} {}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := upgradeRequests(routes, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				got = string(body)
+				if r.ContentLength != int64(len(body)) {
+					t.Errorf("Content-Length = %d for %d bytes", r.ContentLength, len(body))
+				}
+			})
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), versionContextKey, findAPIVersion(tt.version)))
+			handler(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A v2 client can send back the post it read, author and all
+func TestV2PostRoundTrip(t *testing.T) {
+	handler := upgradeRequests(routes, validateRequests(routes, func(w http.ResponseWriter, r *http.Request) {
+		var req CreatePostRequest
+		if err := decodeJSONBody(r, &req); err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(req)
+	}))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/posts/1", strings.NewReader(`{"title":"t","body":"b","author":{"id":3}}`))
+	r = r.WithContext(context.WithValue(r.Context(), versionContextKey, findAPIVersion("2")))
+	handler(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"userId":3`) {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
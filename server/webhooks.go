@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// WEBHOOK_MAX_ATTEMPTS is how many times a delivery is tried before it is
+	// marked dead
+	WEBHOOK_MAX_ATTEMPTS = 8
+	// WEBHOOK_RETRY_BASE is the wait after the first failure. It doubles with
+	// every further failure, up to maxWebhookBackoff.
+	WEBHOOK_RETRY_BASE = 30 * time.Second
+	// WEBHOOK_TIMEOUT bounds one delivery attempt
+	WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+const (
+	maxWebhookBackoff = 6 * time.Hour
+	// webhookBatchSize is how many due deliveries the worker claims at once
+	webhookBatchSize = 20
+	// webhookPollInterval is how often the worker looks for due retries when
+	// nothing new was published
+	webhookPollInterval = 5 * time.Second
+	// maxWebhookResponse is how much of a receiver's response is kept for the
+	// delivery log
+	maxWebhookResponse = 1024
+
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+// Delivery states
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryDead      = "dead"
+)
+
+var (
+	errWebhookNotFound  = errors.New("webhook not found")
+	errDeliveryNotFound = errors.New("delivery not found")
+)
+
+// Webhook is a subscription that receives matching events by POST. Secret is
+// only returned when the webhook is created.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret signs deliveries; one is generated when it is empty
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is one event queued for one webhook, with the outcome of
+// its latest attempt
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int             `json:"webhookId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status" enum:"pending,succeeded,dead"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty"`
+	LastStatusCode *int            `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+func (req CreateWebhookRequest) validate() error {
+	invalid := &validationError{msg: "A webhook needs an http(s) url and at least one event type"}
+	invalid.require("url", req.URL)
+	if req.URL != "" {
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid.fields = append(invalid.fields, FieldError{Field: "url", Code: "format", Message: "url must be an absolute http or https URL"})
+		}
+	}
+	if len(req.Events) == 0 {
+		invalid.fields = append(invalid.fields, FieldError{Field: "events", Code: "required", Message: "events is required"})
+	}
+	for i, typ := range req.Events {
+		if typ != "*" && !slices.Contains(eventTypes, typ) {
+			invalid.fields = append(invalid.fields, FieldError{Field: fmt.Sprintf("events[%d]", i), Code: "enum",
+				Message: fmt.Sprintf("events must be * or one of %s", strings.Join(eventTypes, ", "))})
+		}
+	}
+	if len(invalid.fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// requireAdmin responds 403 unless the request has the admin token. Webhooks
+// hold secrets and make the server call arbitrary URLs, so only admins may
+// manage them.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !isAdmin(r) {
+		respondWithProblem(w, r, http.StatusForbidden, codeForbidden, "Webhooks require an admin token")
+		return false
+	}
+	return true
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req CreateWebhookRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook, err := createWebhook(req.URL, req.Events, req.Secret)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	webhook.Secret = req.Secret
+	respond(w, r, http.StatusCreated, webhook)
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	webhooks, err := listWebhooks()
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, webhooks)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	pathParts := strings.Split(r.URL.Path, "/")
+	var id int
+	fmt.Sscanf(pathParts[2], "%d", &id)
+
+	webhook, err := getWebhook(id)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, webhook)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	pathParts := strings.Split(r.URL.Path, "/")
+	var id int
+	fmt.Sscanf(pathParts[2], "%d", &id)
+
+	if err := deleteWebhook(id); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, SuccessResponse{Message: "Webhook deleted successfully", Data: map[string]int{"id": id}})
+}
+
+// listDeliveriesHandler is the delivery log of one webhook, newest first,
+// optionally narrowed with ?status=
+func listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	pathParts := strings.Split(r.URL.Path, "/")
+	var id int
+	fmt.Sscanf(pathParts[2], "%d", &id)
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != deliveryPending && status != deliverySucceeded && status != deliveryDead {
+		respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "status must be pending, succeeded or dead")
+		return
+	}
+	limit := defaultDeliveryLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			respondWithProblem(w, r, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("limit must be between 1 and %d", maxDeliveryLimit))
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := listDeliveries(id, status, limit)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, deliveries)
+}
+
+// redeliverHandler queues a new delivery of the same payload, whatever the
+// state of the original
+func redeliverHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	pathParts := strings.Split(r.URL.Path, "/")
+	var id int
+	var deliveryID int64
+	fmt.Sscanf(pathParts[2], "%d", &id)
+	fmt.Sscanf(pathParts[4], "%d", &deliveryID)
+
+	delivery, err := redeliver(id, deliveryID)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	wakeWebhookWorker()
+	respond(w, r, http.StatusAccepted, delivery)
+}
+
+// Delivery
+
+// webhookClient does not follow redirects: a 3xx counts as a failed attempt
+var webhookClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// webhookWake lets enqueueing skip the wait for the next poll
+var webhookWake = make(chan struct{}, 1)
+
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// queueWebhookDeliveries queues each change for every webhook subscribed to
+// its type. It runs in the transaction that made the changes, so deliveries
+// exist exactly for the changes that commit.
+func queueWebhookDeliveries(tx queryer, changes []Event) error {
+	query := `INSERT INTO webhook_deliveries (webhook_id, event_type, payload)
+	          SELECT id, $1, $2 FROM webhooks WHERE $1 = ANY(events) OR '*' = ANY(events)`
+	for _, e := range changes {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encoding webhook payload: %w", err)
+		}
+		if _, err := tx.Exec(query, e.Type, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverWebhooks sends due deliveries until stop is closed, finishing the
+// attempts already started. Claiming deliveries with SKIP LOCKED lets several
+// server instances share the queue.
+func deliverWebhooks(stop <-chan struct{}) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			claimed, err := claimDueDeliveries(webhookBatchSize)
+			if err != nil {
+				slog.Error("claiming webhook deliveries", "error", err)
+				break
+			}
+			var wg sync.WaitGroup
+			for _, d := range claimed {
+				wg.Add(1)
+				go func(d claimedDelivery) {
+					defer wg.Done()
+					attemptDelivery(d)
+				}(d)
+			}
+			wg.Wait()
+			if len(claimed) < webhookBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-webhookWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimedDelivery is a due delivery with what is needed to send it
+type claimedDelivery struct {
+	id        int64
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+func attemptDelivery(d claimedDelivery) {
+	status, body, err := sendWebhook(d.url, d.secret, d.id, d.eventType, d.payload)
+	attempts := d.attempts + 1
+	if err == nil {
+		if err := recordDelivery(d.id, attempts, deliverySucceeded, status, "", 0); err != nil {
+			slog.Error("recording webhook delivery", "delivery_id", d.id, "error", err)
+		}
+		return
+	}
+
+	message := err.Error()
+	if body != "" {
+		message += ": " + body
+	}
+	state := deliveryPending
+	if attempts >= WEBHOOK_MAX_ATTEMPTS {
+		state = deliveryDead
+	}
+	if err := recordDelivery(d.id, attempts, state, status, message, webhookBackoff(attempts)); err != nil {
+		slog.Error("recording webhook delivery", "delivery_id", d.id, "error", err)
+	}
+}
+
+// webhookBackoff is the wait after the given number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	wait := WEBHOOK_RETRY_BASE
+	for i := 1; i < attempts && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxWebhookBackoff)
+}
+
+// sendWebhook POSTs one delivery. It returns the response status (0 when
+// there was none) and, for a non-2xx response, the start of its body.
+//
+// The signature header is "t=<unix seconds>,v1=<hex HMAC-SHA256>", signed
+// over "<t>.<body>" with the webhook's secret. Receivers should recompute it
+// and reject old timestamps to stop replays.
+func sendWebhook(target, secret string, deliveryID int64, eventType string, payload []byte) (int, string, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-rest-api-lab-webhooks/1")
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+signWebhook(secret, timestamp, payload))
+
+	client := *webhookClient
+	client.Timeout = WEBHOOK_TIMEOUT
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+		return resp.StatusCode, string(body), fmt.Errorf("receiver responded %d", resp.StatusCode)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+	return resp.StatusCode, "", nil
+}
+
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhook storage
+
+func createWebhook(target string, events []string, secret string) (*Webhook, error) {
+	webhook := &Webhook{}
+	query := `INSERT INTO webhooks (url, events, secret) VALUES ($1, $2, $3)
+	          RETURNING id, url, events, created_at`
+	err := db.QueryRow(query, target, pq.Array(events), secret).Scan(
+		&webhook.ID, &webhook.URL, pq.Array(&webhook.Events), &webhook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func getWebhook(id int) (*Webhook, error) {
+	webhook := &Webhook{}
+	query := `SELECT id, url, events, created_at FROM webhooks WHERE id = $1`
+	err := db.QueryRow(query, id).Scan(&webhook.ID, &webhook.URL, pq.Array(&webhook.Events), &webhook.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func listWebhooks() ([]Webhook, error) {
+	rows, err := db.Query(`SELECT id, url, events, created_at FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		if err := rows.Scan(&webhook.ID, &webhook.URL, pq.Array(&webhook.Events), &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// deleteWebhook removes a webhook and, through ON DELETE CASCADE, its
+// delivery log
+func deleteWebhook(id int) error {
+	result, err := db.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errWebhookNotFound
+	}
+	return nil
+}
+
+const deliveryColumns = `id, webhook_id, event_type, payload, status, attempts, next_attempt_at,
+	last_status_code, last_error, created_at, delivered_at`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	var next, delivered sql.NullTime
+	var statusCode sql.NullInt64
+	var lastError sql.NullString
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &next,
+		&statusCode, &lastError, &d.CreatedAt, &delivered)
+	if err != nil {
+		return nil, err
+	}
+	if next.Valid && d.Status == deliveryPending {
+		d.NextAttemptAt = &next.Time
+	}
+	if delivered.Valid {
+		d.DeliveredAt = &delivered.Time
+	}
+	if statusCode.Valid {
+		code := int(statusCode.Int64)
+		d.LastStatusCode = &code
+	}
+	d.LastError = lastError.String
+	return d, nil
+}
+
+func listDeliveries(webhookID int, status string, limit int) ([]WebhookDelivery, error) {
+	if _, err := getWebhook(webhookID); err != nil {
+		return nil, err
+	}
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries
+	          WHERE webhook_id = $1 AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT $3`
+	rows, err := db.Query(query, webhookID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// redeliver copies a delivery of webhookID into a new pending one
+func redeliver(webhookID int, deliveryID int64) (*WebhookDelivery, error) {
+	query := `INSERT INTO webhook_deliveries (webhook_id, event_type, payload)
+	          SELECT webhook_id, event_type, payload FROM webhook_deliveries WHERE id = $1 AND webhook_id = $2
+	          RETURNING ` + deliveryColumns
+	d, err := scanDelivery(db.QueryRow(query, deliveryID, webhookID))
+	if err == sql.ErrNoRows {
+		return nil, errDeliveryNotFound
+	}
+	return d, err
+}
+
+// claimDueDeliveries takes pending deliveries whose time has come and pushes
+// their next attempt past the delivery timeout, so no other worker picks
+// them up while they are being sent
+func claimDueDeliveries(limit int) ([]claimedDelivery, error) {
+	query := `UPDATE webhook_deliveries d SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second'
+	          FROM webhooks w
+	          WHERE w.id = d.webhook_id AND d.id IN (
+	              SELECT id FROM webhook_deliveries
+	              WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+	              ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+	          RETURNING d.id, d.event_type, d.payload, d.attempts, w.url, w.secret`
+	rows, err := db.Query(query, limit, (2 * WEBHOOK_TIMEOUT).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []claimedDelivery
+	for rows.Next() {
+		var d claimedDelivery
+		if err := rows.Scan(&d.id, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, d)
+	}
+	return claimed, rows.Err()
+}
+
+// recordDelivery stores the outcome of an attempt. A delivery that is still
+// pending is retried after retryIn.
+func recordDelivery(id int64, attempts int, status string, statusCode int, lastError string, retryIn time.Duration) error {
+	query := `UPDATE webhook_deliveries SET attempts = $2, status = $3, last_status_code = NULLIF($4, 0),
+	          last_error = NULLIF($5, ''), next_attempt_at = CURRENT_TIMESTAMP + $6 * INTERVAL '1 second',
+	          delivered_at = CASE WHEN $3 = 'succeeded' THEN CURRENT_TIMESTAMP END
+	          WHERE id = $1`
+	_, err := db.Exec(query, id, attempts, status, statusCode, lastError, retryIn.Seconds())
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a receiver that checks every delivery's headers and
+// signature against secret, then answers with respond
+func webhookReceiver(t *testing.T, secret string, respond func(w http.ResponseWriter, attempt int)) *httptest.Server {
+	t.Helper()
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("X-Webhook-Id") == "" || r.Header.Get("X-Webhook-Event") == "" {
+			t.Errorf("missing X-Webhook-Id or X-Webhook-Event: %v", r.Header)
+		}
+
+		// Verify the signature the way the README tells receivers to
+		var timestamp, signature string
+		for _, part := range strings.Split(r.Header.Get("X-Webhook-Signature"), ",") {
+			key, value, _ := strings.Cut(part, "=")
+			switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				signature = value
+			}
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		io.WriteString(mac, timestamp+"."+string(body))
+		got, _ := hex.DecodeString(signature)
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Webhook-Signature"))
+		}
+		if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+			t.Errorf("bad timestamp %q", timestamp)
+		}
+
+		respond(w, int(attempts.Add(1)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSendWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter, attempt int)
+		status  int
+		body    string
+		wantErr bool
+	}{
+		{name: "ok", status: 200,
+			respond: func(w http.ResponseWriter, _ int) { io.WriteString(w, "thanks") }},
+		{name: "no content", status: 204,
+			respond: func(w http.ResponseWriter, _ int) { w.WriteHeader(http.StatusNoContent) }},
+		{name: "server error", status: 500, body: "boom", wantErr: true,
+			respond: func(w http.ResponseWriter, _ int) { http.Error(w, "boom", http.StatusInternalServerError) }},
+		{name: "long error body is cut", status: 400, body: strings.Repeat("x", maxWebhookResponse), wantErr: true,
+			respond: func(w http.ResponseWriter, _ int) {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, strings.Repeat("x", 2*maxWebhookResponse))
+			}},
+		{name: "redirects are not followed", status: 302, wantErr: true,
+			respond: func(w http.ResponseWriter, _ int) {
+				w.Header().Set("Location", "/elsewhere")
+				w.WriteHeader(http.StatusFound)
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := webhookReceiver(t, "s3cret", tt.respond)
+			status, body, err := sendWebhook(receiver.URL, "s3cret", 42, "user.created", []byte(`{"type":"user.created"}`))
+			if status != tt.status || (err != nil) != tt.wantErr {
+				t.Fatalf("got %d, %v; want %d, error %v", status, err, tt.status, tt.wantErr)
+			}
+			if strings.TrimSpace(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		receiver := webhookReceiver(t, "", nil)
+		receiver.Close()
+		if status, _, err := sendWebhook(receiver.URL, "", 1, "user.created", nil); status != 0 || err == nil {
+			t.Errorf("got %d, %v; want no status and an error", status, err)
+		}
+	})
+}
+
+// recordedDeliveries collects the outcomes attemptDelivery stores
+func recordedDeliveries(t *testing.T) *fakeDB {
+	return useFakeDB(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		return &fakeResult{affected: 1}, nil
+	})
+}
+
+func TestAttemptDeliveryRetries(t *testing.T) {
+	saved := WEBHOOK_MAX_ATTEMPTS
+	defer func() { WEBHOOK_MAX_ATTEMPTS = saved }()
+	WEBHOOK_MAX_ATTEMPTS = 3
+
+	// The receiver fails twice, then accepts
+	receiver := webhookReceiver(t, "s3cret", func(w http.ResponseWriter, attempt int) {
+		if attempt < 3 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+		}
+	})
+
+	tests := []struct {
+		state      string
+		statusCode int64
+		lastError  string
+		retryIn    time.Duration
+	}{
+		{deliveryPending, 503, "receiver responded 503: not yet\n", WEBHOOK_RETRY_BASE},
+		{deliveryPending, 503, "receiver responded 503: not yet\n", 2 * WEBHOOK_RETRY_BASE},
+		{deliverySucceeded, 200, "", 0},
+	}
+	fake := recordedDeliveries(t)
+	d := claimedDelivery{id: 7, eventType: "post.created", payload: []byte(`{}`), url: receiver.URL, secret: "s3cret"}
+	for i, tt := range tests {
+		attemptDelivery(d)
+		d.attempts++
+
+		args := fake.args[len(fake.args)-1]
+		want := []driver.Value{int64(7), int64(i + 1), tt.state, tt.statusCode, tt.lastError, tt.retryIn.Seconds()}
+		for j := range want {
+			if args[j] != want[j] {
+				t.Errorf("attempt %d recorded %v, want %v", i+1, args, want)
+				break
+			}
+		}
+	}
+
+	t.Run("dead after the last attempt", func(t *testing.T) {
+		fake := recordedDeliveries(t)
+		failing := webhookReceiver(t, "s3cret", func(w http.ResponseWriter, _ int) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+		attemptDelivery(claimedDelivery{id: 8, eventType: "post.deleted", payload: []byte(`{}`), attempts: 2, url: failing.URL, secret: "s3cret"})
+		if args := fake.args[len(fake.args)-1]; args[1] != int64(3) || args[2] != deliveryDead {
+			t.Errorf("recorded %v, want attempt 3 dead", args)
+		}
+	})
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{6, 16 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, maxWebhookBackoff},
+		{1000, maxWebhookBackoff},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestCreateWebhookRequestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    CreateWebhookRequest
+		fields []string
+	}{
+		{name: "valid", req: CreateWebhookRequest{URL: "https://example.com/hook", Events: []string{"user.created"}}},
+		{name: "wildcard", req: CreateWebhookRequest{URL: "http://localhost:9000", Events: []string{"*"}}},
+		{name: "empty", fields: []string{"url", "events"}},
+		{name: "relative url", req: CreateWebhookRequest{URL: "/hook", Events: []string{"*"}}, fields: []string{"url"}},
+		{name: "other scheme", req: CreateWebhookRequest{URL: "ftp://example.com", Events: []string{"*"}}, fields: []string{"url"}},
+		{name: "unknown event", req: CreateWebhookRequest{URL: "https://example.com", Events: []string{"user.created", "user.eaten"}},
+			fields: []string{"events[1]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.validate()
+			var fields []string
+			if err != nil {
+				for _, f := range classifyError(err).fields {
+					fields = append(fields, f.Field)
+				}
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("invalid fields = %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Exporter receives every finished, sampled span. ExportSpan is called from
+// many goroutines and must not keep the span after returning.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter replaces the exporter. nil drops spans.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	exporter = e
+	exporterMu.Unlock()
+}
+
+func currentExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+// JSONExporter writes each span as one line of JSON
+type JSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONExporter returns an exporter writing JSON lines to w
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+func (e *JSONExporter) ExportSpan(span *Span) {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(line, '\n'))
+}
+
+// OpenExporter returns the exporter named by dest: "stdout", "stderr", "off"
+// (or "") for none, or otherwise a file path that JSON lines are appended to.
+// The closer releases the file, if any.
+func OpenExporter(dest string) (Exporter, io.Closer, error) {
+	switch dest {
+	case "", "off":
+		return nil, io.NopCloser(nil), nil
+	case "stdout":
+		return NewJSONExporter(os.Stdout), io.NopCloser(nil), nil
+	case "stderr":
+		return NewJSONExporter(os.Stderr), io.NopCloser(nil), nil
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	return NewJSONExporter(f), f, nil
+}
@@ -0,0 +1,197 @@
+// Package tracing propagates W3C Trace Context (the traceparent header) and
+// records spans. Finished spans go to the exporter set with SetExporter;
+// without one they are dropped.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context request header
+const TraceparentHeader = "traceparent"
+
+// SpanKind says which side of a call a span describes
+type SpanKind string
+
+const (
+	KindServer   SpanKind = "server"
+	KindClient   SpanKind = "client"
+	KindInternal SpanKind = "internal"
+)
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether sc has a non-zero trace and span ID
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceIDString is the trace ID as 32 hex digits
+func (sc SpanContext) TraceIDString() string { return hex.EncodeToString(sc.TraceID[:]) }
+
+// SpanIDString is the span ID as 16 hex digits
+func (sc SpanContext) SpanIDString() string { return hex.EncodeToString(sc.SpanID[:]) }
+
+// Traceparent formats sc as a traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceIDString() + "-" + sc.SpanIDString() + "-" + flags
+}
+
+// ParseTraceparent parses a version 00 traceparent header, and the prefix of
+// later versions as the spec asks. ok is false for anything malformed.
+func ParseTraceparent(value string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	if !isLowerHex(parts[0]) || !isLowerHex(parts[1]) || !isLowerHex(parts[2]) || !isLowerHex(parts[3]) {
+		return SpanContext{}, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	var flags [1]byte
+	hex.Decode(flags[:], []byte(parts[3]))
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Span is a timed operation. Its exported fields are what exporters write.
+type Span struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         SpanKind               `json:"kind"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	DurationMS   float64                `json:"durationMs"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Status       string                 `json:"status"`
+	Error        string                 `json:"error,omitempty"`
+
+	sc    SpanContext
+	mu    sync.Mutex
+	ended bool
+}
+
+type spanContextKey struct{}
+type remoteParentContextKey struct{}
+
+// Start begins a span as a child of the span in ctx, or of a remote parent
+// set with ContextWithRemoteParent, or else as the root of a new trace. The
+// returned context carries the new span.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent, hasParent := SpanContextFromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	if !hasParent {
+		rand.Read(sc.TraceID[:])
+		sc.Sampled = true
+	}
+	rand.Read(sc.SpanID[:])
+
+	span := &Span{
+		TraceID: sc.TraceIDString(),
+		SpanID:  sc.SpanIDString(),
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+		sc:      sc,
+	}
+	if hasParent {
+		span.ParentSpanID = parent.SpanIDString()
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// ContextWithRemoteParent makes sc, received from another process, the
+// parent of the next span started from the returned context
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteParentContextKey{}, sc)
+}
+
+// SpanFromContext returns the span started from ctx, if any
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the context of the current span, or of the
+// remote parent when no span has started yet
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.sc, true
+	}
+	sc, ok := ctx.Value(remoteParentContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Context returns the span's identity for propagation
+func (s *Span) Context() SpanContext { return s.sc }
+
+// SetName renames the span, e.g. once the route is known
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	s.Name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute records a key-value pair on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// Finish ends the span, marking it failed when err is non-nil, and hands it
+// to the exporter. Only the first call has an effect.
+func (s *Span) Finish(err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.DurationMS = float64(s.End.Sub(s.Start).Microseconds()) / 1000
+	s.Status = "ok"
+	if err != nil {
+		s.Status = "error"
+		s.Error = err.Error()
+	}
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		if e := currentExporter(); e != nil {
+			e.ExportSpan(s)
+		}
+	}
+}